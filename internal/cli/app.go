@@ -28,9 +28,13 @@ func startAction(ctx *cli.Context) error {
 	mainCtx, stop := signal.NotifyContext(ctx.Context, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
-	MustStartComponents(mainCtx, cfg)
+	relayDone := MustStartComponents(mainCtx, cfg)
 
 	<-mainCtx.Done()
+	// a second signal kills the process without waiting for the drain
+	stop()
+	cliLogger.Info("draining relay conns, signal again to exit now...")
+	<-relayDone
 
 	cliLogger.Info("ehco exit now...")
 	return nil
@@ -86,7 +86,9 @@ func InitConfigAndComponents() (*config.Config, error) {
 	return cfg, nil
 }
 
-func MustStartComponents(mainCtx context.Context, cfg *config.Config) {
+// MustStartComponents starts every component, the returned chan is closed
+// once the relay server drained its conns after mainCtx is done.
+func MustStartComponents(mainCtx context.Context, cfg *config.Config) <-chan struct{} {
 	cliLogger.Infof("Start ehco with version:%s", constant.Version)
 
 	// start relay server
@@ -94,7 +96,9 @@ func MustStartComponents(mainCtx context.Context, cfg *config.Config) {
 	if err != nil {
 		cliLogger.Fatalf("NewRelayServer meet err=%s", err.Error())
 	}
+	relayDone := make(chan struct{})
 	go func() {
+		defer close(relayDone)
 		metrics.EhcoAlive.Set(metrics.EhcoAliveStateRunning)
 		sErr := rs.Start(mainCtx)
 		if sErr != nil {
@@ -104,7 +108,7 @@ func MustStartComponents(mainCtx context.Context, cfg *config.Config) {
 
 	var webS *web.Server
 	if cfg.NeedStartWebServer() {
-		webS, err = web.NewServer(cfg, rs, rs, rs.Cmgr)
+		webS, err = web.NewServer(cfg, rs, rs, rs, rs, rs, rs.Cmgr)
 		if err != nil {
 			cliLogger.Fatalf("NewWebServer meet err=%s", err.Error())
 		}
@@ -133,4 +137,6 @@ func MustStartComponents(mainCtx context.Context, cfg *config.Config) {
 			cliLogger.Fatalf("Start XrayServer meet err=%v", err)
 		}
 	}
+
+	return relayDone
 }
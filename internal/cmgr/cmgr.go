@@ -7,11 +7,14 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Ehco1996/ehco/internal/cmgr/ms"
 	"github.com/Ehco1996/ehco/internal/cmgr/sampler"
 	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/Ehco1996/ehco/pkg/limiter"
 	"go.uber.org/zap"
 )
 
@@ -36,6 +39,22 @@ type Cmgr interface {
 
 	GetActiveConnectCntByRelayLabel(label string) int
 
+	// MaxConnection returns the active connection limit of the node, 0 means no limit.
+	MaxConnection() int
+	// SetMaxConnection changes it, e.g. on config reload.
+	SetMaxConnection(n int)
+
+	// ConnSlots returns the conn limit slots shared by the relays, a conn
+	// holds its slots from before its handshake until its relay ends.
+	ConnSlots() *limiter.ConnSlots
+
+	// GetActiveConnectCntByRemote returns the number of active connections of relay label to remote address.
+	GetActiveConnectCntByRemote(label, remote string) int
+
+	// ListUDPSessions returns the udp listener sessions being relayed, of
+	// every relay when label is empty.
+	ListUDPSessions(label string) []UDPSession
+
 	// Start starts the connection manager.
 	Start(ctx context.Context, errCH chan error)
 
@@ -50,6 +69,15 @@ type Cmgr interface {
 	DBVacuum(ctx context.Context) (*ms.MaintenanceResult, error)
 	DBTruncate(ctx context.Context, confirm string) (*ms.MaintenanceResult, error)
 	DBResetStats() error
+
+	// Quota returns the quota of the rule label with cfg. It is shared by
+	// every relay of the label started later, and its usage is loaded from
+	// the local store the first time.
+	Quota(label string, cfg conf.QuotaConfig) *Quota
+	// RemoveQuota stops reporting the quota of label, its saved usage is kept.
+	RemoveQuota(label string)
+	// SaveQuota persists the usage of the quota of label to the local store.
+	SaveQuota(ctx context.Context, label string) error
 }
 
 // ErrMetricsDisabled is returned by storage-health methods when the
@@ -64,6 +92,11 @@ type cmgrImpl struct {
 	// k: relay label, v: connection list
 	activeConnectionsMap map[string][]conn.RelayConn
 	closedConnectionsMap map[string][]conn.RelayConn
+	// k: relay label
+	quotas map[string]*Quota
+
+	maxConnection atomic.Int64
+	connSlots     *limiter.ConnSlots
 
 	ms *ms.MetricsStore
 	ns *sampler.NodeSampler
@@ -75,10 +108,14 @@ func NewCmgr(cfg *Config) (Cmgr, error) {
 		l:                    zap.S().Named("cmgr"),
 		activeConnectionsMap: make(map[string][]conn.RelayConn),
 		closedConnectionsMap: make(map[string][]conn.RelayConn),
+		quotas:               make(map[string]*Quota),
+		connSlots:            limiter.NewConnSlots(),
 	}
+	cmgr.maxConnection.Store(int64(cfg.MaxConnection))
 	if cfg.NeedMetrics() {
 		cmgr.ns = sampler.NewNodeSampler()
-
+	}
+	if cfg.NeedStore() {
 		homeDir, _ := os.UserHomeDir()
 		dbPath := filepath.Join(homeDir, ".ehco", "metrics.db")
 		ms, err := ms.NewMetricsStore(dbPath)
@@ -197,6 +234,63 @@ func (cm *cmgrImpl) GetActiveConnectCntByRelayLabel(label string) int {
 	return len(cm.activeConnectionsMap[label])
 }
 
+func (cm *cmgrImpl) MaxConnection() int {
+	return int(cm.maxConnection.Load())
+}
+
+func (cm *cmgrImpl) SetMaxConnection(n int) {
+	cm.maxConnection.Store(int64(n))
+}
+
+func (cm *cmgrImpl) ConnSlots() *limiter.ConnSlots {
+	return cm.connSlots
+}
+
+func (cm *cmgrImpl) GetActiveConnectCntByRemote(label, remote string) int {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	cnt := 0
+	for _, c := range cm.activeConnectionsMap[label] {
+		if r := c.GetRemote(); r != nil && r.Address == remote {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// UDPSession is a udp listener session of an active relay conn.
+type UDPSession struct {
+	RelayLabel string `json:"relay_label"`
+	Remote     string `json:"remote"`
+	conn.UDPSessionStats
+}
+
+func (cm *cmgrImpl) ListUDPSessions(label string) []UDPSession {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	sessions := []UDPSession{}
+	for l, conns := range cm.activeConnectionsMap {
+		if label != "" && l != label {
+			continue
+		}
+		for _, c := range conns {
+			stats := c.GetUDPSession()
+			if stats == nil {
+				continue
+			}
+			s := UDPSession{RelayLabel: l, UDPSessionStats: *stats}
+			if r := c.GetRemote(); r != nil {
+				s.Remote = r.Address
+			}
+			sessions = append(sessions, s)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartTime.Before(sessions[j].StartTime)
+	})
+	return sessions
+}
+
 // metricsSampleInterval is the cadence at which we read /metrics/ and
 // persist a row to the local store, so the dashboard's Node page has
 // sub-minute resolution. SyncInterval (default 60s) controls the coarser
@@ -8,6 +8,13 @@ type Config struct {
 	// host / rule samplers. Off when there is no web server to surface
 	// the data — sampling without a reader is just disk churn.
 	EnableMetrics bool
+	// EnableQuota opens the local SQLite store to keep the quota usage
+	// of rules across restarts, without sampling anything.
+	EnableQuota bool
+
+	// MaxConnection is the active connection limit of the node, 0 means
+	// no limit. Relays enforce it, see Cmgr.MaxConnection.
+	MaxConnection int
 }
 
 func (c *Config) NeedSync() bool {
@@ -18,6 +25,10 @@ func (c *Config) NeedMetrics() bool {
 	return c.EnableMetrics && c.SyncInterval > 0
 }
 
+func (c *Config) NeedStore() bool {
+	return c.NeedMetrics() || c.EnableQuota
+}
+
 func (c *Config) Adjust() {
 	if c.SyncInterval <= 0 {
 		c.SyncInterval = 60
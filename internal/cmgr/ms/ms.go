@@ -114,6 +114,17 @@ func (ms *MetricsStore) initDB() error {
             network_out REAL,
             PRIMARY KEY (timestamp)
         )
+    `); err != nil {
+		return err
+	}
+	// Quota usage of rules, one row per label. Kept out of retention
+	// cleanup and truncate: it is state, not metrics.
+	if _, err := ms.db.Exec(`
+        CREATE TABLE IF NOT EXISTS rule_quota (
+            label TEXT PRIMARY KEY,
+            used_bytes INTEGER,
+            period_start INTEGER
+        )
     `); err != nil {
 		return err
 	}
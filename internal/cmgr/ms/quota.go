@@ -0,0 +1,37 @@
+package ms
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// QuotaUsage is the persisted usage of a rule quota in the period that
+// started at PeriodStart, a unix timestamp.
+type QuotaUsage struct {
+	Label       string
+	UsedBytes   int64
+	PeriodStart int64
+}
+
+// LoadQuotaUsage returns the usage of label, nil when none was saved.
+func (ms *MetricsStore) LoadQuotaUsage(ctx context.Context, label string) (*QuotaUsage, error) {
+	u := &QuotaUsage{Label: label}
+	err := ms.db.QueryRowContext(ctx, "SELECT used_bytes, period_start FROM rule_quota WHERE label = ?", label).
+		Scan(&u.UsedBytes, &u.PeriodStart)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (ms *MetricsStore) SaveQuotaUsage(ctx context.Context, u *QuotaUsage) error {
+	_, err := ms.db.ExecContext(ctx, `
+    INSERT OR REPLACE INTO rule_quota (label, used_bytes, period_start)
+    VALUES (?, ?, ?)
+`, u.Label, u.UsedBytes, u.PeriodStart)
+	return err
+}
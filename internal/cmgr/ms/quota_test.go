@@ -0,0 +1,37 @@
+package ms
+
+import (
+	"context"
+	"testing"
+)
+
+func TestQuotaUsage(t *testing.T) {
+	ms := newTestStore(t)
+	ctx := context.Background()
+
+	u, err := ms.LoadQuotaUsage(ctx, "rule")
+	if err != nil || u != nil {
+		t.Fatalf("LoadQuotaUsage of unknown label = %v, %v, want nil", u, err)
+	}
+
+	want := &QuotaUsage{Label: "rule", UsedBytes: 1 << 30, PeriodStart: 1700000000}
+	if err := ms.SaveQuotaUsage(ctx, want); err != nil {
+		t.Fatalf("SaveQuotaUsage: %v", err)
+	}
+	want.UsedBytes += 100
+	if err := ms.SaveQuotaUsage(ctx, want); err != nil {
+		t.Fatalf("SaveQuotaUsage again: %v", err)
+	}
+
+	// usage is state, truncating the metrics keeps it
+	if _, err := ms.Truncate(ctx, truncateConfirm); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	got, err := ms.LoadQuotaUsage(ctx, "rule")
+	if err != nil {
+		t.Fatalf("LoadQuotaUsage: %v", err)
+	}
+	if got == nil || *got != *want {
+		t.Fatalf("LoadQuotaUsage = %+v, want %+v", got, want)
+	}
+}
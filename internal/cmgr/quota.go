@@ -0,0 +1,147 @@
+package cmgr
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/cmgr/ms"
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+var _ conn.Quota = (*Quota)(nil)
+
+// QuotaUsage is the quota state of a rule, sent to the control plane.
+type QuotaUsage struct {
+	RelayLabel  string    `json:"relay_label"`
+	LimitBytes  int64     `json:"limit_bytes"`
+	UsedBytes   int64     `json:"used_bytes"`
+	PeriodStart time.Time `json:"period_start"`
+	NextReset   time.Time `json:"next_reset"`
+	Exceeded    bool      `json:"exceeded"`
+}
+
+// Quota counts the bytes relayed by the conns of a rule in the current
+// period of its quota config.
+type Quota struct {
+	label string
+	used  atomic.Int64
+	limit atomic.Int64
+
+	mu          sync.Mutex
+	cfg         conf.QuotaConfig
+	periodStart time.Time
+}
+
+// NewQuota returns a quota of label with nothing used yet.
+func NewQuota(label string, cfg conf.QuotaConfig) *Quota {
+	q := &Quota{label: label, cfg: cfg, periodStart: cfg.PeriodStart(time.Now())}
+	q.limit.Store(cfg.Bytes)
+	return q
+}
+
+func (q *Quota) Charge(n int64) bool {
+	return q.used.Add(n) >= q.limit.Load()
+}
+
+func (q *Quota) Exceeded() bool {
+	return q.Charge(0)
+}
+
+// Rollover starts a new period when the current one ended, it reports
+// whether it did.
+func (q *Quota) Rollover(now time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	start := q.cfg.PeriodStart(now)
+	if !start.After(q.periodStart) {
+		return false
+	}
+	q.periodStart = start
+	q.used.Store(0)
+	return true
+}
+
+func (q *Quota) Usage() QuotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := q.used.Load()
+	return QuotaUsage{
+		RelayLabel:  q.label,
+		LimitBytes:  q.cfg.Bytes,
+		UsedBytes:   used,
+		PeriodStart: q.periodStart,
+		NextReset:   q.cfg.NextReset(q.periodStart),
+		Exceeded:    used >= q.cfg.Bytes,
+	}
+}
+
+// setConfig changes the config, the usage is kept unless the period of
+// the new config started after the current one.
+func (q *Quota) setConfig(cfg conf.QuotaConfig) {
+	q.mu.Lock()
+	q.cfg = cfg
+	q.limit.Store(cfg.Bytes)
+	q.mu.Unlock()
+	q.Rollover(time.Now())
+}
+
+// restore takes the saved usage when it is of the current period.
+func (q *Quota) restore(u *ms.QuotaUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u.PeriodStart == q.periodStart.Unix() {
+		q.used.Store(u.UsedBytes)
+	}
+}
+
+func (cm *cmgrImpl) Quota(label string, cfg conf.QuotaConfig) *Quota {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if q, ok := cm.quotas[label]; ok {
+		q.setConfig(cfg)
+		return q
+	}
+	q := NewQuota(label, cfg)
+	if cm.ms == nil {
+		cm.l.Warnf("no local store, quota usage of %s is kept in memory only", label)
+	} else if u, err := cm.ms.LoadQuotaUsage(context.TODO(), label); err != nil {
+		cm.l.Errorf("load quota usage of %s: %v", label, err)
+	} else if u != nil {
+		q.restore(u)
+	}
+	cm.quotas[label] = q
+	return q
+}
+
+func (cm *cmgrImpl) RemoveQuota(label string) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	delete(cm.quotas, label)
+}
+
+func (cm *cmgrImpl) SaveQuota(ctx context.Context, label string) error {
+	cm.lock.Lock()
+	q, ok := cm.quotas[label]
+	cm.lock.Unlock()
+	if !ok || cm.ms == nil {
+		return nil
+	}
+	u := q.Usage()
+	return cm.ms.SaveQuotaUsage(ctx, &ms.QuotaUsage{Label: label, UsedBytes: u.UsedBytes, PeriodStart: u.PeriodStart.Unix()})
+}
+
+func (cm *cmgrImpl) listQuotaUsage() []QuotaUsage {
+	cm.lock.RLock()
+	defer cm.lock.RUnlock()
+	res := make([]QuotaUsage, 0, len(cm.quotas))
+	for _, q := range cm.quotas {
+		res = append(res, q.Usage())
+	}
+	slices.SortFunc(res, func(a, b QuotaUsage) int { return strings.Compare(a.RelayLabel, b.RelayLabel) })
+	return res
+}
@@ -2,6 +2,7 @@ package cmgr
 
 import (
 	"context"
+	"slices"
 
 	"github.com/Ehco1996/ehco/internal/cmgr/sampler"
 	"github.com/Ehco1996/ehco/internal/conn"
@@ -17,6 +18,28 @@ type StatsPerRule struct {
 	Down             int64 `json:"down_bytes"`
 	ConnectionCnt    int   `json:"connection_count"`
 	HandShakeLatency int64 `json:"latency_in_ms"`
+
+	// per listen port traffic, only port range rules report it
+	Ports []StatsPerPort `json:"ports,omitempty"`
+}
+
+type StatsPerPort struct {
+	ListenPort int `json:"listen_port"`
+
+	Up            int64 `json:"up_bytes"`
+	Down          int64 `json:"down_bytes"`
+	ConnectionCnt int   `json:"connection_count"`
+}
+
+// StatsPerUser is the traffic of an authenticated user of a rule,
+// only rules whose listen type has auth report it.
+type StatsPerUser struct {
+	RelayLabel string `json:"relay_label"`
+	User       string `json:"user"`
+
+	Up            int64 `json:"up_bytes"`
+	Down          int64 `json:"down_bytes"`
+	ConnectionCnt int   `json:"connection_count"`
 }
 
 type VersionInfo struct {
@@ -69,7 +92,29 @@ func (cm *cmgrImpl) pushStats(ctx context.Context) error {
 	for label, conns := range cm.closedConnectionsMap {
 		s := StatsPerRule{RelayLabel: label}
 		var totalLatency int64
+		userStats := make(map[string]*StatsPerUser)
+		portStats := make(map[int]*StatsPerPort)
 		for _, c := range conns {
+			if port := c.GetListenPort(); port > 0 {
+				ps, ok := portStats[port]
+				if !ok {
+					ps = &StatsPerPort{ListenPort: port}
+					portStats[port] = ps
+				}
+				ps.ConnectionCnt++
+				ps.Up += c.GetStats().Up
+				ps.Down += c.GetStats().Down
+			}
+			if user := c.GetUser(); user != "" {
+				us, ok := userStats[user]
+				if !ok {
+					us = &StatsPerUser{RelayLabel: label, User: user}
+					userStats[user] = us
+				}
+				us.ConnectionCnt++
+				us.Up += c.GetStats().Up
+				us.Down += c.GetStats().Down
+			}
 			s.ConnectionCnt++
 			s.Up += c.GetStats().Up
 			s.Down += c.GetStats().Down
@@ -78,10 +123,18 @@ func (cm *cmgrImpl) pushStats(ctx context.Context) error {
 		if s.ConnectionCnt > 0 {
 			s.HandShakeLatency = totalLatency / int64(s.ConnectionCnt)
 		}
+		for _, ps := range portStats {
+			s.Ports = append(s.Ports, *ps)
+		}
+		slices.SortFunc(s.Ports, func(a, b StatsPerPort) int { return a.ListenPort - b.ListenPort })
 		req.Stats = append(req.Stats, s)
+		for _, us := range userStats {
+			req.UserStats = append(req.UserStats, *us)
+		}
 	}
 	cm.closedConnectionsMap = make(map[string][]conn.RelayConn)
 	cm.lock.Unlock()
+	req.Quotas = cm.listQuotaUsage()
 
 	if !cm.cfg.NeedSync() {
 		cm.l.Debugf("removed %d closed connections", len(req.Stats))
@@ -95,4 +148,8 @@ type syncReq struct {
 	Version VersionInfo         `json:"version"`
 	Node    sampler.NodeMetrics `json:"node"`
 	Stats   []StatsPerRule      `json:"stats"`
+	// only set when some rule has authenticated users
+	UserStats []StatsPerUser `json:"user_stats,omitempty"`
+	// only set when some rule has a quota
+	Quotas []QuotaUsage `json:"quotas,omitempty"`
 }
@@ -36,6 +36,15 @@ type Config struct {
 	RelayConfigs      []*conf.Config `json:"relay_configs"`
 	RelaySyncURL      string         `json:"relay_sync_url,omitempty"`
 	RelaySyncInterval int            `json:"relay_sync_interval,omitempty"`
+	// active relay connections of the whole node, 0 means no limit. rules
+	// handle conns over it with their conn_overflow option
+	RelayMaxConnection int `json:"relay_max_connection,omitempty"`
+	// relays stopped by a reload or a shutdown stop accepting and wait this
+	// long for their conns before closing them, 0 means the default
+	RelayDrainTimeoutSec int `json:"relay_drain_timeout_sec,omitempty"`
+
+	// default active health check for relay rules without their own health_check option
+	RelayHealthCheck *conf.HealthCheckConfig `json:"relay_health_check,omitempty"`
 
 	XRayConfig          *xConf.Config `json:"xray_config,omitempty"`
 	SyncTrafficEndPoint string        `json:"sync_traffic_endpoint,omitempty"`
@@ -70,6 +79,7 @@ func (c *Config) LoadConfig(force bool) error {
 	// across reloads. Forcing fields to nil makes the decoder allocate fresh
 	// objects.
 	c.RelayConfigs = nil
+	c.RelayHealthCheck = nil
 	c.XRayConfig = nil
 	c.lastLoadTime = time.Now()
 	if c.NeedSyncFromServer() {
@@ -106,10 +116,23 @@ func (c *Config) Adjust() error {
 		c.WebHost = "0.0.0.0"
 	}
 
+	if c.RelayMaxConnection < 0 {
+		return fmt.Errorf("relay_max_connection can not be negative")
+	}
+	if c.RelayDrainTimeoutSec < 0 {
+		return fmt.Errorf("relay_drain_timeout_sec can not be negative")
+	}
 	for _, r := range c.RelayConfigs {
 		if err := r.Validate(); err != nil {
 			return err
 		}
+		if c.RelayHealthCheck != nil && r.Options.HealthCheck == nil {
+			r.Options.HealthCheck = c.RelayHealthCheck.Clone()
+			r.Options.HealthCheck.Adjust()
+			if err := r.Options.HealthCheck.Validate(); err != nil {
+				return err
+			}
+		}
 	}
 
 	// check relay config label is unique
@@ -122,7 +145,9 @@ func (c *Config) Adjust() error {
 	}
 	// init tls when need
 	for _, r := range c.RelayConfigs {
-		if r.ListenType == constant.RelayTypeWSS || r.TransportType == constant.RelayTypeWSS {
+		if r.ListenType == constant.RelayTypeWSS || r.TransportType == constant.RelayTypeWSS ||
+			r.ListenType == constant.RelayTypeTLS || r.ListenType == constant.RelayTypeMux ||
+			r.ListenType == constant.RelayTypeQuic {
 			if err := tls.InitTlsCfg(); err != nil {
 				return err
 			}
@@ -144,7 +169,23 @@ func (c *Config) NeedStartRelayServer() bool {
 	return len(c.RelayConfigs) > 0
 }
 
+// HasRelayQuota reports whether any relay rule has a traffic quota.
+func (c *Config) HasRelayQuota() bool {
+	for _, r := range c.RelayConfigs {
+		if r.Options != nil && r.Options.Quota != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) RelayDrainTimeout() time.Duration {
+	if c.RelayDrainTimeoutSec > 0 {
+		return time.Duration(c.RelayDrainTimeoutSec) * time.Second
+	}
+	return constant.DefaultRelayDrainTimeOut
+}
+
 func (c *Config) NeedStartCmgr() bool {
 	return c.RelaySyncURL != "" && c.RelaySyncInterval > 0
 }
-
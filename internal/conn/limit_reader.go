@@ -1,29 +1,74 @@
 package conn
 
 import (
-	"io"
+	"context"
 	"net"
 
-	"github.com/juju/ratelimit"
+	"github.com/Ehco1996/ehco/pkg/limiter"
 )
 
+// RateLimitedConn limits the bytes read from and written to conn, every
+// read waits on all read limits and every write on all write limits.
 type RateLimitedConn struct {
 	net.Conn
-	bucket *ratelimit.Bucket
-	reader io.Reader
+	read, write []*limiter.Bandwidth
+	// reads and writes of a datagram conn are never split
+	datagram bool
 }
 
-func NewRateLimitedConn(conn net.Conn, kbps int64) *RateLimitedConn {
-	bps := float64(kbps) * 1000 // Convert kbps to bps (1 kbps = 1000 bps)
-	rateBytesPerSec := bps / 8  // 1KB = 1024B, 1B = 8b
-	bucket := ratelimit.NewBucketWithRate(rateBytesPerSec, int64(rateBytesPerSec))
-	return &RateLimitedConn{
-		Conn:   conn,
-		bucket: bucket,
-		reader: ratelimit.Reader(conn, bucket),
-	}
+func NewRateLimitedConn(conn net.Conn, read, write []*limiter.Bandwidth) *RateLimitedConn {
+	return &RateLimitedConn{Conn: conn, read: read, write: write}
+}
+
+// NewRateLimitedDatagramConn is NewRateLimitedConn for a conn that keeps
+// datagram boundaries, e.g. a udp session, a datagram larger than a limit
+// waits for it in parts instead.
+func NewRateLimitedDatagramConn(conn net.Conn, read, write []*limiter.Bandwidth) *RateLimitedConn {
+	return &RateLimitedConn{Conn: conn, read: read, write: write, datagram: true}
 }
 
 func (r *RateLimitedConn) Read(p []byte) (int, error) {
-	return r.reader.Read(p)
+	if !r.datagram {
+		p = p[:chunkSize(r.read, len(p))]
+	}
+	n, err := r.Conn.Read(p)
+	if n > 0 {
+		waitAll(r.read, n)
+	}
+	return n, err
+}
+
+func (r *RateLimitedConn) Write(p []byte) (int, error) {
+	if r.datagram {
+		waitAll(r.write, len(p))
+		return r.Conn.Write(p)
+	}
+	written := 0
+	for written < len(p) {
+		m := chunkSize(r.write, len(p)-written)
+		waitAll(r.write, m)
+		n, err := r.Conn.Write(p[written : written+m])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// chunkSize caps n to one second of the slowest limit, so a conn never
+// waits long for a single read or write and a close is noticed soon.
+func chunkSize(limits []*limiter.Bandwidth, n int) int {
+	for _, l := range limits {
+		if burst := l.Burst(); burst > 0 && burst < n {
+			n = burst
+		}
+	}
+	return n
+}
+
+func waitAll(limits []*limiter.Bandwidth, n int) {
+	for _, l := range limits {
+		_ = l.WaitN(context.Background(), n)
+	}
 }
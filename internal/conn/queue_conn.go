@@ -0,0 +1,175 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/metrics"
+)
+
+var _ net.Conn = &QueueConn{}
+
+// QueueConn is a datagram conn for many udp sessions sharing one socket or
+// tunnel: the owner Pushes the datagrams it received for this session and
+// Write is handed to writeFn. Every Read returns exactly one datagram, a
+// datagram bigger than the buffer of Read is dropped.
+type QueueConn struct {
+	local, remote net.Addr
+	writeFn       func(b []byte) (int, error)
+	onClose       func()
+	onDrop        func(reason string)
+
+	ch chan []byte
+
+	mu             sync.Mutex
+	readDeadline   time.Time
+	deadlineNotify chan struct{}
+
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+// NewQueueConn returns a conn of the relay label that writes with writeFn,
+// onClose is called once when the conn is closed and can be nil.
+func NewQueueConn(label string, local, remote net.Addr, writeFn func(b []byte) (int, error), onClose func()) *QueueConn {
+	onDrop := func(reason string) {
+		metrics.UDPDroppedPacketCount.WithLabelValues(label, reason).Inc()
+	}
+	return newQueueConn(local, remote, constant.DefaultUDPQueueSize, writeFn, onClose, onDrop)
+}
+
+// newQueueConn queues up to size datagrams for Read, onDrop counts the
+// datagrams dropped by Read.
+func newQueueConn(local, remote net.Addr, size int, writeFn func(b []byte) (int, error), onClose func(), onDrop func(reason string)) *QueueConn {
+	return &QueueConn{
+		local:          local,
+		remote:         remote,
+		writeFn:        writeFn,
+		onClose:        onClose,
+		onDrop:         onDrop,
+		ch:             make(chan []byte, size),
+		deadlineNotify: make(chan struct{}, 1),
+		die:            make(chan struct{}),
+	}
+}
+
+// Push queues a datagram for Read, it is dropped when the reader falls
+// behind like a full socket buffer. Returns false when dropped or closed.
+func (c *QueueConn) Push(b []byte) bool {
+	select {
+	case <-c.die:
+		return false
+	default:
+	}
+	select {
+	case c.ch <- b:
+		return true
+	default:
+		return false
+	}
+}
+
+// PushWait is like Push but waits for the reader instead of dropping,
+// for datagrams coming from a reliable stream.
+func (c *QueueConn) PushWait(b []byte) bool {
+	select {
+	case c.ch <- b:
+		return true
+	case <-c.die:
+		return false
+	}
+}
+
+func (c *QueueConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		var p []byte
+		var err error
+		select {
+		case p = <-c.ch:
+		case <-c.die:
+			err = io.EOF
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-c.deadlineNotify:
+			// deadline changed, wait again with the new one
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if p == nil {
+			continue
+		}
+		if len(p) > len(b) {
+			// like a udp socket would, without ending the session
+			c.onDrop(metrics.METRIC_UDP_DROP_OVERSIZED)
+			continue
+		}
+		return copy(b, p), nil
+	}
+}
+
+func (c *QueueConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.die:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.writeFn(b)
+}
+
+func (c *QueueConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.die)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+// Done is closed when the conn is closed.
+func (c *QueueConn) Done() <-chan struct{} {
+	return c.die
+}
+
+func (c *QueueConn) LocalAddr() net.Addr  { return c.local }
+func (c *QueueConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *QueueConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *QueueConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	select {
+	case c.deadlineNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *QueueConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
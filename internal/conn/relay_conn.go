@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Ehco1996/ehco/internal/lb"
@@ -21,7 +23,18 @@ const (
 	shortHashLength = 7
 )
 
-var ErrIdleTimeout = errors.New("connection closed due to idle timeout")
+var (
+	ErrIdleTimeout   = errors.New("connection closed due to idle timeout")
+	ErrQuotaExceeded = errors.New("connection closed due to quota exceeded")
+)
+
+// Quota is charged with the bytes relayed by the conns of a rule, they are
+// closed once it is used up.
+type Quota interface {
+	// Charge adds n bytes to the usage and reports whether it is used up.
+	Charge(n int64) bool
+	Exceeded() bool
+}
 
 // RelayConn is the interface that represents a relay connection.
 // it contains two connections: clientConn and remoteConn
@@ -32,7 +45,16 @@ type RelayConn interface {
 	// Transport transports data between the client and the remote connection.
 	Transport() error
 	GetRelayLabel() string
+	GetRemote() *lb.Node
+	// GetUser returns the authenticated user, empty when the listen type has no auth.
+	GetUser() string
+	// GetListenPort returns the port the client connected to, only set for
+	// port range rules.
+	GetListenPort() int
 	GetStats() *Stats
+	// GetUDPSession returns the stats of the udp listener session of the
+	// client, nil for other conns.
+	GetUDPSession() *UDPSessionStats
 	Close() error
 }
 
@@ -58,6 +80,10 @@ type relayConnImpl struct {
 	remoteConn net.Conn
 
 	Closed bool `json:"closed"`
+	// the drain force closes conns their relay closes too
+	closeOnce sync.Once
+	// relayed by the kernel, see spliceConn
+	Spliced bool `json:"spliced,omitempty"`
 
 	Stats     *Stats    `json:"stats"`
 	StartTime time.Time `json:"start_time"`
@@ -68,7 +94,11 @@ type relayConnImpl struct {
 	remote     *lb.Node
 	RelayLabel string `json:"relay_label"`
 	ConnType   string `json:"conn_type"`
+	User       string `json:"user,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
 	Options    *conf.Options
+	quota      Quota
+	udpSession UDPSession
 }
 
 func WithRelayLabel(relayLabel string) RelayConnOption {
@@ -83,10 +113,34 @@ func WithConnType(connType string) RelayConnOption {
 	}
 }
 
+func WithUser(user string) RelayConnOption {
+	return func(rci *relayConnImpl) {
+		rci.User = user
+	}
+}
+
+func WithListenPort(port int) RelayConnOption {
+	return func(rci *relayConnImpl) {
+		rci.ListenPort = port
+	}
+}
+
+func WithQuota(q Quota) RelayConnOption {
+	return func(rci *relayConnImpl) {
+		rci.quota = q
+	}
+}
+
+func WithUDPSession(s UDPSession) RelayConnOption {
+	return func(rci *relayConnImpl) {
+		rci.udpSession = s
+	}
+}
+
 func WithRemote(remote *lb.Node) RelayConnOption {
 	return func(rci *relayConnImpl) {
 		rci.remote = remote
-		rci.Stats.HandShakeLatency = remote.HandShakeDuration
+		rci.Stats.HandShakeLatency = remote.HandShakeDuration()
 	}
 }
 
@@ -104,8 +158,9 @@ func WithRelayOptions(opts *conf.Options) RelayConnOption {
 
 func (rc *relayConnImpl) Transport() error {
 	defer func() {
+		// conns closed by force, e.g. by a drain, are closed already
 		err := rc.Close()
-		if err != nil {
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			rc.l.Errorf("Error closing Transport connection: %s", err)
 		}
 	}()
@@ -119,7 +174,13 @@ func (rc *relayConnImpl) Transport() error {
 	remoteConn.l = rc.l.Named("remote")
 
 	rc.StartTime = time.Now().Local()
-	err := copyConn(clientConn, remoteConn, rc.l)
+	var err error
+	if client, remote, ok := rc.spliceable(); ok {
+		rc.Spliced = true
+		err = rc.spliceConn(client, remote)
+	} else {
+		err = copyConn(clientConn, remoteConn, rc.l)
+	}
 	rc.EndTime = time.Now().Local()
 
 	if err != nil {
@@ -132,10 +193,14 @@ func (rc *relayConnImpl) Transport() error {
 }
 
 func (rc *relayConnImpl) Close() error {
-	err1 := rc.clientConn.Close()
-	err2 := rc.remoteConn.Close()
-	rc.Closed = true
-	return combineErrorsAndMuteIDLE(err1, err2)
+	var err error
+	rc.closeOnce.Do(func() {
+		err1 := rc.clientConn.Close()
+		err2 := rc.remoteConn.Close()
+		rc.Closed = true
+		err = combineErrorsAndMuteIDLE(err1, err2)
+	})
+	return err
 }
 
 // functions that for web ui
@@ -154,10 +219,30 @@ func (rc *relayConnImpl) GetRelayLabel() string {
 	return rc.RelayLabel
 }
 
+func (rc *relayConnImpl) GetRemote() *lb.Node {
+	return rc.remote
+}
+
+func (rc *relayConnImpl) GetUser() string {
+	return rc.User
+}
+
+func (rc *relayConnImpl) GetListenPort() int {
+	return rc.ListenPort
+}
+
 func (rc *relayConnImpl) GetStats() *Stats {
 	return rc.Stats
 }
 
+func (rc *relayConnImpl) GetUDPSession() *UDPSessionStats {
+	if rc.udpSession == nil {
+		return nil
+	}
+	stats := rc.udpSession.SessionStats()
+	return &stats
+}
+
 func (rc *relayConnImpl) GetConnType() string {
 	return rc.ConnType
 }
@@ -198,19 +283,32 @@ func (c *innerConn) recordStats(n int, isRead bool) {
 	if c.rc == nil {
 		return
 	}
+	flow := metrics.METRIC_FLOW_WRITE
 	if isRead {
-		labels := []string{c.rc.RelayLabel, c.rc.ConnType, metrics.METRIC_FLOW_READ, c.rc.remote.Address}
-		metrics.NetWorkTransmitBytes.WithLabelValues(labels...).Add(float64(n))
+		flow = metrics.METRIC_FLOW_READ
 		c.rc.Stats.Record(0, int64(n))
 	} else {
-		labels := []string{c.rc.RelayLabel, c.rc.ConnType, metrics.METRIC_FLOW_WRITE, c.rc.remote.Address}
-		metrics.NetWorkTransmitBytes.WithLabelValues(labels...).Add(float64(n))
 		c.rc.Stats.Record(int64(n), 0)
 	}
+	// every byte relayed is read once, so only reads are charged
+	if isRead && c.rc.quota != nil && c.rc.quota.Charge(int64(n)) {
+		// wake up the reads of both sides so they see the quota
+		_ = c.rc.clientConn.SetReadDeadline(time.Now())
+		_ = c.rc.remoteConn.SetReadDeadline(time.Now())
+	}
+	labels := []string{c.rc.RelayLabel, c.rc.ConnType, flow, c.rc.remote.Address}
+	metrics.NetWorkTransmitBytes.WithLabelValues(labels...).Add(float64(n))
+	if c.rc.ListenPort > 0 {
+		portLabels := []string{c.rc.RelayLabel, c.rc.ConnType, flow, strconv.Itoa(c.rc.ListenPort)}
+		metrics.PortRangeTransmitBytes.WithLabelValues(portLabels...).Add(float64(n))
+	}
 }
 
 func (c *innerConn) Read(p []byte) (n int, err error) {
 	for {
+		if c.rc.quota != nil && c.rc.quota.Exceeded() {
+			return 0, ErrQuotaExceeded
+		}
 		deadline := time.Now().Add(c.rc.Options.ReadTimeout)
 		if err := c.Conn.SetReadDeadline(deadline); err != nil {
 			return 0, err
@@ -0,0 +1,102 @@
+package conn
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+)
+
+// spliceable returns the tcp conns of both sides when the kernel can move
+// the bytes between them by itself: a conn that is rate limited, sniffed
+// or otherwise wrapped is not a *net.TCPConn and takes the copy path.
+func (rc *relayConnImpl) spliceable() (client, remote *net.TCPConn, ok bool) {
+	if !spliceSupported || (rc.Options != nil && rc.Options.DisableSplice) {
+		return nil, nil, false
+	}
+	client, ok1 := rc.clientConn.(*net.TCPConn)
+	remote, ok2 := rc.remoteConn.(*net.TCPConn)
+	return client, remote, ok1 && ok2
+}
+
+// spliceConn relays with io.Copy between the tcp conns, which splices on
+// linux. The bytes never reach user space, so the stats, quota and idle
+// timeout are fed by the kernel counters of the client conn every
+// SpliceStatsInterval and by the copied totals at the end.
+func (rc *relayConnImpl) spliceConn(client, remote *net.TCPConn) error {
+	var up, down atomic.Int64
+	errCH := make(chan error, 2)
+	go func() {
+		n, err := io.Copy(remote, client)
+		up.Store(n)
+		_ = remote.CloseWrite()
+		errCH <- err
+	}()
+	go func() {
+		n, err := io.Copy(client, remote)
+		down.Store(n)
+		_ = client.CloseWrite()
+		errCH <- err
+	}()
+
+	inner := newInnerConn(client, rc)
+	var reported int64
+	record := func(total int64) {
+		if n := total - reported; n > 0 {
+			reported = total
+			// like the copy path every relayed byte is read once and written once
+			inner.recordStats(int(n), true)
+			inner.recordStats(int(n), false)
+			inner.lastActive = time.Now().Local()
+		}
+	}
+
+	ticker := time.NewTicker(constant.SpliceStatsInterval)
+	defer ticker.Stop()
+	var errs []error
+	var closedBy error
+	for len(errs) < 2 {
+		select {
+		case err := <-errCH:
+			errs = append(errs, err)
+		case <-ticker.C:
+			if received, acked, ok := tcpInfoBytes(client); ok {
+				// a FIN takes a sequence number the kernel counts as well,
+				// leave one per direction out so a sample never passes the
+				// copied totals
+				record(received + acked - 2)
+			}
+			if closedBy != nil {
+				continue
+			}
+			switch {
+			case rc.quota != nil && rc.quota.Exceeded():
+				closedBy = ErrQuotaExceeded
+			case time.Since(inner.lastActive) > rc.Options.IdleTimeout:
+				rc.l.Debugf("Splice idle, close remote: %s", rc.remote.Address)
+				closedBy = ErrIdleTimeout
+			default:
+				continue
+			}
+			_ = client.Close()
+			_ = remote.Close()
+		}
+	}
+	record(up.Load() + down.Load())
+	if closedBy != nil {
+		return combineErrorsAndMuteIDLE(closedBy, nil)
+	}
+	return combineErrorsAndMuteIDLE(mutedClosed(errs[0]), mutedClosed(errs[1]))
+}
+
+// mutedClosed drops the error of a copy cut by the other direction
+// closing both conns.
+func mutedClosed(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
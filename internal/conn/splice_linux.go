@@ -0,0 +1,27 @@
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// io.Copy between tcp conns splices on linux
+const spliceSupported = true
+
+// tcpInfoBytes returns the bytes c received and the bytes it sent that the
+// peer acked, from TCP_INFO.
+func tcpInfoBytes(c *net.TCPConn) (received, acked int64, ok bool) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var info *unix.TCPInfo
+	err = raw.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil || info == nil {
+		return 0, 0, false
+	}
+	return int64(info.Bytes_received), int64(info.Bytes_acked), true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package conn
+
+import "net"
+
+const spliceSupported = false
+
+func tcpInfoBytes(c *net.TCPConn) (received, acked int64, ok bool) {
+	return 0, 0, false
+}
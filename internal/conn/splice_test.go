@@ -0,0 +1,88 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+// tcpPair returns both ends of a loopback tcp conn.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	accepted, err := l.Accept()
+	require.NoError(t, err)
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestSpliceConn(t *testing.T) {
+	if !spliceSupported {
+		t.Skip("splice is linux only")
+	}
+	newRelayConn := func(opts *conf.Options) (client, remote net.Conn, rc *relayConnImpl) {
+		client, clientSide := tcpPair(t)
+		remoteSide, remote := tcpPair(t)
+		rc = NewRelayConn(clientSide, remoteSide, WithRemote(&lb.Node{Address: "echo"}), WithRelayOptions(opts)).(*relayConnImpl)
+		return client, remote, rc
+	}
+
+	echo := func(remote net.Conn) {
+		_, _ = io.Copy(remote, remote)
+		_ = remote.(*net.TCPConn).CloseWrite()
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		// bytes are counted once read and once written per direction
+		client, remote, rc := newRelayConn(&conf.Options{IdleTimeout: time.Minute, ReadTimeout: time.Minute})
+		go echo(remote)
+		done := make(chan error, 1)
+		go func() { done <- rc.Transport() }()
+		msg := make([]byte, 1<<20)
+		go func() { _, _ = client.Write(msg) }()
+		_, err := io.ReadFull(client, make([]byte, len(msg)))
+		require.NoError(t, err)
+		require.NoError(t, client.(*net.TCPConn).CloseWrite())
+		require.NoError(t, <-done)
+		require.True(t, rc.Spliced)
+		require.Equal(t, int64(2*len(msg)), rc.Stats.Up)
+		require.Equal(t, int64(2*len(msg)), rc.Stats.Down)
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		client, _, rc := newRelayConn(&conf.Options{IdleTimeout: 500 * time.Millisecond, ReadTimeout: time.Minute})
+		done := make(chan error, 1)
+		go func() { done <- rc.Transport() }()
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("idle spliced conn not closed")
+		}
+		_, err := client.Read(make([]byte, 1))
+		require.Error(t, err)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		client, remote, rc := newRelayConn(&conf.Options{IdleTimeout: time.Minute, ReadTimeout: time.Minute, DisableSplice: true})
+		go echo(remote)
+		done := make(chan error, 1)
+		go func() { done <- rc.Transport() }()
+		_, err := client.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(client, make([]byte, 5))
+		require.NoError(t, err)
+		require.NoError(t, client.(*net.TCPConn).CloseWrite())
+		require.NoError(t, <-done)
+		require.False(t, rc.Spliced)
+	})
+}
@@ -0,0 +1,145 @@
+package conn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h, x/sys does not have it
+const ip6tSoOriginalDst = 80
+
+// TransparentControl sets IP_TRANSPARENT so the socket can accept conns and
+// datagrams to any address steered to it by TPROXY, or bind to a foreign
+// address to answer them. It needs CAP_NET_ADMIN.
+func TransparentControl(network, address string, c syscall.RawConn) error {
+	return setSockOpts(c, false)
+}
+
+// setSockOpts sets the ip and ipv6 flavor of every option, a dual stack
+// socket needs both and a v4 only one refuses the ipv6 ones.
+func setSockOpts(c syscall.RawConn, recvOrigDst bool) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		set := func(v4Level, v4Opt, v6Level, v6Opt int) error {
+			err4 := unix.SetsockoptInt(int(fd), v4Level, v4Opt, 1)
+			err6 := unix.SetsockoptInt(int(fd), v6Level, v6Opt, 1)
+			if err4 != nil && err6 != nil {
+				return err4
+			}
+			return nil
+		}
+		if err := set(unix.SOL_IP, unix.IP_TRANSPARENT, unix.SOL_IPV6, unix.IPV6_TRANSPARENT); err != nil {
+			sockErr = fmt.Errorf("set IP_TRANSPARENT: %w", err)
+			return
+		}
+		if recvOrigDst {
+			if err := set(unix.SOL_IP, unix.IP_RECVORIGDSTADDR, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR); err != nil {
+				sockErr = fmt.Errorf("set IP_RECVORIGDSTADDR: %w", err)
+				return
+			}
+		}
+		// the reply socket binds to the address the listener receives on
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			sockErr = fmt.Errorf("set SO_REUSEADDR: %w", err)
+		}
+	})
+	return errors.Join(err, sockErr)
+}
+
+func listenTransparentUDP(ctx context.Context, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		return setSockOpts(c, true)
+	}}
+	pc, err := lc.ListenPacket(ctx, "udp", laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// dialTransparentUDP returns a socket bound to the original destination of
+// a tproxied datagram, replies sent by it come from that destination.
+func dialTransparentUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp4"
+	if laddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{Control: TransparentControl}
+	pc, err := lc.ListenPacket(context.Background(), network, laddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// parseOrigDst finds the original destination in the control message of a
+// datagram read from a socket with IP_RECVORIGDSTADDR.
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR &&
+			len(msg.Data) >= unix.SizeofSockaddrInet4:
+			sa := (*unix.RawSockaddrInet4)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: ntohs(sa.Port)}, nil
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR &&
+			len(msg.Data) >= unix.SizeofSockaddrInet6:
+			sa := (*unix.RawSockaddrInet6)(unsafe.Pointer(&msg.Data[0]))
+			return &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: ntohs(sa.Port)}, nil
+		}
+	}
+	return nil, errors.New("no original destination in control message")
+}
+
+// ntohs turns a port in network byte order as stored in a sockaddr into a number.
+func ntohs(port uint16) int {
+	var b [2]byte
+	*(*uint16)(unsafe.Pointer(&b[0])) = port
+	return int(binary.BigEndian.Uint16(b[:]))
+}
+
+// OriginalDst returns the destination a REDIRECTed tcp conn was sent to
+// before nat, read from conntrack via SO_ORIGINAL_DST.
+func OriginalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	isV4 := c.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+	var addr *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if isV4 {
+			// sockaddr_in fits into the ipv6_mreq that is read back
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(binary.BigEndian.Uint16(b[2:4]))}
+			return
+		}
+		// sockaddr_in6 is the head of the ip6_mtuinfo that is read back
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		addr = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: ntohs(info.Addr.Port)}
+	})
+	if err = errors.Join(err, sockErr); err != nil {
+		return nil, fmt.Errorf("get SO_ORIGINAL_DST: %w", err)
+	}
+	return addr, nil
+}
@@ -0,0 +1,49 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+func TestUDPListener_Transparent(t *testing.T) {
+	cfg := &conf.Config{Listen: "127.0.0.1:0", ListenType: constant.RelayTypeTProxy}
+	require.NoError(t, cfg.Adjust())
+	l, err := NewUDPListener(context.Background(), cfg)
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("IP_TRANSPARENT needs CAP_NET_ADMIN")
+	}
+	require.NoError(t, err)
+	defer l.Close()
+	laddr := l.listenConn.LocalAddr().(*net.UDPAddr)
+
+	client, err := net.DialUDP("udp", nil, laddr)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+	// without a TPROXY rule the original destination is the listener itself
+	require.Equal(t, laddr.String(), c.OriginalDst().String())
+	require.Equal(t, client.LocalAddr().String(), c.RemoteAddr().String())
+
+	// the reply comes from the original destination
+	_, err = c.Write([]byte("pong"))
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf[:n]))
+}
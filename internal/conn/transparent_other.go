@@ -0,0 +1,32 @@
+//go:build !linux
+
+package conn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+var errTransparentNotSupported = errors.New("transparent proxy is only supported on linux")
+
+func TransparentControl(network, address string, c syscall.RawConn) error {
+	return errTransparentNotSupported
+}
+
+func listenTransparentUDP(ctx context.Context, laddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
+
+func dialTransparentUDP(laddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentNotSupported
+}
+
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, errTransparentNotSupported
+}
+
+func OriginalDst(c *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparentNotSupported
+}
@@ -0,0 +1,168 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/pkg/socks5"
+)
+
+const udpFrameHeaderSize = 2
+
+var _ net.Conn = &UDPFrameConn{}
+
+// UDPFrameConn carries udp datagrams over a stream conn, the udp over
+// stream framing of every non raw transport:
+//
+//	LENGTH(2, big endian) | [ATYP | ADDR | PORT] | PAYLOAD
+//
+// LENGTH covers everything after it. The destination uses the socks5
+// address encoding and is only there on conns made with
+// NewUDPAddrFrameConn, both ends must agree on it.
+//
+// Read keeps the partial frame state between calls, so a read deadline
+// hit in the middle of a frame does not break the framing. Like a udp
+// socket, a datagram bigger than the read buffer or than a udp datagram
+// can be is dropped instead of failing the conn.
+type UDPFrameConn struct {
+	net.Conn
+
+	label    string
+	withAddr bool
+	// destination of Write on conns with address
+	target string
+
+	hdr      [udpFrameHeaderSize]byte
+	hdrN     int
+	frame    []byte
+	frameN   int
+	frameLen int
+
+	readPackets, writePackets atomic.Int64
+	dropped                   atomic.Int64
+}
+
+// NewUDPFrameConn frames datagrams of the relay label without address.
+func NewUDPFrameConn(c net.Conn, label string) *UDPFrameConn {
+	return &UDPFrameConn{Conn: c, label: label}
+}
+
+// NewUDPAddrFrameConn frames datagrams with their destination, for
+// sessions that talk to many destinations like a socks5 udp associate.
+// Write sends to target, WriteTo to any address.
+func NewUDPAddrFrameConn(c net.Conn, label, target string) *UDPFrameConn {
+	return &UDPFrameConn{Conn: c, label: label, withAddr: true, target: target}
+}
+
+func (c *UDPFrameConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+// ReadFrom reads the next datagram that fits b, addr is empty on conns
+// without address.
+func (c *UDPFrameConn) ReadFrom(b []byte) (n int, addr string, err error) {
+	for {
+		frame, err := c.readFrame()
+		if err != nil {
+			return 0, "", err
+		}
+		payload := frame
+		if c.withAddr {
+			r := bytes.NewReader(frame)
+			if addr, err = socks5.ReadAddr(r); err != nil {
+				c.drop(metrics.METRIC_UDP_DROP_BAD_FRAME)
+				continue
+			}
+			payload = frame[len(frame)-r.Len():]
+		}
+		if len(payload) > len(b) {
+			c.drop(metrics.METRIC_UDP_DROP_OVERSIZED)
+			continue
+		}
+		c.readPackets.Add(1)
+		metrics.UDPFramePacketCount.WithLabelValues(c.label, metrics.METRIC_FLOW_READ).Inc()
+		return copy(b, payload), addr, nil
+	}
+}
+
+// readFrame returns the next whole frame, valid until the next call.
+func (c *UDPFrameConn) readFrame() ([]byte, error) {
+	for c.hdrN < udpFrameHeaderSize {
+		n, err := c.Conn.Read(c.hdr[c.hdrN:])
+		c.hdrN += n
+		if err != nil {
+			if err == io.EOF && c.hdrN > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if c.hdrN == udpFrameHeaderSize {
+			c.frameLen = int(binary.BigEndian.Uint16(c.hdr[:]))
+			if cap(c.frame) < c.frameLen {
+				c.frame = make([]byte, c.frameLen)
+			}
+			c.frame = c.frame[:c.frameLen]
+		}
+	}
+	for c.frameN < c.frameLen {
+		n, err := c.Conn.Read(c.frame[c.frameN:])
+		c.frameN += n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	c.hdrN, c.frameN = 0, 0
+	return c.frame, nil
+}
+
+func (c *UDPFrameConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.target)
+}
+
+// WriteTo sends b to addr, addr is ignored on conns without address. A
+// datagram bigger than a udp datagram can be is dropped.
+func (c *UDPFrameConn) WriteTo(b []byte, addr string) (int, error) {
+	if len(b) > constant.MaxUDPDatagramSize {
+		c.drop(metrics.METRIC_UDP_DROP_OVERSIZED)
+		return len(b), nil
+	}
+	buf := make([]byte, udpFrameHeaderSize, udpFrameHeaderSize+len(b))
+	if c.withAddr {
+		var err error
+		if buf, err = socks5.AppendAddr(buf, addr); err != nil {
+			return 0, err
+		}
+	}
+	buf = append(buf, b...)
+	if len(buf)-udpFrameHeaderSize > math.MaxUint16 {
+		c.drop(metrics.METRIC_UDP_DROP_OVERSIZED)
+		return len(b), nil
+	}
+	binary.BigEndian.PutUint16(buf, uint16(len(buf)-udpFrameHeaderSize))
+	if _, err := c.Conn.Write(buf); err != nil {
+		return 0, err
+	}
+	c.writePackets.Add(1)
+	metrics.UDPFramePacketCount.WithLabelValues(c.label, metrics.METRIC_FLOW_WRITE).Inc()
+	return len(b), nil
+}
+
+func (c *UDPFrameConn) drop(reason string) {
+	c.dropped.Add(1)
+	metrics.UDPDroppedPacketCount.WithLabelValues(c.label, reason).Inc()
+}
+
+// Packets returns the datagrams read, written and dropped so far.
+func (c *UDPFrameConn) Packets() (read, write, dropped int64) {
+	return c.readPackets.Load(), c.writePackets.Load(), c.dropped.Load()
+}
@@ -0,0 +1,104 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+)
+
+func TestUDPFrameConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	w, r := NewUDPFrameConn(c1, "test"), NewUDPFrameConn(c2, "test")
+
+	msgs := [][]byte{[]byte("hello"), []byte("udp"), make([]byte, 2000)}
+	go func() {
+		for _, m := range msgs {
+			_, _ = w.Write(m)
+		}
+	}()
+
+	// datagram boundaries are kept even when read with a big buffer
+	buf := make([]byte, 4096)
+	for _, m := range msgs {
+		n, err := r.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, m, buf[:n])
+	}
+
+	// like a udp socket a datagram bigger than the buffer is dropped and
+	// the next one is read
+	go func() {
+		_, _ = w.Write(make([]byte, 100))
+		_, _ = w.Write([]byte("next"))
+	}()
+	n, err := r.Read(buf[:10])
+	require.NoError(t, err)
+	assert.Equal(t, "next", string(buf[:n]))
+
+	// a datagram bigger than udp allows is dropped by the writer
+	n, err = w.Write(make([]byte, constant.MaxUDPDatagramSize+1))
+	require.NoError(t, err)
+	assert.Equal(t, constant.MaxUDPDatagramSize+1, n)
+
+	read, _, dropped := r.Packets()
+	assert.Equal(t, int64(4), read)
+	assert.Equal(t, int64(1), dropped)
+	assert.Eventually(t, func() bool {
+		_, write, dropped := w.Packets()
+		return write == 5 && dropped == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestUDPFrameConn_Addr(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	w, r := NewUDPAddrFrameConn(c1, "test", "1.1.1.1:53"), NewUDPAddrFrameConn(c2, "test", "")
+
+	go func() {
+		_, _ = w.Write([]byte("default"))
+		_, _ = w.WriteTo([]byte("v6"), "[2001:db8::1]:443")
+		_, _ = w.WriteTo([]byte("domain"), "example.com:80")
+	}()
+	buf := make([]byte, 64)
+	for _, want := range []struct{ payload, addr string }{
+		{"default", "1.1.1.1:53"},
+		{"v6", "[2001:db8::1]:443"},
+		{"domain", "example.com:80"},
+	} {
+		n, addr, err := r.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, want.payload, string(buf[:n]))
+		assert.Equal(t, want.addr, addr)
+	}
+
+	_, err := w.WriteTo([]byte("x"), "no port")
+	assert.Error(t, err)
+}
+
+func TestUDPFrameConn_PartialFrame(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	r := NewUDPFrameConn(c2, "test")
+
+	// header and first half of payload, then a read deadline hits
+	go func() { _, _ = c1.Write([]byte{0x00, 0x04, 'a', 'b'}) }()
+	buf := make([]byte, 16)
+	_ = c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := r.Read(buf)
+	assert.Error(t, err)
+
+	_ = c2.SetReadDeadline(time.Time{})
+	go func() { _, _ = c1.Write([]byte{'c', 'd'}) }()
+	n, err := r.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(buf[:n]))
+}
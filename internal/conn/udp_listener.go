@@ -2,87 +2,173 @@
 package conn
 
 import (
+	"bytes"
 	"context"
-	"io"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/metrics"
 	"github.com/Ehco1996/ehco/internal/relay/conf"
-	"github.com/Ehco1996/ehco/pkg/buffer"
 )
 
-var _ net.Conn = &uc{}
+var _ UDPSession = &uc{}
 
+// room for the IP_ORIGDSTADDR control message of a tproxied datagram
+const udpOOBSize = 64
+
+// UDPSession is the conn of one client of a udp listener.
+type UDPSession interface {
+	net.Conn
+	SessionStats() UDPSessionStats
+}
+
+// UDPSessionStats are the counters of a udp session, in is from the client.
+type UDPSessionStats struct {
+	Client     string    `json:"client"`
+	Local      string    `json:"local"`
+	InPackets  int64     `json:"in_packets"`
+	InBytes    int64     `json:"in_bytes"`
+	OutPackets int64     `json:"out_packets"`
+	OutBytes   int64     `json:"out_bytes"`
+	Dropped    int64     `json:"dropped"`
+	StartTime  time.Time `json:"start_time"`
+	LastActive time.Time `json:"last_active"`
+}
+
+// uc is a session of the nat table of a UDPListener, reads block until a
+// datagram of the client is queued, the deadline passes or it is closed.
 type uc struct {
-	conn *net.UDPConn
+	*QueueConn
+
 	addr *net.UDPAddr
+	key  string
 
-	msgCh chan []byte
+	// tproxy only: where the client sent to, replies are sent from it
+	origDst   *net.UDPAddr
+	replyConn *net.UDPConn
 
-	lastActivity atomic.Value
+	startTime  time.Time
+	lastActive atomic.Int64 // unix nano
+
+	inPackets, inBytes   atomic.Int64
+	outPackets, outBytes atomic.Int64
+	dropped              atomic.Int64
 
 	listener *UDPListener
 }
 
-func (c *uc) Read(b []byte) (int, error) {
+func (l *UDPListener) newSession(addr, origDst *net.UDPAddr, replyConn *net.UDPConn) *uc {
+	c := &uc{
+		addr:      addr,
+		key:       sessionKey(addr, origDst),
+		origDst:   origDst,
+		replyConn: replyConn,
+		startTime: time.Now(),
+		listener:  l,
+	}
+	c.lastActive.Store(c.startTime.UnixNano())
+	local := net.Addr(l.listenAddr)
+	if origDst != nil {
+		local = origDst
+	}
+	size := l.cfg.Options.UDPQueueSize
+	if size <= 0 {
+		size = constant.DefaultUDPQueueSize
+	}
+	c.QueueConn = newQueueConn(local, addr, size, c.write, c.onClose, c.drop)
+	return c
+}
+
+// push queues a datagram of the client, it is dropped when the relay
+// falls behind.
+func (c *uc) push(b []byte) {
+	c.touch()
+	if c.Push(b) {
+		c.inPackets.Add(1)
+		c.inBytes.Add(int64(len(b)))
+		return
+	}
+	reason := metrics.METRIC_UDP_DROP_QUEUE_FULL
 	select {
-	case msg := <-c.msgCh:
-		n := copy(b, msg)
-		c.lastActivity.Store(time.Now())
-		return n, nil
+	case <-c.Done():
+		reason = metrics.METRIC_UDP_DROP_CLOSED
 	default:
-		if time.Since(c.lastActivity.Load().(time.Time)) > c.listener.cfg.Options.IdleTimeout {
-			return 0, io.EOF
-		}
-		return 0, nil
 	}
+	c.drop(reason)
 }
 
-func (c *uc) Write(b []byte) (int, error) {
-	n, err := c.conn.WriteToUDP(b, c.addr)
-	c.lastActivity.Store(time.Now())
-	return n, err
+func (c *uc) drop(reason string) {
+	c.dropped.Add(1)
+	metrics.UDPDroppedPacketCount.WithLabelValues(c.listener.cfg.Label, reason).Inc()
 }
 
-func (c *uc) Close() error {
-	c.listener.connsMu.Lock()
-	delete(c.listener.conns, c.addr.String())
-	c.listener.connsMu.Unlock()
-	close(c.msgCh)
-	return nil
+func (c *uc) write(b []byte) (int, error) {
+	w := c.listener.listenConn
+	if c.replyConn != nil {
+		w = c.replyConn
+	}
+	n, err := w.WriteToUDP(b, c.addr)
+	if err == nil {
+		c.touch()
+		c.outPackets.Add(1)
+		c.outBytes.Add(int64(n))
+	}
+	return n, err
 }
 
-func (c *uc) LocalAddr() net.Addr {
-	return c.conn.LocalAddr()
+func (c *uc) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
 }
 
-func (c *uc) RemoteAddr() net.Addr {
-	return c.addr
+func (c *uc) idle() time.Duration {
+	return time.Since(time.Unix(0, c.lastActive.Load()))
 }
 
-func (c *uc) SetDeadline(t time.Time) error {
-	return nil
+// onClose removes the session from the nat table, the next datagram of
+// the client starts a new one.
+func (c *uc) onClose() {
+	c.listener.removeSession(c)
+	if c.replyConn != nil {
+		c.replyConn.Close()
+	}
 }
 
-func (c *uc) SetReadDeadline(t time.Time) error {
-	return nil
+// OriginalDst returns the destination of a tproxied session, nil otherwise.
+func (c *uc) OriginalDst() *net.UDPAddr {
+	return c.origDst
 }
 
-func (c *uc) SetWriteDeadline(t time.Time) error {
-	return nil
+func (c *uc) SessionStats() UDPSessionStats {
+	return UDPSessionStats{
+		Client:     c.addr.String(),
+		Local:      c.LocalAddr().String(),
+		InPackets:  c.inPackets.Load(),
+		InBytes:    c.inBytes.Load(),
+		OutPackets: c.outPackets.Load(),
+		OutBytes:   c.outBytes.Load(),
+		Dropped:    c.dropped.Load(),
+		StartTime:  c.startTime,
+		LastActive: time.Unix(0, c.lastActive.Load()),
+	}
 }
 
+// UDPListener demultiplexes the datagrams of one socket into a session per
+// client, sessions idle for longer than the idle timeout are closed.
 type UDPListener struct {
 	cfg        *conf.Config
 	listenAddr *net.UDPAddr
 	listenConn *net.UDPConn
+	// tproxy listen type, sessions are keyed by client and original destination
+	transparent bool
 
+	// the nat table
 	conns   map[string]*uc
 	connsMu sync.RWMutex
 	connCh  chan *uc
-	msgCh   chan []byte
 	errCh   chan error
 
 	ctx    context.Context
@@ -92,12 +178,24 @@ type UDPListener struct {
 }
 
 func NewUDPListener(ctx context.Context, cfg *conf.Config) (*UDPListener, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", cfg.Listen)
+	return NewUDPListenerAt(ctx, cfg, cfg.Listen)
+}
+
+// NewUDPListenerAt listens on listen instead of cfg.Listen, e.g. one port
+// of a port range rule.
+func NewUDPListenerAt(ctx context.Context, cfg *conf.Config, listen string) (*UDPListener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", listen)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.ListenUDP("udp", udpAddr)
+	transparent := cfg.ListenType == constant.RelayTypeTProxy
+	var conn *net.UDPConn
+	if transparent {
+		conn, err = listenTransparentUDP(ctx, udpAddr)
+	} else {
+		conn, err = net.ListenUDP("udp", udpAddr)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -105,67 +203,151 @@ func NewUDPListener(ctx context.Context, cfg *conf.Config) (*UDPListener, error)
 	ctx, cancel := context.WithCancel(ctx)
 
 	l := &UDPListener{
-		cfg:        cfg,
-		listenConn: conn,
-		listenAddr: udpAddr,
+		cfg:         cfg,
+		listenConn:  conn,
+		listenAddr:  conn.LocalAddr().(*net.UDPAddr),
+		transparent: transparent,
 
 		conns:  make(map[string]*uc),
 		connCh: make(chan *uc),
-		msgCh:  make(chan []byte),
 		errCh:  make(chan error),
 		ctx:    ctx,
 		cancel: cancel,
 	}
 
 	go l.listen()
+	go l.expireSessions()
 
 	return l, nil
 }
 
 func (l *UDPListener) listen() {
-	defer l.listenConn.Close()
+	defer l.Close()
+	// datagrams over the mtu arrive reassembled, a mtu sized buffer would
+	// truncate them
+	buf := make([]byte, constant.MaxUDPDatagramSize)
+	var oob []byte
+	if l.transparent {
+		oob = make([]byte, udpOOBSize)
+	}
 	for {
-		if l.closed.Load() {
-			return
-		}
-
-		buf := buffer.UDPBufferPool.Get()
-		n, addr, err := l.listenConn.ReadFromUDP(buf)
+		n, addr, origDst, err := l.read(buf, oob)
 		if err != nil {
-			if !l.closed.Load() {
-				select {
-				case l.errCh <- err:
-				default:
-				}
+			if l.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case l.errCh <- err:
+			default:
 			}
-			buffer.UDPBufferPool.Put(buf)
 			continue
 		}
 
+		if l.transparent && origDst == nil {
+			metrics.UDPDroppedPacketCount.WithLabelValues(l.cfg.Label, metrics.METRIC_UDP_DROP_NO_ORIG_DST).Inc()
+			continue
+		}
 		l.connsMu.RLock()
-		udpConn, exists := l.conns[addr.String()]
+		session, exists := l.conns[sessionKey(addr, origDst)]
 		l.connsMu.RUnlock()
 		if !exists {
-			l.connsMu.Lock()
-			udpConn = &uc{
-				conn:         l.listenConn,
-				addr:         addr,
-				listener:     l,
-				msgCh:        make(chan []byte, 10),
-				lastActivity: atomic.Value{},
+			if session, err = l.addSession(addr, origDst); err != nil {
+				return
 			}
-			udpConn.lastActivity.Store(time.Now())
-			l.conns[addr.String()] = udpConn
-			l.connCh <- udpConn
-			l.connsMu.Unlock()
+			if session == nil {
+				continue
+			}
+		}
+		// the buffer is reused, the session keeps a copy of the datagram
+		session.push(bytes.Clone(buf[:n]))
+	}
+}
+
+// addSession adds the session of a new client to the nat table and waits
+// for it to be accepted, nil when its reply socket can not be opened.
+func (l *UDPListener) addSession(addr, origDst *net.UDPAddr) (*uc, error) {
+	var replyConn *net.UDPConn
+	if origDst != nil {
+		var err error
+		if replyConn, err = dialTransparentUDP(origDst); err != nil {
+			return nil, nil
 		}
+	}
+	session := l.newSession(addr, origDst, replyConn)
+	l.connsMu.Lock()
+	l.conns[session.key] = session
+	l.connsMu.Unlock()
+	metrics.UDPSessionCount.WithLabelValues(l.cfg.Label).Inc()
+	select {
+	case l.connCh <- session:
+		return session, nil
+	case <-l.ctx.Done():
+		session.Close()
+		return nil, l.ctx.Err()
+	}
+}
+
+func (l *UDPListener) removeSession(c *uc) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	if l.conns[c.key] == c {
+		delete(l.conns, c.key)
+		metrics.UDPSessionCount.WithLabelValues(l.cfg.Label).Dec()
+	}
+}
 
+// expireSessions closes the sessions that idled for longer than the idle
+// timeout, their relay conns see EOF. The listener is closed with its ctx.
+func (l *UDPListener) expireSessions() {
+	ticker := time.NewTicker(constant.UDPSessionExpireCheck)
+	defer ticker.Stop()
+	for {
 		select {
-		case udpConn.msgCh <- buf[:n]:
-		default:
-			buffer.UDPBufferPool.Put(buf)
+		case <-l.ctx.Done():
+			l.Close()
+			return
+		case <-ticker.C:
 		}
+		for _, c := range l.Sessions() {
+			if c.idle() > l.cfg.Options.IdleTimeout {
+				c.Close()
+			}
+		}
+	}
+}
+
+// Sessions returns the sessions of the nat table.
+func (l *UDPListener) Sessions() []*uc {
+	l.connsMu.RLock()
+	defer l.connsMu.RUnlock()
+	sessions := make([]*uc, 0, len(l.conns))
+	for _, c := range l.conns {
+		sessions = append(sessions, c)
 	}
+	return sessions
+}
+
+// read reads one datagram, in transparent mode with its original destination.
+func (l *UDPListener) read(buf, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	if !l.transparent {
+		n, addr, err := l.listenConn.ReadFromUDP(buf)
+		return n, addr, nil, err
+	}
+	n, oobn, _, addr, err := l.listenConn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	// a datagram without original destination can not be answered, the
+	// caller drops it
+	origDst, _ := parseOrigDst(oob[:oobn])
+	return n, addr, origDst, nil
+}
+
+func sessionKey(addr, origDst *net.UDPAddr) string {
+	if origDst == nil {
+		return addr.String()
+	}
+	return addr.String() + "->" + origDst.String()
 }
 
 func (l *UDPListener) Accept() (*uc, error) {
@@ -179,11 +361,15 @@ func (l *UDPListener) Accept() (*uc, error) {
 	}
 }
 
+// Close closes the socket and every session.
 func (l *UDPListener) Close() error {
 	if !l.closed.CompareAndSwap(false, true) {
 		return nil
 	}
 	l.cancel()
-	l.closed.Store(true)
-	return l.listenConn.Close()
+	err := l.listenConn.Close()
+	for _, c := range l.Sessions() {
+		c.Close()
+	}
+	return err
 }
@@ -0,0 +1,104 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+func TestUDPListener_Session(t *testing.T) {
+	cfg := &conf.Config{
+		Label:      "udp-session",
+		Listen:     "127.0.0.1:0",
+		ListenType: constant.RelayTypeRaw,
+		Options:    &conf.Options{IdleTimeoutSec: 1, UDPQueueSize: 2},
+	}
+	require.NoError(t, cfg.Adjust())
+	l, err := NewUDPListener(context.Background(), cfg)
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.DialUDP("udp", nil, l.listenAddr)
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+
+	c, err := l.Accept()
+	require.NoError(t, err)
+	buf := make([]byte, constant.UDPBufSize)
+	n, err := c.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf[:n]))
+
+	// reads block until the deadline instead of returning nothing
+	start := time.Now()
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = c.Read(buf)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	require.NoError(t, c.SetReadDeadline(time.Time{}))
+
+	// datagrams over the queue size are dropped while nobody reads
+	for range 4 {
+		_, err = client.Write([]byte("burst"))
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return c.SessionStats().InPackets+c.SessionStats().Dropped == 5
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(3), c.SessionStats().InPackets)
+	require.Equal(t, int64(2), c.SessionStats().Dropped)
+	for range 2 {
+		n, err = c.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, "burst", string(buf[:n]))
+	}
+
+	// a datagram bigger than the read buffer is dropped, the session goes on
+	_, err = client.Write(make([]byte, 100))
+	require.NoError(t, err)
+	_, err = client.Write([]byte("small"))
+	require.NoError(t, err)
+	n, err = c.Read(buf[:10])
+	require.NoError(t, err)
+	require.Equal(t, "small", string(buf[:n]))
+	require.Equal(t, int64(3), c.SessionStats().Dropped)
+
+	_, err = c.Write([]byte("pong"))
+	require.NoError(t, err)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err = client.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf[:n]))
+	stats := c.SessionStats()
+	require.Equal(t, client.LocalAddr().String(), stats.Client)
+	require.Equal(t, int64(1), stats.OutPackets)
+	require.Equal(t, int64(4), stats.OutBytes)
+
+	// the idle session is closed and removed from the nat table, the next
+	// datagram starts a new one
+	require.Eventually(t, func() bool { return len(l.Sessions()) == 0 }, 3*time.Second, 50*time.Millisecond)
+	_, err = c.Read(buf)
+	require.Error(t, err)
+	_, err = client.Write([]byte("again"))
+	require.NoError(t, err)
+	c2, err := l.Accept()
+	require.NoError(t, err)
+	require.NotSame(t, c, c2)
+	n, err = c2.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "again", string(buf[:n]))
+
+	// closing the listener closes its sessions
+	require.NoError(t, l.Close())
+	_, err = c2.Read(buf)
+	require.Error(t, err)
+}
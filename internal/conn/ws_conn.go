@@ -1,66 +1,193 @@
 package conn
 
 import (
-	"fmt"
+	"bytes"
+	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 
-	"github.com/Ehco1996/ehco/pkg/buffer"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
-	"go.uber.org/zap"
 )
 
-// wsConn represents a WebSocket connection to relay(io.Copy)
+// wsConn represents a WebSocket connection to relay(io.Copy), the payload
+// of the data frames is read as a byte stream straight from the conn.
 type wsConn struct {
 	conn     net.Conn
 	isServer bool
-	buf      []byte
+
+	// the frame header and the control frame being read, a read cut by a
+	// deadline goes on from them in the next call
+	hdr     [ws.MaxHeaderSize]byte
+	hdrN    int
+	control *controlFrame
+
+	// the data frame being read
+	remaining int64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	// set once the close frame of the peer is read
+	closed bool
+
+	// pong and close replies are written by Read
+	writeMu sync.Mutex
+}
+
+type controlFrame struct {
+	header  ws.Header
+	payload []byte
+	n       int
 }
 
 func NewWSConn(conn net.Conn, isServer bool) *wsConn {
-	return &wsConn{conn: conn, isServer: isServer, buf: buffer.BufferPool.Get()}
+	return &wsConn{conn: conn, isServer: isServer}
 }
 
+// Read returns the payload of the data frames, a frame bigger than b is
+// returned by the next calls. Fragments of a message are read as they
+// come, pings are answered and a close frame ends the conn with io.EOF.
 func (c *wsConn) Read(b []byte) (n int, err error) {
-	header, err := ws.ReadHeader(c.conn)
-	if err != nil {
-		return 0, err
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if c.control == nil {
+			header, err := c.readHeader()
+			if err != nil {
+				return 0, err
+			}
+			if !header.OpCode.IsControl() {
+				c.remaining = header.Length
+				c.masked, c.mask, c.maskPos = header.Masked, header.Mask, 0
+				continue
+			}
+			if header.Length > 125 {
+				return 0, ws.ErrProtocolControlPayloadOverflow
+			}
+			if !header.Fin {
+				return 0, ws.ErrProtocolControlNotFinal
+			}
+			c.control = &controlFrame{header: header, payload: make([]byte, header.Length)}
+		}
+		if err := c.handleControl(); err != nil {
+			return 0, err
+		}
 	}
-	if header.Length > int64(cap(c.buf)) {
-		zap.S().Warnf("ws payload size:%d is larger than buffer size:%d", header.Length, cap(c.buf))
-		return 0, fmt.Errorf("buffer size:%d too small to transport ws payload size:%d", len(b), header.Length)
+	if len(b) == 0 {
+		return 0, nil
 	}
-	payload := c.buf[:header.Length]
-	_, err = io.ReadFull(c.conn, payload)
-	if err != nil {
-		return 0, err
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err = c.conn.Read(b)
+	if c.masked {
+		ws.Cipher(b[:n], c.mask, c.maskPos)
+		c.maskPos += n
+	}
+	c.remaining -= int64(n)
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readHeader reads the next frame header.
+func (c *wsConn) readHeader() (ws.Header, error) {
+	size := func() int {
+		if c.hdrN < ws.MinHeaderSize {
+			return ws.MinHeaderSize
+		}
+		return headerSize(c.hdr[1])
 	}
+	for c.hdrN < size() {
+		n, err := c.conn.Read(c.hdr[c.hdrN:size()])
+		c.hdrN += n
+		if err != nil {
+			if err == io.EOF && c.hdrN > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return ws.Header{}, err
+		}
+	}
+	header, err := ws.ReadHeader(bytes.NewReader(c.hdr[:c.hdrN]))
+	c.hdrN = 0
+	return header, err
+}
+
+// headerSize returns the size of a frame header from its second byte,
+// which holds the mask bit and the payload length.
+func headerSize(b byte) int {
+	size := ws.MinHeaderSize
+	if b&0x80 != 0 {
+		size += 4
+	}
+	switch b & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	return size
+}
+
+// handleControl reads the payload of the control frame, at most 125 bytes,
+// and answers pings and close frames.
+func (c *wsConn) handleControl() error {
+	f := c.control
+	for f.n < len(f.payload) {
+		n, err := c.conn.Read(f.payload[f.n:])
+		f.n += n
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	c.control = nil
+	header, payload := f.header, f.payload
 	if header.Masked {
 		ws.Cipher(payload, header.Mask, 0)
 	}
-	if len(payload) > len(b) {
-		return 0, fmt.Errorf("buffer size:%d too small to transport ws payload size:%d", len(b), len(payload))
+	switch header.OpCode {
+	case ws.OpPing:
+		return c.writeFrame(ws.OpPong, payload)
+	case ws.OpClose:
+		c.closed = true
+		// echo the status code back, the peer closes the tcp conn then
+		code, _ := ws.ParseCloseFrameData(payload)
+		body := ws.NewCloseFrameBody(code, "")
+		if code.Empty() {
+			body = nil
+		}
+		if err := c.writeFrame(ws.OpClose, body); err != nil && !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		return io.EOF
 	}
-	copy(b, payload)
-	return len(payload), nil
+	return nil
 }
 
-func (c *wsConn) Write(b []byte) (n int, err error) {
+func (c *wsConn) writeFrame(op ws.OpCode, p []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	if c.isServer {
-		err = wsutil.WriteServerBinary(c.conn, b)
-	} else {
-		err = wsutil.WriteClientBinary(c.conn, b)
+		return wsutil.WriteServerMessage(c.conn, op, p)
 	}
-	if err != nil {
+	return wsutil.WriteClientMessage(c.conn, op, p)
+}
+
+func (c *wsConn) Write(b []byte) (n int, err error) {
+	if err := c.writeFrame(ws.OpBinary, b); err != nil {
 		return 0, err
 	}
 	return len(b), nil
 }
 
 func (c *wsConn) Close() error {
-	defer buffer.BufferPool.Put(c.buf)
 	return c.conn.Close()
 }
 
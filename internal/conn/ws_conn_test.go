@@ -1,14 +1,20 @@
 package conn
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestClientConn_ReadWrite(t *testing.T) {
@@ -67,4 +73,103 @@ func TestClientConn_ReadWrite(t *testing.T) {
 		assert.Equal(t, len(data), n, "test cnt %d", i)
 		assert.Equal(t, "hello", string(buf[:n]), "test cnt %d", i)
 	}
+
+	// the rest of a frame is returned by the next reads
+	_, err = wsClientConn.Write(data)
+	assert.NoError(t, err)
+	buf := make([]byte, 2)
+	var got []byte
+	for len(got) < len(data) {
+		n, err := wsClientConn.Read(buf)
+		assert.NoError(t, err)
+		got = append(got, buf[:n]...)
+	}
+	assert.Equal(t, "hello", string(got))
+}
+
+func TestWSConn_Frames(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	wsc := NewWSConn(server, true)
+	defer wsc.Close()
+
+	big := bytes.Repeat([]byte("x"), 100*1024)
+	writeErr := make(chan error, 1)
+	go func() {
+		frames := []ws.Frame{
+			// a frame bigger than any read buffer
+			ws.NewBinaryFrame(big),
+			// a ping between the fragments of a message
+			ws.NewFrame(ws.OpBinary, false, []byte("frag")),
+			ws.NewPingFrame([]byte("ping")),
+			ws.NewFrame(ws.OpContinuation, true, []byte("ment")),
+			ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye")),
+		}
+		for _, f := range frames {
+			if err := ws.WriteFrame(client, ws.MaskFrame(f)); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+		writeErr <- nil
+	}()
+	replies := make(chan ws.Frame, 2)
+	go func() {
+		for range 2 {
+			f, err := ws.ReadFrame(client)
+			if err != nil {
+				return
+			}
+			replies <- f
+		}
+	}()
+
+	got, err := io.ReadAll(wsc)
+	require.NoError(t, err)
+	require.Equal(t, append(big, "fragment"...), got)
+	require.NoError(t, <-writeErr)
+
+	pong := <-replies
+	require.Equal(t, ws.OpPong, pong.Header.OpCode)
+	require.Equal(t, "ping", string(pong.Payload))
+	closeReply := <-replies
+	require.Equal(t, ws.OpClose, closeReply.Header.OpCode)
+	code, _ := ws.ParseCloseFrameData(closeReply.Payload)
+	require.Equal(t, ws.StatusNormalClosure, code)
+
+	// reads after the close frame keep returning EOF
+	_, err = wsc.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestWSConn_PartialHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	wsc := NewWSConn(server, true)
+	go func() {
+		// answer the pong so the ping does not block
+		_, _ = ws.ReadFrame(client)
+	}()
+
+	var frames bytes.Buffer
+	require.NoError(t, ws.WriteFrame(&frames, ws.MaskFrame(ws.NewPingFrame([]byte("ping")))))
+	require.NoError(t, ws.WriteFrame(&frames, ws.MaskFrame(ws.NewBinaryFrame([]byte("data")))))
+	raw := frames.Bytes()
+
+	// every read is cut by a deadline after one more byte of the headers
+	// and the ping came, only the payload of the data frame is left then
+	buf := make([]byte, 16)
+	headers := len(raw) - len("data")
+	for i := range headers {
+		go func() { _, _ = client.Write(raw[i : i+1]) }()
+		_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err := wsc.Read(buf)
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	}
+	_ = server.SetReadDeadline(time.Time{})
+	go func() { _, _ = client.Write(raw[headers:]) }()
+	n, err := io.ReadAtLeast(wsc, buf, len("data"))
+	require.NoError(t, err)
+	require.Equal(t, "data", string(buf[:n]))
 }
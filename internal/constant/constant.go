@@ -22,10 +22,60 @@ const (
 	DefaultIdleTimeOut  = 30 * time.Second
 	DefaultSniffTimeOut = 300 * time.Millisecond
 
+	// passive outlier ejection of remotes
+	DefaultMaxFails    = 3
+	DefaultFailTimeOut = 10 * time.Second
+	MaxEjectTimeOut    = 5 * time.Minute
+
+	// active health check of remotes
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultHealthCheckRise     = 1
+	DefaultHealthCheckFall     = 2
+
+	// mux tunnel pool, per remote
+	DefaultMuxMaxTunnels        = 2
+	DefaultMuxMaxStreams        = 128
+	DefaultMuxKeepAliveInterval = 10 * time.Second
+	DefaultMuxKeepAliveTimeOut  = 30 * time.Second
+
+	// ports one port range rule may listen on, every port is a listener
+	MaxPortRangeSize = 1024
+
+	// reverse agent redials a lost tunnel with backoff up to the max
+	DefaultReverseRetryInterval = time.Second
+	MaxReverseRetryInterval     = 30 * time.Second
+
+	// clients rejected by the per ip limits are listed this long after
+	// their last rejection
+	IPLimitOffenderTTL = 10 * time.Minute
+
+	// conns over a connection limit with conn_overflow queue wait this long
+	// by default for a free slot
+	DefaultConnQueueTimeOut = 10 * time.Second
+
+	// datagrams queued per udp session before new ones are dropped, and how
+	// often the sessions are checked for idling
+	DefaultUDPQueueSize   = 64
+	UDPSessionExpireCheck = time.Second
+
+	// stats of spliced tcp conns are read from the kernel this often
+	SpliceStatsInterval = time.Second
+
+	// relays stopped by a reload or a shutdown wait this long for their conns
+	// by default before closing them
+	DefaultRelayDrainTimeOut = 30 * time.Second
+
+	// the quota usage of a rule is saved and its period checked this often
+	QuotaSaveInterval = 30 * time.Second
+
 	// todo,support config in relay config
 	BUFFER_POOL_SIZE = 1024      // support 512 connections
 	BUFFER_SIZE      = 40 * 1024 // 40KB ,the maximum packet size of shadowsocks is about 16 KiB so this is enough
 	UDPBufSize       = 1500      // use default max mtu 1500
+
+	// the largest payload of a udp datagram over ipv4, bigger ones can
+	// not be sent and are dropped
+	MaxUDPDatagramSize = 65507
 )
 
 // relay type
@@ -35,4 +85,22 @@ const (
 	// ws relay
 	RelayTypeWS  RelayType = "ws"
 	RelayTypeWSS RelayType = "wss"
+	// tls relay, tcp stream wrapped in tls without ws framing
+	RelayTypeTLS RelayType = "tls"
+	// many relay conns multiplexed over a few long-lived tls tunnels
+	RelayTypeMux RelayType = "mux"
+	// tcp conns as quic streams and udp as quic datagrams
+	RelayTypeQuic RelayType = "quic"
+	// listen only, destination comes from the socks5 client
+	RelayTypeSocks5 RelayType = "socks5"
+	// listen only, http CONNECT and absolute-uri forward proxy
+	RelayTypeHTTPProxy RelayType = "http_proxy"
+	// listen only and linux only, traffic steered by iptables/nftables,
+	// the destination is the original one of the conn
+	RelayTypeRedirect RelayType = "redirect"
+	RelayTypeTProxy   RelayType = "tproxy"
+	// reverse tunnel, the agent behind NAT dials the server over ws/wss/mux
+	// and the server relays conns of its public listeners back through it
+	RelayTypeReverseServer RelayType = "reverse_server"
+	RelayTypeReverseAgent  RelayType = "reverse_agent"
 )
@@ -2,6 +2,7 @@ package glue
 
 import (
 	"context"
+	"time"
 )
 
 type Reloader interface {
@@ -11,6 +12,86 @@ type Reloader interface {
 type HealthChecker interface {
 	// get relay by ID and check the connection health
 	HealthCheck(ctx context.Context, RelayID string) (int64, error)
+
+	// list remotes state of relay, empty RelayID means all relays
+	ListRemoteStatus(RelayID string) ([]RemoteStatus, error)
+}
+
+type ClientLimiter interface {
+	// list clients hit the per ip limits of relay, empty RelayID means all relays
+	ListLimitedClients(RelayID string) ([]LimitedClient, error)
+	// lift the ban of ip, empty RelayID means all relays
+	UnbanClient(RelayID, ip string) error
+}
+
+type BandwidthLimiter interface {
+	// list bandwidth limits of relay, empty RelayID means all relays
+	ListBandwidth(RelayID string) ([]Bandwidth, error)
+	// change the bandwidth limits of a running relay, conns relayed now included,
+	// except tcp conns started while the relay had no limit
+	UpdateBandwidth(RelayID string, limits Bandwidth) error
+}
+
+type Drainer interface {
+	// list relays stopped by a reload or a shutdown whose conns are drained now
+	ListDraining() []DrainingRelay
+}
+
+// DrainingRelay is a relay that stopped accepting, its conns still relayed
+// at the deadline are closed.
+type DrainingRelay struct {
+	RelayLabel  string    `json:"relay_label"`
+	ActiveConns int       `json:"active_conns"`
+	StartedAt   time.Time `json:"started_at"`
+	Deadline    time.Time `json:"deadline,omitempty"`
+}
+
+// Bandwidth is the bandwidth limits of a relay rule, of each conn, of all
+// conns together and of the conns of each client ip together.
+type Bandwidth struct {
+	RelayLabel string         `json:"relay_label"`
+	Conn       BandwidthLimit `json:"conn"`
+	Rule       BandwidthLimit `json:"rule"`
+	IP         BandwidthLimit `json:"ip"`
+}
+
+// BandwidthLimit is in kbps, 0 means unlimited. Upload is client to remote.
+type BandwidthLimit struct {
+	UploadKbps   int64 `json:"upload_kbps"`
+	DownloadKbps int64 `json:"download_kbps"`
+}
+
+// LimitedClient is a client ip rejected by the per ip limits of a relay
+// rule recently or banned now.
+type LimitedClient struct {
+	RelayLabel     string    `json:"relay_label"`
+	IP             string    `json:"ip"`
+	ActiveConns    int       `json:"active_conns"`
+	Rejected       int64     `json:"rejected"`
+	LastRejectedAt time.Time `json:"last_rejected_at"`
+	BannedUntil    time.Time `json:"banned_until,omitempty"`
+}
+
+// RemoteStatus is the live state of one remote of a relay rule.
+type RemoteStatus struct {
+	RelayLabel       string    `json:"relay_label"`
+	Address          string    `json:"address"`
+	Weight           int       `json:"weight"`
+	Ejected          bool      `json:"ejected"`
+	EjectedUntil     time.Time `json:"ejected_until,omitempty"`
+	ConsecutiveFails int       `json:"consecutive_fails"`
+	LatencyMs        int64     `json:"latency_ms"` // ewma of handshake latency
+
+	// filled by the background health checker, a remote never probed is healthy
+	Healthy       bool           `json:"healthy"`
+	HealthHistory []HealthSample `json:"health_history"`
+}
+
+type HealthSample struct {
+	At        time.Time `json:"at"`
+	Up        bool      `json:"up"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
 }
 
 // XrayStatus is the slice of XrayServer the web admin needs for its
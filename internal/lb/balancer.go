@@ -0,0 +1,93 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	StrategyRoundRobin         = "round_robin"
+	StrategyWeightedRoundRobin = "weighted_round_robin"
+	StrategyLeastConn          = "least_conn"
+	StrategyLatency            = "latency"
+	StrategyConsistentHash     = "consistent_hash"
+)
+
+// Balancer picks the remote node for every new relayed connection.
+type Balancer interface {
+	Next() *Node
+	GetAll() []*Node
+}
+
+// KeyedBalancer picks the node by a key such as the client ip,
+// so the same key keeps landing on the same node.
+type KeyedBalancer interface {
+	Balancer
+	NextFor(key string) *Node
+}
+
+// ActiveCounter returns the number of active connections to a node, it's
+// provided by the caller(cmgr) so lb does not depend on it.
+type ActiveCounter func(n *Node) int
+
+type Config struct {
+	// empty means round robin
+	Strategy string
+	// used by least_conn, may be nil
+	Counter ActiveCounter
+	// used by consistent_hash, zero disables the sticky table
+	StickyTTL time.Duration
+}
+
+func ValidStrategy(strategy string) bool {
+	switch strategy {
+	case "", StrategyRoundRobin, StrategyWeightedRoundRobin, StrategyLeastConn, StrategyLatency, StrategyConsistentHash:
+		return true
+	}
+	return false
+}
+
+// NewBalancer builds the balancer for cfg.Strategy.
+func NewBalancer(nodeList []*Node, cfg *Config) (Balancer, error) {
+	switch cfg.Strategy {
+	case "", StrategyRoundRobin:
+		return NewRoundRobin(nodeList), nil
+	case StrategyWeightedRoundRobin:
+		return NewWeightedRoundRobin(nodeList), nil
+	case StrategyLeastConn:
+		return NewLeastConn(nodeList, cfg.Counter), nil
+	case StrategyLatency:
+		return NewLatency(nodeList), nil
+	case StrategyConsistentHash:
+		return NewConsistentHash(nodeList, cfg.StickyTTL), nil
+	default:
+		return nil, fmt.Errorf("unsupported lb strategy: %s", cfg.Strategy)
+	}
+}
+
+// NextFor picks a node for the client address, only keyed balancers care
+// about it, the others fall back to Next.
+func NextFor(b Balancer, clientAddr string) *Node {
+	kb, ok := b.(KeyedBalancer)
+	if !ok {
+		return b.Next()
+	}
+	// key by ip only, a client opens conns from many source ports
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		clientAddr = host
+	}
+	return kb.NextFor(clientAddr)
+}
+
+// anyAvailable reports whether at least one node is outside its ejection
+// window, strategies only skip ejected nodes when this is true so a rule
+// whose remotes are all ejected still fails open.
+func anyAvailable(nodeList []*Node) bool {
+	for _, n := range nodeList {
+		if n.Available() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+package lb
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newNodes(addrs ...string) []*Node {
+	nodeList := make([]*Node, len(addrs))
+	for i := range addrs {
+		nodeList[i] = &Node{Address: addrs[i]}
+	}
+	return nodeList
+}
+
+func TestNewBalancer(t *testing.T) {
+	nodeList := newNodes("127.0.0.1")
+	for _, s := range []string{"", StrategyRoundRobin, StrategyWeightedRoundRobin, StrategyLeastConn, StrategyLatency, StrategyConsistentHash} {
+		b, err := NewBalancer(nodeList, &Config{Strategy: s})
+		assert.NoError(t, err, s)
+		assert.Equal(t, "127.0.0.1", b.Next().Address, s)
+	}
+	_, err := NewBalancer(nodeList, &Config{Strategy: "random"})
+	assert.Error(t, err)
+	assert.False(t, ValidStrategy("random"))
+}
+
+func TestWeightedRoundRobin_Next(t *testing.T) {
+	nodeList := newNodes("a", "b", "c")
+	nodeList[0].Weight = 5
+	b := NewWeightedRoundRobin(nodeList)
+
+	got := ""
+	for i := 0; i < 7; i++ {
+		got += b.Next().Address
+	}
+	// smooth wrr should not send 5 conns to a in a row
+	assert.Equal(t, "aabacaa", got)
+}
+
+func TestLeastConn_Next(t *testing.T) {
+	nodeList := newNodes("a", "b", "c")
+	active := map[string]int{"a": 3, "b": 1, "c": 2}
+	b := NewLeastConn(nodeList, func(n *Node) int { return active[n.Address] })
+	assert.Equal(t, "b", b.Next().Address)
+
+	// weight 4 on a makes 3 conns cheaper than 1 conn on b
+	nodeList[0].Weight = 4
+	assert.Equal(t, "a", b.Next().Address)
+
+	// without counter fallback to round robin
+	b = NewLeastConn(nodeList, nil)
+	assert.Equal(t, "a", b.Next().Address)
+	assert.Equal(t, "b", b.Next().Address)
+}
+
+func TestLatency_Next(t *testing.T) {
+	nodeList := newNodes("fast", "slow")
+	b := NewLatency(nodeList)
+
+	// unmeasured nodes are tried in turn
+	assert.Equal(t, "fast", b.Next().Address)
+	assert.Equal(t, "slow", b.Next().Address)
+
+	nodeList[0].RecordHandShake(10 * time.Millisecond)
+	nodeList[1].RecordHandShake(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "fast", b.Next().Address)
+	}
+
+	// primary gets slow, ewma moves traffic to backup after a few samples
+	for i := 0; i < 10; i++ {
+		nodeList[0].RecordHandShake(time.Second)
+	}
+	assert.Equal(t, "slow", b.Next().Address)
+}
+
+func TestLatency_FailingNode(t *testing.T) {
+	nodeList := newNodes("dead", "live")
+	b := NewLatency(nodeList)
+
+	// the dead remote fails every dial, without ejection it must not stay
+	// the first pick
+	assert.Equal(t, "dead", b.Next().Address)
+	nodeList[0].RecordHandShakeFailure(5 * time.Second)
+	assert.Equal(t, "live", b.Next().Address)
+	nodeList[1].RecordHandShake(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "live", b.Next().Address)
+	}
+	assert.Equal(t, 5*time.Second, nodeList[0].EWMALatency())
+	assert.Zero(t, nodeList[0].HandShakeDuration())
+}
+
+func TestNode_RecordHandShake(t *testing.T) {
+	n := &Node{Address: "a"}
+	n.RecordHandShake(100 * time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, n.EWMALatency())
+	n.RecordHandShake(200 * time.Millisecond)
+	assert.Equal(t, 130*time.Millisecond, n.EWMALatency())
+	assert.Equal(t, 200*time.Millisecond, n.HandShakeDuration())
+	assert.Equal(t, n.EWMALatency(), n.Clone().EWMALatency())
+}
+
+func TestNode_Eject(t *testing.T) {
+	p := &EjectPolicy{MaxFails: 2, BaseEjectTime: time.Minute, MaxEjectTime: 3 * time.Minute}
+	n := &Node{Address: "a"}
+
+	assert.False(t, n.RecordFailure(p))
+	assert.True(t, n.Available())
+	assert.True(t, n.RecordFailure(p))
+	assert.False(t, n.Available())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), n.EjectedUntil(), time.Second)
+
+	// failures inside the window do not escalate it
+	assert.False(t, n.RecordFailure(p))
+	assert.WithinDuration(t, time.Now().Add(time.Minute), n.EjectedUntil(), time.Second)
+
+	// still in probation once the window ends, one failure re-ejects with doubled window
+	endWindow := func() { n.ejectedUntil.Store(time.Now().UnixNano() - 1) }
+	endWindow()
+	assert.True(t, n.RecordFailure(p))
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), n.EjectedUntil(), time.Second)
+	endWindow()
+	assert.True(t, n.RecordFailure(p))
+	assert.WithinDuration(t, time.Now().Add(3*time.Minute), n.EjectedUntil(), time.Second)
+
+	assert.True(t, n.RecordSuccess())
+	assert.True(t, n.Available())
+	assert.False(t, n.RecordSuccess())
+
+	// disabled policy never ejects
+	assert.False(t, n.RecordFailure(&EjectPolicy{MaxFails: -1}))
+}
+
+func TestBalancer_SkipEjected(t *testing.T) {
+	p := &EjectPolicy{MaxFails: 1, BaseEjectTime: time.Minute, MaxEjectTime: time.Minute}
+	for _, s := range []string{StrategyRoundRobin, StrategyWeightedRoundRobin, StrategyLeastConn, StrategyLatency, StrategyConsistentHash} {
+		nodeList := newNodes("a", "b")
+		b, err := NewBalancer(nodeList, &Config{Strategy: s, Counter: func(*Node) int { return 0 }})
+		assert.NoError(t, err)
+
+		nodeList[0].RecordFailure(p)
+		for i := 0; i < 3; i++ {
+			assert.Equal(t, "b", b.Next().Address, s)
+		}
+
+		// all ejected, fail open
+		nodeList[1].RecordFailure(p)
+		assert.NotNil(t, b.Next(), s)
+	}
+}
+
+func TestNode_RecordProbe(t *testing.T) {
+	n := &Node{Address: "a"}
+	errDown := assert.AnError
+	assert.True(t, n.Healthy())
+
+	// fall=2: one failed probe is not enough
+	assert.False(t, n.RecordProbe(HealthSample{Err: errDown}, 1, 2))
+	assert.True(t, n.Available())
+	assert.True(t, n.RecordProbe(HealthSample{Err: errDown}, 1, 2))
+	assert.False(t, n.Healthy())
+	assert.False(t, n.Available())
+
+	assert.True(t, n.RecordProbe(HealthSample{Latency: time.Millisecond}, 1, 2))
+	assert.True(t, n.Available())
+
+	for i := 0; i < healthHistorySize+5; i++ {
+		n.RecordProbe(HealthSample{Latency: time.Duration(i)}, 1, 2)
+	}
+	history := n.HealthHistory()
+	assert.Len(t, history, healthHistorySize)
+	assert.Equal(t, time.Duration(5), history[0].Latency)
+	assert.Equal(t, time.Duration(healthHistorySize+4), history[healthHistorySize-1].Latency)
+}
+
+func TestConsistentHash_NextFor(t *testing.T) {
+	nodeList := newNodes("a:1", "b:1", "c:1")
+	b := NewConsistentHash(nodeList, 0)
+
+	// same key always lands on the same node, ports are ignored by NextFor
+	first := NextFor(b, "1.1.1.1:1000")
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, NextFor(b, "1.1.1.1:2000"))
+	}
+
+	// adding a remote only moves keys to the new remote
+	keys := make([]string, 1000)
+	before := make(map[string]string, len(keys))
+	for i := range keys {
+		keys[i] = "10.0." + strconv.Itoa(i/256) + "." + strconv.Itoa(i%256)
+		before[keys[i]] = b.NextFor(keys[i]).Address
+	}
+	b2 := NewConsistentHash(newNodes("a:1", "b:1", "c:1", "d:1"), 0)
+	moved := 0
+	for _, k := range keys {
+		after := b2.NextFor(k).Address
+		if after != before[k] {
+			moved++
+			assert.Equal(t, "d:1", after)
+		}
+	}
+	assert.Less(t, moved, len(keys)/2)
+
+	// ejected owner is skipped
+	owner := b.NextFor("1.1.1.1")
+	owner.RecordFailure(&EjectPolicy{MaxFails: 1, BaseEjectTime: time.Minute, MaxEjectTime: time.Minute})
+	assert.NotEqual(t, owner, b.NextFor("1.1.1.1"))
+}
+
+func TestConsistentHash_Reload(t *testing.T) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = "10." + strconv.Itoa(i/65536) + "." + strconv.Itoa(i/256%256) + "." + strconv.Itoa(i%256)
+	}
+	addrs := []string{"a:1", "b:1", "c:1", "d:1", "e:1"}
+	for n := 2; n < len(addrs); n++ {
+		// a reload builds the balancer from new nodes with one more remote,
+		// only about 1/(n+1) of the keys move and all of them to the new one
+		old := NewConsistentHash(newNodes(addrs[:n]...), 0)
+		reloaded := NewConsistentHash(newNodes(addrs[:n+1]...), 0)
+		moved := 0
+		for _, k := range keys {
+			after := reloaded.NextFor(k).Address
+			if after != old.NextFor(k).Address {
+				moved++
+				assert.Equal(t, addrs[n], after)
+			}
+		}
+		want := len(keys) / (n + 1)
+		assert.InDelta(t, want, moved, float64(want)/4, "%d remotes", n+1)
+	}
+}
+
+func TestConsistentHash_Sticky(t *testing.T) {
+	nodeList := newNodes("a:1", "b:1")
+	b := NewConsistentHash(nodeList, time.Minute).(*consistentHash)
+	node := b.NextFor("1.1.1.1")
+	// pretend the ring now says otherwise, sticky entry keeps the node
+	other := nodeList[0]
+	if other == node {
+		other = nodeList[1]
+	}
+	for h := range b.owner {
+		b.owner[h] = other
+	}
+	assert.Equal(t, node, b.NextFor("1.1.1.1"))
+
+	b.sticky["1.1.1.1"].lastSeen = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, other, b.NextFor("1.1.1.1"))
+}
@@ -0,0 +1,127 @@
+package lb
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// virtualNodes per weight unit on the ring, enough to keep the spread even
+// for a handful of remotes without making the ring big.
+const virtualNodes = 160
+
+var _ KeyedBalancer = &consistentHash{}
+
+// consistentHash maps a key(client ip) to a node on a hash ring built from
+// node addresses, so when remotes change on reload only the keys owned by
+// the added/removed remotes move. Unavailable nodes are skipped clockwise.
+// With stickyTTL > 0 the picked node is remembered per key, so a key moved
+// off its ejected or down owner stays on the node it moved to after the
+// owner comes back, until the entry idles out. A reload builds a new
+// balancer, the sticky table does not survive it.
+type consistentHash struct {
+	nodeList []*Node
+	ring     []uint64
+	owner    map[uint64]*Node
+
+	stickyTTL time.Duration
+	mu        sync.Mutex
+	sticky    map[string]*stickyEntry
+	lastSweep time.Time
+
+	// used by Next() when there is no key
+	fallback Balancer
+}
+
+type stickyEntry struct {
+	node     *Node
+	lastSeen time.Time
+}
+
+func NewConsistentHash(nodeList []*Node, stickyTTL time.Duration) KeyedBalancer {
+	c := &consistentHash{
+		nodeList:  nodeList,
+		owner:     make(map[uint64]*Node),
+		stickyTTL: stickyTTL,
+		sticky:    make(map[string]*stickyEntry),
+		lastSweep: time.Now(),
+		fallback:  NewRoundRobin(nodeList),
+	}
+	for _, node := range nodeList {
+		for i := 0; i < virtualNodes*node.GetWeight(); i++ {
+			h := hashKey(node.Address + "#" + strconv.Itoa(i))
+			if _, ok := c.owner[h]; ok {
+				continue
+			}
+			c.owner[h] = node
+			c.ring = append(c.ring, h)
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i] < c.ring[j] })
+	return c
+}
+
+// hashKey is fnv-64a with the murmur3 finalizer, fnv alone clusters the
+// hashes of the near identical virtual node names and skews the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (c *consistentHash) Next() *Node {
+	return c.fallback.Next()
+}
+
+func (c *consistentHash) NextFor(key string) *Node {
+	if key == "" {
+		return c.Next()
+	}
+	if c.stickyTTL <= 0 {
+		return c.lookup(key)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.lastSweep) > c.stickyTTL {
+		for k, e := range c.sticky {
+			if now.Sub(e.lastSeen) > c.stickyTTL {
+				delete(c.sticky, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if e, ok := c.sticky[key]; ok && now.Sub(e.lastSeen) <= c.stickyTTL && e.node.Available() {
+		e.lastSeen = now
+		return e.node
+	}
+	node := c.lookup(key)
+	c.sticky[key] = &stickyEntry{node: node, lastSeen: now}
+	return node
+}
+
+func (c *consistentHash) lookup(key string) *Node {
+	h := hashKey(key)
+	start := sort.Search(len(c.ring), func(i int) bool { return c.ring[i] >= h })
+	skipEjected := anyAvailable(c.nodeList)
+	for i := 0; i < len(c.ring); i++ {
+		node := c.owner[c.ring[(start+i)%len(c.ring)]]
+		if !skipEjected || node.Available() {
+			return node
+		}
+	}
+	return c.nodeList[0]
+}
+
+func (c *consistentHash) GetAll() []*Node {
+	return c.nodeList
+}
@@ -0,0 +1,80 @@
+package lb
+
+import (
+	"sync"
+	"time"
+)
+
+// healthHistorySize is how many probe results are kept per node,
+// 60 samples is 30 minutes with the default 30s interval.
+const healthHistorySize = 60
+
+type HealthSample struct {
+	At      time.Time
+	Latency time.Duration
+	Err     error
+}
+
+// healthState is updated by the active health checker, a node starts up
+// and is marked down after `fall` failed probes in a row, then up again
+// after `rise` successful ones.
+type healthState struct {
+	mu        sync.Mutex
+	successes int
+	failures  int
+	history   []HealthSample
+	next      int // ring buffer write index
+}
+
+// RecordProbe stores one active probe result, returns true when the
+// node's up/down state changed because of it.
+func (n *Node) RecordProbe(s HealthSample, rise, fall int) bool {
+	h := &n.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.history) < healthHistorySize {
+		h.history = append(h.history, s)
+	} else {
+		h.history[h.next] = s
+	}
+	h.next = (h.next + 1) % healthHistorySize
+
+	if s.Err == nil {
+		h.successes++
+		h.failures = 0
+		if n.down.Load() && h.successes >= rise {
+			n.down.Store(false)
+			return true
+		}
+		return false
+	}
+	h.failures++
+	h.successes = 0
+	if !n.down.Load() && h.failures >= fall {
+		n.down.Store(true)
+		return true
+	}
+	return false
+}
+
+// Healthy reports the last known state from active health checks, a node
+// that was never probed is healthy.
+func (n *Node) Healthy() bool {
+	return !n.down.Load()
+}
+
+// HealthHistory returns probe results from oldest to newest.
+func (n *Node) HealthHistory() []HealthSample {
+	h := &n.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := make([]HealthSample, 0, len(h.history))
+	if len(h.history) == healthHistorySize {
+		res = append(res, h.history[h.next:]...)
+		res = append(res, h.history[:h.next]...)
+	} else {
+		res = append(res, h.history...)
+	}
+	return res
+}
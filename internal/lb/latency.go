@@ -0,0 +1,40 @@
+package lb
+
+import (
+	"go.uber.org/atomic"
+)
+
+var _ Balancer = &latency{}
+
+// latency picks the node with the lowest EWMA handshake latency, failed
+// handshakes count as the dial timeout. Nodes never tried are picked first
+// so every remote gets measured, ties (e.g. all untried) fall back to
+// round-robin.
+type latency struct {
+	nodeList []*Node
+	offset   *atomic.Int64
+}
+
+func NewLatency(nodeList []*Node) Balancer {
+	return &latency{nodeList: nodeList, offset: atomic.NewInt64(0)}
+}
+
+func (l *latency) Next() *Node {
+	start := int(l.offset.Add(1)-1) % len(l.nodeList)
+	skipEjected := anyAvailable(l.nodeList)
+	var best *Node
+	for i := range l.nodeList {
+		node := l.nodeList[(start+i)%len(l.nodeList)]
+		if skipEjected && !node.Available() {
+			continue
+		}
+		if best == nil || node.EWMALatency() < best.EWMALatency() {
+			best = node
+		}
+	}
+	return best
+}
+
+func (l *latency) GetAll() []*Node {
+	return l.nodeList
+}
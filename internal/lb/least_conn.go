@@ -0,0 +1,50 @@
+package lb
+
+import (
+	"go.uber.org/atomic"
+)
+
+var _ Balancer = &leastConn{}
+
+// leastConn picks the node with the fewest active connections divided by
+// its weight, ties are broken round-robin so idle nodes share new conns.
+type leastConn struct {
+	nodeList []*Node
+	counter  ActiveCounter
+	offset   *atomic.Int64
+}
+
+func NewLeastConn(nodeList []*Node, counter ActiveCounter) Balancer {
+	return &leastConn{nodeList: nodeList, counter: counter, offset: atomic.NewInt64(0)}
+}
+
+func (l *leastConn) Next() *Node {
+	start := int(l.offset.Add(1)-1) % len(l.nodeList)
+	if l.counter == nil {
+		// count every node as idle so ties rotate from start
+		return l.pick(start, func(*Node) int { return 0 })
+	}
+	return l.pick(start, l.counter)
+}
+
+func (l *leastConn) pick(start int, counter ActiveCounter) *Node {
+	skipEjected := anyAvailable(l.nodeList)
+	var best *Node
+	var bestWeight, bestCnt int
+	for i := range l.nodeList {
+		node := l.nodeList[(start+i)%len(l.nodeList)]
+		if skipEjected && !node.Available() {
+			continue
+		}
+		cnt, weight := counter(node), node.GetWeight()
+		// compare cnt/weight without float: cnt*bestWeight < bestCnt*weight
+		if best == nil || cnt*bestWeight < bestCnt*weight {
+			best, bestCnt, bestWeight = node, cnt, weight
+		}
+	}
+	return best
+}
+
+func (l *leastConn) GetAll() []*Node {
+	return l.nodeList
+}
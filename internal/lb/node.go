@@ -0,0 +1,185 @@
+package lb
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// ewmaDecay is the weight given to the newest handshake sample when
+// updating Node's latency average, 0.3 reacts within a handful of conns
+// while still smoothing out a single slow handshake.
+const ewmaDecay = 0.3
+
+// EjectPolicy controls passive outlier ejection: a node that fails MaxFails
+// handshakes in a row is ejected for BaseEjectTime, the window doubles on
+// every re-ejection until the node succeeds again, capped by MaxEjectTime.
+type EjectPolicy struct {
+	MaxFails      int // <=0 disables ejection
+	BaseEjectTime time.Duration
+	MaxEjectTime  time.Duration
+}
+
+type Node struct {
+	Address string
+
+	// Weight is only used by weighted strategies, zero means 1.
+	Weight int
+
+	// latest handshake latency in nanoseconds
+	handShake atomic.Int64
+	// ewma of handshake latency in nanoseconds, zero means no sample yet
+	ewma atomic.Int64
+
+	// outlier ejection state
+	fails        atomic.Int32
+	ejections    atomic.Int32
+	ejectedUntil atomic.Int64 // unix nano, zero means never ejected
+
+	// active health check state
+	down   atomic.Bool
+	health healthState
+}
+
+func (n *Node) Clone() *Node {
+	c := &Node{
+		Address: n.Address,
+		Weight:  n.Weight,
+	}
+	c.handShake.Store(n.handShake.Load())
+	c.ewma.Store(n.ewma.Load())
+	return c
+}
+
+// RecordHandShake stores the latest handshake latency and folds it into
+// the node's moving average, which the latency balancer reads.
+func (n *Node) RecordHandShake(d time.Duration) {
+	n.handShake.Store(int64(d))
+	n.foldLatency(d)
+}
+
+// RecordHandShakeFailure folds penalty, e.g. the dial timeout, into the
+// node's moving average, so a remote that never finishes a handshake is
+// not picked first by the latency balancer.
+func (n *Node) RecordHandShakeFailure(penalty time.Duration) {
+	n.foldLatency(penalty)
+}
+
+func (n *Node) foldLatency(d time.Duration) {
+	for {
+		old := n.ewma.Load()
+		new := int64(d)
+		if old != 0 {
+			new = int64(ewmaDecay*float64(d) + (1-ewmaDecay)*float64(old))
+		}
+		if n.ewma.CompareAndSwap(old, new) {
+			return
+		}
+	}
+}
+
+// HandShakeDuration returns the latency of the latest handshake.
+func (n *Node) HandShakeDuration() time.Duration {
+	return time.Duration(n.handShake.Load())
+}
+
+// EWMALatency returns the moving average of handshake latency, failures
+// count as their penalty, zero when the node was never tried.
+func (n *Node) EWMALatency() time.Duration {
+	return time.Duration(n.ewma.Load())
+}
+
+// RecordFailure counts a failed dial/handshake, returns true when this
+// failure ejects the node. A node that was ejected and has not succeeded
+// since is re-ejected by a single failure once its window ends, failures
+// of conns dialed before that, which all end in the same window, do not
+// escalate it.
+func (n *Node) RecordFailure(p *EjectPolicy) bool {
+	if p == nil || p.MaxFails <= 0 {
+		return false
+	}
+	until := n.ejectedUntil.Load()
+	now := time.Now()
+	if now.UnixNano() < until {
+		return false
+	}
+	ejections := n.ejections.Load()
+	if ejections == 0 && n.fails.Add(1) < int32(p.MaxFails) {
+		return false
+	}
+	ejections++
+	d := p.MaxEjectTime
+	if ejections <= 16 {
+		d = min(p.BaseEjectTime<<(ejections-1), p.MaxEjectTime)
+	}
+	// only one of the failures racing here ejects the node
+	if !n.ejectedUntil.CompareAndSwap(until, now.Add(d).UnixNano()) {
+		return false
+	}
+	n.fails.Store(0)
+	n.ejections.Add(1)
+	return true
+}
+
+// RecordSuccess resets the failure state, returns true when the node was
+// ejected before, which means it just recovered.
+func (n *Node) RecordSuccess() bool {
+	n.fails.Store(0)
+	if n.ejections.Swap(0) == 0 {
+		return false
+	}
+	n.ejectedUntil.Store(0)
+	return true
+}
+
+// Available reports whether the node should get new connections: it is
+// outside its ejection window and not marked down by active health checks.
+func (n *Node) Available() bool {
+	return !n.Ejected() && n.Healthy()
+}
+
+// Ejected reports whether the node is inside its ejection window.
+func (n *Node) Ejected() bool {
+	until := n.ejectedUntil.Load()
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// EjectedUntil returns the end of the current ejection window,
+// zero time when the node is not ejected.
+func (n *Node) EjectedUntil() time.Time {
+	if !n.Ejected() {
+		return time.Time{}
+	}
+	return time.Unix(0, n.ejectedUntil.Load())
+}
+
+func (n *Node) ConsecutiveFails() int {
+	return int(n.fails.Load())
+}
+
+func (n *Node) GetWeight() int {
+	if n.Weight <= 0 {
+		return 1
+	}
+	return n.Weight
+}
+
+func extractHost(input string) (string, error) {
+	// Check if the input string has a scheme, if not, add "http://"
+	if !strings.Contains(input, "://") {
+		input = "http://" + input
+	}
+	// Parse the URL
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
+}
+
+// NOTE for (https/ws/wss)://xxx.com -> xxx.com
+func (n *Node) GetAddrHost() (string, error) {
+	return extractHost(n.Address)
+}
@@ -0,0 +1,43 @@
+package lb
+
+import "sync"
+
+var _ Balancer = &weightedRoundRobin{}
+
+// weightedRoundRobin is the smooth weighted round-robin used by nginx,
+// for weights {5,1,1} it yields a,a,b,a,c,a,a instead of bursting a five times.
+type weightedRoundRobin struct {
+	mu       sync.Mutex
+	nodeList []*Node
+	current  []int
+}
+
+func NewWeightedRoundRobin(nodeList []*Node) Balancer {
+	return &weightedRoundRobin{nodeList: nodeList, current: make([]int, len(nodeList))}
+}
+
+func (w *weightedRoundRobin) Next() *Node {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	skipEjected := anyAvailable(w.nodeList)
+	total := 0
+	best := -1
+	for idx, node := range w.nodeList {
+		if skipEjected && !node.Available() {
+			continue
+		}
+		weight := node.GetWeight()
+		w.current[idx] += weight
+		total += weight
+		if best == -1 || w.current[idx] > w.current[best] {
+			best = idx
+		}
+	}
+	w.current[best] -= total
+	return w.nodeList[best]
+}
+
+func (w *weightedRoundRobin) GetAll() []*Node {
+	return w.nodeList
+}
@@ -12,12 +12,31 @@ const (
 	METRIC_NS                = "ehco"
 	METRIC_SUBSYSTEM_TRAFFIC = "traffic"
 	METRIC_SUBSYSTEM_PING    = "ping"
+	METRIC_SUBSYSTEM_HEALTH  = "health"
 
 	METRIC_CONN_TYPE_TCP = "tcp"
 	METRIC_CONN_TYPE_UDP = "udp"
 	METRIC_FLOW_READ     = "read"
 	METRIC_FLOW_WRITE    = "write"
 
+	METRIC_PROTOCOL_UNKNOWN = "unknown"
+	METRIC_SNIFF_PASS       = "pass"
+	METRIC_SNIFF_BLOCK      = "block"
+
+	METRIC_IP_LIMIT_MAX_CONNS = "max_conns"
+	METRIC_IP_LIMIT_RATE      = "rate"
+	METRIC_IP_LIMIT_BANNED    = "banned"
+
+	METRIC_CONN_LIMIT_NODE   = "node"
+	METRIC_CONN_LIMIT_RULE   = "rule"
+	METRIC_CONN_LIMIT_REMOTE = "remote"
+
+	METRIC_UDP_DROP_QUEUE_FULL  = "queue_full"
+	METRIC_UDP_DROP_NO_ORIG_DST = "no_orig_dst"
+	METRIC_UDP_DROP_CLOSED      = "closed"
+	METRIC_UDP_DROP_OVERSIZED   = "oversized"
+	METRIC_UDP_DROP_BAD_FRAME   = "bad_frame"
+
 	EhcoAliveStateInit    = 0
 	EhcoAliveStateRunning = 1
 )
@@ -82,6 +101,122 @@ var (
 		Help:        "传输流量总量bytes",
 		ConstLabels: ConstLabels,
 	}, []string{"label", "conn_type", "flow", "remote"})
+
+	// port range rules only, the per port breakdown of network_transmit_bytes
+	PortRangeTransmitBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "port_range_transmit_bytes",
+		Help:        "端口段规则每个监听端口的流量bytes",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "conn_type", "flow", "listen_port"})
+
+	SniffedConnectionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "sniffed_connection_count",
+		Help:        "按嗅探协议统计的链接数 action=pass/block",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "conn_type", "protocol", "action"})
+
+	ACLRejectedConnectionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "acl_rejected_connection_count",
+		Help:        "被 cidr acl 拒绝的链接数",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "conn_type"})
+
+	IPLimitRejectedConnectionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "ip_limit_rejected_connection_count",
+		Help:        "超过单 ip 限制被拒绝的链接数 reason=max_conns/rate/banned",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "conn_type", "reason"})
+
+	ConnLimitRejectedConnectionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "conn_limit_rejected_connection_count",
+		Help:        "超过活跃链接数限制被拒绝的链接数 limit=node/rule/remote",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "limit"})
+
+	QuotaRejectedConnectionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "quota_rejected_connection_count",
+		Help:        "流量配额用尽后被拒绝的链接数",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "conn_type"})
+
+	QuotaUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "quota_used_bytes",
+		Help:        "当前周期已用的流量配额",
+		ConstLabels: ConstLabels,
+	}, []string{"label"})
+
+	UDPSessionCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "udp_session_count",
+		Help:        "udp 监听当前的会话数",
+		ConstLabels: ConstLabels,
+	}, []string{"label"})
+
+	UDPDroppedPacketCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "udp_dropped_packet_count",
+		Help:        "udp 监听丢弃的包数",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "reason"})
+
+	UDPFramePacketCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "udp_frame_packet_count",
+		Help:        "经 ws/tls/mux 等流式传输分帧收发的 udp 包数",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "flow"})
+
+	RemoteEjected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "remote_ejected",
+		Help:        "remote 是否因连续失败被摘除 1=ejected",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "remote"})
+
+	RemoteEjectionCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_TRAFFIC,
+		Name:        "remote_ejection_count",
+		Help:        "remote 被摘除次数",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "remote"})
+)
+
+// health check metrics
+var (
+	RemoteUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_HEALTH,
+		Name:        "remote_up",
+		Help:        "remote 主动健康检查状态 1=up",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "remote"})
+
+	RemoteProbeLatencyMilliseconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   METRIC_NS,
+		Subsystem:   METRIC_SUBSYSTEM_HEALTH,
+		Name:        "remote_probe_latency_milliseconds",
+		Help:        "最近一次成功健康检查的耗时ms",
+		ConstLabels: ConstLabels,
+	}, []string{"label", "remote"})
 )
 
 func RegisterEhcoMetrics(cfg *config.Config) error {
@@ -89,7 +224,23 @@ func RegisterEhcoMetrics(cfg *config.Config) error {
 	prometheus.MustRegister(EhcoAlive)
 	prometheus.MustRegister(CurConnectionCount)
 	prometheus.MustRegister(NetWorkTransmitBytes)
+	prometheus.MustRegister(PortRangeTransmitBytes)
+	prometheus.MustRegister(SniffedConnectionCount)
+	prometheus.MustRegister(ACLRejectedConnectionCount)
+	prometheus.MustRegister(IPLimitRejectedConnectionCount)
+	prometheus.MustRegister(ConnLimitRejectedConnectionCount)
+	prometheus.MustRegister(QuotaRejectedConnectionCount)
+	prometheus.MustRegister(QuotaUsedBytes)
+	prometheus.MustRegister(UDPSessionCount)
+	prometheus.MustRegister(UDPDroppedPacketCount)
+	prometheus.MustRegister(UDPFramePacketCount)
 	prometheus.MustRegister(HandShakeDurationMilliseconds)
+	prometheus.MustRegister(RemoteEjected)
+	prometheus.MustRegister(RemoteEjectionCount)
+
+	// health check
+	prometheus.MustRegister(RemoteUp)
+	prometheus.MustRegister(RemoteProbeLatencyMilliseconds)
 
 	EhcoAlive.Set(EhcoAliveStateInit)
 
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Ehco1996/ehco/internal/glue"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+var _ glue.BandwidthLimiter = (*Server)(nil)
+
+func (r *Server) ListBandwidth(relayID string) ([]glue.Bandwidth, error) {
+	if relayID != "" {
+		rs, ok := r.relayM.Load(relayID)
+		if !ok {
+			return nil, fmt.Errorf("label for relay: %s not found", relayID)
+		}
+		return []glue.Bandwidth{rs.(*Relay).Bandwidth()}, nil
+	}
+	res := []glue.Bandwidth{}
+	r.relayM.Range(func(key, value interface{}) bool {
+		res = append(res, value.(*Relay).Bandwidth())
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].RelayLabel < res[j].RelayLabel })
+	return res, nil
+}
+
+func (r *Server) UpdateBandwidth(relayID string, limits glue.Bandwidth) error {
+	rs, ok := r.relayM.Load(relayID)
+	if !ok {
+		return fmt.Errorf("label for relay: %s not found", relayID)
+	}
+	return rs.(*Relay).UpdateBandwidth(conf.BandwidthConfig{
+		Conn: conf.BandwidthLimit(limits.Conn),
+		Rule: conf.BandwidthLimit(limits.Rule),
+		IP:   conf.BandwidthLimit(limits.IP),
+	})
+}
+
+func (r *Relay) Bandwidth() glue.Bandwidth {
+	cfg := r.relayServer.GetBandwidth()
+	return glue.Bandwidth{
+		RelayLabel: r.cfg.Label,
+		Conn:       glue.BandwidthLimit(cfg.Conn),
+		Rule:       glue.BandwidthLimit(cfg.Rule),
+		IP:         glue.BandwidthLimit(cfg.IP),
+	}
+}
+
+// UpdateBandwidth changes the bandwidth limits of the running relay, the
+// config of the rule is kept so a reload with it unchanged keeps them.
+func (r *Relay) UpdateBandwidth(cfg conf.BandwidthConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	r.relayServer.UpdateBandwidth(cfg)
+	return nil
+}
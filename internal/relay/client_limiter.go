@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Ehco1996/ehco/internal/glue"
+)
+
+var _ glue.ClientLimiter = (*Server)(nil)
+
+func (r *Server) ListLimitedClients(relayID string) ([]glue.LimitedClient, error) {
+	if relayID != "" {
+		rs, ok := r.relayM.Load(relayID)
+		if !ok {
+			return nil, fmt.Errorf("label for relay: %s not found", relayID)
+		}
+		return rs.(*Relay).LimitedClients(), nil
+	}
+	res := []glue.LimitedClient{}
+	r.relayM.Range(func(key, value interface{}) bool {
+		res = append(res, value.(*Relay).LimitedClients()...)
+		return true
+	})
+	sort.SliceStable(res, func(i, j int) bool { return res[i].RelayLabel < res[j].RelayLabel })
+	return res, nil
+}
+
+func (r *Server) UnbanClient(relayID, ip string) error {
+	if relayID != "" {
+		rs, ok := r.relayM.Load(relayID)
+		if !ok {
+			return fmt.Errorf("label for relay: %s not found", relayID)
+		}
+		if !rs.(*Relay).UnbanClient(ip) {
+			return fmt.Errorf("ip: %s is not banned by relay: %s", ip, relayID)
+		}
+		return nil
+	}
+	unbanned := false
+	r.relayM.Range(func(key, value interface{}) bool {
+		if value.(*Relay).UnbanClient(ip) {
+			unbanned = true
+		}
+		return true
+	})
+	if !unbanned {
+		return fmt.Errorf("ip: %s is not banned", ip)
+	}
+	return nil
+}
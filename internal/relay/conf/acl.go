@@ -0,0 +1,142 @@
+package conf
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Ehco1996/ehco/pkg/iptrie"
+)
+
+// ACL decides which client ips may use a relay. Deny wins over allow, when
+// no allow cidr is set every ip not denied is allowed.
+type ACL struct {
+	allow, deny *iptrie.Trie
+}
+
+// Allowed reports whether ip may use the relay, an invalid ip is only
+// allowed when there is no allow cidr.
+func (a *ACL) Allowed(ip netip.Addr) bool {
+	if a.deny.Contains(ip) {
+		return false
+	}
+	return a.allow == nil || a.allow.Contains(ip)
+}
+
+// HasACL reports whether any cidr or cidr file is configured.
+func (o *Options) HasACL() bool {
+	return len(o.AllowCIDRs) > 0 || len(o.DenyCIDRs) > 0 || len(o.AllowCIDRFiles) > 0 || len(o.DenyCIDRFiles) > 0
+}
+
+// ToACL builds the acl of the rule, reading the cidr files again, nil when
+// the rule has no acl.
+func (r *Config) ToACL() (*ACL, error) {
+	if !r.Options.HasACL() {
+		return nil, nil
+	}
+	acl := &ACL{deny: iptrie.New()}
+	if len(r.Options.AllowCIDRs) > 0 || len(r.Options.AllowCIDRFiles) > 0 {
+		acl.allow = iptrie.New()
+		if err := insertCIDRs(acl.allow, r.Options.AllowCIDRs, r.Options.AllowCIDRFiles); err != nil {
+			return nil, err
+		}
+	}
+	if err := insertCIDRs(acl.deny, r.Options.DenyCIDRs, r.Options.DenyCIDRFiles); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// ToTrustedProxies builds the trie of trusted_proxies, nil when there is
+// none.
+func (r *Config) ToTrustedProxies() (*iptrie.Trie, error) {
+	if len(r.Options.TrustedProxies) == 0 {
+		return nil, nil
+	}
+	t := iptrie.New()
+	if err := insertCIDRs(t, r.Options.TrustedProxies, nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func insertCIDRs(t *iptrie.Trie, cidrs, files []string) error {
+	for _, s := range cidrs {
+		p, err := ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		t.Insert(p)
+	}
+	for _, path := range files {
+		prefixes, err := ReadCIDRFile(path)
+		if err != nil {
+			return err
+		}
+		for _, p := range prefixes {
+			t.Insert(p)
+		}
+	}
+	return nil
+}
+
+// ParseCIDR parses a cidr, a single ip is taken as a /32 or /128.
+func ParseCIDR(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid cidr %s: %w", s, err)
+		}
+		return p.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid cidr %s: %w", s, err)
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// ReadCIDRFile reads one cidr per line, blank lines and lines starting
+// with # are skipped.
+func ReadCIDRFile(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		prefixes = append(prefixes, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return prefixes, nil
+}
+
+func (r *Config) validateACL() error {
+	for _, s := range slices.Concat(r.Options.AllowCIDRs, r.Options.DenyCIDRs) {
+		if _, err := ParseCIDR(s); err != nil {
+			return err
+		}
+	}
+	for _, path := range slices.Concat(r.Options.AllowCIDRFiles, r.Options.DenyCIDRFiles) {
+		if path == "" {
+			return fmt.Errorf("empty cidr file path")
+		}
+	}
+	return nil
+}
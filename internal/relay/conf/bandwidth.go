@@ -0,0 +1,59 @@
+package conf
+
+import "fmt"
+
+// BandwidthLimit caps the two directions of a stream in kbps, 0 means
+// unlimited. Upload is client to remote, download is remote to client.
+type BandwidthLimit struct {
+	UploadKbps   int64 `json:"upload_kbps,omitempty"`
+	DownloadKbps int64 `json:"download_kbps,omitempty"`
+}
+
+func (l BandwidthLimit) validate(name string) error {
+	if l.UploadKbps < 0 || l.DownloadKbps < 0 {
+		return fmt.Errorf("negative %s bandwidth limit", name)
+	}
+	return nil
+}
+
+// BandwidthConfig holds the limit of every tcp conn of a rule, the one all
+// conns of the rule share and the one the conns of each client ip share.
+type BandwidthConfig struct {
+	Conn BandwidthLimit `json:"conn"`
+	Rule BandwidthLimit `json:"rule"`
+	IP   BandwidthLimit `json:"ip"`
+}
+
+// Limited reports whether any limit is set.
+func (b BandwidthConfig) Limited() bool {
+	return b != BandwidthConfig{}
+}
+
+func (b BandwidthConfig) Validate() error {
+	if err := b.Conn.validate("conn"); err != nil {
+		return err
+	}
+	if err := b.Rule.validate("rule"); err != nil {
+		return err
+	}
+	return b.IP.validate("ip")
+}
+
+// GetBandwidth returns the bandwidth limits of the rule, max_read_rate_kbps
+// is the conn upload limit when bandwidth does not set one.
+func (o *Options) GetBandwidth() BandwidthConfig {
+	var b BandwidthConfig
+	if o.Bandwidth != nil {
+		b = *o.Bandwidth
+	}
+	if b.Conn.UploadKbps == 0 {
+		b.Conn.UploadKbps = o.MaxReadRateKbps
+	}
+	return b
+}
+
+// BandwidthDifferent reports whether the bandwidth limits changed, they are
+// updated without restarting the relay.
+func (r *Config) BandwidthDifferent(new *Config) bool {
+	return r.Options.GetBandwidth() != new.Options.GetBandwidth()
+}
@@ -1,8 +1,15 @@
 package conf
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"maps"
+	"net"
 	"net/url"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Ehco1996/ehco/internal/constant"
@@ -11,6 +18,13 @@ import (
 	"go.uber.org/zap"
 )
 
+const (
+	// active health check probe types
+	HealthCheckTCP       = "tcp"       // tcp connect to the remote host
+	HealthCheckHandShake = "handshake" // full transport handshake, ws/wss upgrade for ws remotes
+	HealthCheckEcho      = "echo"      // handshake then expect the payload echoed back end to end
+)
+
 const (
 	ProtocolHTTP         = "http"
 	ProtocolTLS          = "tls"
@@ -18,6 +32,29 @@ const (
 	WS_QUERY_REMOTE_ADDR = "remote_addr"
 )
 
+// protocols recognised by sniffing, quic only on udp and stun on both
+const (
+	ProtocolSSH        = "ssh"
+	ProtocolSOCKS4     = "socks4"
+	ProtocolSOCKS5     = "socks5"
+	ProtocolBitTorrent = "bittorrent"
+	ProtocolQUIC       = "quic"
+	ProtocolRDP        = "rdp"
+	ProtocolSTUN       = "stun"
+)
+
+// what a conn over a connection limit gets
+const (
+	ConnOverflowReject = "reject" // closed at once, the default
+	ConnOverflowQueue  = "queue"  // waits for a free slot up to conn_queue_timeout_sec
+)
+
+// SniffProtocols can be used in blocked_protocols and allowed_protocols.
+var SniffProtocols = []string{
+	ProtocolHTTP, ProtocolTLS, ProtocolSSH, ProtocolSOCKS4, ProtocolSOCKS5,
+	ProtocolBitTorrent, ProtocolQUIC, ProtocolRDP, ProtocolSTUN,
+}
+
 type WSConfig struct {
 	Path       string `json:"path,omitempty"`
 	RemoteAddr string `json:"remote_addr,omitempty"`
@@ -30,17 +67,347 @@ func (w *WSConfig) Clone() *WSConfig {
 	}
 }
 
+type TLSConfig struct {
+	// client side: sni and name to verify, default is the remote host
+	ServerName string   `json:"server_name,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+	// server side: cert/key files, default is the built in self-signed cert
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// client side: verify server cert against this ca instead of system roots
+	CAFile             string `json:"ca_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+func (t *TLSConfig) Clone() *TLSConfig {
+	new := *t
+	new.ALPN = make([]string, len(t.ALPN))
+	copy(new.ALPN, t.ALPN)
+	return &new
+}
+
+func (t *TLSConfig) equal(o *TLSConfig) bool {
+	return t.ServerName == o.ServerName &&
+		slices.Equal(t.ALPN, o.ALPN) &&
+		t.CertFile == o.CertFile &&
+		t.KeyFile == o.KeyFile &&
+		t.CAFile == o.CAFile &&
+		t.InsecureSkipVerify == o.InsecureSkipVerify
+}
+
+type MuxConfig struct {
+	// tunnels kept to each remote, a new one is dialed when all of them
+	// carry max_streams streams
+	MaxTunnels int `json:"max_tunnels,omitempty"`
+	MaxStreams int `json:"max_streams,omitempty"`
+	// ping interval, a tunnel that received nothing for keepalive_timeout_sec is closed
+	KeepAliveIntervalSec int `json:"keepalive_interval_sec,omitempty"`
+	KeepAliveTimeoutSec  int `json:"keepalive_timeout_sec,omitempty"`
+
+	KeepAliveInterval time.Duration `json:"-"`
+	KeepAliveTimeout  time.Duration `json:"-"`
+}
+
+func (m *MuxConfig) Clone() *MuxConfig {
+	new := *m
+	return &new
+}
+
+func (m *MuxConfig) Adjust() {
+	if m.MaxTunnels <= 0 {
+		m.MaxTunnels = constant.DefaultMuxMaxTunnels
+	}
+	if m.MaxStreams <= 0 {
+		m.MaxStreams = constant.DefaultMuxMaxStreams
+	}
+	m.KeepAliveInterval = getDuration(m.KeepAliveIntervalSec, constant.DefaultMuxKeepAliveInterval)
+	m.KeepAliveTimeout = getDuration(m.KeepAliveTimeoutSec, constant.DefaultMuxKeepAliveTimeOut)
+}
+
+func (m *MuxConfig) Validate() error {
+	if m.KeepAliveTimeout <= m.KeepAliveInterval {
+		return fmt.Errorf("mux keepalive timeout must be longer than keepalive interval")
+	}
+	return nil
+}
+
+// ProxyConfig is for listen types that take the destination from the
+// client, socks5 and http_proxy. redirect and tproxy only use the acl.
+type ProxyConfig struct {
+	// k: username v: password, empty means no auth
+	Users map[string]string `json:"users,omitempty"`
+	// destinations the client may ask for, empty means any. an entry is an
+	// ip, a cidr, a domain or *.suffix for the domain and its subdomains.
+	// ip and cidr entries only match ip destinations, domains are not resolved
+	AllowedDestinations []string `json:"allowed_destinations,omitempty"`
+	// empty means any port
+	AllowedPorts []int `json:"allowed_ports,omitempty"`
+
+	allowedNets []*net.IPNet
+}
+
+func (p *ProxyConfig) Clone() *ProxyConfig {
+	new := &ProxyConfig{
+		AllowedDestinations: make([]string, len(p.AllowedDestinations)),
+		AllowedPorts:        make([]int, len(p.AllowedPorts)),
+		allowedNets:         p.allowedNets,
+	}
+	copy(new.AllowedDestinations, p.AllowedDestinations)
+	copy(new.AllowedPorts, p.AllowedPorts)
+	if p.Users != nil {
+		new.Users = make(map[string]string, len(p.Users))
+		for k, v := range p.Users {
+			new.Users[k] = v
+		}
+	}
+	return new
+}
+
+// Adjust parses the ip and cidr entries of allowed_destinations,
+// invalid ones are reported by Validate.
+func (p *ProxyConfig) Adjust() {
+	p.allowedNets = nil
+	for _, dst := range p.AllowedDestinations {
+		if ipNet, err := parseIPOrCIDR(dst); err == nil && ipNet != nil {
+			p.allowedNets = append(p.allowedNets, ipNet)
+		}
+	}
+}
+
+func (p *ProxyConfig) Validate() error {
+	for _, dst := range p.AllowedDestinations {
+		if dst == "" {
+			return fmt.Errorf("invalid allowed destination: %s", dst)
+		}
+		if _, err := parseIPOrCIDR(dst); err != nil {
+			return fmt.Errorf("invalid allowed destination %s: %w", dst, err)
+		}
+	}
+	for _, port := range p.AllowedPorts {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid allowed port: %d", port)
+		}
+	}
+	return nil
+}
+
+func (p *ProxyConfig) equal(o *ProxyConfig) bool {
+	return maps.Equal(p.Users, o.Users) &&
+		slices.Equal(p.AllowedDestinations, o.AllowedDestinations) &&
+		slices.Equal(p.AllowedPorts, o.AllowedPorts)
+}
+
+// ReverseConfig is for the reverse_server and reverse_agent listen types.
+type ReverseConfig struct {
+	// shared by the server and its agents, checked when an agent registers
+	Token string `json:"token"`
+	// reverse_server: k: service name v: public listen address
+	// reverse_agent: k: service name v: local address the service is relayed to
+	Services map[string]string `json:"services"`
+}
+
+func (rc *ReverseConfig) Clone() *ReverseConfig {
+	new := &ReverseConfig{Token: rc.Token}
+	if rc.Services != nil {
+		new.Services = maps.Clone(rc.Services)
+	}
+	return new
+}
+
+func (rc *ReverseConfig) Validate() error {
+	if rc.Token == "" {
+		return fmt.Errorf("reverse token must be set")
+	}
+	if len(rc.Services) == 0 {
+		return fmt.Errorf("reverse services must not be empty")
+	}
+	for name, addr := range rc.Services {
+		if name == "" || addr == "" {
+			return fmt.Errorf("invalid reverse service %q: %q", name, addr)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address of reverse service %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (rc *ReverseConfig) equal(o *ReverseConfig) bool {
+	return rc.Token == o.Token && maps.Equal(rc.Services, o.Services)
+}
+
+func (p *ProxyConfig) NeedAuth() bool {
+	return len(p.Users) > 0
+}
+
+// CheckUser reports whether user and pass match, the password compare is
+// constant time.
+func (p *ProxyConfig) CheckUser(user, pass string) bool {
+	expected, ok := p.Users[user]
+	return ok && subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) == 1
+}
+
+// AllowDestination reports whether addr(host:port) passes the allow lists.
+func (p *ProxyConfig) AllowDestination(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if len(p.AllowedPorts) > 0 {
+		port, err := strconv.Atoi(portStr)
+		if err != nil || !slices.Contains(p.AllowedPorts, port) {
+			return false
+		}
+	}
+	if len(p.AllowedDestinations) == 0 {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range p.allowedNets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, dst := range p.AllowedDestinations {
+		dst = strings.ToLower(dst)
+		if suffix, ok := strings.CutPrefix(dst, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == dst {
+			return true
+		}
+	}
+	return false
+}
+
+type HealthCheckConfig struct {
+	Type        string `json:"type,omitempty"`
+	IntervalSec int    `json:"interval_sec,omitempty"`
+	TimeoutSec  int    `json:"timeout_sec,omitempty"`
+	// consecutive probes needed to mark a remote up/down
+	Rise int `json:"rise,omitempty"`
+	Fall int `json:"fall,omitempty"`
+
+	Interval time.Duration `json:"-"`
+	Timeout  time.Duration `json:"-"`
+}
+
+func (h *HealthCheckConfig) Clone() *HealthCheckConfig {
+	new := *h
+	return &new
+}
+
+func (h *HealthCheckConfig) Adjust() {
+	if h.Type == "" {
+		h.Type = HealthCheckHandShake
+	}
+	if h.Rise <= 0 {
+		h.Rise = constant.DefaultHealthCheckRise
+	}
+	if h.Fall <= 0 {
+		h.Fall = constant.DefaultHealthCheckFall
+	}
+	h.Interval = getDuration(h.IntervalSec, constant.DefaultHealthCheckInterval)
+	h.Timeout = getDuration(h.TimeoutSec, constant.DefaultDialTimeOut)
+}
+
+func (h *HealthCheckConfig) Validate() error {
+	if h.Type != HealthCheckTCP && h.Type != HealthCheckHandShake && h.Type != HealthCheckEcho {
+		return fmt.Errorf("invalid health check type: %s", h.Type)
+	}
+	return nil
+}
+
 type Options struct {
 	EnableUDP          bool `json:"enable_udp,omitempty"`
 	EnableMultipathTCP bool `json:"enable_multipath_tcp,omitempty"`
+	// raw to raw tcp conns are spliced by the kernel on linux when not rate
+	// limited or sniffed, this keeps them on the user space copy
+	DisableSplice bool `json:"disable_splice,omitempty"`
+	// datagrams queued per udp session of the listener, newer ones are
+	// dropped while it is full
+	UDPQueueSize int `json:"udp_queue_size,omitempty"`
+
+	// active connection limits of the rule and of each of its remotes, a full
+	// remote is passed over for another one. checked for new tcp conns
+	MaxConnection     int `json:"max_connection,omitempty"`
+	MaxConnsPerRemote int `json:"max_conns_per_remote,omitempty"`
+	// what a conn over those or the node limit gets, see ConnOverflow*.
+	// queued conns wait up to conn_queue_timeout_sec for a free slot
+	ConnOverflow        string `json:"conn_overflow,omitempty"`
+	ConnQueueTimeoutSec int    `json:"conn_queue_timeout_sec,omitempty"`
 
-	// connection limit
-	MaxConnection    int      `json:"max_connection,omitempty"`
 	BlockedProtocols []string `json:"blocked_protocols,omitempty"`
-	MaxReadRateKbps  int64    `json:"max_read_rate_kbps,omitempty"`
+	// only relay conns sniffed as one of these, conns of unknown protocol
+	// included are rejected, can not be used with blocked_protocols
+	AllowedProtocols []string `json:"allowed_protocols,omitempty"`
+	// conn upload limit, bandwidth.conn.upload_kbps wins when set
+	MaxReadRateKbps int64 `json:"max_read_rate_kbps,omitempty"`
+	// per conn, per rule and per client ip limits of tcp conns and udp
+	// sessions, they are changed without restart on reload or through the api
+	Bandwidth *BandwidthConfig `json:"bandwidth,omitempty"`
+	// traffic cap of the rule, its usage survives restarts
+	Quota *QuotaConfig `json:"quota,omitempty"`
+
+	// per client ip limits, a client over them is rejected and, with
+	// ban_sec set, banned for that long
+	MaxConnsPerIP       int `json:"max_conns_per_ip,omitempty"`
+	NewConnsPerIPPerSec int `json:"new_conns_per_ip_per_sec,omitempty"`
+	BanSec              int `json:"ban_sec,omitempty"`
+
+	// client ip acl, deny wins over allow and no allow cidr allows all.
+	// the files hold one cidr per line and are read again on every reload
+	AllowCIDRs     []string `json:"allow_cidrs,omitempty"`
+	DenyCIDRs      []string `json:"deny_cidrs,omitempty"`
+	AllowCIDRFiles []string `json:"allow_cidr_files,omitempty"`
+	DenyCIDRFiles  []string `json:"deny_cidr_files,omitempty"`
 
 	// ws related
 	WSConfig *WSConfig `json:"ws_config,omitempty"`
+	// tls related, used by tls listen/transport type
+	TLSConfig *TLSConfig `json:"tls_config,omitempty"`
+	// mux related, tunnels also use tls_config. quic uses the keepalive settings
+	MuxConfig *MuxConfig `json:"mux_config,omitempty"`
+	// auth and destination acl for socks5 and http_proxy listen types,
+	// redirect and tproxy only check the acl
+	ProxyConfig *ProxyConfig `json:"proxy_config,omitempty"`
+	// token and services of reverse_server and reverse_agent listen types
+	ReverseConfig *ReverseConfig `json:"reverse_config,omitempty"`
+
+	// proxy protocol: parse the header sent by a load balancer in front of
+	// the tcp listener and use its client address, the header is required
+	AcceptProxyProtocol bool `json:"accept_proxy_protocol,omitempty"`
+	// send a proxy protocol header of this version(1 or 2) to remotes, raw transport only
+	SendProxyProtocol int `json:"send_proxy_protocol,omitempty"`
+	// ws/wss listen only, take the client address from X-Forwarded-For
+	// set by the previous ehco hop or a reverse proxy, its right most entry
+	TrustForwardedFor bool `json:"trust_forwarded_for,omitempty"`
+	// cidrs of the hops whose X-Forwarded-For is believed, the header of
+	// other peers is ignored and the entries of these hops are skipped
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// sni/host based routing of tcp conns, remotes of the rule are the default route
+	Routes []*RouteConfig `json:"routes,omitempty"`
+
+	// load balance related, see lb.Strategy* for supported strategies
+	LBStrategy string `json:"lb_strategy,omitempty"`
+	// k: remote address v: weight, remotes not listed have weight 1
+	RemoteWeights map[string]int `json:"remote_weights,omitempty"`
+	// consistent_hash only: remember the remote picked for a client ip until
+	// it idles for this long, 0 disables the sticky table
+	StickyTTLSec int `json:"sticky_ttl_sec,omitempty"`
+
+	// outlier ejection: consecutive dial/handshake errors before a remote is ejected,
+	// 0 means default and negative disables ejection
+	MaxFails       int `json:"max_fails,omitempty"`
+	FailTimeoutSec int `json:"fail_timeout_sec,omitempty"`
+
+	// active health check, nil means disabled
+	HealthCheck *HealthCheckConfig `json:"health_check,omitempty"`
 
 	DialTimeoutSec  int `json:"dial_timeout_sec,omitempty"`
 	IdleTimeoutSec  int `json:"idle_timeout_sec,omitempty"`
@@ -52,6 +419,9 @@ type Options struct {
 	IdleTimeout  time.Duration `json:"-"`
 	ReadTimeout  time.Duration `json:"-"`
 	SniffTimeout time.Duration `json:"-"`
+	FailTimeout  time.Duration `json:"-"`
+
+	ConnQueueTimeout time.Duration `json:"-"`
 }
 
 func (o *Options) Clone() *Options {
@@ -61,11 +431,68 @@ func (o *Options) Clone() *Options {
 		MaxConnection:      o.MaxConnection,
 		MaxReadRateKbps:    o.MaxReadRateKbps,
 		BlockedProtocols:   make([]string, len(o.BlockedProtocols)),
+		AllowedProtocols:   slices.Clone(o.AllowedProtocols),
+		AllowCIDRs:         slices.Clone(o.AllowCIDRs),
+		DenyCIDRs:          slices.Clone(o.DenyCIDRs),
+		AllowCIDRFiles:     slices.Clone(o.AllowCIDRFiles),
+		DenyCIDRFiles:      slices.Clone(o.DenyCIDRFiles),
+		LBStrategy:         o.LBStrategy,
+		StickyTTLSec:       o.StickyTTLSec,
+		MaxFails:           o.MaxFails,
+		FailTimeoutSec:     o.FailTimeoutSec,
+
+		MaxConnsPerIP:       o.MaxConnsPerIP,
+		NewConnsPerIPPerSec: o.NewConnsPerIPPerSec,
+		BanSec:              o.BanSec,
+
+		MaxConnsPerRemote:   o.MaxConnsPerRemote,
+		ConnOverflow:        o.ConnOverflow,
+		ConnQueueTimeoutSec: o.ConnQueueTimeoutSec,
+
+		UDPQueueSize:  o.UDPQueueSize,
+		DisableSplice: o.DisableSplice,
+
+		AcceptProxyProtocol: o.AcceptProxyProtocol,
+		SendProxyProtocol:   o.SendProxyProtocol,
+		TrustForwardedFor:   o.TrustForwardedFor,
+		TrustedProxies:      slices.Clone(o.TrustedProxies),
 	}
 	copy(opt.BlockedProtocols, o.BlockedProtocols)
+	if o.RemoteWeights != nil {
+		opt.RemoteWeights = make(map[string]int, len(o.RemoteWeights))
+		for k, v := range o.RemoteWeights {
+			opt.RemoteWeights[k] = v
+		}
+	}
 	if o.WSConfig != nil {
 		opt.WSConfig = o.WSConfig.Clone()
 	}
+	if o.HealthCheck != nil {
+		opt.HealthCheck = o.HealthCheck.Clone()
+	}
+	if o.Bandwidth != nil {
+		bw := *o.Bandwidth
+		opt.Bandwidth = &bw
+	}
+	if o.Quota != nil {
+		quota := *o.Quota
+		opt.Quota = &quota
+	}
+	if o.TLSConfig != nil {
+		opt.TLSConfig = o.TLSConfig.Clone()
+	}
+	if o.MuxConfig != nil {
+		opt.MuxConfig = o.MuxConfig.Clone()
+	}
+	if o.ProxyConfig != nil {
+		opt.ProxyConfig = o.ProxyConfig.Clone()
+	}
+	if o.ReverseConfig != nil {
+		opt.ReverseConfig = o.ReverseConfig.Clone()
+	}
+	for _, rc := range o.Routes {
+		opt.Routes = append(opt.Routes, rc.Clone())
+	}
 	return opt
 }
 
@@ -110,6 +537,20 @@ func (r *Config) Adjust() error {
 		r.Options.IdleTimeout = getDuration(r.Options.IdleTimeoutSec, constant.DefaultIdleTimeOut)
 		r.Options.ReadTimeout = getDuration(r.Options.ReadTimeoutSec, constant.DefaultReadTimeOut)
 		r.Options.SniffTimeout = getDuration(r.Options.SniffTimeoutSec, constant.DefaultSniffTimeOut)
+		r.Options.FailTimeout = getDuration(r.Options.FailTimeoutSec, constant.DefaultFailTimeOut)
+		r.Options.ConnQueueTimeout = getDuration(r.Options.ConnQueueTimeoutSec, constant.DefaultConnQueueTimeOut)
+		if r.Options.MaxFails == 0 {
+			r.Options.MaxFails = constant.DefaultMaxFails
+		}
+		if r.Options.HealthCheck != nil {
+			r.Options.HealthCheck.Adjust()
+		}
+		if r.Options.MuxConfig != nil {
+			r.Options.MuxConfig.Adjust()
+		}
+		if r.Options.ProxyConfig != nil {
+			r.Options.ProxyConfig.Adjust()
+		}
 	}
 	return nil
 }
@@ -121,7 +562,8 @@ func (r *Config) Validate() error {
 	if err := r.validateType(); err != nil {
 		return err
 	}
-	if r.Listen == "" {
+	// the reverse agent dials out and listens on nothing
+	if (r.Listen == "") != (r.ListenType == constant.RelayTypeReverseAgent) {
 		return fmt.Errorf("invalid listen: %s", r.Listen)
 	}
 	for _, addr := range r.Remotes {
@@ -129,11 +571,88 @@ func (r *Config) Validate() error {
 			return fmt.Errorf("invalid remote addr: %s", addr)
 		}
 	}
+	if err := r.validatePortRange(); err != nil {
+		return err
+	}
+	if err := r.validateRoutes(); err != nil {
+		return err
+	}
+	if err := r.validateACL(); err != nil {
+		return err
+	}
+	if r.Options.MaxConnsPerIP < 0 || r.Options.NewConnsPerIPPerSec < 0 || r.Options.BanSec < 0 {
+		return fmt.Errorf("per ip limits can not be negative")
+	}
+	if r.Options.BanSec > 0 && r.Options.MaxConnsPerIP == 0 && r.Options.NewConnsPerIPPerSec == 0 {
+		return fmt.Errorf("ban_sec needs max_conns_per_ip or new_conns_per_ip_per_sec")
+	}
+	if r.Options.MaxConnection < 0 || r.Options.MaxConnsPerRemote < 0 {
+		return fmt.Errorf("connection limits can not be negative")
+	}
+	if r.Options.ConnOverflow != "" && r.Options.ConnOverflow != ConnOverflowReject && r.Options.ConnOverflow != ConnOverflowQueue {
+		return fmt.Errorf("invalid conn overflow: %s", r.Options.ConnOverflow)
+	}
+	if r.Options.MaxReadRateKbps < 0 {
+		return fmt.Errorf("max_read_rate_kbps can not be negative")
+	}
+	if r.Options.UDPQueueSize < 0 {
+		return fmt.Errorf("udp_queue_size can not be negative")
+	}
+	if r.Options.Bandwidth != nil {
+		if err := r.Options.Bandwidth.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Options.Quota != nil {
+		if err := r.Options.Quota.Validate(); err != nil {
+			return err
+		}
+	}
 	for _, protocol := range r.Options.BlockedProtocols {
-		if protocol != ProtocolHTTP && protocol != ProtocolTLS {
+		if !slices.Contains(SniffProtocols, protocol) {
 			return fmt.Errorf("invalid blocked protocol: %s", protocol)
 		}
 	}
+	for _, protocol := range r.Options.AllowedProtocols {
+		if !slices.Contains(SniffProtocols, protocol) {
+			return fmt.Errorf("invalid allowed protocol: %s", protocol)
+		}
+	}
+	if len(r.Options.BlockedProtocols) > 0 && len(r.Options.AllowedProtocols) > 0 {
+		return fmt.Errorf("blocked_protocols and allowed_protocols can not be used together")
+	}
+	if r.Options.HealthCheck != nil {
+		if err := r.Options.HealthCheck.Validate(); err != nil {
+			return err
+		}
+		if r.Options.HealthCheck.Type == HealthCheckTCP && r.TransportType == constant.RelayTypeQuic {
+			return fmt.Errorf("tcp health check does not work with quic transport")
+		}
+	}
+	if r.Options.MuxConfig != nil {
+		if err := r.Options.MuxConfig.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := r.validateProxyProtocol(); err != nil {
+		return err
+	}
+	if r.Options.ProxyConfig != nil {
+		if err := r.Options.ProxyConfig.Validate(); err != nil {
+			return err
+		}
+	}
+	if !lb.ValidStrategy(r.Options.LBStrategy) {
+		return fmt.Errorf("invalid lb strategy: %s", r.Options.LBStrategy)
+	}
+	for addr, weight := range r.Options.RemoteWeights {
+		if !inArray(addr, r.allRemotes()) {
+			return fmt.Errorf("remote weight for unknown remote: %s", addr)
+		}
+		if weight <= 0 {
+			return fmt.Errorf("invalid weight %d for remote: %s", weight, addr)
+		}
+	}
 	return nil
 }
 
@@ -165,6 +684,98 @@ func (r *Config) Different(new *Config) bool {
 			return true
 		}
 	}
+	// the running relay sniffs with its own config
+	if !slices.Equal(r.Options.BlockedProtocols, new.Options.BlockedProtocols) ||
+		!slices.Equal(r.Options.AllowedProtocols, new.Options.AllowedProtocols) {
+		return true
+	}
+	// the per ip limiters keep their state in the running relay
+	if r.Options.MaxConnsPerIP != new.Options.MaxConnsPerIP ||
+		r.Options.NewConnsPerIPPerSec != new.Options.NewConnsPerIPPerSec ||
+		r.Options.BanSec != new.Options.BanSec {
+		return true
+	}
+	// the running relay checks the connection limits of its own config
+	if r.Options.MaxConnection != new.Options.MaxConnection ||
+		r.Options.MaxConnsPerRemote != new.Options.MaxConnsPerRemote ||
+		r.Options.ConnOverflow != new.Options.ConnOverflow ||
+		r.Options.ConnQueueTimeoutSec != new.Options.ConnQueueTimeoutSec {
+		return true
+	}
+	// the udp listeners size the session queues and the relay conns pick
+	// splice with the options the rule started with
+	if r.Options.UDPQueueSize != new.Options.UDPQueueSize ||
+		r.Options.DisableSplice != new.Options.DisableSplice {
+		return true
+	}
+	// the quota is fetched from cmgr when the relay starts
+	oldQuota, newQuota := r.Options.Quota, new.Options.Quota
+	if (oldQuota == nil) != (newQuota == nil) || (oldQuota != nil && *oldQuota != *newQuota) {
+		return true
+	}
+	// listener and client address handling
+	if r.Options.AcceptProxyProtocol != new.Options.AcceptProxyProtocol ||
+		r.Options.SendProxyProtocol != new.Options.SendProxyProtocol ||
+		r.Options.TrustForwardedFor != new.Options.TrustForwardedFor ||
+		!slices.Equal(r.Options.TrustedProxies, new.Options.TrustedProxies) {
+		return true
+	}
+	// balancer is built once when relay starts, so restart it when lb changed
+	if r.Options.LBStrategy != new.Options.LBStrategy ||
+		r.Options.StickyTTLSec != new.Options.StickyTTLSec ||
+		len(r.Options.RemoteWeights) != len(new.Options.RemoteWeights) {
+		return true
+	}
+	for addr, weight := range r.Options.RemoteWeights {
+		if new.Options.RemoteWeights[addr] != weight {
+			return true
+		}
+	}
+	// so is the eject policy
+	if r.Options.MaxFails != new.Options.MaxFails ||
+		r.Options.FailTimeoutSec != new.Options.FailTimeoutSec {
+		return true
+	}
+	// health checker is started with the relay as well
+	oldHC, newHC := r.Options.HealthCheck, new.Options.HealthCheck
+	if (oldHC == nil) != (newHC == nil) {
+		return true
+	}
+	if oldHC != nil && (oldHC.Type != newHC.Type || oldHC.IntervalSec != newHC.IntervalSec ||
+		oldHC.TimeoutSec != newHC.TimeoutSec || oldHC.Rise != newHC.Rise || oldHC.Fall != newHC.Fall) {
+		return true
+	}
+	// tls servers and transports load their certs when the relay starts
+	oldTLS, newTLS := r.Options.TLSConfig, new.Options.TLSConfig
+	if (oldTLS == nil) != (newTLS == nil) {
+		return true
+	}
+	if oldTLS != nil && !oldTLS.equal(newTLS) {
+		return true
+	}
+	// so is the mux tunnel pool
+	oldMux, newMux := r.Options.MuxConfig, new.Options.MuxConfig
+	if (oldMux == nil) != (newMux == nil) {
+		return true
+	}
+	if oldMux != nil && *oldMux != *newMux {
+		return true
+	}
+	// the running relay keeps its own config, so proxy users and acl need a restart too
+	oldProxy, newProxy := r.Options.ProxyConfig, new.Options.ProxyConfig
+	if (oldProxy == nil) != (newProxy == nil) {
+		return true
+	}
+	if oldProxy != nil && !oldProxy.equal(newProxy) {
+		return true
+	}
+	oldReverse, newReverse := r.Options.ReverseConfig, new.Options.ReverseConfig
+	if (oldReverse == nil) != (newReverse == nil) {
+		return true
+	}
+	if oldReverse != nil && !oldReverse.equal(newReverse) {
+		return true
+	}
 	return false
 }
 
@@ -175,38 +786,202 @@ func (r *Config) DefaultLabel() string {
 	return defaultLabel
 }
 
-func (r *Config) ToRemotesLB() lb.RoundRobin {
+// ToRemotesLB builds the balancer chosen by lb_strategy,
+// counter is only needed by least_conn and can be nil.
+func (r *Config) ToRemotesLB(counter lb.ActiveCounter) (lb.Balancer, error) {
+	return lb.NewBalancer(r.GetAllRemotes(), &lb.Config{
+		Strategy:  r.Options.LBStrategy,
+		Counter:   counter,
+		StickyTTL: time.Duration(r.Options.StickyTTLSec) * time.Second,
+	})
+}
+
+func (r *Config) GetAllRemotes() []*lb.Node {
 	tcpNodeList := make([]*lb.Node, len(r.Remotes))
 	for idx, addr := range r.Remotes {
 		tcpNodeList[idx] = &lb.Node{Address: addr}
+		if r.Options != nil {
+			tcpNodeList[idx].Weight = r.Options.RemoteWeights[addr]
+		}
 	}
-	return lb.NewRoundRobin(tcpNodeList)
+	return tcpNodeList
 }
 
-func (r *Config) GetAllRemotes() []*lb.Node {
-	lb := r.ToRemotesLB()
-	return lb.GetAll()
+func (r *Config) GetEjectPolicy() *lb.EjectPolicy {
+	return &lb.EjectPolicy{
+		MaxFails:      r.Options.MaxFails,
+		BaseEjectTime: r.Options.FailTimeout,
+		MaxEjectTime:  constant.MaxEjectTimeOut,
+	}
 }
 
 func (r *Config) GetLoggerName() string {
 	return fmt.Sprintf("%s(%s<->%s)", r.Label, r.ListenType, r.TransportType)
 }
 
+func (r *Config) GetTLSConfig() *TLSConfig {
+	if r.Options != nil && r.Options.TLSConfig != nil {
+		return r.Options.TLSConfig
+	}
+	return &TLSConfig{}
+}
+
+// GetProxyConfig returns the proxy config, an empty one when not set.
+func (r *Config) GetProxyConfig() *ProxyConfig {
+	if r.Options != nil && r.Options.ProxyConfig != nil {
+		return r.Options.ProxyConfig
+	}
+	return &ProxyConfig{}
+}
+
+// GetReverseConfig returns the reverse config, an empty one when not set.
+func (r *Config) GetReverseConfig() *ReverseConfig {
+	if r.Options != nil && r.Options.ReverseConfig != nil {
+		return r.Options.ReverseConfig
+	}
+	return &ReverseConfig{}
+}
+
+// GetMuxConfig returns the adjusted mux config, defaults when not set.
+func (r *Config) GetMuxConfig() *MuxConfig {
+	if r.Options != nil && r.Options.MuxConfig != nil {
+		return r.Options.MuxConfig
+	}
+	mc := &MuxConfig{}
+	mc.Adjust()
+	return mc
+}
+
 func (r *Config) validateType() error {
 	if r.ListenType != constant.RelayTypeRaw &&
 		r.ListenType != constant.RelayTypeWS &&
-		r.ListenType != constant.RelayTypeWSS {
+		r.ListenType != constant.RelayTypeWSS &&
+		r.ListenType != constant.RelayTypeTLS &&
+		r.ListenType != constant.RelayTypeMux &&
+		r.ListenType != constant.RelayTypeQuic &&
+		r.ListenType != constant.RelayTypeSocks5 &&
+		r.ListenType != constant.RelayTypeHTTPProxy &&
+		r.ListenType != constant.RelayTypeRedirect &&
+		r.ListenType != constant.RelayTypeTProxy &&
+		r.ListenType != constant.RelayTypeReverseServer &&
+		r.ListenType != constant.RelayTypeReverseAgent {
 		return fmt.Errorf("invalid listen type:%s", r.ListenType)
 	}
 
 	if r.TransportType != constant.RelayTypeRaw &&
 		r.TransportType != constant.RelayTypeWS &&
-		r.TransportType != constant.RelayTypeWSS {
+		r.TransportType != constant.RelayTypeWSS &&
+		r.TransportType != constant.RelayTypeTLS &&
+		r.TransportType != constant.RelayTypeMux &&
+		r.TransportType != constant.RelayTypeQuic {
 		return fmt.Errorf("invalid transport type:%s", r.TransportType)
 	}
+	if r.ListenType == constant.RelayTypeTLS || r.ListenType == constant.RelayTypeMux || r.ListenType == constant.RelayTypeQuic {
+		tc := r.GetTLSConfig()
+		if (tc.CertFile == "") != (tc.KeyFile == "") {
+			return fmt.Errorf("cert_file and key_file must be set together")
+		}
+	}
+	if r.ListenType == constant.RelayTypeRedirect || r.ListenType == constant.RelayTypeTProxy {
+		if runtime.GOOS != "linux" {
+			return fmt.Errorf("%s listen type is only supported on linux", r.ListenType)
+		}
+		if r.ListenType == constant.RelayTypeRedirect && r.Options.EnableUDP {
+			return fmt.Errorf("redirect listen type does not support udp, use tproxy")
+		}
+	}
+	if r.ListenType == constant.RelayTypeSocks5 || r.ListenType == constant.RelayTypeHTTPProxy ||
+		r.ListenType == constant.RelayTypeRedirect || r.ListenType == constant.RelayTypeTProxy {
+		// the destination comes from the client, raw dials it directly and
+		// ws/wss hand it to the remote ehco server
+		switch r.TransportType {
+		case constant.RelayTypeRaw:
+			if len(r.Remotes) > 0 {
+				return fmt.Errorf("%s with raw transport dials the destination directly, remotes must be empty", r.ListenType)
+			}
+		case constant.RelayTypeWS, constant.RelayTypeWSS:
+			if len(r.Remotes) == 0 {
+				return fmt.Errorf("%s with %s transport needs remotes", r.ListenType, r.TransportType)
+			}
+		default:
+			return fmt.Errorf("%s listen type does not support transport type:%s", r.ListenType, r.TransportType)
+		}
+	}
+	if r.ListenType == constant.RelayTypeReverseServer || r.ListenType == constant.RelayTypeReverseAgent {
+		// the transport is the one the tunnel between server and agent runs on
+		switch r.TransportType {
+		case constant.RelayTypeWS, constant.RelayTypeWSS, constant.RelayTypeMux:
+		default:
+			return fmt.Errorf("%s listen type does not support transport type:%s", r.ListenType, r.TransportType)
+		}
+		if r.Options.ReverseConfig == nil {
+			return fmt.Errorf("%s listen type needs reverse_config", r.ListenType)
+		}
+		if err := r.Options.ReverseConfig.Validate(); err != nil {
+			return err
+		}
+		if r.ListenType == constant.RelayTypeReverseServer && len(r.Remotes) > 0 {
+			return fmt.Errorf("reverse_server relays to its agents, remotes must be empty")
+		}
+		if r.ListenType == constant.RelayTypeReverseAgent && len(r.Remotes) == 0 {
+			return fmt.Errorf("reverse_agent needs the reverse_server as remotes")
+		}
+	}
 	return nil
 }
 
+// parseIPOrCIDR returns nil without error when s is neither an ip nor a cidr.
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		return ipNet, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}, nil
+}
+
+func (r *Config) validateProxyProtocol() error {
+	if r.Options.AcceptProxyProtocol && r.ListenType == constant.RelayTypeQuic {
+		return fmt.Errorf("accept_proxy_protocol needs a tcp listener, not %s", r.ListenType)
+	}
+	switch r.Options.SendProxyProtocol {
+	case 0:
+	case 1, 2:
+		if r.TransportType != constant.RelayTypeRaw {
+			return fmt.Errorf("send_proxy_protocol only works with raw transport, not %s", r.TransportType)
+		}
+	default:
+		return fmt.Errorf("invalid send_proxy_protocol version: %d", r.Options.SendProxyProtocol)
+	}
+	if r.Options.TrustForwardedFor && r.ListenType != constant.RelayTypeWS && r.ListenType != constant.RelayTypeWSS {
+		return fmt.Errorf("trust_forwarded_for only works with ws/wss listen type, not %s", r.ListenType)
+	}
+	if len(r.Options.TrustedProxies) > 0 && !r.Options.TrustForwardedFor {
+		return fmt.Errorf("trusted_proxies needs trust_forwarded_for")
+	}
+	for _, s := range r.Options.TrustedProxies {
+		if _, err := ParseCIDR(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func inArray(ele string, array []string) bool {
+	for _, v := range array {
+		if v == ele {
+			return true
+		}
+	}
+	return false
+}
+
 func getDuration(seconds int, defaultDuration time.Duration) time.Duration {
 	if seconds > 0 {
 		return time.Duration(seconds) * time.Second
@@ -229,5 +1004,12 @@ func newDefaultOptions() *Options {
 
 		SniffTimeout:    constant.DefaultSniffTimeOut,
 		SniffTimeoutSec: int(constant.DefaultSniffTimeOut.Seconds()),
+
+		MaxFails:       constant.DefaultMaxFails,
+		FailTimeout:    constant.DefaultFailTimeOut,
+		FailTimeoutSec: int(constant.DefaultFailTimeOut.Seconds()),
+
+		ConnQueueTimeout:    constant.DefaultConnQueueTimeOut,
+		ConnQueueTimeoutSec: int(constant.DefaultConnQueueTimeOut.Seconds()),
 	}
 }
@@ -0,0 +1,121 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+)
+
+// portRange is an address like 0.0.0.0:20000-20100, both ends included.
+type portRange struct {
+	host       string
+	start, end int
+}
+
+// parsePortRange returns nil without error when addr has a single port.
+func parsePortRange(addr string) (*portRange, error) {
+	if strings.Contains(addr, "://") {
+		return nil, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil
+	}
+	first, last, ok := strings.Cut(port, "-")
+	if !ok {
+		return nil, nil
+	}
+	start, err := parsePort(first)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parsePort(last)
+	if err != nil {
+		return nil, err
+	}
+	if start > end {
+		return nil, fmt.Errorf("port range %s starts after it ends", port)
+	}
+	pr := &portRange{host: host, start: start, end: end}
+	if pr.size() > constant.MaxPortRangeSize {
+		return nil, fmt.Errorf("port range %s has %d ports, at most %d", port, pr.size(), constant.MaxPortRangeSize)
+	}
+	return pr, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
+
+func (p *portRange) size() int {
+	return p.end - p.start + 1
+}
+
+func (p *portRange) addr(offset int) string {
+	return net.JoinHostPort(p.host, strconv.Itoa(p.start+offset))
+}
+
+// IsPortRange reports whether the rule listens on a port range.
+func (r *Config) IsPortRange() bool {
+	pr, err := parsePortRange(r.Listen)
+	return err == nil && pr != nil
+}
+
+// ListenAddrs returns one address per listen port, in port order.
+func (r *Config) ListenAddrs() []string {
+	pr, err := parsePortRange(r.Listen)
+	if err != nil || pr == nil {
+		return []string{r.Listen}
+	}
+	addrs := make([]string, pr.size())
+	for i := range addrs {
+		addrs[i] = pr.addr(i)
+	}
+	return addrs
+}
+
+// RemoteAddrAt returns the address of remote for the listen port at offset
+// of the listen range, a remote with a single port is used for every port.
+func RemoteAddrAt(remote string, offset int) string {
+	pr, err := parsePortRange(remote)
+	if err != nil || pr == nil || offset < 0 || offset >= pr.size() {
+		return remote
+	}
+	return pr.addr(offset)
+}
+
+func (r *Config) validatePortRange() error {
+	listen, err := parsePortRange(r.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen %s: %w", r.Listen, err)
+	}
+	if listen != nil && r.ListenType != constant.RelayTypeRaw {
+		return fmt.Errorf("port range listen only works with raw listen type, not %s", r.ListenType)
+	}
+	for _, addr := range r.allRemotes() {
+		remote, err := parsePortRange(addr)
+		if err != nil {
+			return fmt.Errorf("invalid remote %s: %w", addr, err)
+		}
+		if remote == nil {
+			continue
+		}
+		if r.TransportType != constant.RelayTypeRaw {
+			return fmt.Errorf("remote port range only works with raw transport, not %s", r.TransportType)
+		}
+		if listen == nil {
+			return fmt.Errorf("remote port range %s needs a listen port range", addr)
+		}
+		if remote.size() != listen.size() {
+			return fmt.Errorf("remote port range %s has %d ports but listen has %d", addr, remote.size(), listen.size())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package conf
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	QuotaResetNever   = "never"
+	QuotaResetDaily   = "daily"
+	QuotaResetWeekly  = "weekly"
+	QuotaResetMonthly = "monthly"
+)
+
+// QuotaConfig caps the bytes a rule relays in both directions in a period,
+// once they are used up the rule rejects new conns and drops the open ones.
+type QuotaConfig struct {
+	Bytes int64 `json:"bytes"`
+	// one of QuotaReset*, never when empty
+	ResetPeriod string `json:"reset_period,omitempty"`
+	// monthly: day of month 1-31, the last day for months shorter than it.
+	// weekly: day of week 0-6, 0 is sunday. 0 is taken as 1 for monthly
+	ResetDay int `json:"reset_day,omitempty"`
+}
+
+func (q *QuotaConfig) Validate() error {
+	if q.Bytes <= 0 {
+		return fmt.Errorf("quota bytes must be positive")
+	}
+	switch q.ResetPeriod {
+	case "", QuotaResetNever, QuotaResetDaily:
+	case QuotaResetWeekly:
+		if q.ResetDay < 0 || q.ResetDay > 6 {
+			return fmt.Errorf("invalid weekly quota reset day: %d", q.ResetDay)
+		}
+	case QuotaResetMonthly:
+		if q.ResetDay < 0 || q.ResetDay > 31 {
+			return fmt.Errorf("invalid monthly quota reset day: %d", q.ResetDay)
+		}
+	default:
+		return fmt.Errorf("invalid quota reset period: %s", q.ResetPeriod)
+	}
+	return nil
+}
+
+// PeriodStart returns when the period holding now started, in the local
+// time zone. It is zero for quotas that never reset.
+func (q *QuotaConfig) PeriodStart(now time.Time) time.Time {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	switch q.ResetPeriod {
+	case QuotaResetDaily:
+		return today
+	case QuotaResetWeekly:
+		days := (int(now.Weekday()) - q.ResetDay + 7) % 7
+		return today.AddDate(0, 0, -days)
+	case QuotaResetMonthly:
+		start := q.monthlyReset(now.Year(), now.Month(), now.Location())
+		if start.After(now) {
+			start = q.monthlyReset(now.Year(), now.Month()-1, now.Location())
+		}
+		return start
+	default:
+		return time.Time{}
+	}
+}
+
+// NextReset returns when the period holding now ends, zero for quotas that
+// never reset.
+func (q *QuotaConfig) NextReset(now time.Time) time.Time {
+	start := q.PeriodStart(now)
+	switch q.ResetPeriod {
+	case QuotaResetDaily:
+		return start.AddDate(0, 0, 1)
+	case QuotaResetWeekly:
+		return start.AddDate(0, 0, 7)
+	case QuotaResetMonthly:
+		return q.monthlyReset(start.Year(), start.Month()+1, start.Location())
+	default:
+		return time.Time{}
+	}
+}
+
+// monthlyReset returns the reset day of month, month out of 1-12 is
+// normalized like time.Date does.
+func (q *QuotaConfig) monthlyReset(year int, month time.Month, loc *time.Location) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, loc)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	day := min(max(q.ResetDay, 1), lastDay)
+	return first.AddDate(0, 0, day-1)
+}
@@ -0,0 +1,133 @@
+package conf
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/lb"
+)
+
+// RouteConfig sends the tcp conns whose sniffed tls sni or http host
+// matches to its own remotes, conns no route matches go to the remotes of
+// the rule. Routes are tried in order and the first match wins, tls is
+// routed without being terminated.
+type RouteConfig struct {
+	// exact hostnames or *.example.com for the subdomains of example.com,
+	// empty matches any host
+	Hosts []string `json:"hosts,omitempty"`
+	// http only, the request path must start with it
+	PathPrefix string `json:"path_prefix,omitempty"`
+
+	Remotes []string `json:"remotes"`
+}
+
+func (rc *RouteConfig) Clone() *RouteConfig {
+	return &RouteConfig{
+		Hosts:      slices.Clone(rc.Hosts),
+		PathPrefix: rc.PathPrefix,
+		Remotes:    slices.Clone(rc.Remotes),
+	}
+}
+
+func (rc *RouteConfig) Validate() error {
+	if len(rc.Hosts) == 0 && rc.PathPrefix == "" {
+		return fmt.Errorf("route needs hosts or path_prefix")
+	}
+	for _, host := range rc.Hosts {
+		name := strings.TrimPrefix(host, "*.")
+		if name == "" || strings.Contains(name, "*") {
+			return fmt.Errorf("invalid route host: %s", host)
+		}
+	}
+	if rc.PathPrefix != "" && !strings.HasPrefix(rc.PathPrefix, "/") {
+		return fmt.Errorf("route path_prefix must start with /: %s", rc.PathPrefix)
+	}
+	if len(rc.Remotes) == 0 {
+		return fmt.Errorf("route for %v has no remotes", rc.Hosts)
+	}
+	for _, addr := range rc.Remotes {
+		if addr == "" {
+			return fmt.Errorf("invalid route remote addr: %s", addr)
+		}
+	}
+	return nil
+}
+
+func (rc *RouteConfig) Equal(o *RouteConfig) bool {
+	return slices.Equal(rc.Hosts, o.Hosts) && rc.PathPrefix == o.PathPrefix && slices.Equal(rc.Remotes, o.Remotes)
+}
+
+// MatchHost reports whether host(without port) matches one of the hosts
+// of the route, an empty host only matches a route without hosts.
+func (rc *RouteConfig) MatchHost(host string) bool {
+	if len(rc.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return false
+	}
+	for _, h := range rc.Hosts {
+		h = strings.ToLower(h)
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == h {
+			return true
+		}
+	}
+	return false
+}
+
+// ToRemotesLB builds the balancer of the route with the lb settings of the rule.
+func (rc *RouteConfig) ToRemotesLB(r *Config, counter lb.ActiveCounter) (lb.Balancer, error) {
+	nodes := make([]*lb.Node, len(rc.Remotes))
+	for idx, addr := range rc.Remotes {
+		nodes[idx] = &lb.Node{Address: addr, Weight: r.Options.RemoteWeights[addr]}
+	}
+	return lb.NewBalancer(nodes, &lb.Config{
+		Strategy:  r.Options.LBStrategy,
+		Counter:   counter,
+		StickyTTL: time.Duration(r.Options.StickyTTLSec) * time.Second,
+	})
+}
+
+// RoutesDifferent reports whether the routes changed, the running relay
+// swaps them in place instead of restarting.
+func (r *Config) RoutesDifferent(new *Config) bool {
+	return !slices.EqualFunc(r.Options.Routes, new.Options.Routes, (*RouteConfig).Equal)
+}
+
+func (r *Config) validateRoutes() error {
+	if len(r.Options.Routes) == 0 {
+		return nil
+	}
+	switch r.ListenType {
+	case constant.RelayTypeRaw, constant.RelayTypeWS, constant.RelayTypeWSS,
+		constant.RelayTypeTLS, constant.RelayTypeMux, constant.RelayTypeQuic:
+	default:
+		return fmt.Errorf("%s listen type does not support routes", r.ListenType)
+	}
+	if len(r.Remotes) == 0 {
+		return fmt.Errorf("remotes are the default route and must be set with routes")
+	}
+	for _, rc := range r.Options.Routes {
+		if err := rc.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allRemotes returns the remotes of the rule followed by those of the routes.
+func (r *Config) allRemotes() []string {
+	all := slices.Clone(r.Remotes)
+	for _, rc := range r.Options.Routes {
+		all = append(all, rc.Remotes...)
+	}
+	return all
+}
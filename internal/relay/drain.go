@@ -0,0 +1,26 @@
+package relay
+
+import (
+	"sort"
+
+	"github.com/Ehco1996/ehco/internal/glue"
+)
+
+var _ glue.Drainer = (*Server)(nil)
+
+func (s *Server) ListDraining() []glue.DrainingRelay {
+	res := []glue.DrainingRelay{}
+	s.drainingM.Range(func(key, value interface{}) bool {
+		if d, ok := key.(*Relay).Draining(); ok {
+			res = append(res, d)
+		}
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].RelayLabel != res[j].RelayLabel {
+			return res[i].RelayLabel < res[j].RelayLabel
+		}
+		return res[i].StartedAt.Before(res[j].StartedAt)
+	})
+	return res
+}
@@ -3,6 +3,7 @@ package relay
 import (
 	"context"
 	"fmt"
+	"sort"
 
 	"github.com/Ehco1996/ehco/internal/glue"
 )
@@ -17,3 +18,20 @@ func (r *Server) HealthCheck(ctx context.Context, relayID string) (int64, error)
 	inner, _ := rs.(*Relay)
 	return inner.relayServer.HealthCheck(ctx)
 }
+
+func (r *Server) ListRemoteStatus(relayID string) ([]glue.RemoteStatus, error) {
+	if relayID != "" {
+		rs, ok := r.relayM.Load(relayID)
+		if !ok {
+			return nil, fmt.Errorf("label for relay: %s not found", relayID)
+		}
+		return rs.(*Relay).RemoteStatus(), nil
+	}
+	res := []glue.RemoteStatus{}
+	r.relayM.Range(func(key, value interface{}) bool {
+		res = append(res, value.(*Relay).RemoteStatus()...)
+		return true
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].RelayLabel < res[j].RelayLabel })
+	return res, nil
+}
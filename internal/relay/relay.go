@@ -2,10 +2,15 @@ package relay
 
 import (
 	"context"
+	"errors"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/Ehco1996/ehco/internal/cmgr"
+	"github.com/Ehco1996/ehco/internal/glue"
+	"github.com/Ehco1996/ehco/internal/lb"
 	"github.com/Ehco1996/ehco/internal/relay/conf"
 	"github.com/Ehco1996/ehco/internal/transporter"
 )
@@ -15,6 +20,17 @@ type Relay struct {
 	l   *zap.SugaredLogger
 
 	relayServer transporter.RelayServer
+
+	// stop background health check and quota saving when relay stopped
+	hcCtx    context.Context
+	hcCancel context.CancelFunc
+	// the listeners and tunnels of the relay, cancelled once it is drained
+	serveCtx    context.Context
+	serveCancel context.CancelFunc
+
+	drainMu       sync.Mutex
+	drainStart    time.Time
+	drainDeadline time.Time
 }
 
 func (r *Relay) UniqueID() string {
@@ -32,18 +48,140 @@ func NewRelay(cfg *conf.Config, cmgr cmgr.Cmgr) (*Relay, error) {
 		cfg:         cfg,
 		l:           zap.S().Named("relay"),
 	}
+	r.hcCtx, r.hcCancel = context.WithCancel(context.Background())
+	r.serveCtx, r.serveCancel = context.WithCancel(context.Background())
 	return r, nil
 }
 
+// ListenAndServe serves until the relay is stopped by Shutdown or Stop, a
+// done ctx does not stop it so the conns can be drained after it.
 func (r *Relay) ListenAndServe(ctx context.Context) error {
 	errCh := make(chan error)
+	go r.relayServer.RunHealthCheck(r.hcCtx)
+	go r.relayServer.RunQuota(r.hcCtx)
 	go func() {
 		r.l.Infof("Start Relay Server: %s", r.cfg.DefaultLabel())
-		errCh <- r.relayServer.ListenAndServe(ctx)
+		errCh <- r.relayServer.ListenAndServe(r.serveCtx)
 	}()
 	return <-errCh
 }
 
+func (r *Relay) RemoteStatus() []glue.RemoteStatus {
+	nodes := r.relayServer.ListRemotes()
+	res := make([]glue.RemoteStatus, 0, len(nodes))
+	for _, n := range nodes {
+		res = append(res, glue.RemoteStatus{
+			RelayLabel:       r.cfg.Label,
+			Address:          n.Address,
+			Weight:           n.GetWeight(),
+			Ejected:          n.Ejected(),
+			EjectedUntil:     n.EjectedUntil(),
+			ConsecutiveFails: n.ConsecutiveFails(),
+			LatencyMs:        n.EWMALatency().Milliseconds(),
+			Healthy:          n.Healthy(),
+			HealthHistory:    toHealthSamples(n.HealthHistory()),
+		})
+	}
+	return res
+}
+
+// UpdateRoutes swaps the routes of the running relay server.
+func (r *Relay) UpdateRoutes(routes []*conf.RouteConfig) error {
+	return r.relayServer.UpdateRoutes(routes)
+}
+
+// UpdateACL rebuilds the client ip acl from cfg, reading its cidr files
+// again, the old acl is kept when that fails.
+func (r *Relay) UpdateACL(cfg *conf.Config) error {
+	acl, err := cfg.ToACL()
+	if err != nil {
+		return err
+	}
+	r.relayServer.UpdateACL(acl)
+	return nil
+}
+
+func (r *Relay) LimitedClients() []glue.LimitedClient {
+	clients := r.relayServer.ListLimitedClients()
+	res := make([]glue.LimitedClient, 0, len(clients))
+	for _, c := range clients {
+		res = append(res, glue.LimitedClient{
+			RelayLabel:     r.cfg.Label,
+			IP:             c.IP,
+			ActiveConns:    c.ActiveConns,
+			Rejected:       c.Rejected,
+			LastRejectedAt: c.LastRejectedAt,
+			BannedUntil:    c.BannedUntil,
+		})
+	}
+	return res
+}
+
+func (r *Relay) UnbanClient(ip string) bool {
+	return r.relayServer.UnbanClient(ip)
+}
+
+// StopAccepting closes the listeners of the relay, so another relay can
+// listen on its address, and rejects new conns. Drain has to follow.
+func (r *Relay) StopAccepting() error {
+	r.drainMu.Lock()
+	if r.drainStart.IsZero() {
+		r.drainStart = time.Now()
+	}
+	r.drainMu.Unlock()
+	return r.relayServer.StopAccepting()
+}
+
+// Drain waits for the conns being relayed until ctx is done, closes the
+// rest and then the relay.
+func (r *Relay) Drain(ctx context.Context) error {
+	r.drainMu.Lock()
+	r.drainDeadline, _ = ctx.Deadline()
+	r.drainMu.Unlock()
+	if n := r.relayServer.Drain(ctx); n > 0 {
+		r.l.Warnf("relay %s closed %d conns not finished in the drain timeout", r.cfg.Label, n)
+	}
+	err := r.relayServer.Close()
+	r.serveCancel()
+	// the quota usage of the drained conns is saved on the way out
+	r.hcCancel()
+	return err
+}
+
+// Shutdown stops accepting and drains the relay until ctx is done.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	return errors.Join(r.StopAccepting(), r.Drain(ctx))
+}
+
+// Stop closes the relay and its conns now.
 func (r *Relay) Stop() error {
-	return r.relayServer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return r.Shutdown(ctx)
+}
+
+// Draining returns the drain state of the relay, false when it still accepts.
+func (r *Relay) Draining() (glue.DrainingRelay, bool) {
+	r.drainMu.Lock()
+	defer r.drainMu.Unlock()
+	if r.drainStart.IsZero() {
+		return glue.DrainingRelay{}, false
+	}
+	return glue.DrainingRelay{
+		RelayLabel:  r.cfg.Label,
+		ActiveConns: r.relayServer.ActiveConns(),
+		StartedAt:   r.drainStart,
+		Deadline:    r.drainDeadline,
+	}, true
+}
+
+func toHealthSamples(history []lb.HealthSample) []glue.HealthSample {
+	res := make([]glue.HealthSample, len(history))
+	for i, h := range history {
+		res[i] = glue.HealthSample{At: h.At, Up: h.Err == nil, LatencyMs: h.Latency.Milliseconds()}
+		if h.Err != nil {
+			res[i].Error = h.Err.Error()
+		}
+	}
+	return res
 }
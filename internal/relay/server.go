@@ -21,6 +21,10 @@ type Server struct {
 	cfg    *config.Config
 	l      *zap.SugaredLogger
 
+	// relays that stopped accepting and drain their conns, k: *Relay
+	drainingM *sync.Map
+	drainWG   sync.WaitGroup
+
 	errCH    chan error    // once error happen, server will exit
 	reloadCH chan struct{} // reload config
 
@@ -33,6 +37,8 @@ func NewServer(cfg *config.Config) (*Server, error) {
 		SyncURL:       cfg.RelaySyncURL,
 		SyncInterval:  cfg.RelaySyncInterval,
 		EnableMetrics: cfg.NeedStartWebServer(),
+		EnableQuota:   cfg.HasRelayQuota(),
+		MaxConnection: cfg.RelayMaxConnection,
 	}
 	cmgrCfg.Adjust()
 	cmgr, err := cmgr.NewCmgr(cmgrCfg)
@@ -40,12 +46,13 @@ func NewServer(cfg *config.Config) (*Server, error) {
 		return nil, err
 	}
 	s := &Server{
-		cfg:      cfg,
-		l:        l,
-		relayM:   &sync.Map{},
-		errCH:    make(chan error, 1),
-		reloadCH: make(chan struct{}, 1),
-		Cmgr:     cmgr,
+		cfg:       cfg,
+		l:         l,
+		relayM:    &sync.Map{},
+		drainingM: &sync.Map{},
+		errCH:     make(chan error, 1),
+		reloadCH:  make(chan struct{}, 1),
+		Cmgr:      cmgr,
 	}
 	return s, nil
 }
@@ -60,9 +67,25 @@ func (s *Server) startOneRelay(ctx context.Context, r *Relay) {
 	}
 }
 
+// stopOneRelay stops r accepting right away, so a new relay can listen on
+// its address, and drains its conns in background up to the drain timeout.
 func (s *Server) stopOneRelay(r *Relay) {
-	_ = r.Stop()
 	s.relayM.Delete(r.UniqueID())
+	if err := r.StopAccepting(); err != nil {
+		s.l.Errorf("stop relay %s accepting meet error: %s", r.UniqueID(), err)
+	}
+	s.drainingM.Store(r, struct{}{})
+	s.drainWG.Add(1)
+	timeout := s.cfg.RelayDrainTimeout()
+	go func() {
+		defer s.drainWG.Done()
+		defer s.drainingM.Delete(r)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := r.Drain(ctx); err != nil {
+			s.l.Errorf("drain relay %s meet error: %s", r.UniqueID(), err)
+		}
+	}()
 }
 
 func (s *Server) Start(ctx context.Context) error {
@@ -95,16 +118,16 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 }
 
+// Stop stops every relay accepting and waits for their conns, including
+// those of relays stopped by reloads, up to the drain timeout.
 func (s *Server) Stop() error {
-	var err error
 	s.relayM.Range(func(key, value interface{}) bool {
-		r := value.(*Relay)
-		if e := r.Stop(); e != nil {
-			err = errors.Join(err, e)
-		}
+		s.stopOneRelay(value.(*Relay))
 		return true
 	})
-	return err
+	s.l.Infof("draining relay conns, up to %s", s.cfg.RelayDrainTimeout())
+	s.drainWG.Wait()
+	return nil
 }
 
 func (s *Server) TriggerReload() {
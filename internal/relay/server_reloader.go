@@ -25,6 +25,8 @@ func (s *Server) Reload(force bool) error {
 		return err
 	}
 
+	s.Cmgr.SetMaxConnection(s.cfg.RelayMaxConnection)
+
 	// find all new relay label
 	for _, newCfg := range s.cfg.RelayConfigs {
 		// start bread new relay that not in old relayM
@@ -69,6 +71,26 @@ func (s *Server) Reload(force bool) error {
 					continue
 				}
 				go s.startOneRelay(context.TODO(), r)
+			} else {
+				oldR := old.(*Relay)
+				if oldCfg.RoutesDifferent(newCfg) {
+					s.l.Infof("relay routes changed, update routes of relay name=%s", newCfg.Label)
+					if err := oldR.UpdateRoutes(newCfg.Options.Routes); err != nil {
+						s.l.Error("update routes meet error", zap.Error(err))
+					}
+				}
+				if oldCfg.BandwidthDifferent(newCfg) {
+					s.l.Infof("relay bandwidth changed, update bandwidth of relay name=%s", newCfg.Label)
+					if err := oldR.UpdateBandwidth(newCfg.Options.GetBandwidth()); err != nil {
+						s.l.Error("update bandwidth meet error", zap.Error(err))
+					}
+				}
+				// cidr files change without the config, so read them on every reload
+				if oldCfg.Options.HasACL() || newCfg.Options.HasACL() {
+					if err := oldR.UpdateACL(newCfg); err != nil {
+						s.l.Error("update acl meet error", zap.Error(err))
+					}
+				}
 			}
 		}
 	}
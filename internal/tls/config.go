@@ -0,0 +1,49 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// NewServerTLSConfig loads the cert/key pair from files, when they are empty
+// the built in self-signed cert is used so InitTlsCfg must be called first.
+func NewServerTLSConfig(certFile, keyFile string, alpn []string) (*tls.Config, error) {
+	cfg := &tls.Config{NextProtos: alpn}
+	if certFile == "" && keyFile == "" {
+		if DefaultTLSConfig == nil {
+			return nil, fmt.Errorf("default tls config not init")
+		}
+		cfg.Certificates = DefaultTLSConfig.Certificates
+		return cfg, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load cert/key pair failed: %w", err)
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	return cfg, nil
+}
+
+// NewClientTLSConfig verifies the server cert against the system roots,
+// or against caFile when given. serverName is used for SNI and verification.
+func NewClientTLSConfig(serverName, caFile string, alpn []string, insecureSkipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		NextProtos:         alpn,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no cert found in ca file: %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
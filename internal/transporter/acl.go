@@ -0,0 +1,74 @@
+package transporter
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+// UpdateACL swaps the client ip acl of the running relay, nil removes it.
+// Conns already accepted are kept.
+func (b *BaseRelayServer) UpdateACL(acl *conf.ACL) {
+	b.acl.Store(acl)
+}
+
+// allowClient checks the client address of a conn just accepted against
+// the acl and counts the rejected ones. Tcp conns are checked in their own
+// goroutine: the address of a proxy protocol conn is only known once its
+// header is read, which must not hold back the accept loop.
+func (b *BaseRelayServer) allowClient(addr net.Addr, connType string) bool {
+	acl := b.acl.Load()
+	if acl == nil || acl.Allowed(clientIP(addr)) {
+		return true
+	}
+	b.rejectClient(addr.String(), connType)
+	return false
+}
+
+// allowHTTPClient is allowClient for http requests, the rejected ones get
+// 403. The client address is the one ehco uses for the relayed conn.
+func (b *BaseRelayServer) allowHTTPClient(w http.ResponseWriter, req *http.Request, connType string) bool {
+	acl := b.acl.Load()
+	if acl == nil {
+		return true
+	}
+	addr := req.RemoteAddr
+	if src, ok := b.forwardedClient(req); ok {
+		addr = src.String()
+	}
+	if acl.Allowed(parseClientIP(addr)) {
+		return true
+	}
+	b.rejectClient(addr, connType)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
+func (b *BaseRelayServer) rejectClient(addr, connType string) {
+	b.l.Debugf("client %s rejected by acl", addr)
+	metrics.ACLRejectedConnectionCount.WithLabelValues(b.cfg.Label, connType).Inc()
+}
+
+// clientIP returns the ip of a client address, invalid when addr has none.
+func clientIP(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case nil:
+		return netip.Addr{}
+	}
+	return parseClientIP(addr.String())
+}
+
+func parseClientIP(addr string) netip.Addr {
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
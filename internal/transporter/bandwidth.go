@@ -0,0 +1,130 @@
+package transporter
+
+import (
+	"net"
+	"sync"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/Ehco1996/ehco/pkg/limiter"
+)
+
+// bandwidthPair is the upload and download bucket of one limit.
+type bandwidthPair struct {
+	up, down *limiter.Bandwidth
+}
+
+func newBandwidthPair(l conf.BandwidthLimit) *bandwidthPair {
+	return &bandwidthPair{up: limiter.NewBandwidth(l.UploadKbps), down: limiter.NewBandwidth(l.DownloadKbps)}
+}
+
+func (p *bandwidthPair) set(l conf.BandwidthLimit) {
+	p.up.SetKbps(l.UploadKbps)
+	p.down.SetKbps(l.DownloadKbps)
+}
+
+type ipBandwidth struct {
+	*bandwidthPair
+	conns int
+}
+
+// bandwidthLimiter holds the buckets of a rule: the one shared by all its
+// conns, one per client ip shared by the conns of that ip and one per conn.
+// It keeps the buckets of the conns relayed now so a limit change reaches
+// them.
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	cfg  conf.BandwidthConfig
+	rule *bandwidthPair
+	// k: ip
+	ips   map[string]*ipBandwidth
+	conns map[*bandwidthPair]struct{}
+}
+
+func newBandwidthLimiter(cfg conf.BandwidthConfig) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		cfg:   cfg,
+		rule:  newBandwidthPair(cfg.Rule),
+		ips:   make(map[string]*ipBandwidth),
+		conns: make(map[*bandwidthPair]struct{}),
+	}
+}
+
+// limit wraps c with the buckets of the rule, of ip and of its own, release
+// must be called when c is done. A tcp conn is returned as is when the rule
+// has no limit, so a raw relay can still splice it, and such a conn is not
+// limited by later changes either. A udp session is never spliced and is
+// always wrapped.
+func (l *bandwidthLimiter) limit(c net.Conn, ip string, datagram bool) (net.Conn, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !datagram && !l.cfg.Limited() {
+		return c, func() {}
+	}
+	own := newBandwidthPair(l.cfg.Conn)
+	l.conns[own] = struct{}{}
+	shared, ok := l.ips[ip]
+	if !ok {
+		shared = &ipBandwidth{bandwidthPair: newBandwidthPair(l.cfg.IP)}
+		l.ips[ip] = shared
+	}
+	shared.conns++
+
+	read := []*limiter.Bandwidth{own.up, shared.up, l.rule.up}
+	write := []*limiter.Bandwidth{own.down, shared.down, l.rule.down}
+	release := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.conns, own)
+		if shared.conns--; shared.conns == 0 {
+			delete(l.ips, ip)
+		}
+	}
+	if datagram {
+		return conn.NewRateLimitedDatagramConn(c, read, write), sync.OnceFunc(release)
+	}
+	return conn.NewRateLimitedConn(c, read, write), sync.OnceFunc(release)
+}
+
+// update changes the limits of the rule and of the conns relayed now.
+func (l *bandwidthLimiter) update(cfg conf.BandwidthConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	l.rule.set(cfg.Rule)
+	for _, shared := range l.ips {
+		shared.set(cfg.IP)
+	}
+	for own := range l.conns {
+		own.set(cfg.Conn)
+	}
+}
+
+func (l *bandwidthLimiter) limits() conf.BandwidthConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cfg
+}
+
+// UpdateBandwidth changes the bandwidth limits of the running relay, udp
+// sessions relayed now included and tcp conns relayed now when the rule had
+// a limit when they started.
+func (b *BaseRelayServer) UpdateBandwidth(cfg conf.BandwidthConfig) {
+	b.bandwidth.update(cfg)
+	b.l.Infof("bandwidth limits updated: %+v", cfg)
+}
+
+func (b *BaseRelayServer) GetBandwidth() conf.BandwidthConfig {
+	return b.bandwidth.limits()
+}
+
+// applyRateLimit limits the tcp conn c from a client, release must be called
+// when c is done.
+func (b *BaseRelayServer) applyRateLimit(c net.Conn) (net.Conn, func()) {
+	return b.bandwidth.limit(c, clientIP(c.RemoteAddr()).String(), false)
+}
+
+// applyUDPRateLimit is applyRateLimit for the udp session c.
+func (b *BaseRelayServer) applyUDPRateLimit(c net.Conn) (net.Conn, func()) {
+	return b.bandwidth.limit(c, clientIP(c.RemoteAddr()).String(), true)
+}
@@ -2,8 +2,12 @@ package transporter
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -14,6 +18,7 @@ import (
 	"github.com/Ehco1996/ehco/internal/lb"
 	"github.com/Ehco1996/ehco/internal/metrics"
 	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/Ehco1996/ehco/pkg/iptrie"
 )
 
 var _ RelayServer = &BaseRelayServer{}
@@ -23,8 +28,19 @@ type BaseRelayServer struct {
 	cfg  *conf.Config
 	l    *zap.SugaredLogger
 
-	remotes lb.RoundRobin
-	relayer RelayClient
+	remotes     lb.Balancer
+	counter     lb.ActiveCounter
+	routes      atomic.Pointer[[]*route]
+	acl         atomic.Pointer[conf.ACL]
+	ipLimiter   *ipLimiter
+	bandwidth   *bandwidthLimiter
+	quota       *cmgr.Quota
+	ejectPolicy *lb.EjectPolicy
+	relayer     RelayClient
+	relayConns  relayConns
+
+	// nil when every peer may set X-Forwarded-For
+	trustedProxies *iptrie.Trie
 }
 
 func newBaseRelayServer(cfg *conf.Config, cmgr cmgr.Cmgr) (*BaseRelayServer, error) {
@@ -32,110 +48,299 @@ func newBaseRelayServer(cfg *conf.Config, cmgr cmgr.Cmgr) (*BaseRelayServer, err
 	if err != nil {
 		return nil, err
 	}
-	return &BaseRelayServer{
-		relayer: relayer,
-		cfg:     cfg,
-		cmgr:    cmgr,
-		remotes: cfg.ToRemotesLB(),
-		l:       zap.S().Named(cfg.GetLoggerName()),
-	}, nil
+	var counter lb.ActiveCounter
+	if cmgr != nil {
+		counter = func(n *lb.Node) int { return cmgr.GetActiveConnectCntByRemote(cfg.Label, n.Address) }
+	}
+	remotes, err := cfg.ToRemotesLB(counter)
+	if err != nil {
+		return nil, err
+	}
+	b := &BaseRelayServer{
+		relayer:     relayer,
+		cfg:         cfg,
+		cmgr:        cmgr,
+		remotes:     remotes,
+		counter:     counter,
+		ipLimiter:   newIPLimiter(cfg.Options),
+		bandwidth:   newBandwidthLimiter(cfg.Options.GetBandwidth()),
+		quota:       newQuota(cfg, cmgr),
+		ejectPolicy: cfg.GetEjectPolicy(),
+		l:           zap.S().Named(cfg.GetLoggerName()),
+	}
+	routes, err := b.buildRoutes(cfg.Options.Routes, nil)
+	if err != nil {
+		return nil, err
+	}
+	b.routes.Store(&routes)
+	acl, err := cfg.ToACL()
+	if err != nil {
+		return nil, err
+	}
+	b.acl.Store(acl)
+	if b.trustedProxies, err = cfg.ToTrustedProxies(); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 func (b *BaseRelayServer) RelayTCPConn(ctx context.Context, c net.Conn, remote *lb.Node) error {
+	ctx, slots, err := b.acquireConnSlots(ctx)
+	if err != nil {
+		return err
+	}
+	defer slots.release()
+	if err := b.checkQuota(metrics.METRIC_CONN_TYPE_TCP); err != nil {
+		return err
+	}
+	release, err := b.acquireClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if b.sniffEnabled() || len(*b.routes.Load()) > 0 {
+		var peek []byte
+		c, peek = b.peek(c)
+		res := sniff(peek, false)
+		if err := b.checkProtocol(res.Protocol, metrics.METRIC_CONN_TYPE_TCP); err != nil {
+			return err
+		}
+		// remotes set by the client are not routed
+		if b.poolOf(remote) == b.remotes {
+			if routed := b.routeRemote(res, c.RemoteAddr().String()); routed != nil {
+				remote = routed
+			}
+		}
+	}
+
+	c, unlimit := b.applyRateLimit(c)
+	defer unlimit()
+
+	remote, err = b.pickRemote(ctx, remote)
+	if err != nil {
+		return err
+	}
+	rc, remote, err := b.handShake(withSource(ctx, c), remote, true)
+	if err != nil {
+		return fmt.Errorf("handshake error: %w", err)
+	}
+	defer rc.Close()
+
 	labels := []string{b.cfg.Label, metrics.METRIC_CONN_TYPE_TCP, remote.Address}
 	metrics.CurConnectionCount.WithLabelValues(labels...).Inc()
 	defer metrics.CurConnectionCount.WithLabelValues(labels...).Dec()
 
-	if err := b.checkConnectionLimit(); err != nil {
+	b.l.Infof("RelayTCPConn from %s to %s", c.RemoteAddr(), remote.Address)
+	return b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_TCP, listenPortOpts(ctx)...)
+}
+
+func (b *BaseRelayServer) RelayUDPConn(ctx context.Context, c net.Conn, remote *lb.Node) error {
+	if err := b.checkQuota(metrics.METRIC_CONN_TYPE_UDP); err != nil {
 		return err
 	}
-
-	var err error
-	c, err = b.sniffAndBlockProtocol(c)
+	release, err := b.acquireClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_UDP)
 	if err != nil {
 		return err
 	}
-	c = b.applyRateLimit(c)
+	defer release()
 
-	rc, err := b.relayer.HandShake(ctx, remote, true)
+	opts := listenPortOpts(ctx)
+	// the session stats stay visible when c is wrapped to replay the sniffed
+	// datagram or to be rate limited
+	if s, ok := c.(conn.UDPSession); ok {
+		opts = append(opts, conn.WithUDPSession(s))
+	}
+	session, _ := c.(interface{ Done() <-chan struct{} })
+	if b.sniffEnabled() {
+		var peek []byte
+		c, peek = b.peekDatagram(c)
+		if err := b.checkProtocol(sniff(peek, true).Protocol, metrics.METRIC_CONN_TYPE_UDP); err != nil {
+			return err
+		}
+	}
+	c, unlimit := b.applyUDPRateLimit(c)
+	defer unlimit()
+
+	rc, remote, err := b.handShake(withSource(ctx, c), remote, false)
 	if err != nil {
 		return fmt.Errorf("handshake error: %w", err)
 	}
 	defer rc.Close()
-	b.l.Infof("RelayTCPConn from %s to %s", c.LocalAddr(), remote.Address)
-	return b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_TCP)
-}
+	if session != nil {
+		// the remote sends no eof, a session closed with its listener or
+		// for idling ends the relay right away
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-session.Done():
+				rc.Close()
+			case <-stop:
+			}
+		}()
+	}
 
-func (b *BaseRelayServer) RelayUDPConn(ctx context.Context, c net.Conn, remote *lb.Node) error {
 	labels := []string{b.cfg.Label, metrics.METRIC_CONN_TYPE_UDP, remote.Address}
 	metrics.CurConnectionCount.WithLabelValues(labels...).Inc()
 	defer metrics.CurConnectionCount.WithLabelValues(labels...).Dec()
 
-	rc, err := b.relayer.HandShake(ctx, remote, false)
-	if err != nil {
-		return fmt.Errorf("handshake error: %w", err)
-	}
-	defer rc.Close()
+	b.l.Infof("RelayUDPConn from %s to %s", c.RemoteAddr(), remote.Address)
+	return b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_UDP, opts...)
+}
 
-	b.l.Infof("RelayUDPConn from %s to %s", c.LocalAddr(), remote.Address)
-	return b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_UDP)
+// handShake dials remote, when it fails the node is marked for outlier
+// ejection and the next available remote of its pool, the rule or the
+// route it belongs to, is tried until all of them failed. The node that was finally used is returned.
+func (b *BaseRelayServer) handShake(ctx context.Context, remote *lb.Node, isTCP bool) (net.Conn, *lb.Node, error) {
+	var errs error
+	tried := make(map[*lb.Node]struct{})
+	for {
+		tried[remote] = struct{}{}
+		rc, err := b.relayer.HandShake(ctx, remote, isTCP)
+		if err == nil {
+			b.recordSuccess(remote)
+			return rc, remote, nil
+		}
+		errs = errors.Join(errs, fmt.Errorf("%s: %w", remote.Address, err))
+		// remote set by client(e.g. ws remote_addr query) is not in the pool, no failover
+		pool := b.poolOf(remote)
+		if pool == nil {
+			return nil, remote, errs
+		}
+		b.recordFailure(remote)
+		next := nextUntried(pool, tried, b.takeRemote(ctx))
+		if next == nil || ctx.Err() != nil {
+			return nil, remote, errs
+		}
+		b.l.Warnf("handshake to %s failed: %s, failover to %s", remote.Address, err, next.Address)
+		remote = next
+	}
 }
 
-func (b *BaseRelayServer) checkConnectionLimit() error {
-	if b.cmgr == nil {
-		return nil
+// nextUntried returns an available remote of pool that is not tried and
+// is taken by take, nil when there is none.
+func nextUntried(pool lb.Balancer, tried map[*lb.Node]struct{}, take func(*lb.Node) bool) *lb.Node {
+	all := pool.GetAll()
+	// ask the balancer first so failover still follows the strategy
+	for i := 0; i < len(all); i++ {
+		next := pool.Next()
+		if _, ok := tried[next]; !ok && next.Available() && take(next) {
+			return next
+		}
 	}
-	if b.cfg.Options.MaxConnection > 0 && b.cmgr.CountConnection(cmgr.ConnectionTypeActive) >= b.cfg.Options.MaxConnection {
-		return fmt.Errorf("relay:%s active connection count exceed limit %d", b.cfg.Label, b.cfg.Options.MaxConnection)
+	for _, next := range all {
+		if _, ok := tried[next]; !ok && next.Available() && take(next) {
+			return next
+		}
 	}
 	return nil
 }
 
+func (b *BaseRelayServer) recordFailure(remote *lb.Node) {
+	remote.RecordHandShakeFailure(b.cfg.Options.DialTimeout)
+	if remote.RecordFailure(b.ejectPolicy) {
+		b.l.Warnf("remote %s ejected until %s", remote.Address, remote.EjectedUntil().Format(time.DateTime))
+		metrics.RemoteEjected.WithLabelValues(b.cfg.Label, remote.Address).Set(1)
+		metrics.RemoteEjectionCount.WithLabelValues(b.cfg.Label, remote.Address).Inc()
+	}
+}
+
+func (b *BaseRelayServer) recordSuccess(remote *lb.Node) {
+	if remote.RecordSuccess() {
+		b.l.Infof("remote %s recovered", remote.Address)
+		metrics.RemoteEjected.WithLabelValues(b.cfg.Label, remote.Address).Set(0)
+	}
+}
+
+// sniffEnabled reports whether conns are checked against the blocked or
+// allowed protocols.
+func (b *BaseRelayServer) sniffEnabled() bool {
+	return len(b.cfg.Options.BlockedProtocols) > 0 || len(b.cfg.Options.AllowedProtocols) > 0
+}
+
 func (b *BaseRelayServer) sniffAndBlockProtocol(c net.Conn) (net.Conn, error) {
-	if len(b.cfg.Options.BlockedProtocols) == 0 {
+	if !b.sniffEnabled() {
 		return c, nil
 	}
+	c, peek := b.peek(c)
+	return c, b.checkProtocol(sniffProtocol(peek), metrics.METRIC_CONN_TYPE_TCP)
+}
 
+// peek reads the first bytes of c until the tls ClientHello or http request
+// head is complete, the buffer is full or the sniff timeout passed. The
+// returned conn replays them.
+func (b *BaseRelayServer) peek(c net.Conn) (net.Conn, []byte) {
 	if err := c.SetReadDeadline(time.Now().Add(b.cfg.Options.SniffTimeout)); err != nil {
 		b.l.Debugf("sniff: failed to set read deadline: %s", err)
 		return c, nil
 	}
 
 	peek := make([]byte, peekBufferSize)
-	n, err := c.Read(peek)
+	n := 0
+	for n < len(peek) {
+		m, err := c.Read(peek[n:])
+		n += m
+		if err != nil {
+			b.l.Debugf("sniff error: %s", err)
+			break
+		}
+		if sniffComplete(peek[:n]) {
+			break
+		}
+	}
 
 	// Reset deadline regardless of read result
 	_ = c.SetReadDeadline(time.Time{})
 
 	if n == 0 {
-		if err != nil {
-			b.l.Debugf("sniff error: %s", err)
-		}
 		return c, nil
 	}
 	peek = peek[:n]
+	return newPeekedConn(c, peek), peek
+}
 
-	protocol := sniffProtocol(peek)
-	if protocol != "" {
-		b.l.Infof("sniffed protocol: %s", protocol)
-		for _, p := range b.cfg.Options.BlockedProtocols {
-			if protocol == p {
-				return c, fmt.Errorf("relay:%s blocked protocol:%s", b.cfg.Label, protocol)
-			}
-		}
-	}
+// peekDatagram reads the first datagram of the udp session c within the
+// sniff timeout, the returned conn replays it.
+func (b *BaseRelayServer) peekDatagram(c net.Conn) (net.Conn, []byte) {
+	_ = c.SetReadDeadline(time.Now().Add(b.cfg.Options.SniffTimeout))
+	defer c.SetReadDeadline(time.Time{}) //nolint:errcheck
 
-	return newPeekedConn(c, peek), nil
+	buf := make([]byte, constant.MaxUDPDatagramSize)
+	n, err := c.Read(buf)
+	if err != nil {
+		b.l.Debugf("sniff error: %s", err)
+		return c, nil
+	}
+	// keep only the datagram, not the max sized buffer
+	peek := slices.Clone(buf[:n])
+	return newPeekedConn(c, peek), peek
 }
 
-func (b *BaseRelayServer) applyRateLimit(c net.Conn) net.Conn {
-	if b.cfg.Options.MaxReadRateKbps > 0 {
-		return conn.NewRateLimitedConn(c, b.cfg.Options.MaxReadRateKbps)
+// checkProtocol counts the sniffed protocol and rejects it when blocked or
+// not allowed, unknown protocols only pass when no allow list is set.
+func (b *BaseRelayServer) checkProtocol(protocol, connType string) error {
+	label := protocol
+	if protocol == "" {
+		label = metrics.METRIC_PROTOCOL_UNKNOWN
+	} else {
+		b.l.Infof("sniffed protocol: %s", protocol)
+	}
+	var err error
+	if slices.Contains(b.cfg.Options.BlockedProtocols, protocol) {
+		err = fmt.Errorf("relay:%s blocked protocol:%s", b.cfg.Label, label)
+	} else if len(b.cfg.Options.AllowedProtocols) > 0 && !slices.Contains(b.cfg.Options.AllowedProtocols, protocol) {
+		err = fmt.Errorf("relay:%s protocol:%s not allowed", b.cfg.Label, label)
+	}
+	action := metrics.METRIC_SNIFF_PASS
+	if err != nil {
+		action = metrics.METRIC_SNIFF_BLOCK
 	}
-	return c
+	metrics.SniffedConnectionCount.WithLabelValues(b.cfg.Label, connType, label, action).Inc()
+	return err
 }
 
-func (b *BaseRelayServer) handleRelayConn(c, rc net.Conn, remote *lb.Node, connType string) error {
+func (b *BaseRelayServer) handleRelayConn(c, rc net.Conn, remote *lb.Node, connType string, extra ...conn.RelayConnOption) error {
 	opts := []conn.RelayConnOption{
 		conn.WithLogger(b.l),
 		conn.WithRemote(remote),
@@ -143,7 +348,18 @@ func (b *BaseRelayServer) handleRelayConn(c, rc net.Conn, remote *lb.Node, connT
 		conn.WithRelayLabel(b.cfg.Label),
 		conn.WithRelayOptions(b.cfg.Options),
 	}
+	if b.quota != nil {
+		opts = append(opts, conn.WithQuota(b.quota))
+	}
+	if s, ok := c.(conn.UDPSession); ok {
+		opts = append(opts, conn.WithUDPSession(s))
+	}
+	opts = append(opts, extra...)
 	relayConn := conn.NewRelayConn(c, rc, opts...)
+	if err := b.addRelayConn(relayConn); err != nil {
+		return err
+	}
+	defer b.removeRelayConn(relayConn)
 	if b.cmgr != nil {
 		b.cmgr.AddConnection(relayConn)
 		defer b.cmgr.RemoveConnection(relayConn)
@@ -153,16 +369,46 @@ func (b *BaseRelayServer) handleRelayConn(c, rc net.Conn, remote *lb.Node, connT
 }
 
 func (b *BaseRelayServer) HealthCheck(ctx context.Context) (int64, error) {
-	remote := b.remotes.Next().Clone()
+	next := b.remotes.Next()
+	if next == nil {
+		return 0, fmt.Errorf("relay:%s has no remote to check", b.cfg.Label)
+	}
+	remote := next.Clone()
 	// us tcp handshake to check health
-	_, err := b.relayer.HandShake(ctx, remote, true)
-	return int64(remote.HandShakeDuration.Milliseconds()), err
+	rc, err := b.relayer.HandShake(ctx, remote, true)
+	if err != nil {
+		return 0, err
+	}
+	_ = rc.Close()
+	return int64(remote.HandShakeDuration().Milliseconds()), nil
+}
+
+// ListRemotes returns the remotes of the rule followed by those of the routes.
+func (b *BaseRelayServer) ListRemotes() []*lb.Node {
+	// clone, GetAll may return the slice of the balancer
+	nodes := slices.Clone(b.remotes.GetAll())
+	for _, r := range *b.routes.Load() {
+		nodes = append(nodes, r.remotes.GetAll()...)
+	}
+	return nodes
 }
 
 func (b *BaseRelayServer) Close() error {
 	return fmt.Errorf("not implemented")
 }
 
+func (b *BaseRelayServer) StopAccepting() error {
+	return fmt.Errorf("not implemented")
+}
+
+// closeRelayer releases resources held by the client side, e.g. pooled tunnels.
+func (b *BaseRelayServer) closeRelayer() error {
+	if c, ok := b.relayer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (b *BaseRelayServer) ListenAndServe(ctx context.Context) error {
 	return fmt.Errorf("not implemented")
 }
@@ -174,11 +420,24 @@ func NewNetDialer(cfg *conf.Config) *net.Dialer {
 }
 
 func NewTCPListener(ctx context.Context, cfg *conf.Config) (net.Listener, error) {
-	addr, err := net.ResolveTCPAddr("tcp", cfg.Listen)
+	return NewTCPListenerAt(ctx, cfg, cfg.Listen)
+}
+
+// NewTCPListenerAt listens on listen instead of cfg.Listen, e.g. one port
+// of a port range rule.
+func NewTCPListenerAt(ctx context.Context, cfg *conf.Config, listen string) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", listen)
 	if err != nil {
 		return nil, err
 	}
 	lcfg := net.ListenConfig{}
 	lcfg.SetMultipathTCP(cfg.Options.EnableMultipathTCP)
-	return lcfg.Listen(ctx, "tcp", addr.String())
+	l, err := lcfg.Listen(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Options.AcceptProxyProtocol {
+		l = wrapProxyProtoListener(l, cfg.Options.ReadTimeout)
+	}
+	return l, nil
 }
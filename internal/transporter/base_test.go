@@ -0,0 +1,53 @@
+package transporter
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseRelayServer_HandShakeFailover(t *testing.T) {
+	alive, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer alive.Close()
+
+	// grab a free port and close it so dialing it is refused
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	cfg := &conf.Config{
+		Listen:        "127.0.0.1:0",
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{deadAddr, alive.Addr().String()},
+		Options:       &conf.Options{MaxFails: 1},
+	}
+	require.NoError(t, cfg.Validate())
+	b, err := newBaseRelayServer(cfg, nil)
+	require.NoError(t, err)
+
+	dead0 := b.remotes.Next()
+	require.Equal(t, deadAddr, dead0.Address)
+	rc, used, err := b.handShake(context.Background(), dead0, true)
+	require.NoError(t, err)
+	defer rc.Close()
+	assert.Equal(t, alive.Addr().String(), used.Address)
+	assert.False(t, dead0.Available(), "dead remote should be ejected")
+
+	// ejected remote is skipped by the balancer
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, alive.Addr().String(), b.remotes.Next().Address)
+	}
+
+	// remote given by client is never failed over
+	_, _, err = b.handShake(context.Background(), &lb.Node{Address: deadAddr}, true)
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+package transporter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/Ehco1996/ehco/pkg/limiter"
+)
+
+// the slots of the node, of a rule label and of a remote of a rule label
+// live in cmgr, so the conns of a relay being drained still count against
+// the relay restarted with the same label.
+const nodeSlotKey = "node"
+
+func ruleSlotKey(label string) string { return "rule/" + label }
+
+func remoteSlotKey(label, addr string) string { return "remote/" + label + "/" + addr }
+
+// connSlots are the conn limit slots a tcp conn holds from before its
+// handshake until its relay ends, so the conns still being set up count
+// against the limits too.
+type connSlots struct {
+	slots *limiter.ConnSlots
+	keys  []string
+	// key of the remote slot, empty when remotes are not limited
+	remote string
+}
+
+func (s *connSlots) release() {
+	if s == nil {
+		return
+	}
+	for _, key := range s.keys {
+		s.slots.Release(key)
+	}
+	if s.remote != "" {
+		s.slots.Release(s.remote)
+	}
+}
+
+type connSlotsCtxKey struct{}
+
+func withConnSlots(ctx context.Context, s *connSlots) context.Context {
+	return context.WithValue(ctx, connSlotsCtxKey{}, s)
+}
+
+func connSlotsFrom(ctx context.Context) *connSlots {
+	s, _ := ctx.Value(connSlotsCtxKey{}).(*connSlots)
+	return s
+}
+
+// acquireConnSlots takes the node and rule slots of a new tcp conn, both
+// or none, so a conn queued for a full rule holds no node slot the other
+// rules could use. The slots go with the returned ctx, pickRemote and the
+// failover of handShake take the remote slot with it.
+func (b *BaseRelayServer) acquireConnSlots(ctx context.Context) (context.Context, *connSlots, error) {
+	if b.cmgr == nil {
+		return ctx, nil, nil
+	}
+	s := &connSlots{slots: b.cmgr.ConnSlots()}
+	node := limiter.Slot{Key: nodeSlotKey, Max: b.cmgr.MaxConnection()}
+	rule := limiter.Slot{Key: ruleSlotKey(b.cfg.Label), Max: b.cfg.Options.MaxConnection}
+	full := func() (string, error) {
+		if node.Max > 0 && s.slots.Count(node.Key) >= node.Max {
+			return metrics.METRIC_CONN_LIMIT_NODE,
+				fmt.Errorf("relay:%s node active connection count exceed limit %d", b.cfg.Label, node.Max)
+		}
+		return metrics.METRIC_CONN_LIMIT_RULE,
+			fmt.Errorf("relay:%s active connection count exceed limit %d", b.cfg.Label, rule.Max)
+	}
+	take := func() bool { return s.slots.TryAcquireAll(node, rule) }
+	wait := func(ctx context.Context) error { return s.slots.AcquireAll(ctx, node, rule) }
+	if err := b.waitConnSlot(ctx, take, wait, full); err != nil {
+		return ctx, nil, err
+	}
+	s.keys = []string{node.Key, rule.Key}
+	return withConnSlots(ctx, s), s, nil
+}
+
+// pickRemote returns remote or, when it has max_conns_per_remote active
+// conns, another available remote of its pool with room, and takes the
+// slot of the remote returned. Remotes set by the client are not limited.
+func (b *BaseRelayServer) pickRemote(ctx context.Context, remote *lb.Node) (*lb.Node, error) {
+	s := connSlotsFrom(ctx)
+	limit := b.cfg.Options.MaxConnsPerRemote
+	if s == nil || limit <= 0 {
+		return remote, nil
+	}
+	pool := b.poolOf(remote)
+	if pool == nil {
+		return remote, nil
+	}
+	nodes := []*lb.Node{remote}
+	keys := []string{remoteSlotKey(b.cfg.Label, remote.Address)}
+	for _, n := range pool.GetAll() {
+		if n != remote && n.Available() {
+			nodes = append(nodes, n)
+			keys = append(keys, remoteSlotKey(b.cfg.Label, n.Address))
+		}
+	}
+	var key string
+	take := func() (ok bool) {
+		key, ok = s.slots.TryAcquire(limit, keys...)
+		return ok
+	}
+	wait := func(ctx context.Context) (err error) {
+		key, err = s.slots.Acquire(ctx, limit, keys...)
+		return err
+	}
+	full := func() (string, error) {
+		return metrics.METRIC_CONN_LIMIT_REMOTE, fmt.Errorf("relay:%s every remote has %d active connections", b.cfg.Label, limit)
+	}
+	if err := b.waitConnSlot(ctx, take, wait, full); err != nil {
+		return nil, err
+	}
+	s.remote = key
+	for i, k := range keys {
+		if k == key {
+			return nodes[i], nil
+		}
+	}
+	return remote, nil
+}
+
+// takeRemote returns the check of the remotes to fail over to: a remote
+// without room is skipped and the remote slot of the conn moves to the one
+// taken.
+func (b *BaseRelayServer) takeRemote(ctx context.Context) func(*lb.Node) bool {
+	s := connSlotsFrom(ctx)
+	if s == nil || s.remote == "" {
+		return func(*lb.Node) bool { return true }
+	}
+	return func(n *lb.Node) bool {
+		key, ok := s.slots.TryAcquire(b.cfg.Options.MaxConnsPerRemote, remoteSlotKey(b.cfg.Label, n.Address))
+		if !ok {
+			return false
+		}
+		s.slots.Release(s.remote)
+		s.remote = key
+		return true
+	}
+}
+
+// waitConnSlot takes slots with take, full names the limit hit and returns
+// its error. With conn_overflow queue the conn waits for the slots with
+// wait up to conn_queue_timeout, otherwise full is returned at once.
+func (b *BaseRelayServer) waitConnSlot(ctx context.Context, take func() bool, wait func(context.Context) error, full func() (string, error)) error {
+	if take() {
+		return nil
+	}
+	queued := false
+	if b.cfg.Options.ConnOverflow == conf.ConnOverflowQueue {
+		qctx, cancel := context.WithTimeout(ctx, b.cfg.Options.ConnQueueTimeout)
+		defer cancel()
+		if wait(qctx) == nil {
+			return nil
+		}
+		queued = ctx.Err() == nil
+	}
+	limit, err := full()
+	if queued {
+		err = fmt.Errorf("%w, queued for %s", err, b.cfg.Options.ConnQueueTimeout)
+	}
+	metrics.ConnLimitRejectedConnectionCount.WithLabelValues(b.cfg.Label, limit).Inc()
+	return err
+}
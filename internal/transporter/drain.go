@@ -0,0 +1,154 @@
+package transporter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+)
+
+// ErrDraining rejects the new relay conns of a server being drained.
+var ErrDraining = errors.New("relay is draining")
+
+// relayConns are the relay conns of a server being relayed now.
+type relayConns struct {
+	mu       sync.Mutex
+	conns    map[conn.RelayConn]struct{}
+	draining bool
+	// closed once draining with no conns left
+	empty chan struct{}
+}
+
+// addRelayConn tracks rc until its transport ends, new conns are rejected
+// once the server drains.
+func (b *BaseRelayServer) addRelayConn(rc conn.RelayConn) error {
+	rcs := &b.relayConns
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+	if rcs.draining {
+		return ErrDraining
+	}
+	if rcs.conns == nil {
+		rcs.conns = make(map[conn.RelayConn]struct{})
+	}
+	rcs.conns[rc] = struct{}{}
+	return nil
+}
+
+func (b *BaseRelayServer) removeRelayConn(rc conn.RelayConn) {
+	rcs := &b.relayConns
+	rcs.mu.Lock()
+	defer rcs.mu.Unlock()
+	delete(rcs.conns, rc)
+	if rcs.draining && len(rcs.conns) == 0 {
+		closeOnce(rcs.empty)
+	}
+}
+
+// ActiveConns returns the number of conns being relayed now.
+func (b *BaseRelayServer) ActiveConns() int {
+	b.relayConns.mu.Lock()
+	defer b.relayConns.mu.Unlock()
+	return len(b.relayConns.conns)
+}
+
+// Drain rejects new relay conns and waits for the active ones to finish
+// until ctx is done, the rest are closed then. It returns the number of
+// conns closed by force, the server is closed after it so tunnels to the
+// remotes live as long as the conns over them.
+func (b *BaseRelayServer) Drain(ctx context.Context) int {
+	rcs := &b.relayConns
+	rcs.mu.Lock()
+	if !rcs.draining {
+		rcs.draining = true
+		rcs.empty = make(chan struct{})
+		if len(rcs.conns) == 0 {
+			close(rcs.empty)
+		}
+	}
+	empty := rcs.empty
+	rcs.mu.Unlock()
+
+	closed := 0
+	select {
+	case <-empty:
+	case <-ctx.Done():
+		rcs.mu.Lock()
+		left := make([]conn.RelayConn, 0, len(rcs.conns))
+		for rc := range rcs.conns {
+			left = append(left, rc)
+		}
+		rcs.mu.Unlock()
+		for _, rc := range left {
+			_ = rc.Close()
+		}
+		closed = len(left)
+	}
+	return closed
+}
+
+func closeOnce(ch chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// listeners are the sockets a server binds in ListenAndServe, they are
+// closed by StopAccepting and Close on another goroutine, e.g. a reload.
+// A socket bound after that is closed right away, so a stopped relay
+// never keeps its address.
+type listeners struct {
+	mu      sync.Mutex
+	closed  bool
+	closers []io.Closer
+}
+
+// add tracks c, once the listeners are closed it closes c and returns
+// net.ErrClosed.
+func (ls *listeners) add(c io.Closer) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.closed {
+		_ = c.Close()
+		return net.ErrClosed
+	}
+	ls.closers = append(ls.closers, c)
+	return nil
+}
+
+// close closes the sockets in the reverse order they were added.
+func (ls *listeners) close() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.closed = true
+	var err error
+	for i := len(ls.closers) - 1; i >= 0; i-- {
+		err = errors.Join(err, closeListener(ls.closers[i]))
+	}
+	return err
+}
+
+// closeListener closes l, one closed by StopAccepting already is no error.
+func closeListener(l io.Closer) error {
+	if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// stopHTTPServer closes the listeners of s, conns being served are left
+// to the drain.
+func stopHTTPServer(s *http.Server) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
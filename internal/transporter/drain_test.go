@@ -0,0 +1,106 @@
+package transporter
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+func TestBaseRelayServer_Drain(t *testing.T) {
+	cfg := &conf.Config{
+		Listen:        "127.0.0.1:0",
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{"127.0.0.1:1"},
+	}
+	require.NoError(t, cfg.Validate())
+	remote := &lb.Node{Address: "127.0.0.1:1"}
+
+	// relay returns the client end of a conn relayed to an echo remote and
+	// the end of the remote
+	relay := func(b *BaseRelayServer) (net.Conn, net.Conn, chan error) {
+		client, c := net.Pipe()
+		rc, echo := net.Pipe()
+		go func() { _, _ = io.Copy(echo, echo) }()
+		done := make(chan error, 1)
+		go func() { done <- b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_TCP) }()
+		require.Eventually(t, func() bool { return b.ActiveConns() > 0 }, time.Second, 10*time.Millisecond)
+		return client, echo, done
+	}
+	ping := func(c net.Conn) error {
+		if _, err := c.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := io.ReadFull(c, make([]byte, 4))
+		return err
+	}
+
+	t.Run("finished", func(t *testing.T) {
+		b, err := newBaseRelayServer(cfg, nil)
+		require.NoError(t, err)
+		client, echo, done := relay(b)
+
+		drained := make(chan int, 1)
+		go func() { drained <- b.Drain(context.Background()) }()
+		require.Eventually(t, func() bool {
+			b.relayConns.mu.Lock()
+			defer b.relayConns.mu.Unlock()
+			return b.relayConns.draining
+		}, time.Second, 10*time.Millisecond)
+		// the conn is relayed while draining, new ones are rejected
+		require.NoError(t, ping(client))
+		c, rc := net.Pipe()
+		defer c.Close()
+		defer rc.Close()
+		require.ErrorIs(t, b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_TCP), ErrDraining)
+
+		client.Close()
+		echo.Close()
+		<-done
+		require.Equal(t, 0, <-drained)
+		require.Equal(t, 0, b.ActiveConns())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		b, err := newBaseRelayServer(cfg, nil)
+		require.NoError(t, err)
+		client, echo, done := relay(b)
+		defer client.Close()
+		defer echo.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		require.Equal(t, 1, b.Drain(ctx))
+		require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+		<-done
+		require.Error(t, ping(client))
+	})
+}
+
+func TestListeners(t *testing.T) {
+	var ls listeners
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, ls.add(l1))
+	require.NoError(t, ls.close())
+	_, err = l1.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	// bound after the server was stopped, e.g. a reload during startup
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.ErrorIs(t, ls.add(l2), net.ErrClosed)
+	_, err = l2.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.NoError(t, ls.close())
+}
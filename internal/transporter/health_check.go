@@ -0,0 +1,158 @@
+package transporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+const echoProbeSize = 16
+
+// RunHealthCheck probes every remote of this relay on the configured
+// interval until ctx is done, returns at once when health check is off.
+func (b *BaseRelayServer) RunHealthCheck(ctx context.Context) {
+	hc := b.cfg.Options.HealthCheck
+	if hc == nil {
+		return
+	}
+	b.l.Infof("start health check type=%s interval=%s", hc.Type, hc.Interval)
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+	for {
+		b.probeAll(ctx, hc)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (b *BaseRelayServer) probeAll(ctx context.Context, hc *conf.HealthCheckConfig) {
+	var wg sync.WaitGroup
+	for _, node := range b.ListRemotes() {
+		wg.Add(1)
+		go func(node *lb.Node) {
+			defer wg.Done()
+			b.probeOne(ctx, hc, node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+func (b *BaseRelayServer) probeOne(ctx context.Context, hc *conf.HealthCheckConfig, node *lb.Node) {
+	probeCtx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+
+	t1 := time.Now()
+	err := b.probe(probeCtx, hc.Type, node)
+	latency := time.Since(t1)
+	if ctx.Err() != nil {
+		// relay is stopping, the result means nothing
+		return
+	}
+
+	if node.RecordProbe(lb.HealthSample{At: t1, Latency: latency, Err: err}, hc.Rise, hc.Fall) {
+		if node.Healthy() {
+			b.l.Infof("health check: remote %s is up", node.Address)
+		} else {
+			b.l.Warnf("health check: remote %s is down: %s", node.Address, err)
+		}
+	}
+	labels := []string{b.cfg.Label, node.Address}
+	if err != nil {
+		b.l.Debugf("health check: probe %s failed: %s", node.Address, err)
+	} else {
+		b.recordSuccess(node)
+		metrics.RemoteProbeLatencyMilliseconds.WithLabelValues(labels...).Set(float64(latency.Milliseconds()))
+	}
+	if node.Healthy() {
+		metrics.RemoteUp.WithLabelValues(labels...).Set(1)
+	} else {
+		metrics.RemoteUp.WithLabelValues(labels...).Set(0)
+	}
+}
+
+func (b *BaseRelayServer) probe(ctx context.Context, probeType string, node *lb.Node) error {
+	switch probeType {
+	case conf.HealthCheckTCP:
+		// a remote port range is probed on its first port
+		addr, err := probeAddr(conf.RemoteAddrAt(node.Address, 0))
+		if err != nil {
+			return err
+		}
+		c, err := NewNetDialer(b.cfg).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	case conf.HealthCheckHandShake:
+		rc, err := b.relayer.HandShake(ctx, node, true)
+		if err != nil {
+			return err
+		}
+		return rc.Close()
+	case conf.HealthCheckEcho:
+		rc, err := b.relayer.HandShake(ctx, node, true)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		return echoProbe(ctx, rc)
+	default:
+		return fmt.Errorf("unsupported health check type: %s", probeType)
+	}
+}
+
+func echoProbe(ctx context.Context, c net.Conn) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	payload := make([]byte, echoProbeSize)
+	_, _ = rand.Read(payload)
+	if _, err := c.Write(payload); err != nil {
+		return err
+	}
+	got := make([]byte, echoProbeSize)
+	if _, err := io.ReadFull(c, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(payload, got) {
+		return fmt.Errorf("echo probe payload mismatch")
+	}
+	return nil
+}
+
+// probeAddr turns a remote into host:port for tcp probe,
+// for ws remotes like wss://xxx.com/path the scheme decides the default port.
+func probeAddr(remote string) (string, error) {
+	if !strings.Contains(remote, "://") {
+		return remote, nil
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "", err
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	switch u.Scheme {
+	case "wss", "https":
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	default:
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+}
@@ -0,0 +1,78 @@
+package transporter
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeAddr(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"127.0.0.1:80", "127.0.0.1:80"},
+		{"ws://1.1.1.1:2000", "1.1.1.1:2000"},
+		{"ws://example.com/path", "example.com:80"},
+		{"wss://example.com", "example.com:443"},
+	}
+	for _, tt := range tests {
+		got, err := probeAddr(tt.remote)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got, tt.remote)
+	}
+}
+
+func TestBaseRelayServer_Probe(t *testing.T) {
+	echoL, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echoL.Close()
+	go func() {
+		for {
+			c, err := echoL.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	cfg := &conf.Config{
+		Listen:        "127.0.0.1:0",
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{echoL.Addr().String(), deadAddr},
+		Options:       &conf.Options{HealthCheck: &conf.HealthCheckConfig{Type: conf.HealthCheckEcho, Fall: 1}},
+	}
+	require.NoError(t, cfg.Validate())
+	b, err := newBaseRelayServer(cfg, nil)
+	require.NoError(t, err)
+
+	for _, typ := range []string{conf.HealthCheckTCP, conf.HealthCheckHandShake, conf.HealthCheckEcho} {
+		assert.NoError(t, b.probe(context.Background(), typ, b.remotes.GetAll()[0]), typ)
+		assert.Error(t, b.probe(context.Background(), typ, b.remotes.GetAll()[1]), typ)
+	}
+
+	b.probeAll(context.Background(), cfg.Options.HealthCheck)
+	nodes := b.ListRemotes()
+	assert.True(t, nodes[0].Healthy())
+	assert.False(t, nodes[1].Healthy())
+	// down remote is skipped by the balancer
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, nodes[0], b.remotes.Next())
+	}
+}
@@ -0,0 +1,199 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/web"
+)
+
+var _ RelayServer = &HTTPProxyServer{}
+
+const (
+	httpProxyRealm = "ehco"
+
+	httpProxyConnectOK  = "HTTP/1.1 200 Connection established\r\n\r\n"
+	httpProxyBadGateway = "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+)
+
+// hop-by-hop headers of the client side, not forwarded to the destination
+var httpProxyHopHeaders = []string{
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Connection",
+}
+
+// HTTPProxyServer handles CONNECT and absolute-uri requests, the destination
+// is reached through the raw/ws/wss relay client of the rule. Requests that
+// are not proxy requests are served by the web stack, like the ws server.
+type HTTPProxyServer struct {
+	*BaseRelayServer
+
+	httpServer *http.Server
+	direct     *lb.Node
+}
+
+func newHTTPProxyServer(bs *BaseRelayServer) (*HTTPProxyServer, error) {
+	s := &HTTPProxyServer{BaseRelayServer: bs, direct: &lb.Node{Address: directRemoteAddress}}
+	e := web.NewEchoServer()
+	e.Use(web.NginxLogMiddleware(zap.S().Named("http-proxy-server")))
+	e.GET("/", echo.WrapHandler(web.MakeIndexF()))
+	s.httpServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodConnect || r.URL.IsAbs() {
+				s.handleProxy(w, r)
+				return
+			}
+			e.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: bs.cfg.Options.ReadTimeout,
+	}
+	return s, nil
+}
+
+func (s *HTTPProxyServer) ListenAndServe(ctx context.Context) error {
+	listener, err := NewTCPListener(ctx, s.cfg)
+	if err != nil {
+		return err
+	}
+	s.httpServer.BaseContext = func(net.Listener) context.Context { return ctx }
+	return s.httpServer.Serve(listener)
+}
+
+func (s *HTTPProxyServer) StopAccepting() error {
+	return stopHTTPServer(s.httpServer)
+}
+
+func (s *HTTPProxyServer) Close() error {
+	return errors.Join(s.closeRelayer(), closeListener(s.httpServer))
+}
+
+func (s *HTTPProxyServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if !s.allowHTTPClient(w, r, metrics.METRIC_CONN_TYPE_TCP) {
+		return
+	}
+	pc := s.cfg.GetProxyConfig()
+	var user string
+	if pc.NeedAuth() {
+		u, pass, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+		if !ok || !pc.CheckUser(u, pass) {
+			s.l.Warnf("http proxy auth failed from %s user:%s", r.RemoteAddr, u)
+			w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", httpProxyRealm))
+			http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+			return
+		}
+		user = u
+	}
+
+	target := httpProxyTarget(r)
+	if target == "" {
+		http.Error(w, "missing destination host", http.StatusBadRequest)
+		return
+	}
+	if !pc.AllowDestination(target) {
+		s.l.Warnf("http proxy user:%s destination %s not allowed", user, target)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	// the head of an absolute-uri request is sent in origin form, the body
+	// is still in the client stream and relayed as is
+	var head []byte
+	if r.Method != http.MethodConnect {
+		head = httpProxyRequestHead(r)
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		s.l.Errorf("hijack conn from %s meet error: %s", r.RemoteAddr, err)
+		return
+	}
+	defer c.Close()
+	if n := brw.Reader.Buffered(); n > 0 || head != nil {
+		buffered, _ := brw.Reader.Peek(n)
+		c = newPeekedConn(c, append(head, buffered...))
+	}
+
+	remote := s.proxyRemote(s.direct, r.RemoteAddr)
+	err = s.relayProxyTCP(r.Context(), c, remote, target, user, func(_ net.Conn, err error) error {
+		if err != nil {
+			_, werr := c.Write([]byte(httpProxyBadGateway))
+			return werr
+		}
+		if r.Method == http.MethodConnect {
+			_, werr := c.Write([]byte(httpProxyConnectOK))
+			return werr
+		}
+		return nil
+	})
+	if err != nil {
+		s.l.Errorf("handleProxy meet error: %s", err)
+	}
+}
+
+// httpProxyTarget returns host:port of the destination, the port defaults
+// to the one of the scheme.
+func httpProxyTarget(r *http.Request) string {
+	host := r.URL.Host
+	if host == "" {
+		host = r.Host
+	}
+	if host == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if r.URL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// httpProxyRequestHead rebuilds the request line and headers in origin form,
+// the destination is asked to close the conn after this request so the next
+// one of the client may go to another host.
+func httpProxyRequestHead(r *http.Request) []byte {
+	for _, h := range httpProxyHopHeaders {
+		r.Header.Del(h)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.URL.RequestURI(), r.URL.Host)
+	if len(r.TransferEncoding) > 0 {
+		fmt.Fprintf(&buf, "Transfer-Encoding: %s\r\n", strings.Join(r.TransferEncoding, ", "))
+	}
+	r.Header.Write(&buf)
+	buf.WriteString("Connection: close\r\n\r\n")
+	return buf.Bytes()
+}
+
+func parseProxyAuth(auth string) (user, pass string, ok bool) {
+	encoded, found := strings.CutPrefix(auth, "Basic ")
+	if !found {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
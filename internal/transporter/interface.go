@@ -24,6 +24,12 @@ func newRelayClient(cfg *conf.Config) (RelayClient, error) {
 		return newWsClient(cfg)
 	case constant.RelayTypeWSS:
 		return newWssClient(cfg)
+	case constant.RelayTypeTLS:
+		return newTlsClient(cfg)
+	case constant.RelayTypeMux:
+		return newMuxClient(cfg)
+	case constant.RelayTypeQuic:
+		return newQuicClient(cfg)
 	default:
 		return nil, fmt.Errorf("unsupported transport type: %s", cfg.TransportType)
 	}
@@ -32,10 +38,34 @@ func newRelayClient(cfg *conf.Config) (RelayClient, error) {
 type RelayServer interface {
 	ListenAndServe(ctx context.Context) error
 	Close() error
+	// StopAccepting closes the listeners and leaves the conns being relayed
+	// to Drain, Close still has to be called after it
+	StopAccepting() error
+	// Drain waits for the relay conns until ctx is done and closes the rest,
+	// it returns the number closed by force
+	Drain(ctx context.Context) int
+	// conns being relayed now
+	ActiveConns() int
 
 	RelayTCPConn(ctx context.Context, c net.Conn, remote *lb.Node) error
 	RelayUDPConn(ctx context.Context, c net.Conn, remote *lb.Node) error
 	HealthCheck(ctx context.Context) (int64, error) // latency in ms
+	// RunHealthCheck probes all remotes in background until ctx is done
+	RunHealthCheck(ctx context.Context)
+	// RunQuota resets and saves the quota usage in background until ctx is done
+	RunQuota(ctx context.Context)
+	ListRemotes() []*lb.Node
+	// UpdateRoutes swaps the sni/host routes without restarting
+	UpdateRoutes(routes []*conf.RouteConfig) error
+	// UpdateACL swaps the client ip acl without restarting
+	UpdateACL(acl *conf.ACL)
+	// bandwidth limits are changed without restarting conns
+	GetBandwidth() conf.BandwidthConfig
+	UpdateBandwidth(cfg conf.BandwidthConfig)
+
+	// clients rejected by the per ip limits recently or banned now
+	ListLimitedClients() []LimitedClient
+	UnbanClient(ip string) bool
 }
 
 func NewRelayServer(cfg *conf.Config, cmgr cmgr.Cmgr) (RelayServer, error) {
@@ -50,6 +80,22 @@ func NewRelayServer(cfg *conf.Config, cmgr cmgr.Cmgr) (RelayServer, error) {
 		return newWsServer(base)
 	case constant.RelayTypeWSS:
 		return newWssServer(base)
+	case constant.RelayTypeTLS:
+		return newTlsServer(base)
+	case constant.RelayTypeMux:
+		return newMuxServer(base)
+	case constant.RelayTypeQuic:
+		return newQuicServer(base)
+	case constant.RelayTypeSocks5:
+		return newSocks5Server(base)
+	case constant.RelayTypeHTTPProxy:
+		return newHTTPProxyServer(base)
+	case constant.RelayTypeRedirect, constant.RelayTypeTProxy:
+		return newTProxyServer(base)
+	case constant.RelayTypeReverseServer:
+		return newReverseServer(base)
+	case constant.RelayTypeReverseAgent:
+		return newReverseAgent(base)
 	default:
 		panic("unsupported transport type" + cfg.ListenType)
 	}
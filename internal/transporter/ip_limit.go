@@ -0,0 +1,171 @@
+package transporter
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/Ehco1996/ehco/pkg/limiter"
+)
+
+// LimitedClient is a client ip rejected by the per ip limits recently or
+// banned now.
+type LimitedClient struct {
+	IP             string
+	ActiveConns    int
+	Rejected       int64
+	LastRejectedAt time.Time
+	BannedUntil    time.Time
+}
+
+type offender struct {
+	rejected       int64
+	lastRejectedAt time.Time
+}
+
+// ipLimiter enforces max_conns_per_ip and new_conns_per_ip_per_sec of a
+// rule, both tcp conns and udp sessions count.
+type ipLimiter struct {
+	conns *limiter.IPConnLimiter // nil without max_conns_per_ip
+	rate  *limiter.IPRateLimiter // nil without new_conns_per_ip_per_sec
+	bans  *limiter.BanList
+	ban   time.Duration
+
+	mu sync.Mutex
+	// k: ip
+	offenders map[string]*offender
+}
+
+// newIPLimiter returns nil when the rule has no per ip limit.
+func newIPLimiter(opts *conf.Options) *ipLimiter {
+	if opts.MaxConnsPerIP == 0 && opts.NewConnsPerIPPerSec == 0 {
+		return nil
+	}
+	l := &ipLimiter{
+		bans:      limiter.NewBanList(),
+		ban:       time.Duration(opts.BanSec) * time.Second,
+		offenders: make(map[string]*offender),
+	}
+	if opts.MaxConnsPerIP > 0 {
+		l.conns = limiter.NewIPConnLimiter(opts.MaxConnsPerIP)
+	}
+	if opts.NewConnsPerIPPerSec > 0 {
+		n := opts.NewConnsPerIPPerSec
+		l.rate = limiter.NewIPRateLimiter(rate.Limit(n), n, zap.L().Named("ip-limiter"))
+	}
+	return l
+}
+
+// acquire checks a new conn of ip, the returned release must be called when
+// the conn is done. The reason is one of metrics.METRIC_IP_LIMIT_*.
+func (l *ipLimiter) acquire(ip string) (release func(), reason string) {
+	if l.bans.Banned(ip) {
+		l.reject(ip, false)
+		return nil, metrics.METRIC_IP_LIMIT_BANNED
+	}
+	if l.rate != nil && !l.rate.CanServe(ip) {
+		l.reject(ip, true)
+		return nil, metrics.METRIC_IP_LIMIT_RATE
+	}
+	if l.conns == nil {
+		return func() {}, ""
+	}
+	if !l.conns.Acquire(ip) {
+		l.reject(ip, true)
+		return nil, metrics.METRIC_IP_LIMIT_MAX_CONNS
+	}
+	return sync.OnceFunc(func() { l.conns.Release(ip) }), ""
+}
+
+func (l *ipLimiter) reject(ip string, ban bool) {
+	if ban && l.ban > 0 {
+		l.bans.Ban(ip, l.ban)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, o := range l.offenders {
+		if now.Sub(o.lastRejectedAt) > constant.IPLimitOffenderTTL {
+			delete(l.offenders, k)
+		}
+	}
+	o, ok := l.offenders[ip]
+	if !ok {
+		o = &offender{}
+		l.offenders[ip] = o
+	}
+	o.rejected++
+	o.lastRejectedAt = now
+}
+
+func (l *ipLimiter) list() []LimitedClient {
+	bans := l.bans.List()
+	l.mu.Lock()
+	res := make([]LimitedClient, 0, len(l.offenders))
+	for ip, o := range l.offenders {
+		if time.Since(o.lastRejectedAt) > constant.IPLimitOffenderTTL && bans[ip].IsZero() {
+			continue
+		}
+		res = append(res, LimitedClient{IP: ip, Rejected: o.rejected, LastRejectedAt: o.lastRejectedAt})
+	}
+	l.mu.Unlock()
+	for ip, until := range bans {
+		idx := slices.IndexFunc(res, func(c LimitedClient) bool { return c.IP == ip })
+		if idx < 0 {
+			res = append(res, LimitedClient{IP: ip})
+			idx = len(res) - 1
+		}
+		res[idx].BannedUntil = until
+	}
+	for i := range res {
+		if l.conns != nil {
+			res[i].ActiveConns = l.conns.Count(res[i].IP)
+		}
+	}
+	slices.SortFunc(res, func(a, b LimitedClient) int { return strings.Compare(a.IP, b.IP) })
+	return res
+}
+
+// acquireClient applies the per ip limits to a new conn or udp session from
+// addr, release must be called when it is done.
+func (b *BaseRelayServer) acquireClient(addr net.Addr, connType string) (release func(), err error) {
+	if b.ipLimiter == nil {
+		return func() {}, nil
+	}
+	ip := clientIP(addr)
+	if !ip.IsValid() {
+		return func() {}, nil
+	}
+	release, reason := b.ipLimiter.acquire(ip.String())
+	if release == nil {
+		metrics.IPLimitRejectedConnectionCount.WithLabelValues(b.cfg.Label, connType, reason).Inc()
+		return nil, fmt.Errorf("relay:%s client %s rejected by per ip limit: %s", b.cfg.Label, ip, reason)
+	}
+	return release, nil
+}
+
+// ListLimitedClients returns the clients rejected by the per ip limits in
+// the last constant.IPLimitOffenderTTL and the banned ones.
+func (b *BaseRelayServer) ListLimitedClients() []LimitedClient {
+	if b.ipLimiter == nil {
+		return nil
+	}
+	return b.ipLimiter.list()
+}
+
+// UnbanClient lifts the ban of ip, false when it was not banned.
+func (b *BaseRelayServer) UnbanClient(ip string) bool {
+	if b.ipLimiter == nil {
+		return false
+	}
+	return b.ipLimiter.bans.Unban(ip)
+}
@@ -0,0 +1,305 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	mytls "github.com/Ehco1996/ehco/internal/tls"
+	"github.com/Ehco1996/ehco/pkg/mux"
+)
+
+// alpnMux is negotiated on every mux tunnel, so a mux client pointed at a
+// plain tls server fails fast instead of sending frames into a relay.
+const alpnMux = "ehco-mux"
+
+// stream meta, tells the server how to relay the stream
+const (
+	muxStreamTCP byte = iota
+	muxStreamUDP
+)
+
+var (
+	_ RelayClient = &MuxClient{}
+	_ RelayServer = &MuxServer{}
+)
+
+// MuxClient opens one stream per relay conn on a small pool of
+// long-lived tls tunnels, so only the first conn pays for the handshakes.
+type MuxClient struct {
+	*TlsClient
+	muxCfg *conf.MuxConfig
+
+	mu    sync.Mutex
+	pools map[string]*muxPool // k: remote address
+}
+
+func newMuxClient(cfg *conf.Config) (*MuxClient, error) {
+	tc, err := newTlsClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &MuxClient{
+		TlsClient: tc,
+		muxCfg:    cfg.GetMuxConfig(),
+		pools:     make(map[string]*muxPool),
+	}, nil
+}
+
+func (c *MuxClient) HandShake(ctx context.Context, remote *lb.Node, isTCP bool) (net.Conn, error) {
+	t1 := time.Now()
+	meta := []byte{muxStreamTCP}
+	if !isTCP {
+		meta[0] = muxStreamUDP
+	}
+	pool := c.getPool(remote.Address)
+	sess, err := pool.get(ctx, c, remote)
+	if err != nil {
+		return nil, err
+	}
+	st, err := sess.OpenStream(meta)
+	if err != nil {
+		// the tunnel died right before we used it, retry on a fresh one
+		if sess, err = pool.get(ctx, c, remote); err != nil {
+			return nil, err
+		}
+		if st, err = sess.OpenStream(meta); err != nil {
+			return nil, err
+		}
+	}
+
+	latency := time.Since(t1)
+	connType := metrics.METRIC_CONN_TYPE_TCP
+	if !isTCP {
+		connType = metrics.METRIC_CONN_TYPE_UDP
+	}
+	labels := []string{c.cfg.Label, connType, remote.Address}
+	metrics.HandShakeDurationMilliseconds.WithLabelValues(labels...).Observe(float64(latency.Milliseconds()))
+	remote.RecordHandShake(latency)
+	if !isTCP {
+		return conn.NewUDPFrameConn(st, c.cfg.Label), nil
+	}
+	return st, nil
+}
+
+// Close closes all pooled tunnels, streams on them are closed as well.
+func (c *MuxClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pools {
+		p.close()
+	}
+	clear(c.pools)
+	return nil
+}
+
+func (c *MuxClient) getPool(addr string) *muxPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pools[addr]
+	if !ok {
+		p = &muxPool{}
+		c.pools[addr] = p
+	}
+	return p
+}
+
+func (c *MuxClient) dialSession(ctx context.Context, remote *lb.Node) (*mux.Session, error) {
+	tc, err := c.dial(ctx, remote, alpnMux)
+	if err != nil {
+		return nil, err
+	}
+	if tc.ConnectionState().NegotiatedProtocol != alpnMux {
+		tc.Close()
+		return nil, errors.New("remote is not a mux server")
+	}
+	c.l.Debugf("new mux tunnel to %s", remote.Address)
+	return mux.Client(tc, newMuxSessionConfig(c.muxCfg)), nil
+}
+
+type muxPool struct {
+	mu       sync.Mutex
+	sessions []*mux.Session
+	// tunnels being dialed, they count against max_tunnels already
+	dialing int
+	closed  bool
+}
+
+// get returns the least loaded tunnel, a new tunnel is dialed when all of
+// them are full and the pool is not. The dial runs without the lock so a
+// slow remote does not hold back conns that fit in the open tunnels.
+func (p *muxPool) get(ctx context.Context, c *MuxClient, remote *lb.Node) (*mux.Session, error) {
+	p.mu.Lock()
+	best := p.leastLoaded()
+	if best != nil && (best.NumStreams() < c.muxCfg.MaxStreams || len(p.sessions)+p.dialing >= c.muxCfg.MaxTunnels) {
+		p.mu.Unlock()
+		return best, nil
+	}
+	p.dialing++
+	p.mu.Unlock()
+
+	sess, err := c.dialSession(ctx, remote)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if p.closed {
+		if sess != nil {
+			sess.Close()
+		}
+		return nil, mux.ErrSessionClosed
+	}
+	best = p.leastLoaded()
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	// the pool may have filled up while dialing
+	if best != nil && len(p.sessions) >= c.muxCfg.MaxTunnels {
+		sess.Close()
+		return best, nil
+	}
+	p.sessions = append(p.sessions, sess)
+	return sess, nil
+}
+
+// leastLoaded drops the dead tunnels and returns the one with the fewest
+// streams, nil when there is none. p.mu must be held.
+func (p *muxPool) leastLoaded() *mux.Session {
+	p.sessions = slices.DeleteFunc(p.sessions, (*mux.Session).IsClosed)
+	var best *mux.Session
+	for _, s := range p.sessions {
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	return best
+}
+
+func (p *muxPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.sessions {
+		s.Close()
+	}
+	p.sessions = nil
+	p.closed = true
+}
+
+type MuxServer struct {
+	*BaseRelayServer
+	lis listeners
+}
+
+func newMuxServer(bs *BaseRelayServer) (*MuxServer, error) {
+	return &MuxServer{BaseRelayServer: bs}, nil
+}
+
+func (s *MuxServer) ListenAndServe(ctx context.Context) error {
+	tc := s.cfg.GetTLSConfig()
+	tlsCfg, err := mytls.NewServerTLSConfig(tc.CertFile, tc.KeyFile, []string{alpnMux})
+	if err != nil {
+		return err
+	}
+	lis, err := newTLSListener(ctx, s.cfg, tlsCfg)
+	if err != nil {
+		return err
+	}
+	if err := s.lis.add(lis); err != nil {
+		return err
+	}
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveTunnel(ctx, c.(*tls.Conn))
+	}
+}
+
+func (s *MuxServer) serveTunnel(ctx context.Context, c *tls.Conn) {
+	if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+		c.Close()
+		return
+	}
+	s.acceptMuxStreams(ctx, c, s.handleStream)
+}
+
+// acceptMuxStreams finishes the tls handshake of a mux tunnel and hands
+// every stream opened by the client to handle until the tunnel dies.
+func (b *BaseRelayServer) acceptMuxStreams(ctx context.Context, c *tls.Conn, handle func(context.Context, *mux.Stream)) {
+	hsCtx, cancel := context.WithTimeout(ctx, b.cfg.Options.ReadTimeout)
+	err := c.HandshakeContext(hsCtx)
+	cancel()
+	if err != nil {
+		b.l.Debugf("mux tunnel handshake with %s failed: %s", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	if c.ConnectionState().NegotiatedProtocol != alpnMux {
+		b.l.Debugf("mux tunnel from %s did not negotiate %s", c.RemoteAddr(), alpnMux)
+		c.Close()
+		return
+	}
+	sess := mux.Server(c, newMuxSessionConfig(b.cfg.GetMuxConfig()))
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			b.l.Debugf("mux tunnel from %s closed: %s", c.RemoteAddr(), err)
+			return
+		}
+		go handle(ctx, st)
+	}
+}
+
+func (s *MuxServer) handleStream(ctx context.Context, st *mux.Stream) {
+	defer st.Close()
+	remote := lb.NextFor(s.remotes, st.RemoteAddr().String())
+	var err error
+	switch meta := st.Meta(); {
+	case len(meta) == 1 && meta[0] == muxStreamTCP:
+		err = s.RelayTCPConn(ctx, st, remote)
+	case len(meta) == 1 && meta[0] == muxStreamUDP:
+		if !s.cfg.Options.EnableUDP {
+			s.l.Warnf("udp stream from %s rejected, enable_udp is off", st.RemoteAddr())
+			return
+		}
+		err = s.RelayUDPConn(ctx, conn.NewUDPFrameConn(st, s.cfg.Label), remote)
+	default:
+		err = errors.New("unknown mux stream type")
+	}
+	if err != nil {
+		s.l.Errorf("handleStream meet error: %s", err)
+	}
+}
+
+// StopAccepting closes the listener, the tunnels live on until the ctx of
+// ListenAndServe is done and their new streams are rejected by the drain.
+func (s *MuxServer) StopAccepting() error {
+	return s.lis.close()
+}
+
+func (s *MuxServer) Close() error {
+	return errors.Join(s.closeRelayer(), s.StopAccepting())
+}
+
+func newMuxSessionConfig(mc *conf.MuxConfig) *mux.Config {
+	cfg := mux.DefaultConfig()
+	cfg.KeepAliveInterval = mc.KeepAliveInterval
+	cfg.KeepAliveTimeout = mc.KeepAliveTimeout
+	return cfg
+}
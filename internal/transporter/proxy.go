@@ -0,0 +1,117 @@
+package transporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+)
+
+// directRemoteAddress is the remote of proxy rules that dial the destination
+// themselves, one node per rule keeps the metrics labels bounded.
+const directRemoteAddress = "direct"
+
+type targetCtxKey struct{}
+
+// withTarget tells the relay client the destination the proxy client asked
+// for, raw dials it instead of the remote and ws passes it to the remote.
+func withTarget(ctx context.Context, target string) context.Context {
+	return context.WithValue(ctx, targetCtxKey{}, target)
+}
+
+func targetFrom(ctx context.Context) (string, bool) {
+	target, ok := ctx.Value(targetCtxKey{}).(string)
+	return target, ok && target != ""
+}
+
+// proxyRemote picks the next hop for a proxy conn, direct is used when the
+// rule has no remotes.
+func (b *BaseRelayServer) proxyRemote(direct *lb.Node, clientAddr string) *lb.Node {
+	if len(b.remotes.GetAll()) == 0 {
+		return direct
+	}
+	return lb.NextFor(b.remotes, clientAddr)
+}
+
+// relayProxyTCP relays c to target through remote. reply is called with the
+// handshake result before any data is relayed, so the proxy protocol can
+// answer its client, a reply error aborts the relay.
+func (b *BaseRelayServer) relayProxyTCP(
+	ctx context.Context, c net.Conn, remote *lb.Node, target, user string,
+	reply func(rc net.Conn, err error) error,
+) error {
+	ctx, slots, err := b.acquireConnSlots(ctx)
+	if err != nil {
+		_ = reply(nil, err)
+		return err
+	}
+	defer slots.release()
+	if err := b.checkQuota(metrics.METRIC_CONN_TYPE_TCP); err != nil {
+		_ = reply(nil, err)
+		return err
+	}
+	release, err := b.acquireClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP)
+	if err != nil {
+		_ = reply(nil, err)
+		return err
+	}
+	defer release()
+	if remote, err = b.pickRemote(ctx, remote); err != nil {
+		_ = reply(nil, err)
+		return err
+	}
+	rc, remote, err := b.handShake(withTarget(withSource(ctx, c), target), remote, true)
+	if rerr := reply(rc, err); rerr != nil && err == nil {
+		err = rerr
+	}
+	if err != nil {
+		if rc != nil {
+			rc.Close() // nolint: errcheck
+		}
+		return fmt.Errorf("handshake to %s error: %w", target, err)
+	}
+	defer rc.Close() // nolint: errcheck
+
+	if c, err = b.sniffAndBlockProtocol(c); err != nil {
+		return err
+	}
+	c, unlimit := b.applyRateLimit(c)
+	defer unlimit()
+
+	labels := []string{b.cfg.Label, metrics.METRIC_CONN_TYPE_TCP, remote.Address}
+	metrics.CurConnectionCount.WithLabelValues(labels...).Inc()
+	defer metrics.CurConnectionCount.WithLabelValues(labels...).Dec()
+
+	b.l.Infof("relayProxyTCP from %s to %s via %s user:%s", c.RemoteAddr(), target, remote.Address, user)
+	return b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_TCP, conn.WithUser(user))
+}
+
+// relayProxyUDP relays the datagram conn c to target through remote.
+func (b *BaseRelayServer) relayProxyUDP(ctx context.Context, c net.Conn, remote *lb.Node, target, user string) error {
+	if err := b.checkQuota(metrics.METRIC_CONN_TYPE_UDP); err != nil {
+		return err
+	}
+	rc, remote, err := b.handShake(withTarget(withSource(ctx, c), target), remote, false)
+	if err != nil {
+		return fmt.Errorf("handshake to %s error: %w", target, err)
+	}
+	defer rc.Close() // nolint: errcheck
+
+	opts := []conn.RelayConnOption{conn.WithUser(user)}
+	// the session stats stay visible when c is rate limited
+	if s, ok := c.(conn.UDPSession); ok {
+		opts = append(opts, conn.WithUDPSession(s))
+	}
+	c, unlimit := b.applyUDPRateLimit(c)
+	defer unlimit()
+
+	labels := []string{b.cfg.Label, metrics.METRIC_CONN_TYPE_UDP, remote.Address}
+	metrics.CurConnectionCount.WithLabelValues(labels...).Inc()
+	defer metrics.CurConnectionCount.WithLabelValues(labels...).Dec()
+
+	b.l.Infof("relayProxyUDP from %s to %s via %s user:%s", c.RemoteAddr(), target, remote.Address, user)
+	return b.handleRelayConn(c, rc, remote, metrics.METRIC_CONN_TYPE_UDP, opts...)
+}
@@ -0,0 +1,108 @@
+package transporter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+
+	"github.com/Ehco1996/ehco/pkg/iptrie"
+)
+
+const headerForwardedFor = "X-Forwarded-For"
+
+type sourceCtxKey struct{}
+
+// connSource is the address of the client and the address it connected
+// to, it is what a proxy protocol header or X-Forwarded-For carries.
+type connSource struct {
+	src, dst net.Addr
+}
+
+// withSource tells the relay client where the relayed conn comes from.
+func withSource(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, sourceCtxKey{}, connSource{src: c.RemoteAddr(), dst: c.LocalAddr()})
+}
+
+func sourceFrom(ctx context.Context) (connSource, bool) {
+	s, ok := ctx.Value(sourceCtxKey{}).(connSource)
+	return s, ok && s.src != nil
+}
+
+// wrapProxyProtoListener makes the conns of l report the client address
+// from the proxy protocol header, conns without a header are rejected.
+func wrapProxyProtoListener(l net.Listener, readHeaderTimeout time.Duration) net.Listener {
+	return &proxyproto.Listener{
+		Listener: l,
+		ConnPolicy: func(proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			return proxyproto.REQUIRE, nil
+		},
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+}
+
+// writeProxyHeader sends the proxy protocol header for the client of ctx,
+// without a client(e.g. health check) a LOCAL header is sent.
+func writeProxyHeader(ctx context.Context, rc net.Conn, version int) error {
+	header := &proxyproto.Header{
+		Version:           byte(version),
+		Command:           proxyproto.LOCAL,
+		TransportProtocol: proxyproto.UNSPEC,
+	}
+	if s, ok := sourceFrom(ctx); ok {
+		header = proxyproto.HeaderProxyFromAddrs(byte(version), s.src, s.dst)
+	}
+	_, err := header.WriteTo(rc)
+	return err
+}
+
+// forwardedClient returns the client address of req from X-Forwarded-For
+// when the rule trusts it.
+func (b *BaseRelayServer) forwardedClient(req *http.Request) (net.Addr, bool) {
+	if !b.cfg.Options.TrustForwardedFor {
+		return nil, false
+	}
+	return forwardedFor(req.Header, req.RemoteAddr, b.trustedProxies)
+}
+
+// forwardedFor returns the client address from X-Forwarded-For. Every hop
+// appends the address it got the request from and the entries on the left
+// are whatever the client sent, so the entries are read from the right:
+// those of trusted proxies are skipped and the first other one is the
+// client. Without trusted proxies the right most entry is the client. The
+// header of a peer that is not a trusted proxy is ignored.
+func forwardedFor(h http.Header, peer string, trusted *iptrie.Trie) (net.Addr, bool) {
+	if trusted != nil && !trusted.Contains(parseClientIP(peer)) {
+		return nil, false
+	}
+	var entries []string
+	for _, v := range h.Values(headerForwardedFor) {
+		entries = append(entries, strings.Split(v, ",")...)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(entries[i]))
+		if err != nil {
+			// nothing left of a broken entry can be believed
+			return nil, false
+		}
+		ip = ip.Unmap()
+		if trusted != nil && trusted.Contains(ip) && i > 0 {
+			continue
+		}
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0)), true
+	}
+	return nil, false
+}
+
+// addrConn overrides the remote address of a conn, e.g. with the one
+// from X-Forwarded-For.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
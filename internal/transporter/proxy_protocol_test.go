@@ -0,0 +1,102 @@
+package transporter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	"github.com/Ehco1996/ehco/pkg/iptrie"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyProtocolRoundTrip(t *testing.T) {
+	for _, version := range []int{1, 2} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		pl := wrapProxyProtoListener(l, time.Second)
+
+		client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+		dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+		go func() {
+			rc, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return
+			}
+			defer rc.Close()
+			ctx := context.WithValue(context.Background(), sourceCtxKey{}, connSource{src: client, dst: dst})
+			_ = writeProxyHeader(ctx, rc, version)
+			_, _ = rc.Write([]byte("ping"))
+		}()
+
+		c, err := pl.Accept()
+		require.NoError(t, err)
+		buf := make([]byte, 4)
+		_, err = c.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(buf))
+		require.Equal(t, client.String(), c.RemoteAddr().String())
+		require.Equal(t, dst.String(), c.LocalAddr().String())
+		c.Close()
+		pl.Close()
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	h := http.Header{}
+	_, ok := forwardedFor(h, "192.0.2.1:1234", nil)
+	require.False(t, ok)
+
+	// the left most entry is whatever the client sent
+	h.Set(headerForwardedFor, "203.0.113.7, 10.0.0.1")
+	addr, ok := forwardedFor(h, "192.0.2.1:1234", nil)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.1", addr.(*net.TCPAddr).IP.String())
+
+	trusted := iptrie.New()
+	trusted.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+	h.Add(headerForwardedFor, "10.0.0.2")
+	addr, ok = forwardedFor(h, "10.0.0.3:1234", trusted)
+	require.True(t, ok)
+	require.Equal(t, "203.0.113.7", addr.(*net.TCPAddr).IP.String())
+
+	// the header of a peer that is not a trusted proxy is ignored
+	_, ok = forwardedFor(h, "192.0.2.1:1234", trusted)
+	require.False(t, ok)
+
+	h.Set(headerForwardedFor, "not-an-ip, 10.0.0.1")
+	_, ok = forwardedFor(h, "10.0.0.3:1234", trusted)
+	require.False(t, ok)
+}
+
+func TestAllowHTTPClient_SpoofedForwardedFor(t *testing.T) {
+	cfg := &conf.Config{
+		Listen:        "127.0.0.1:0",
+		ListenType:    constant.RelayTypeWS,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{"127.0.0.1:1"},
+		Options: &conf.Options{
+			TrustForwardedFor: true,
+			DenyCIDRs:         []string{"198.51.100.0/24"},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	b, err := newBaseRelayServer(cfg, nil)
+	require.NoError(t, err)
+
+	allowed := func(xff string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set(headerForwardedFor, xff)
+		return b.allowHTTPClient(httptest.NewRecorder(), req, "ws")
+	}
+	require.True(t, allowed("203.0.113.7"))
+	require.False(t, allowed("198.51.100.7"))
+	// a denied client can not hide behind an allowed address it made up
+	require.False(t, allowed("203.0.113.7, 198.51.100.7"))
+}
@@ -0,0 +1,329 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/quic-go"
+	"go.uber.org/zap"
+
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	mytls "github.com/Ehco1996/ehco/internal/tls"
+)
+
+const (
+	alpnQuic = "ehco-quic"
+	// streams are cheap in quic, the limit only guards against a runaway peer
+	quicMaxIncomingStreams = 1 << 16
+)
+
+var (
+	_ RelayClient = &QuicClient{}
+	_ RelayServer = &QuicServer{}
+)
+
+// QuicClient keeps one quic conn to each remote and opens a stream per
+// relayed conn, so a lost packet only stalls the stream it belongs to.
+// Session tickets are cached so a redial resumes with 0-RTT, note that
+// early data can be replayed by an on-path attacker.
+type QuicClient struct {
+	cfg     *conf.Config
+	l       *zap.SugaredLogger
+	tlsCfg  *tls.Config
+	quicCfg *quic.Config
+
+	mu      sync.Mutex
+	tunnels map[string]*quicTunnelSlot // k: remote address
+}
+
+type quicTunnelSlot struct {
+	mu  sync.Mutex
+	tun *quicTunnel
+	// the dial in flight, nil when there is none
+	dialing *quicDial
+	closed  bool
+}
+
+// quicDial is a dial shared by the conns that need the tunnel while it is
+// in flight, a failed one is not kept so the next conn dials again.
+type quicDial struct {
+	done chan struct{}
+	tun  *quicTunnel
+	err  error
+}
+
+func newQuicClient(cfg *conf.Config) (*QuicClient, error) {
+	tc := cfg.GetTLSConfig()
+	tlsCfg, err := mytls.NewClientTLSConfig(tc.ServerName, tc.CAFile, []string{alpnQuic}, tc.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	return &QuicClient{
+		cfg:     cfg,
+		l:       zap.S().Named(string(cfg.TransportType)),
+		tlsCfg:  tlsCfg,
+		quicCfg: newQuicConfig(cfg.GetMuxConfig()),
+		tunnels: make(map[string]*quicTunnelSlot),
+	}, nil
+}
+
+func (c *QuicClient) HandShake(ctx context.Context, remote *lb.Node, isTCP bool) (net.Conn, error) {
+	t1 := time.Now()
+	tun, err := c.getTunnel(ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+	var rc net.Conn
+	if isTCP {
+		rc, err = tun.openStream(ctx, []byte{quicStreamTCP})
+	} else {
+		id := tun.nextUDPID.Add(1)
+		hdr := make([]byte, 1+quicUDPSessionIDSize)
+		hdr[0] = quicStreamUDP
+		binary.BigEndian.PutUint32(hdr[1:], id)
+		var sc *quicStreamConn
+		if sc, err = tun.openStream(ctx, hdr); err == nil {
+			rc = tun.newUDPConn(sc, id)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	latency := time.Since(t1)
+	connType := metrics.METRIC_CONN_TYPE_TCP
+	if !isTCP {
+		connType = metrics.METRIC_CONN_TYPE_UDP
+	}
+	labels := []string{c.cfg.Label, connType, remote.Address}
+	metrics.HandShakeDurationMilliseconds.WithLabelValues(labels...).Observe(float64(latency.Milliseconds()))
+	remote.RecordHandShake(latency)
+	return rc, nil
+}
+
+// Close closes the quic conns to all remotes.
+func (c *QuicClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, slot := range c.tunnels {
+		slot.mu.Lock()
+		if slot.tun != nil {
+			slot.tun.close()
+		}
+		slot.closed = true
+		slot.mu.Unlock()
+	}
+	clear(c.tunnels)
+	return nil
+}
+
+func (c *QuicClient) getTunnel(ctx context.Context, remote *lb.Node) (*quicTunnel, error) {
+	c.mu.Lock()
+	slot, ok := c.tunnels[remote.Address]
+	if !ok {
+		slot = &quicTunnelSlot{}
+		c.tunnels[remote.Address] = slot
+	}
+	c.mu.Unlock()
+
+	// the dial takes up to the dial timeout, the slot is not locked
+	// meanwhile so the conns to the remote wait for it and not each other
+	slot.mu.Lock()
+	if slot.tun != nil && slot.tun.alive() {
+		slot.mu.Unlock()
+		return slot.tun, nil
+	}
+	d := slot.dialing
+	if d == nil {
+		d = &quicDial{done: make(chan struct{})}
+		slot.dialing = d
+		go c.dialSlot(ctx, slot, d, remote)
+	}
+	slot.mu.Unlock()
+	select {
+	case <-d.done:
+		return d.tun, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dialSlot dials the tunnel of slot for the conns waiting on d, the dial
+// is not canceled with the conn that started it.
+func (c *QuicClient) dialSlot(ctx context.Context, slot *quicTunnelSlot, d *quicDial, remote *lb.Node) {
+	d.tun, d.err = c.dial(context.WithoutCancel(ctx), remote)
+	slot.mu.Lock()
+	slot.dialing = nil
+	switch {
+	case d.err != nil:
+	case slot.closed:
+		d.tun.close()
+		d.tun, d.err = nil, net.ErrClosed
+	default:
+		slot.tun = d.tun
+	}
+	slot.mu.Unlock()
+	close(d.done)
+}
+
+func (c *QuicClient) dial(ctx context.Context, remote *lb.Node) (*quicTunnel, error) {
+	raddr, err := net.ResolveUDPAddr("udp", remote.Address)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := c.tlsCfg.Clone()
+	if tlsCfg.ServerName == "" {
+		if tlsCfg.ServerName, err = remote.GetAddrHost(); err != nil {
+			return nil, err
+		}
+	}
+	// not bound to a local address, so when our address changes the
+	// server sees a new path on the same conn instead of a dead one
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: pc}
+	dialCtx, cancel := context.WithTimeout(ctx, c.cfg.Options.DialTimeout)
+	defer cancel()
+	qc, err := tr.DialEarly(dialCtx, raddr, tlsCfg, c.quicCfg)
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, err
+	}
+	tun := newQuicTunnel(qc, c.cfg.Label, c.l)
+	tun.addTransport(tr)
+	go tun.watchPath(raddr, c.quicCfg.KeepAlivePeriod)
+	c.l.Debugf("new quic conn to %s", remote.Address)
+	return tun, nil
+}
+
+type QuicServer struct {
+	*BaseRelayServer
+	// the udp socket, the transport and its listener
+	lis listeners
+}
+
+func newQuicServer(bs *BaseRelayServer) (*QuicServer, error) {
+	return &QuicServer{BaseRelayServer: bs}, nil
+}
+
+func (s *QuicServer) ListenAndServe(ctx context.Context) error {
+	tc := s.cfg.GetTLSConfig()
+	tlsCfg, err := mytls.NewServerTLSConfig(tc.CertFile, tc.KeyFile, []string{alpnQuic})
+	if err != nil {
+		return err
+	}
+	lcfg := net.ListenConfig{}
+	pc, err := lcfg.ListenPacket(ctx, "udp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	if err := s.lis.add(pc); err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: pc}
+	if err := s.lis.add(tr); err != nil {
+		return err
+	}
+	quicCfg := newQuicConfig(s.cfg.GetMuxConfig())
+	quicCfg.Allow0RTT = true
+	lis, err := tr.ListenEarly(tlsCfg, quicCfg)
+	if err != nil {
+		return err
+	}
+	if err := s.lis.add(lis); err != nil {
+		return err
+	}
+	for {
+		qc, err := lis.Accept(ctx)
+		if err != nil {
+			return err
+		}
+		if !s.allowClient(qc.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+			qc.CloseWithError(0, "rejected")
+			continue
+		}
+		go s.serveConn(ctx, qc)
+	}
+}
+
+func (s *QuicServer) serveConn(ctx context.Context, qc *quic.Conn) {
+	tun := newQuicTunnel(qc, s.cfg.Label, s.l)
+	defer tun.close()
+	for {
+		st, err := qc.AcceptStream(ctx)
+		if err != nil {
+			s.l.Debugf("quic conn from %s closed: %s", qc.RemoteAddr(), err)
+			return
+		}
+		go s.handleStream(ctx, tun, newQuicStreamConn(st, qc))
+	}
+}
+
+func (s *QuicServer) handleStream(ctx context.Context, tun *quicTunnel, sc *quicStreamConn) {
+	defer sc.Close()
+	sc.SetReadDeadline(time.Now().Add(s.cfg.Options.ReadTimeout))
+	var streamType [1]byte
+	if _, err := io.ReadFull(sc, streamType[:]); err != nil {
+		s.l.Debugf("read quic stream type from %s failed: %s", sc.RemoteAddr(), err)
+		return
+	}
+	remote := lb.NextFor(s.remotes, sc.RemoteAddr().String())
+	var err error
+	switch streamType[0] {
+	case quicStreamTCP:
+		sc.SetReadDeadline(time.Time{})
+		err = s.RelayTCPConn(ctx, sc, remote)
+	case quicStreamUDP:
+		var id [quicUDPSessionIDSize]byte
+		if _, err := io.ReadFull(sc, id[:]); err != nil {
+			s.l.Debugf("read quic udp session id from %s failed: %s", sc.RemoteAddr(), err)
+			return
+		}
+		sc.SetReadDeadline(time.Time{})
+		if !s.cfg.Options.EnableUDP {
+			s.l.Warnf("udp session from %s rejected, enable_udp is off", sc.RemoteAddr())
+			return
+		}
+		uc := tun.newUDPConn(sc, binary.BigEndian.Uint32(id[:]))
+		defer uc.Close()
+		err = s.RelayUDPConn(ctx, uc, remote)
+	default:
+		err = errors.New("unknown quic stream type")
+	}
+	if err != nil {
+		s.l.Errorf("handleStream meet error: %s", err)
+	}
+}
+
+// StopAccepting closes the listener, the transport and its udp socket,
+// the quic conns share that socket so they end with it and the relay
+// restarted on the same address can bind it.
+func (s *QuicServer) StopAccepting() error {
+	return s.lis.close()
+}
+
+func (s *QuicServer) Close() error {
+	return errors.Join(s.closeRelayer(), s.StopAccepting())
+}
+
+func newQuicConfig(mc *conf.MuxConfig) *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:    mc.KeepAliveInterval,
+		MaxIdleTimeout:     mc.KeepAliveTimeout,
+		MaxIncomingStreams: quicMaxIncomingStreams,
+		EnableDatagrams:    true,
+	}
+}
@@ -0,0 +1,312 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/quic-go"
+	"go.uber.org/zap"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+)
+
+// first bytes written on every quic stream, udp streams carry the session id after it
+const (
+	quicStreamTCP byte = iota
+	quicStreamUDP
+)
+
+const (
+	quicUDPSessionIDSize = 4
+
+	// datagrams may overtake the stream that announces their session,
+	// they are held for a while instead of dropped
+	quicPendingTTL      = 5 * time.Second
+	quicMaxPendingIDs   = 256
+	quicMaxPendingPerID = 16
+)
+
+type quicPendingDatagrams struct {
+	at   time.Time
+	data [][]byte
+}
+
+// quicTunnel is one quic conn between two ehco nodes. Every relayed tcp
+// conn is a stream, every udp session is a stream too but its datagrams
+// are sent as quic datagrams prefixed with the session id, the stream only
+// carries datagrams that do not fit into a quic datagram.
+type quicTunnel struct {
+	conn *quic.Conn
+	// relay label of the udp frame metrics
+	label string
+	l     *zap.SugaredLogger
+
+	mu          sync.Mutex
+	udpSessions map[uint32]*quicUDPConn
+	pending     map[uint32]*quicPendingDatagrams
+	nextUDPID   atomic.Uint32
+	// sockets owned by the client side, one more per migration
+	transports []*quic.Transport
+}
+
+func newQuicTunnel(c *quic.Conn, label string, l *zap.SugaredLogger) *quicTunnel {
+	t := &quicTunnel{
+		conn:        c,
+		label:       label,
+		l:           l,
+		udpSessions: make(map[uint32]*quicUDPConn),
+		pending:     make(map[uint32]*quicPendingDatagrams),
+	}
+	go t.recvDatagrams()
+	context.AfterFunc(c.Context(), t.closeTransports)
+	return t
+}
+
+func (t *quicTunnel) alive() bool {
+	return t.conn.Context().Err() == nil
+}
+
+func (t *quicTunnel) close() {
+	t.conn.CloseWithError(0, "")
+}
+
+// openStream opens a stream on the client side, with 0-RTT the stream is
+// sent as early data. When the server rejects early data the conn has to
+// be switched over to 1-RTT before new streams can be opened.
+func (t *quicTunnel) openStream(ctx context.Context, hdr []byte) (*quicStreamConn, error) {
+	st, err := t.conn.OpenStreamSync(ctx)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		if _, err = t.conn.NextConnection(ctx); err != nil {
+			return nil, err
+		}
+		st, err = t.conn.OpenStreamSync(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := newQuicStreamConn(st, t.conn)
+	if _, err := sc.Write(hdr); err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+func (t *quicTunnel) newUDPConn(sc *quicStreamConn, id uint32) *quicUDPConn {
+	c := &quicUDPConn{sc: sc, id: id, tun: t, frames: conn.NewUDPFrameConn(sc, t.label)}
+	c.QueueConn = conn.NewQueueConn(t.label, sc.LocalAddr(), sc.RemoteAddr(), c.write, func() {
+		t.removeUDPConn(id)
+		sc.Close()
+	})
+	t.mu.Lock()
+	t.udpSessions[id] = c
+	if p, ok := t.pending[id]; ok {
+		delete(t.pending, id)
+		for _, b := range p.data {
+			c.Push(b)
+		}
+	}
+	t.mu.Unlock()
+	go c.readFrames()
+	return c
+}
+
+func (t *quicTunnel) removeUDPConn(id uint32) {
+	t.mu.Lock()
+	delete(t.udpSessions, id)
+	t.mu.Unlock()
+}
+
+func (t *quicTunnel) recvDatagrams() {
+	for {
+		b, err := t.conn.ReceiveDatagram(t.conn.Context())
+		if err != nil {
+			return
+		}
+		if len(b) < quicUDPSessionIDSize {
+			continue
+		}
+		id := binary.BigEndian.Uint32(b)
+		t.mu.Lock()
+		if c, ok := t.udpSessions[id]; ok {
+			c.Push(b[quicUDPSessionIDSize:])
+		} else {
+			t.addPending(id, b[quicUDPSessionIDSize:])
+		}
+		t.mu.Unlock()
+	}
+}
+
+// addPending must be called with t.mu held.
+func (t *quicTunnel) addPending(id uint32, b []byte) {
+	now := time.Now()
+	p, ok := t.pending[id]
+	if !ok {
+		for pid, p := range t.pending {
+			if now.Sub(p.at) > quicPendingTTL {
+				delete(t.pending, pid)
+			}
+		}
+		if len(t.pending) >= quicMaxPendingIDs {
+			return
+		}
+		p = &quicPendingDatagrams{at: now}
+		t.pending[id] = p
+	}
+	if len(p.data) < quicMaxPendingPerID {
+		p.data = append(p.data, b)
+	}
+}
+
+func (t *quicTunnel) addTransport(tr *quic.Transport) {
+	t.mu.Lock()
+	t.transports = append(t.transports, tr)
+	t.mu.Unlock()
+}
+
+func (t *quicTunnel) closeTransports() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.transports {
+		tr.Close()
+		tr.Conn.Close()
+	}
+	t.transports = nil
+}
+
+// watchPath migrates the conn to a fresh socket when the local address
+// used to reach the server changes, e.g. the default route moved to
+// another link. A mere NAT rebinding needs nothing from us, the server
+// validates the new path and follows it.
+func (t *quicTunnel) watchPath(raddr *net.UDPAddr, interval time.Duration) {
+	last := localIPFor(raddr)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.conn.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		cur := localIPFor(raddr)
+		if cur == "" || cur == last {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(t.conn.Context(), interval)
+		err := t.migrate(ctx)
+		cancel()
+		if err != nil {
+			t.l.Warnf("quic migrate to new local address %s failed: %s", cur, err)
+			continue
+		}
+		t.l.Infof("quic conn to %s migrated from %s to %s", raddr, last, cur)
+		last = cur
+	}
+}
+
+func (t *quicTunnel) migrate(ctx context.Context) error {
+	pc, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	tr := &quic.Transport{Conn: pc}
+	path, err := t.conn.AddPath(tr)
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return err
+	}
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		tr.Close()
+		pc.Close()
+		return err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		tr.Close()
+		pc.Close()
+		return err
+	}
+	t.addTransport(tr)
+	return nil
+}
+
+// localIPFor returns the local ip the kernel picks to reach raddr,
+// connecting an udp socket sends no packet.
+func localIPFor(raddr *net.UDPAddr) string {
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return ""
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// quicStreamConn makes a quic stream a net.Conn, Close closes both directions.
+type quicStreamConn struct {
+	*quic.Stream
+	qc *quic.Conn
+}
+
+func newQuicStreamConn(st *quic.Stream, qc *quic.Conn) *quicStreamConn {
+	return &quicStreamConn{Stream: st, qc: qc}
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr  { return c.qc.LocalAddr() }
+func (c *quicStreamConn) RemoteAddr() net.Addr { return c.qc.RemoteAddr() }
+
+func (c *quicStreamConn) Close() error {
+	c.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// quicUDPConn is one udp session inside a quic tunnel, every Read/Write is
+// one datagram. The session lives as long as its stream.
+type quicUDPConn struct {
+	*conn.QueueConn
+	sc     *quicStreamConn
+	id     uint32
+	tun    *quicTunnel
+	frames *conn.UDPFrameConn
+}
+
+func (c *quicUDPConn) write(b []byte) (int, error) {
+	p := make([]byte, quicUDPSessionIDSize+len(b))
+	binary.BigEndian.PutUint32(p, c.id)
+	copy(p[quicUDPSessionIDSize:], b)
+	err := c.tun.conn.SendDatagram(p)
+	var tooLarge *quic.DatagramTooLargeError
+	if errors.As(err, &tooLarge) {
+		return c.frames.Write(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readFrames reads the oversized datagrams sent on the stream, the session
+// ends when the peer closes the stream.
+func (c *quicUDPConn) readFrames() {
+	defer c.Close()
+	buf := make([]byte, math.MaxUint16)
+	for {
+		n, err := c.frames.Read(buf)
+		if err != nil {
+			return
+		}
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		if !c.PushWait(p) {
+			return
+		}
+	}
+}
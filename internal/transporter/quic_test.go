@@ -0,0 +1,135 @@
+package transporter
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	mytls "github.com/Ehco1996/ehco/internal/tls"
+	"github.com/stretchr/testify/require"
+)
+
+func freeUDPAddr(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	return pc.LocalAddr().String()
+}
+
+func TestQuic_UDPDatagramAndOversize(t *testing.T) {
+	require.NoError(t, mytls.InitTlsCfg())
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	serverCfg := &conf.Config{
+		Listen:        freeUDPAddr(t),
+		ListenType:    constant.RelayTypeQuic,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{echo.LocalAddr().String()},
+		Options:       &conf.Options{EnableUDP: true},
+	}
+	require.NoError(t, serverCfg.Validate())
+	server, err := NewRelayServer(serverCfg, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.ListenAndServe(ctx) // nolint: errcheck
+	defer server.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	clientCfg := &conf.Config{
+		Listen:        "127.0.0.1:0",
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeQuic,
+		Remotes:       []string{serverCfg.Listen},
+		Options:       &conf.Options{TLSConfig: &conf.TLSConfig{InsecureSkipVerify: true}},
+	}
+	require.NoError(t, clientCfg.Validate())
+	client, err := newQuicClient(clientCfg)
+	require.NoError(t, err)
+	defer client.Close()
+
+	rc, err := client.HandShake(ctx, &lb.Node{Address: serverCfg.Listen}, false)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	// the big one does not fit into a quic datagram and goes over the stream
+	for _, size := range []int{16, 4000} {
+		msg := bytes.Repeat([]byte{'x'}, size)
+		_, err := rc.Write(msg)
+		require.NoError(t, err)
+		require.NoError(t, rc.SetReadDeadline(time.Now().Add(3*time.Second)))
+		buf := make([]byte, 65535)
+		n, err := rc.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, buf[:n])
+	}
+}
+
+func TestQuicClient_SharedDial(t *testing.T) {
+	// a remote that never answers, every dial to it takes the dial timeout
+	blackhole, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer blackhole.Close()
+
+	cfg := &conf.Config{
+		Listen:        "127.0.0.1:0",
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeQuic,
+		Remotes:       []string{blackhole.LocalAddr().String()},
+		Options: &conf.Options{
+			DialTimeoutSec: 1,
+			TLSConfig:      &conf.TLSConfig{InsecureSkipVerify: true},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	client, err := newQuicClient(cfg)
+	require.NoError(t, err)
+	defer client.Close()
+	remote := &lb.Node{Address: blackhole.LocalAddr().String()}
+
+	// the conns to the remote wait for one dial, not one after another
+	start := time.Now()
+	errs := make(chan error, 5)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := client.getTunnel(context.Background(), remote)
+			errs <- err
+		}()
+	}
+	// a conn that goes away does not wait for the dial
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.getTunnel(ctx, remote)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+	for i := 0; i < cap(errs); i++ {
+		require.Error(t, <-errs)
+	}
+	require.Less(t, time.Since(start), 1900*time.Millisecond)
+
+	// the failed dial is not kept
+	slot := client.tunnels[remote.Address]
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	require.Nil(t, slot.tun)
+	require.Nil(t, slot.dialing)
+}
@@ -0,0 +1,71 @@
+package transporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/cmgr"
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+// newQuota returns the quota of the rule, nil when it has none. With a
+// cmgr the quota is shared by the relays of the label, so a restarted
+// relay goes on counting.
+func newQuota(cfg *conf.Config, cm cmgr.Cmgr) *cmgr.Quota {
+	if cfg.Options.Quota == nil {
+		if cm != nil {
+			cm.RemoveQuota(cfg.Label)
+		}
+		return nil
+	}
+	if cm == nil {
+		return cmgr.NewQuota(cfg.Label, *cfg.Options.Quota)
+	}
+	return cm.Quota(cfg.Label, *cfg.Options.Quota)
+}
+
+// checkQuota rejects new conns and udp sessions once the quota is used up.
+func (b *BaseRelayServer) checkQuota(connType string) error {
+	if b.quota == nil || !b.quota.Exceeded() {
+		return nil
+	}
+	metrics.QuotaRejectedConnectionCount.WithLabelValues(b.cfg.Label, connType).Inc()
+	return fmt.Errorf("relay:%s quota of %d bytes exceeded", b.cfg.Label, b.cfg.Options.Quota.Bytes)
+}
+
+// RunQuota starts the next period of the quota when the current one ended
+// and saves its usage on constant.QuotaSaveInterval until ctx is done,
+// returns at once when the rule has no quota.
+func (b *BaseRelayServer) RunQuota(ctx context.Context) {
+	if b.quota == nil {
+		return
+	}
+	ticker := time.NewTicker(constant.QuotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.saveQuota(context.Background())
+			return
+		case now := <-ticker.C:
+			if b.quota.Rollover(now) {
+				b.l.Infof("quota period started, usage reset")
+			}
+			b.saveQuota(ctx)
+		}
+	}
+}
+
+func (b *BaseRelayServer) saveQuota(ctx context.Context) {
+	u := b.quota.Usage()
+	metrics.QuotaUsedBytes.WithLabelValues(b.cfg.Label).Set(float64(u.UsedBytes))
+	if b.cmgr == nil {
+		return
+	}
+	if err := b.cmgr.SaveQuota(ctx, b.cfg.Label); err != nil {
+		b.l.Errorf("save quota usage: %s", err)
+	}
+}
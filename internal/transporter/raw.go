@@ -5,6 +5,8 @@ import (
 	"context"
 	"errors"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Ehco1996/ehco/internal/conn"
@@ -36,16 +38,28 @@ func newRawClient(cfg *conf.Config) (*RawClient, error) {
 
 func (raw *RawClient) HandShake(ctx context.Context, remote *lb.Node, isTCP bool) (net.Conn, error) {
 	t1 := time.Now()
+	// a remote port range is dialed on the port matching the listen port
+	slot, _ := listenSlotFrom(ctx)
+	addr := conf.RemoteAddrAt(remote.Address, slot.offset)
+	if target, ok := targetFrom(ctx); ok {
+		addr = target
+	}
 	var rc net.Conn
 	var err error
 	if isTCP {
-		rc, err = raw.dialer.DialContext(ctx, "tcp", remote.Address)
+		rc, err = raw.dialer.DialContext(ctx, "tcp", addr)
 	} else {
-		rc, err = raw.dialer.DialContext(ctx, "udp", remote.Address)
+		rc, err = raw.dialer.DialContext(ctx, "udp", addr)
 	}
 	if err != nil {
 		return nil, err
 	}
+	if isTCP && raw.cfg.Options.SendProxyProtocol > 0 {
+		if err := writeProxyHeader(ctx, rc, raw.cfg.Options.SendProxyProtocol); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
 	latency := time.Since(t1)
 	connType := metrics.METRIC_CONN_TYPE_TCP
 	if !isTCP {
@@ -53,15 +67,44 @@ func (raw *RawClient) HandShake(ctx context.Context, remote *lb.Node, isTCP bool
 	}
 	labels := []string{raw.cfg.Label, connType, remote.Address}
 	metrics.HandShakeDurationMilliseconds.WithLabelValues(labels...).Observe(float64(latency.Milliseconds()))
-	remote.HandShakeDuration = latency
+	remote.RecordHandShake(latency)
 	return rc, nil
 }
 
+type listenSlotCtxKey struct{}
+
+// listenSlot is the listen port of a port range rule a conn came from and
+// its offset in the range.
+type listenSlot struct {
+	offset, port int
+}
+
+func withListenSlot(ctx context.Context, slot listenSlot) context.Context {
+	return context.WithValue(ctx, listenSlotCtxKey{}, slot)
+}
+
+func listenSlotFrom(ctx context.Context) (listenSlot, bool) {
+	slot, ok := ctx.Value(listenSlotCtxKey{}).(listenSlot)
+	return slot, ok
+}
+
+// listenPortOpts records the listen port on the relay conn for the per
+// port stats of port range rules.
+func listenPortOpts(ctx context.Context) []conn.RelayConnOption {
+	if slot, ok := listenSlotFrom(ctx); ok {
+		return []conn.RelayConnOption{conn.WithListenPort(slot.port)}
+	}
+	return nil
+}
+
+// RawServer listens on every port of a port range rule, the listeners
+// share the remotes and stats of the rule.
 type RawServer struct {
 	*BaseRelayServer
 
-	tcpLis net.Listener
-	udpLis *conn.UDPListener
+	mu     sync.Mutex
+	tcpLis []net.Listener
+	udpLis []*conn.UDPListener
 }
 
 func newRawServer(bs *BaseRelayServer) (*RawServer, error) {
@@ -70,50 +113,87 @@ func newRawServer(bs *BaseRelayServer) (*RawServer, error) {
 	return rs, nil
 }
 
+// StopAccepting closes the tcp and udp listeners. The udp sessions have
+// no state worth draining, they end with their socket so the relay
+// restarted on the same ports can bind them.
+func (s *RawServer) StopAccepting() error {
+	return s.closeListeners()
+}
+
 func (s *RawServer) Close() error {
-	err := s.tcpLis.Close()
-	if s.udpLis != nil {
-		err2 := s.udpLis.Close()
-		err = errors.Join(err, err2)
+	return errors.Join(s.closeRelayer(), s.closeListeners())
+}
+
+func (s *RawServer) closeListeners() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, l := range s.tcpLis {
+		err = errors.Join(err, closeListener(l))
+	}
+	for _, l := range s.udpLis {
+		err = errors.Join(err, l.Close())
 	}
 	return err
 }
 
 func (s *RawServer) ListenAndServe(ctx context.Context) error {
-	ts, err := NewTCPListener(ctx, s.cfg)
-	if err != nil {
-		return err
-	}
-	s.tcpLis = ts
+	addrs := s.cfg.ListenAddrs()
+	errCh := make(chan error, len(addrs))
+	for offset, addr := range addrs {
+		lctx := ctx
+		if s.cfg.IsPortRange() {
+			_, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.Atoi(port)
+			lctx = withListenSlot(ctx, listenSlot{offset: offset, port: p})
+		}
 
-	if s.cfg.Options != nil && s.cfg.Options.EnableUDP {
-		udpLis, err := conn.NewUDPListener(ctx, s.cfg)
+		ts, err := NewTCPListenerAt(ctx, s.cfg, addr)
 		if err != nil {
-			return err
+			// the ports bound already must not serve a rule that failed
+			return errors.Join(err, s.closeListeners())
 		}
-		s.udpLis = udpLis
-	}
+		s.mu.Lock()
+		s.tcpLis = append(s.tcpLis, ts)
+		s.mu.Unlock()
+		go func() { errCh <- s.serveTCP(lctx, ts) }()
 
-	if s.udpLis != nil {
-		go s.listenUDP(ctx)
+		if s.cfg.Options != nil && s.cfg.Options.EnableUDP {
+			udpLis, err := conn.NewUDPListenerAt(ctx, s.cfg, addr)
+			if err != nil {
+				return errors.Join(err, s.closeListeners())
+			}
+			s.mu.Lock()
+			s.udpLis = append(s.udpLis, udpLis)
+			s.mu.Unlock()
+			go s.listenUDP(lctx, udpLis)
+		}
 	}
+	// one listener failing stops the whole rule
+	return <-errCh
+}
+
+func (s *RawServer) serveTCP(ctx context.Context, lis net.Listener) error {
 	for {
-		c, err := s.tcpLis.Accept()
+		c, err := lis.Accept()
 		if err != nil {
 			return err
 		}
 		go func(c net.Conn) {
 			defer c.Close()
-			if err := s.RelayTCPConn(ctx, c, s.remotes.Next()); err != nil {
+			if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+				return
+			}
+			if err := s.RelayTCPConn(ctx, c, lb.NextFor(s.remotes, c.RemoteAddr().String())); err != nil {
 				s.l.Errorf("RelayTCPConn meet error: %s", err.Error())
 			}
 		}(c)
 	}
 }
 
-func (s *RawServer) listenUDP(ctx context.Context) error {
+func (s *RawServer) listenUDP(ctx context.Context, lis *conn.UDPListener) error {
 	for {
-		c, err := s.udpLis.Accept()
+		c, err := lis.Accept()
 		if err != nil {
 			// Check if the error is due to context cancellation
 			if errors.Is(err, context.Canceled) {
@@ -122,8 +202,14 @@ func (s *RawServer) listenUDP(ctx context.Context) error {
 			s.l.Errorf("UDP accept error: %v", err)
 			return err
 		}
+		if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_UDP) {
+			c.Close()
+			continue
+		}
 		go func() {
-			if err := s.RelayUDPConn(ctx, c, s.remotes.Next()); err != nil {
+			// drops the session of a rejected client too
+			defer c.Close()
+			if err := s.RelayUDPConn(ctx, c, lb.NextFor(s.remotes, c.RemoteAddr().String())); err != nil {
 				s.l.Errorf("RelayUDPConn meet error: %s", err.Error())
 			}
 		}()
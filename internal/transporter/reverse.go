@@ -0,0 +1,714 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	mytls "github.com/Ehco1996/ehco/internal/tls"
+	"github.com/Ehco1996/ehco/internal/web"
+	"github.com/Ehco1996/ehco/pkg/mux"
+)
+
+var (
+	_ RelayServer = &ReverseServer{}
+	_ RelayServer = &ReverseAgent{}
+)
+
+// reverseRegister is the first line an agent sends on a new tunnel, the
+// server answers with reverseRegisterReply. After that the server opens a
+// mux stream on the tunnel for every conn of a public listener, the meta of
+// the stream is the conn type followed by the service name.
+type reverseRegister struct {
+	Token    string   `json:"token"`
+	Services []string `json:"services"`
+}
+
+type reverseRegisterReply struct {
+	Error string `json:"error,omitempty"`
+}
+
+func writeJSONLine(w io.Writer, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// readJSONLine reads one line, which must fit in the buffer of br.
+func readJSONLine(br *bufio.Reader, v any) error {
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// bufferedConn returns c with the bytes br has read ahead of the line.
+func bufferedConn(c net.Conn, br *bufio.Reader) net.Conn {
+	if n := br.Buffered(); n > 0 {
+		peek, _ := br.Peek(n)
+		return newPeekedConn(c, peek)
+	}
+	return c
+}
+
+// reverseStreamGoAway is the meta of the stream the server opens when it
+// stops accepting, e.g. on a reload. The agent dials a new tunnel right
+// away and serves the streams of the old one until the server closes it
+// at the end of its drain.
+const reverseStreamGoAway byte = 0xff
+
+var errReverseGoAway = errors.New("reverse server asked to redial")
+
+func reverseStreamMeta(isTCP bool, service string) []byte {
+	if isTCP {
+		return append([]byte{muxStreamTCP}, service...)
+	}
+	return append([]byte{muxStreamUDP}, service...)
+}
+
+// ReverseServer is the public side of a reverse tunnel. Agents dial its
+// listen over the rule transport and register services, the public
+// listener of a service relays its conns back through a tunnel of the
+// service.
+type ReverseServer struct {
+	*BaseRelayServer
+
+	httpServer *http.Server // ws/wss tunnels
+	// the listener of the mux tunnels and those of the services
+	lis listeners
+
+	// k: service name, nodes are the remotes in metrics and cmgr
+	nodes map[string]*lb.Node
+
+	mu      sync.Mutex
+	tunnels map[string][]*mux.Session // k: service name
+}
+
+func newReverseServer(bs *BaseRelayServer) (*ReverseServer, error) {
+	s := &ReverseServer{
+		BaseRelayServer: bs,
+		nodes:           make(map[string]*lb.Node),
+		tunnels:         make(map[string][]*mux.Session),
+	}
+	for name := range bs.cfg.GetReverseConfig().Services {
+		s.nodes[name] = &lb.Node{Address: name}
+	}
+	if bs.cfg.TransportType != constant.RelayTypeMux {
+		e := web.NewEchoServer()
+		e.Use(web.NginxLogMiddleware(zap.S().Named("reverse-server")))
+		e.GET("/", echo.WrapHandler(web.MakeIndexF()))
+		e.GET(bs.cfg.GetWSHandShakePath(), echo.WrapHandler(http.HandlerFunc(s.handleWSTunnel)))
+		s.httpServer = &http.Server{Handler: e}
+	}
+	return s, nil
+}
+
+func (s *ReverseServer) ListenAndServe(ctx context.Context) error {
+	if err := s.listenServices(ctx); err != nil {
+		// the ports bound already must not serve a rule that failed
+		return errors.Join(err, s.lis.close())
+	}
+
+	if s.cfg.TransportType == constant.RelayTypeMux {
+		tc := s.cfg.GetTLSConfig()
+		tlsCfg, err := mytls.NewServerTLSConfig(tc.CertFile, tc.KeyFile, []string{alpnMux})
+		if err != nil {
+			return err
+		}
+		lis, err := newTLSListener(ctx, s.cfg, tlsCfg)
+		if err != nil {
+			return errors.Join(err, s.lis.close())
+		}
+		if err := s.lis.add(lis); err != nil {
+			return err
+		}
+		for {
+			c, err := lis.Accept()
+			if err != nil {
+				return err
+			}
+			go func(c *tls.Conn) {
+				if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+					c.Close()
+					return
+				}
+				s.acceptMuxStreams(ctx, c, func(ctx context.Context, st *mux.Stream) {
+					if meta := st.Meta(); len(meta) != 1 || meta[0] != muxStreamTCP {
+						st.Close()
+						return
+					}
+					s.serveTunnel(ctx, st)
+				})
+			}(c.(*tls.Conn))
+		}
+	}
+
+	lis, err := NewTCPListener(ctx, s.cfg)
+	if err != nil {
+		return errors.Join(err, s.lis.close())
+	}
+	if s.cfg.TransportType == constant.RelayTypeWSS {
+		lis = tls.NewListener(lis, mytls.DefaultTLSConfig)
+	}
+	s.httpServer.BaseContext = func(net.Listener) context.Context { return ctx }
+	return s.httpServer.Serve(lis)
+}
+
+func (s *ReverseServer) handleWSTunnel(w http.ResponseWriter, req *http.Request) {
+	if !s.allowHTTPClient(w, req, metrics.METRIC_CONN_TYPE_TCP) {
+		return
+	}
+	wsc, _, _, err := ws.UpgradeHTTP(req, w)
+	if err != nil {
+		return
+	}
+	s.serveTunnel(req.Context(), conn.NewWSConn(wsc, true))
+}
+
+// serveTunnel registers the services of the agent on c and keeps them
+// until the tunnel dies.
+func (s *ReverseServer) serveTunnel(ctx context.Context, c net.Conn) {
+	agent := c.RemoteAddr()
+	services, c, err := s.register(c)
+	if err != nil {
+		s.l.Warnf("reverse agent from %s register failed: %s", agent, err)
+		c.Close()
+		return
+	}
+	// the session owns c from now on
+	sess := mux.Client(c, newMuxSessionConfig(s.cfg.GetMuxConfig()))
+	defer sess.Close()
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+
+	s.addTunnel(services, sess)
+	defer s.removeTunnel(services, sess)
+	s.l.Infof("reverse agent from %s registered services %v", agent, services)
+	<-sess.CloseChan()
+	s.l.Infof("reverse tunnel from %s closed", agent)
+}
+
+func (s *ReverseServer) register(c net.Conn) ([]string, net.Conn, error) {
+	c.SetDeadline(time.Now().Add(s.cfg.Options.ReadTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(c, constant.BUFFER_SIZE)
+	var req reverseRegister
+	if err := readJSONLine(br, &req); err != nil {
+		return nil, c, err
+	}
+	err := s.checkRegister(&req)
+	var reply reverseRegisterReply
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	if werr := writeJSONLine(c, &reply); werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		return nil, c, err
+	}
+	return req.Services, bufferedConn(c, br), nil
+}
+
+func (s *ReverseServer) checkRegister(req *reverseRegister) error {
+	rc := s.cfg.GetReverseConfig()
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(rc.Token)) != 1 {
+		return errors.New("invalid token")
+	}
+	if len(req.Services) == 0 {
+		return errors.New("no service to register")
+	}
+	for _, name := range req.Services {
+		if _, ok := rc.Services[name]; !ok {
+			return fmt.Errorf("unknown service %s", name)
+		}
+	}
+	return nil
+}
+
+func (s *ReverseServer) addTunnel(services []string, sess *mux.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range services {
+		s.tunnels[name] = append(s.tunnels[name], sess)
+	}
+}
+
+func (s *ReverseServer) removeTunnel(services []string, sess *mux.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range services {
+		s.tunnels[name] = slices.DeleteFunc(s.tunnels[name], func(t *mux.Session) bool { return t == sess })
+	}
+}
+
+// pickTunnel returns the least loaded tunnel of the service, nil when no
+// agent of it is online.
+func (s *ReverseServer) pickTunnel(name string) *mux.Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *mux.Session
+	for _, t := range s.tunnels[name] {
+		if t.IsClosed() {
+			continue
+		}
+		if best == nil || t.NumStreams() < best.NumStreams() {
+			best = t
+		}
+	}
+	return best
+}
+
+func (s *ReverseServer) listenServices(ctx context.Context) error {
+	for name, addr := range s.cfg.GetReverseConfig().Services {
+		lis, err := NewTCPListenerAt(ctx, s.cfg, addr)
+		if err != nil {
+			return err
+		}
+		if err := s.lis.add(lis); err != nil {
+			return err
+		}
+		go s.serveService(ctx, name, lis)
+
+		if s.cfg.Options.EnableUDP {
+			udpLis, err := conn.NewUDPListenerAt(ctx, s.cfg, addr)
+			if err != nil {
+				return err
+			}
+			if err := s.lis.add(udpLis); err != nil {
+				return err
+			}
+			go s.serveServiceUDP(ctx, name, udpLis)
+		}
+	}
+	return nil
+}
+
+func (s *ReverseServer) serveService(ctx context.Context, name string, lis net.Listener) {
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.l.Errorf("service %s accept error: %s", name, err)
+			}
+			return
+		}
+		go func() {
+			defer c.Close()
+			if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+				return
+			}
+			if err := s.relayToAgent(ctx, c, name, true); err != nil {
+				s.l.Errorf("relayToAgent meet error: %s", err.Error())
+			}
+		}()
+	}
+}
+
+func (s *ReverseServer) serveServiceUDP(ctx context.Context, name string, lis *conn.UDPListener) {
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				s.l.Errorf("service %s udp accept error: %s", name, err)
+			}
+			return
+		}
+		if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_UDP) {
+			c.Close()
+			continue
+		}
+		go func() {
+			defer c.Close()
+			if err := s.relayToAgent(ctx, c, name, false); err != nil {
+				s.l.Errorf("relayToAgent meet error: %s", err.Error())
+			}
+		}()
+	}
+}
+
+// relayToAgent relays c through a tunnel of the service, the agent dials
+// the local address of the service.
+func (s *ReverseServer) relayToAgent(ctx context.Context, c net.Conn, name string, isTCP bool) error {
+	connType := metrics.METRIC_CONN_TYPE_UDP
+	if isTCP {
+		connType = metrics.METRIC_CONN_TYPE_TCP
+		_, slots, err := s.acquireConnSlots(ctx)
+		if err != nil {
+			return err
+		}
+		defer slots.release()
+	}
+	if err := s.checkQuota(connType); err != nil {
+		return err
+	}
+	release, err := s.acquireClient(c.RemoteAddr(), connType)
+	if err != nil {
+		return err
+	}
+	defer release()
+	var opts []conn.RelayConnOption
+	var unlimit func()
+	if isTCP {
+		if c, err = s.sniffAndBlockProtocol(c); err != nil {
+			return err
+		}
+		c, unlimit = s.applyRateLimit(c)
+	} else {
+		// the session stats stay visible when c is rate limited
+		if us, ok := c.(conn.UDPSession); ok {
+			opts = append(opts, conn.WithUDPSession(us))
+		}
+		c, unlimit = s.applyUDPRateLimit(c)
+	}
+	defer unlimit()
+
+	node := s.nodes[name]
+	t1 := time.Now()
+	sess := s.pickTunnel(name)
+	if sess == nil {
+		return fmt.Errorf("service %s has no agent online", name)
+	}
+	st, err := sess.OpenStream(reverseStreamMeta(isTCP, name))
+	if err != nil {
+		return fmt.Errorf("open stream to agent %s of %s: %w", sess.RemoteAddr(), name, err)
+	}
+	var rc net.Conn = st
+	if !isTCP {
+		rc = conn.NewUDPFrameConn(st, s.cfg.Label)
+	}
+	defer rc.Close()
+	latency := time.Since(t1)
+	labels := []string{s.cfg.Label, connType, node.Address}
+	metrics.HandShakeDurationMilliseconds.WithLabelValues(labels...).Observe(float64(latency.Milliseconds()))
+	node.RecordHandShake(latency)
+
+	metrics.CurConnectionCount.WithLabelValues(labels...).Inc()
+	defer metrics.CurConnectionCount.WithLabelValues(labels...).Dec()
+
+	s.l.Infof("relayToAgent from %s to %s via agent %s", c.RemoteAddr(), name, sess.RemoteAddr())
+	return s.handleRelayConn(c, rc, node, connType, opts...)
+}
+
+// ListRemotes returns one node per service, agents come and go so they
+// are not the remotes of the rule.
+func (s *ReverseServer) ListRemotes() []*lb.Node {
+	nodes := make([]*lb.Node, 0, len(s.nodes))
+	for _, name := range slices.Sorted(maps.Keys(s.nodes)) {
+		nodes = append(nodes, s.nodes[name])
+	}
+	return nodes
+}
+
+// StopAccepting closes the listeners of the services and of the agents,
+// the tunnels of the registered agents carry the tcp conns being drained
+// and the udp sessions end with their socket. The agents are told to dial
+// a new tunnel, so the relay restarted by a reload has them at once.
+func (s *ReverseServer) StopAccepting() error {
+	var err error
+	if s.httpServer != nil {
+		err = stopHTTPServer(s.httpServer)
+	}
+	err = errors.Join(err, s.lis.close())
+	s.goAway()
+	return err
+}
+
+func (s *ReverseServer) goAway() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := make(map[*mux.Session]struct{})
+	for _, tunnels := range s.tunnels {
+		for _, t := range tunnels {
+			if _, ok := sent[t]; ok {
+				continue
+			}
+			sent[t] = struct{}{}
+			// a stalled tunnel must not hold the reload up
+			go func() {
+				if st, err := t.OpenStream([]byte{reverseStreamGoAway}); err == nil {
+					st.Close()
+				}
+			}()
+		}
+	}
+}
+
+func (s *ReverseServer) Close() error {
+	err := s.closeRelayer()
+	if s.httpServer != nil {
+		err = errors.Join(err, closeListener(s.httpServer))
+	}
+	err = errors.Join(err, s.lis.close())
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// hijacked ws conns are not closed by the http server
+	for _, tunnels := range s.tunnels {
+		for _, t := range tunnels {
+			t.Close()
+		}
+	}
+	return err
+}
+
+// ReverseAgent is the side of a reverse tunnel behind NAT. It keeps a
+// tunnel to one of its remotes, the reverse servers, registers its
+// services and relays every stream the server opens to the local address
+// of the service.
+type ReverseAgent struct {
+	*BaseRelayServer
+
+	// dials the local address of a service
+	local *RawClient
+	// k: service name, v: node of the local address
+	nodes map[string]*lb.Node
+
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	sess *mux.Session
+	// tunnels the servers sent go away on, they live until the server
+	// closes them
+	oldSess map[*mux.Session]struct{}
+}
+
+func newReverseAgent(bs *BaseRelayServer) (*ReverseAgent, error) {
+	local, err := newRawClient(bs.cfg)
+	if err != nil {
+		return nil, err
+	}
+	a := &ReverseAgent{
+		BaseRelayServer: bs,
+		local:           local,
+		nodes:           make(map[string]*lb.Node),
+		closeCh:         make(chan struct{}),
+		oldSess:         make(map[*mux.Session]struct{}),
+	}
+	for name, addr := range bs.cfg.GetReverseConfig().Services {
+		a.nodes[name] = &lb.Node{Address: addr}
+	}
+	return a, nil
+}
+
+// ListenAndServe keeps the tunnel up, a lost tunnel is redialed with
+// backoff until the agent is closed.
+func (a *ReverseAgent) ListenAndServe(ctx context.Context) error {
+	retry := constant.DefaultReverseRetryInterval
+	for {
+		registered, err := a.serveTunnel(ctx)
+		if registered {
+			retry = constant.DefaultReverseRetryInterval
+		}
+		select {
+		case <-a.closeCh:
+			return nil
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+		if errors.Is(err, errReverseGoAway) {
+			// the relay replacing the server may not listen yet, retry soon
+			a.l.Info(err.Error())
+			retry = constant.DefaultReverseRetryInterval / 10
+			continue
+		}
+		a.l.Warnf("reverse tunnel meet error: %s, redial in %s", err, retry)
+		select {
+		case <-time.After(retry):
+		case <-a.closeCh:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+		retry = min(retry*2, constant.MaxReverseRetryInterval)
+	}
+}
+
+// serveTunnel dials a reverse server and serves its streams until the
+// tunnel dies, registered tells whether the server accepted the agent.
+func (a *ReverseAgent) serveTunnel(ctx context.Context) (bool, error) {
+	remote := a.remotes.Next()
+	if remote == nil {
+		return false, errors.New("no reverse server to dial")
+	}
+	c, remote, err := a.handShake(ctx, remote, true)
+	if err != nil {
+		return false, err
+	}
+	services := slices.Sorted(maps.Keys(a.nodes))
+	if c, err = a.register(c, services); err != nil {
+		c.Close()
+		return false, fmt.Errorf("register to %s: %w", remote.Address, err)
+	}
+	// the session owns c from now on
+	sess := mux.Server(c, newMuxSessionConfig(a.cfg.GetMuxConfig()))
+	if !a.setSession(sess) {
+		sess.Close()
+		return true, net.ErrClosed
+	}
+
+	a.l.Infof("reverse tunnel to %s registered services %v", remote.Address, services)
+	err = a.acceptStreams(ctx, sess)
+	if !errors.Is(err, errReverseGoAway) {
+		sess.Close()
+		return true, err
+	}
+	a.mu.Lock()
+	a.oldSess[sess] = struct{}{}
+	a.mu.Unlock()
+	go func() {
+		for err := errReverseGoAway; errors.Is(err, errReverseGoAway); {
+			err = a.acceptStreams(ctx, sess)
+		}
+		sess.Close()
+		a.mu.Lock()
+		delete(a.oldSess, sess)
+		a.mu.Unlock()
+	}()
+	return true, err
+}
+
+// acceptStreams serves the streams of sess until it dies or the server
+// sends go away.
+func (a *ReverseAgent) acceptStreams(ctx context.Context, sess *mux.Session) error {
+	stop := context.AfterFunc(ctx, func() { sess.Close() })
+	defer stop()
+	for {
+		st, err := sess.AcceptStream()
+		if err != nil {
+			return err
+		}
+		if meta := st.Meta(); len(meta) == 1 && meta[0] == reverseStreamGoAway {
+			st.Close()
+			return errReverseGoAway
+		}
+		go a.handleStream(ctx, st)
+	}
+}
+
+func (a *ReverseAgent) register(c net.Conn, services []string) (net.Conn, error) {
+	c.SetDeadline(time.Now().Add(a.cfg.Options.ReadTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	req := reverseRegister{Token: a.cfg.GetReverseConfig().Token, Services: services}
+	if err := writeJSONLine(c, &req); err != nil {
+		return c, err
+	}
+	br := bufio.NewReaderSize(c, constant.BUFFER_SIZE)
+	var reply reverseRegisterReply
+	if err := readJSONLine(br, &reply); err != nil {
+		return c, err
+	}
+	if reply.Error != "" {
+		return c, errors.New(reply.Error)
+	}
+	return bufferedConn(c, br), nil
+}
+
+func (a *ReverseAgent) setSession(sess *mux.Session) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-a.closeCh:
+		return false
+	default:
+	}
+	a.sess = sess
+	return true
+}
+
+func (a *ReverseAgent) handleStream(ctx context.Context, st *mux.Stream) {
+	defer st.Close()
+	meta := st.Meta()
+	if len(meta) < 2 {
+		a.l.Warnf("reverse stream without service")
+		return
+	}
+	name := string(meta[1:])
+	node, ok := a.nodes[name]
+	if !ok {
+		a.l.Warnf("reverse stream for unknown service %s", name)
+		return
+	}
+	var err error
+	switch meta[0] {
+	case muxStreamTCP:
+		err = a.relayToLocal(ctx, st, node, true)
+	case muxStreamUDP:
+		if !a.cfg.Options.EnableUDP {
+			a.l.Warnf("udp stream of %s rejected, enable_udp is off", name)
+			return
+		}
+		err = a.relayToLocal(ctx, conn.NewUDPFrameConn(st, a.cfg.Label), node, false)
+	default:
+		err = fmt.Errorf("unknown reverse stream type %d", meta[0])
+	}
+	if err != nil {
+		a.l.Errorf("handleStream meet error: %s", err)
+	}
+}
+
+func (a *ReverseAgent) relayToLocal(ctx context.Context, c net.Conn, node *lb.Node, isTCP bool) error {
+	rc, err := a.local.HandShake(ctx, node, isTCP)
+	if err != nil {
+		return fmt.Errorf("dial %s error: %w", node.Address, err)
+	}
+	defer rc.Close()
+
+	connType := metrics.METRIC_CONN_TYPE_TCP
+	if !isTCP {
+		connType = metrics.METRIC_CONN_TYPE_UDP
+	}
+	labels := []string{a.cfg.Label, connType, node.Address}
+	metrics.CurConnectionCount.WithLabelValues(labels...).Inc()
+	defer metrics.CurConnectionCount.WithLabelValues(labels...).Dec()
+
+	a.l.Infof("relayToLocal from tunnel to %s", node.Address)
+	return a.handleRelayConn(c, rc, node, connType)
+}
+
+// StopAccepting stops redialing the tunnel, the streams the server opens
+// on it now are rejected by the drain.
+func (a *ReverseAgent) StopAccepting() error {
+	a.closeOnce.Do(func() { close(a.closeCh) })
+	return nil
+}
+
+func (a *ReverseAgent) Close() error {
+	_ = a.StopAccepting()
+	a.mu.Lock()
+	if a.sess != nil {
+		a.sess.Close()
+	}
+	for sess := range a.oldSess {
+		sess.Close()
+	}
+	a.mu.Unlock()
+	return a.closeRelayer()
+}
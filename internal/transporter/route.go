@@ -0,0 +1,88 @@
+package transporter
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+// route is a RouteConfig with the balancer of its remotes.
+type route struct {
+	cfg     *conf.RouteConfig
+	remotes lb.Balancer
+}
+
+// buildRoutes reuses the route of old with the same config so its nodes
+// keep their health and ejection state across updates.
+func (b *BaseRelayServer) buildRoutes(cfgs []*conf.RouteConfig, old []*route) ([]*route, error) {
+	routes := make([]*route, 0, len(cfgs))
+	for _, rc := range cfgs {
+		if idx := slices.IndexFunc(old, func(r *route) bool { return r.cfg.Equal(rc) }); idx >= 0 {
+			routes = append(routes, old[idx])
+			continue
+		}
+		remotes, err := rc.ToRemotesLB(b.cfg, b.counter)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, &route{cfg: rc.Clone(), remotes: remotes})
+	}
+	return routes, nil
+}
+
+// UpdateRoutes swaps the routes of the running relay, conns already
+// relayed keep their remote.
+func (b *BaseRelayServer) UpdateRoutes(cfgs []*conf.RouteConfig) error {
+	routes, err := b.buildRoutes(cfgs, *b.routes.Load())
+	if err != nil {
+		return err
+	}
+	b.routes.Store(&routes)
+	b.l.Infof("routes updated, %d routes now", len(routes))
+	return nil
+}
+
+// routeRemote picks a remote of the first route matching the tls sni or
+// the http host and path of the sniffed conn, nil when no route matches.
+func (b *BaseRelayServer) routeRemote(res sniffResult, clientAddr string) *lb.Node {
+	routes := *b.routes.Load()
+	if len(routes) == 0 {
+		return nil
+	}
+	var host string
+	switch res.Protocol {
+	case conf.ProtocolTLS:
+		host = res.SNI
+	case conf.ProtocolHTTP:
+		host = res.Host
+	default:
+		return nil
+	}
+	for _, r := range routes {
+		if r.cfg.PathPrefix != "" && (res.Protocol != conf.ProtocolHTTP || !strings.HasPrefix(res.Path, r.cfg.PathPrefix)) {
+			continue
+		}
+		if r.cfg.MatchHost(host) {
+			remote := lb.NextFor(r.remotes, clientAddr)
+			b.l.Debugf("route %s host=%s path=%s to %s", res.Protocol, host, res.Path, remote.Address)
+			return remote
+		}
+	}
+	return nil
+}
+
+// poolOf returns the balancer remote belongs to, the one of the rule or
+// of a route, nil for remotes set by the client.
+func (b *BaseRelayServer) poolOf(remote *lb.Node) lb.Balancer {
+	if slices.Contains(b.remotes.GetAll(), remote) {
+		return b.remotes
+	}
+	for _, r := range *b.routes.Load() {
+		if slices.Contains(r.remotes.GetAll(), remote) {
+			return r.remotes
+		}
+	}
+	return nil
+}
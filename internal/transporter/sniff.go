@@ -2,24 +2,83 @@ package transporter
 
 import (
 	"bytes"
+	"encoding/binary"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/Ehco1996/ehco/internal/relay/conf"
 )
 
 const peekBufferSize = 4096
 
-// sniffProtocol detects the protocol from peeked connection data.
-// Returns conf.ProtocolTLS, conf.ProtocolHTTP, or empty string if unknown.
-func sniffProtocol(data []byte) string {
-	if isTLSClientHello(data) {
-		return conf.ProtocolTLS
+// sniffResult is what the sniffers learned from the first bytes of a conn,
+// Protocol is empty when none of them matched.
+type sniffResult struct {
+	Protocol string
+
+	// tls only, from the ClientHello
+	SNI  string
+	ALPN []string
+	// http only, from the request head
+	Host string
+	Path string
+}
+
+// sniffer recognises one protocol from the first bytes of a tcp conn or the
+// first datagram of a udp session, sniff returns nil when data is not it.
+type sniffer struct {
+	protocol string
+	tcp, udp bool
+	sniff    func(data []byte) *sniffResult
+}
+
+// sniffers are tried in registration order, the first match wins.
+var sniffers []*sniffer
+
+func registerSniffer(s *sniffer) {
+	sniffers = append(sniffers, s)
+}
+
+func init() {
+	registerSniffer(&sniffer{protocol: conf.ProtocolTLS, tcp: true, sniff: sniffTLS})
+	registerSniffer(&sniffer{protocol: conf.ProtocolHTTP, tcp: true, sniff: sniffHTTP})
+	registerSniffer(&sniffer{protocol: conf.ProtocolSSH, tcp: true, sniff: match(conf.ProtocolSSH, isSSHBanner)})
+	registerSniffer(&sniffer{protocol: conf.ProtocolSOCKS4, tcp: true, sniff: match(conf.ProtocolSOCKS4, isSOCKS4Request)})
+	registerSniffer(&sniffer{protocol: conf.ProtocolSOCKS5, tcp: true, sniff: match(conf.ProtocolSOCKS5, isSOCKS5Greeting)})
+	registerSniffer(&sniffer{protocol: conf.ProtocolBitTorrent, tcp: true, sniff: match(conf.ProtocolBitTorrent, isBitTorrentHandshake)})
+	registerSniffer(&sniffer{protocol: conf.ProtocolRDP, tcp: true, sniff: match(conf.ProtocolRDP, isRDPConnectionRequest)})
+	registerSniffer(&sniffer{protocol: conf.ProtocolSTUN, tcp: true, udp: true, sniff: match(conf.ProtocolSTUN, isSTUNMessage)})
+	registerSniffer(&sniffer{protocol: conf.ProtocolQUIC, udp: true, sniff: match(conf.ProtocolQUIC, isQUICInitial)})
+}
+
+// match makes a sniffer of a detector that parses no fields.
+func match(protocol string, detect func([]byte) bool) func([]byte) *sniffResult {
+	return func(data []byte) *sniffResult {
+		if !detect(data) {
+			return nil
+		}
+		return &sniffResult{Protocol: protocol}
 	}
-	if isHTTPRequest(data) {
-		return conf.ProtocolHTTP
+}
+
+// sniff runs the sniffers of the network on data.
+func sniff(data []byte, udp bool) sniffResult {
+	for _, s := range sniffers {
+		if (udp && !s.udp) || (!udp && !s.tcp) {
+			continue
+		}
+		if res := s.sniff(data); res != nil {
+			return *res
+		}
 	}
-	return ""
+	return sniffResult{}
+}
+
+// sniffProtocol detects the protocol from peeked tcp connection data.
+// Returns one of conf.SniffProtocols, or empty string if unknown.
+func sniffProtocol(data []byte) string {
+	return sniff(data, false).Protocol
 }
 
 // isTLSClientHello checks if data looks like a TLS ClientHello message.
@@ -38,6 +97,14 @@ func isTLSClientHello(data []byte) bool {
 	return data[5] == 0x01
 }
 
+func sniffTLS(data []byte) *sniffResult {
+	if !isTLSClientHello(data) {
+		return nil
+	}
+	sni, alpn := parseClientHello(data)
+	return &sniffResult{Protocol: conf.ProtocolTLS, SNI: sni, ALPN: alpn}
+}
+
 var httpMethods = [][]byte{
 	[]byte("GET "),
 	[]byte("POST "),
@@ -59,6 +126,202 @@ func isHTTPRequest(data []byte) bool {
 	return false
 }
 
+func sniffHTTP(data []byte) *sniffResult {
+	if !isHTTPRequest(data) {
+		return nil
+	}
+	host, path := parseHTTPHost(data)
+	return &sniffResult{Protocol: conf.ProtocolHTTP, Host: host, Path: path}
+}
+
+// isSSHBanner checks the version exchange the client sends first, RFC 4253 4.2.
+func isSSHBanner(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("SSH-1.")) || bytes.HasPrefix(data, []byte("SSH-2.0-"))
+}
+
+// isSOCKS4Request checks VER(4) | CMD(1 connect, 2 bind) | PORT(2) | IP(4) | USERID | NULL
+func isSOCKS4Request(data []byte) bool {
+	if len(data) < 9 || data[0] != 0x04 || (data[1] != 0x01 && data[1] != 0x02) {
+		return false
+	}
+	return bytes.IndexByte(data[8:], 0) >= 0
+}
+
+// isSOCKS5Greeting checks VER(5) | NMETHODS | METHODS, the client waits for
+// the method selection so nothing follows the greeting.
+func isSOCKS5Greeting(data []byte) bool {
+	return len(data) >= 3 && data[0] == 0x05 && data[1] > 0 && len(data) == 2+int(data[1])
+}
+
+var bitTorrentProtocol = []byte("\x13BitTorrent protocol")
+
+func isBitTorrentHandshake(data []byte) bool {
+	return bytes.HasPrefix(data, bitTorrentProtocol)
+}
+
+// isRDPConnectionRequest checks a TPKT header(version 3) carrying a X.224
+// connection request, the first packet of an rdp client.
+func isRDPConnectionRequest(data []byte) bool {
+	if len(data) < 11 || data[0] != 0x03 || data[1] != 0x00 {
+		return false
+	}
+	if int(binary.BigEndian.Uint16(data[2:4])) != len(data) {
+		return false
+	}
+	// length indicator covers the rest of the x.224 header, CR code is 0xE0
+	return int(data[4]) == len(data)-5 && data[5]&0xf0 == 0xe0
+}
+
+const stunMagicCookie = 0x2112a442
+
+// isSTUNMessage checks the 20 bytes header of RFC 5389, the top two bits
+// are zero and the magic cookie follows the message type and length.
+func isSTUNMessage(data []byte) bool {
+	if len(data) < 20 || data[0]&0xc0 != 0 {
+		return false
+	}
+	if binary.BigEndian.Uint32(data[4:8]) != stunMagicCookie {
+		return false
+	}
+	msgLen := int(binary.BigEndian.Uint16(data[2:4]))
+	return msgLen%4 == 0 && len(data) >= 20+msgLen
+}
+
+const (
+	quicVersion1 = 0x00000001
+	quicVersion2 = 0x6b3343cf
+	// RFC 9000 14.1, datagrams with a client initial are padded to this
+	quicMinInitialSize = 1200
+)
+
+// isQUICInitial checks the long header of a client initial packet of quic
+// v1 or v2, the payload is encrypted so nothing more is parsed.
+func isQUICInitial(data []byte) bool {
+	if len(data) < quicMinInitialSize || data[0]&0xc0 != 0xc0 {
+		return false
+	}
+	packetType := data[0] & 0x30 >> 4
+	switch binary.BigEndian.Uint32(data[1:5]) {
+	case quicVersion1:
+		return packetType == 0
+	case quicVersion2:
+		return packetType == 1
+	default:
+		return false
+	}
+}
+
+// sniffComplete reports whether data holds the whole tls record of the
+// ClientHello or the whole http request head, data of other protocols is
+// never waited for.
+func sniffComplete(data []byte) bool {
+	switch {
+	case isTLSClientHello(data):
+		return len(data) >= 5+int(binary.BigEndian.Uint16(data[3:5]))
+	case isHTTPRequest(data):
+		return bytes.Contains(data, []byte("\r\n\r\n"))
+	default:
+		return true
+	}
+}
+
+// parseClientHello returns the server_name and the alpn protocols of a
+// ClientHello, empty when data is not a ClientHello or lacks them.
+func parseClientHello(data []byte) (sni string, alpn []string) {
+	if !isTLSClientHello(data) {
+		return "", nil
+	}
+	// record header(5), handshake type(1) and length(3), version(2), random(32)
+	rec := data[5:]
+	if recLen := int(binary.BigEndian.Uint16(data[3:5])); len(rec) > recLen {
+		rec = rec[:recLen]
+	}
+	if len(rec) < 4 {
+		return "", nil
+	}
+	p := rec[4:]
+	skip := func(n int) bool {
+		if len(p) < n {
+			return false
+		}
+		p = p[n:]
+		return true
+	}
+	// skipVec skips a vector with a big endian length prefix of size bytes
+	skipVec := func(size int) bool {
+		if len(p) < size {
+			return false
+		}
+		n := 0
+		for _, b := range p[:size] {
+			n = n<<8 | int(b)
+		}
+		return skip(size + n)
+	}
+	if !skip(2+32) || !skipVec(1) || !skipVec(2) || !skipVec(1) {
+		return "", nil
+	}
+	if len(p) < 2 {
+		return "", nil
+	}
+	exts := p[2:]
+	if n := int(binary.BigEndian.Uint16(p)); n < len(exts) {
+		exts = exts[:n]
+	}
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		exts = exts[4:]
+		if n > len(exts) {
+			break
+		}
+		ext := exts[:n]
+		exts = exts[n:]
+		switch typ {
+		case 0: // server_name
+			// server name list length(2), then name type(1) and length(2)
+			if len(ext) < 5 || ext[2] != 0 {
+				continue
+			}
+			if nameLen := int(binary.BigEndian.Uint16(ext[3:])); len(ext) >= 5+nameLen {
+				sni = string(ext[5 : 5+nameLen])
+			}
+		case 16: // application_layer_protocol_negotiation
+			// protocol name list length(2), then names with a length(1) prefix
+			if len(ext) < 2 {
+				continue
+			}
+			for list := ext[2:]; len(list) > 0 && len(list) > int(list[0]); list = list[1+int(list[0]):] {
+				alpn = append(alpn, string(list[1:1+int(list[0])]))
+			}
+		}
+	}
+	return sni, alpn
+}
+
+// parseHTTPHost returns the Host header without port and the request path
+// of an http request head.
+func parseHTTPHost(data []byte) (host, path string) {
+	head, _, _ := bytes.Cut(data, []byte("\r\n\r\n"))
+	lines := strings.Split(string(head), "\r\n")
+	if fields := strings.Fields(lines[0]); len(fields) == 3 {
+		path = fields[1]
+	}
+	for _, line := range lines[1:] {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "Host") {
+			continue
+		}
+		host = strings.TrimSpace(v)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		break
+	}
+	return host, path
+}
+
 // peekedConn wraps a net.Conn, prepending previously peeked data to reads.
 type peekedConn struct {
 	net.Conn
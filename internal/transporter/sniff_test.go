@@ -1,10 +1,14 @@
 package transporter
 
 import (
+	"crypto/tls"
+	"net"
+	"slices"
 	"testing"
 
 	"github.com/Ehco1996/ehco/internal/relay/conf"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIsTLSClientHello(t *testing.T) {
@@ -110,3 +114,111 @@ func TestSniffProtocol(t *testing.T) {
 		})
 	}
 }
+
+// clientHello returns the first record a crypto/tls client sends.
+func clientHello(t *testing.T, sni string, alpn ...string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		_ = tls.Client(c, &tls.Config{ServerName: sni, NextProtos: alpn, InsecureSkipVerify: true}).Handshake()
+		c.Close()
+	}()
+	buf := make([]byte, peekBufferSize)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	return buf[:n]
+}
+
+func TestParseClientHello(t *testing.T) {
+	hello := clientHello(t, "api.example.com", "h2", "http/1.1")
+	assert.True(t, sniffComplete(hello))
+	sni, alpn := parseClientHello(hello)
+	assert.Equal(t, "api.example.com", sni)
+	assert.Equal(t, []string{"h2", "http/1.1"}, alpn)
+
+	res := sniff(hello, false)
+	assert.Equal(t, conf.ProtocolTLS, res.Protocol)
+	assert.Equal(t, "api.example.com", res.SNI)
+	assert.Equal(t, []string{"h2", "http/1.1"}, res.ALPN)
+
+	// an ip server name is not sent as sni
+	sni, alpn = parseClientHello(clientHello(t, "127.0.0.1"))
+	assert.Equal(t, "", sni)
+	assert.Empty(t, alpn)
+
+	// truncated hello neither panics nor is complete
+	for _, n := range []int{6, 10, 50, len(hello) / 2} {
+		assert.False(t, sniffComplete(hello[:n]), n)
+		assert.NotPanics(t, func() { parseClientHello(hello[:n]) })
+	}
+	sni, _ = parseClientHello([]byte("GET / HTTP/1.1\r\n"))
+	assert.Equal(t, "", sni)
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		host string
+		path string
+	}{
+		{name: "host", data: "GET /v1/x HTTP/1.1\r\nHost: Example.com\r\n\r\n", host: "Example.com", path: "/v1/x"},
+		{name: "host with port", data: "POST / HTTP/1.1\r\nhost: example.com:8080\r\n\r\n", host: "example.com", path: "/"},
+		{name: "ipv6", data: "GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n", host: "::1", path: "/"},
+		{name: "no host", data: "GET /a HTTP/1.0\r\nAccept: */*\r\n\r\n", path: "/a"},
+		{name: "body not parsed", data: "POST / HTTP/1.1\r\n\r\nHost: x.com\r\n", path: "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host, path := parseHTTPHost([]byte(tt.data))
+			assert.Equal(t, tt.host, host)
+			assert.Equal(t, tt.path, path)
+		})
+	}
+	assert.False(t, sniffComplete([]byte("GET / HTTP/1.1\r\nHost: x.com\r\n")))
+	assert.True(t, sniffComplete([]byte("GET / HTTP/1.1\r\nHost: x.com\r\n\r\n")))
+	assert.True(t, sniffComplete([]byte("SSH-2.0-OpenSSH")))
+}
+
+func TestSniffRegistry(t *testing.T) {
+	stun := []byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}
+	stun = append(stun, make([]byte, 12)...)
+	rdp := []byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00}
+	quicV1 := append([]byte{0xc3, 0x00, 0x00, 0x00, 0x01}, make([]byte, 1195)...)
+	quicV2 := append([]byte{0xd3, 0x6b, 0x33, 0x43, 0xcf}, make([]byte, 1195)...)
+
+	tests := []struct {
+		name string
+		data []byte
+		udp  bool
+		want string
+	}{
+		{name: "ssh", data: []byte("SSH-2.0-OpenSSH_9.6\r\n"), want: conf.ProtocolSSH},
+		{name: "socks4", data: []byte{0x04, 0x01, 0x00, 0x50, 0x01, 0x02, 0x03, 0x04, 'u', 0x00}, want: conf.ProtocolSOCKS4},
+		{name: "socks4 without userid end", data: []byte{0x04, 0x01, 0x00, 0x50, 0x01, 0x02, 0x03, 0x04, 'u'}, want: ""},
+		{name: "socks5", data: []byte{0x05, 0x02, 0x00, 0x02}, want: conf.ProtocolSOCKS5},
+		{name: "socks5 wrong method count", data: []byte{0x05, 0x03, 0x00, 0x02}, want: ""},
+		{name: "bittorrent", data: append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...), want: conf.ProtocolBitTorrent},
+		{name: "rdp", data: rdp, want: conf.ProtocolRDP},
+		{name: "rdp wrong length", data: rdp[:12], want: ""},
+		{name: "stun tcp", data: stun, want: conf.ProtocolSTUN},
+		{name: "stun udp", data: stun, udp: true, want: conf.ProtocolSTUN},
+		{name: "quic v1", data: quicV1, udp: true, want: conf.ProtocolQUIC},
+		{name: "quic v2", data: quicV2, udp: true, want: conf.ProtocolQUIC},
+		{name: "quic too short", data: quicV1[:100], udp: true, want: ""},
+		{name: "quic handshake packet", data: append([]byte{0xe3}, quicV1[1:]...), udp: true, want: ""},
+		{name: "quic is udp only", data: quicV1, want: ""},
+		{name: "http is tcp only", data: []byte("GET / HTTP/1.1\r\n\r\n"), udp: true, want: ""},
+		{name: "unknown", data: []byte{0x00, 0x01, 0x02, 0x03}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sniff(tt.data, tt.udp).Protocol)
+		})
+	}
+
+	// every protocol accepted by the config has a sniffer
+	for _, protocol := range conf.SniffProtocols {
+		assert.True(t, slices.ContainsFunc(sniffers, func(s *sniffer) bool { return s.protocol == protocol }), protocol)
+	}
+}
@@ -0,0 +1,292 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/pkg/socks5"
+)
+
+var _ RelayServer = &Socks5Server{}
+
+// udp sessions one udp associate can open, one per destination
+const socks5MaxUDPSessions = 256
+
+var errSocks5AuthFailed = errors.New("socks5 auth failed")
+
+// Socks5Server takes the destination from the socks5 client, the next hop
+// is reached through the raw/ws/wss relay client of the rule.
+type Socks5Server struct {
+	*BaseRelayServer
+
+	lis    listeners
+	direct *lb.Node
+}
+
+func newSocks5Server(bs *BaseRelayServer) (*Socks5Server, error) {
+	return &Socks5Server{BaseRelayServer: bs, direct: &lb.Node{Address: directRemoteAddress}}, nil
+}
+
+func (s *Socks5Server) ListenAndServe(ctx context.Context) error {
+	lis, err := NewTCPListener(ctx, s.cfg)
+	if err != nil {
+		return err
+	}
+	if err := s.lis.add(lis); err != nil {
+		return err
+	}
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+				return
+			}
+			if err := s.handleConn(ctx, c); err != nil {
+				s.l.Errorf("handleConn meet error: %s", err.Error())
+			}
+		}(c)
+	}
+}
+
+func (s *Socks5Server) StopAccepting() error {
+	return s.lis.close()
+}
+
+func (s *Socks5Server) Close() error {
+	return errors.Join(s.closeRelayer(), s.StopAccepting())
+}
+
+func (s *Socks5Server) handleConn(ctx context.Context, c net.Conn) error {
+	// negotiation must finish in time, the relay sets its own deadlines
+	c.SetDeadline(time.Now().Add(s.cfg.Options.ReadTimeout))
+	br := bufio.NewReader(c)
+	user, err := s.negotiate(br, c)
+	if err != nil {
+		return err
+	}
+	req, err := socks5.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("read request from %s: %w", c.RemoteAddr(), err)
+	}
+	c.SetDeadline(time.Time{})
+	// some clients send data without waiting for the reply
+	if n := br.Buffered(); n > 0 {
+		peek, _ := br.Peek(n)
+		c = newPeekedConn(c, peek)
+	}
+
+	switch req.Cmd {
+	case socks5.CmdConnect:
+		if !s.cfg.GetProxyConfig().AllowDestination(req.Addr) {
+			socks5.WriteReply(c, socks5.RepNotAllowed, nil)
+			return fmt.Errorf("user:%s destination %s not allowed", user, req.Addr)
+		}
+		remote := s.proxyRemote(s.direct, c.RemoteAddr().String())
+		return s.relayProxyTCP(ctx, c, remote, req.Addr, user, func(rc net.Conn, err error) error {
+			if err != nil {
+				return socks5.WriteReply(c, socks5.RepHostUnreachable, nil)
+			}
+			return socks5.WriteReply(c, socks5.RepSuccess, rc.LocalAddr())
+		})
+	case socks5.CmdUDPAssociate:
+		if !s.cfg.Options.EnableUDP {
+			socks5.WriteReply(c, socks5.RepCommandNotSupported, nil)
+			return fmt.Errorf("udp associate from %s but udp is not enabled", c.RemoteAddr())
+		}
+		return s.handleUDPAssociate(ctx, c, req, user)
+	default:
+		socks5.WriteReply(c, socks5.RepCommandNotSupported, nil)
+		return fmt.Errorf("unsupported socks5 command %d from %s", req.Cmd, c.RemoteAddr())
+	}
+}
+
+// negotiate picks the auth method and returns the authenticated user.
+func (s *Socks5Server) negotiate(r io.Reader, w io.Writer) (string, error) {
+	methods, err := socks5.ReadGreeting(r)
+	if err != nil {
+		return "", err
+	}
+	pc := s.cfg.GetProxyConfig()
+	want := socks5.MethodNoAuth
+	if pc.NeedAuth() {
+		want = socks5.MethodUserPass
+	}
+	if !slices.Contains(methods, want) {
+		socks5.WriteMethod(w, socks5.MethodNoAcceptable)
+		return "", fmt.Errorf("no acceptable auth method in %v", methods)
+	}
+	if err := socks5.WriteMethod(w, want); err != nil {
+		return "", err
+	}
+	if want == socks5.MethodNoAuth {
+		return "", nil
+	}
+
+	user, pass, err := socks5.ReadUserPass(r)
+	if err != nil {
+		return "", err
+	}
+	if !pc.CheckUser(user, pass) {
+		socks5.WriteUserPassStatus(w, false)
+		return "", fmt.Errorf("%w for user:%s", errSocks5AuthFailed, user)
+	}
+	return user, socks5.WriteUserPassStatus(w, true)
+}
+
+// handleUDPAssociate relays datagrams of the client until the control conn
+// c is closed. Every destination is a session relayed on its own, just like
+// a udp conn of the raw listener.
+func (s *Socks5Server) handleUDPAssociate(ctx context.Context, c net.Conn, req *socks5.Request, user string) error {
+	clientIP := c.RemoteAddr().(*net.TCPAddr).IP
+	// the client may tell the port it sends from, 0 means unknown
+	var clientPort int
+	if addr, err := net.ResolveUDPAddr("udp", req.Addr); err == nil {
+		clientPort = addr.Port
+	}
+
+	localIP := c.LocalAddr().(*net.TCPAddr).IP
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		socks5.WriteReply(c, socks5.RepGeneralFailure, nil)
+		return err
+	}
+	defer pc.Close()
+	if err := socks5.WriteReply(c, socks5.RepSuccess, pc.LocalAddr()); err != nil {
+		return err
+	}
+
+	a := &socks5Association{
+		s:          s,
+		pc:         pc,
+		user:       user,
+		clientIP:   clientIP,
+		clientPort: clientPort,
+		sessions:   make(map[string]*conn.QueueConn),
+	}
+	go func() {
+		// the association ends with the control conn
+		io.Copy(io.Discard, c)
+		pc.Close()
+	}()
+	a.serve(ctx)
+	return nil
+}
+
+type socks5Association struct {
+	s    *Socks5Server
+	pc   *net.UDPConn
+	user string
+
+	clientIP   net.IP
+	clientPort int
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr
+	sessions   map[string]*conn.QueueConn
+}
+
+func (a *socks5Association) serve(ctx context.Context) {
+	defer a.closeSessions()
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := a.pc.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.clientIP) || (a.clientPort != 0 && from.Port != a.clientPort) {
+			continue
+		}
+		target, payload, err := socks5.ParseUDPDatagram(buf[:n])
+		if err != nil {
+			a.s.l.Debugf("drop udp datagram from %s: %s", from, err)
+			continue
+		}
+		a.mu.Lock()
+		a.clientAddr = from
+		a.mu.Unlock()
+
+		qc := a.session(ctx, target)
+		if qc == nil {
+			continue
+		}
+		p := make([]byte, len(payload))
+		copy(p, payload)
+		qc.Push(p)
+	}
+}
+
+// session returns the session to target, a new one is relayed when it
+// does not exist yet. nil means the datagram should be dropped.
+func (a *socks5Association) session(ctx context.Context, target string) *conn.QueueConn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if qc, ok := a.sessions[target]; ok {
+		return qc
+	}
+	if len(a.sessions) >= socks5MaxUDPSessions {
+		return nil
+	}
+	if !a.s.cfg.GetProxyConfig().AllowDestination(target) {
+		a.s.l.Debugf("user:%s udp destination %s not allowed", a.user, target)
+		return nil
+	}
+
+	var qc *conn.QueueConn
+	write := func(b []byte) (int, error) {
+		p, err := socks5.BuildUDPDatagram(target, b)
+		if err != nil {
+			return 0, err
+		}
+		a.mu.Lock()
+		clientAddr := a.clientAddr
+		a.mu.Unlock()
+		if _, err := a.pc.WriteToUDP(p, clientAddr); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	qc = conn.NewQueueConn(a.s.cfg.Label, a.pc.LocalAddr(), a.clientAddr, write, func() {
+		a.mu.Lock()
+		if a.sessions[target] == qc {
+			delete(a.sessions, target)
+		}
+		a.mu.Unlock()
+	})
+	a.sessions[target] = qc
+
+	remote := a.s.proxyRemote(a.s.direct, a.clientAddr.String())
+	go func() {
+		defer qc.Close()
+		if err := a.s.relayProxyUDP(ctx, qc, remote, target, a.user); err != nil {
+			a.s.l.Errorf("relayProxyUDP meet error: %s", err.Error())
+		}
+	}()
+	return qc
+}
+
+func (a *socks5Association) closeSessions() {
+	a.mu.Lock()
+	sessions := make([]*conn.QueueConn, 0, len(a.sessions))
+	for _, qc := range a.sessions {
+		sessions = append(sessions, qc)
+	}
+	a.mu.Unlock()
+	for _, qc := range sessions {
+		qc.Close()
+	}
+}
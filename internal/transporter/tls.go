@@ -0,0 +1,182 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+	mytls "github.com/Ehco1996/ehco/internal/tls"
+)
+
+// alpnUDP is offered by the client for udp sessions, so the server knows
+// to unwrap length-prefixed datagrams without an extra preamble and plain
+// tls clients can still use the tls listener for tcp.
+const alpnUDP = "ehco-udp"
+
+var (
+	_ RelayClient = &TlsClient{}
+	_ RelayServer = &TlsServer{}
+)
+
+type TlsClient struct {
+	dialer *net.Dialer
+	cfg    *conf.Config
+	l      *zap.SugaredLogger
+
+	tlsCfg *tls.Config
+}
+
+func newTlsClient(cfg *conf.Config) (*TlsClient, error) {
+	tc := cfg.GetTLSConfig()
+	tlsCfg, err := mytls.NewClientTLSConfig(tc.ServerName, tc.CAFile, tc.ALPN, tc.InsecureSkipVerify)
+	if err != nil {
+		return nil, err
+	}
+	dialer := NewNetDialer(cfg)
+	dialer.Timeout = cfg.Options.DialTimeout
+	return &TlsClient{
+		cfg:    cfg,
+		dialer: dialer,
+		tlsCfg: tlsCfg,
+		l:      zap.S().Named(string(cfg.TransportType)),
+	}, nil
+}
+
+func (c *TlsClient) HandShake(ctx context.Context, remote *lb.Node, isTCP bool) (net.Conn, error) {
+	t1 := time.Now()
+	alpn := ""
+	if !isTCP {
+		alpn = alpnUDP
+	}
+	tc, err := c.dial(ctx, remote, alpn)
+	if err != nil {
+		return nil, err
+	}
+	if !isTCP && tc.ConnectionState().NegotiatedProtocol != alpnUDP {
+		tc.Close()
+		return nil, errors.New("remote tls server does not support udp")
+	}
+
+	latency := time.Since(t1)
+	connType := metrics.METRIC_CONN_TYPE_TCP
+	if !isTCP {
+		connType = metrics.METRIC_CONN_TYPE_UDP
+	}
+	labels := []string{c.cfg.Label, connType, remote.Address}
+	metrics.HandShakeDurationMilliseconds.WithLabelValues(labels...).Observe(float64(latency.Milliseconds()))
+	remote.RecordHandShake(latency)
+	if !isTCP {
+		return conn.NewUDPFrameConn(tc, c.cfg.Label), nil
+	}
+	return tc, nil
+}
+
+// dial returns a conn that finished the tls handshake,
+// alpn overrides the configured protocols when not empty.
+func (c *TlsClient) dial(ctx context.Context, remote *lb.Node, alpn string) (*tls.Conn, error) {
+	rc, err := c.dialer.DialContext(ctx, "tcp", remote.Address)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := c.tlsCfg.Clone()
+	if tlsCfg.ServerName == "" {
+		host, err := remote.GetAddrHost()
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		tlsCfg.ServerName = host
+	}
+	if alpn != "" {
+		tlsCfg.NextProtos = []string{alpn}
+	}
+	tc := tls.Client(rc, tlsCfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+type TlsServer struct {
+	*BaseRelayServer
+	lis listeners
+}
+
+func newTlsServer(bs *BaseRelayServer) (*TlsServer, error) {
+	return &TlsServer{BaseRelayServer: bs}, nil
+}
+
+func (s *TlsServer) ListenAndServe(ctx context.Context) error {
+	tc := s.cfg.GetTLSConfig()
+	tlsCfg, err := mytls.NewServerTLSConfig(tc.CertFile, tc.KeyFile, tc.ALPN)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Options.EnableUDP && !slices.Contains(tlsCfg.NextProtos, alpnUDP) {
+		tlsCfg.NextProtos = append(tlsCfg.NextProtos, alpnUDP)
+	}
+	lis, err := newTLSListener(ctx, s.cfg, tlsCfg)
+	if err != nil {
+		return err
+	}
+	if err := s.lis.add(lis); err != nil {
+		return err
+	}
+	for {
+		c, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(ctx, c.(*tls.Conn))
+	}
+}
+
+func (s *TlsServer) handleConn(ctx context.Context, c *tls.Conn) {
+	defer c.Close()
+	if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+		return
+	}
+	hsCtx, cancel := context.WithTimeout(ctx, s.cfg.Options.ReadTimeout)
+	err := c.HandshakeContext(hsCtx)
+	cancel()
+	if err != nil {
+		s.l.Debugf("tls handshake with %s failed: %s", c.RemoteAddr(), err)
+		return
+	}
+	remote := lb.NextFor(s.remotes, c.RemoteAddr().String())
+	if c.ConnectionState().NegotiatedProtocol == alpnUDP {
+		err = s.RelayUDPConn(ctx, conn.NewUDPFrameConn(c, s.cfg.Label), remote)
+	} else {
+		err = s.RelayTCPConn(ctx, c, remote)
+	}
+	if err != nil {
+		s.l.Errorf("handleConn meet error: %s", err)
+	}
+}
+
+func (s *TlsServer) StopAccepting() error {
+	return s.lis.close()
+}
+
+func (s *TlsServer) Close() error {
+	return errors.Join(s.closeRelayer(), s.StopAccepting())
+}
+
+func newTLSListener(ctx context.Context, cfg *conf.Config, tlsCfg *tls.Config) (net.Listener, error) {
+	ts, err := NewTCPListener(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ts, tlsCfg), nil
+}
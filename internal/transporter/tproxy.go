@@ -0,0 +1,177 @@
+// nolint: errcheck
+package transporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Ehco1996/ehco/internal/conn"
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/lb"
+	"github.com/Ehco1996/ehco/internal/metrics"
+)
+
+var _ RelayServer = &TProxyServer{}
+
+// TProxyServer relays conns steered to it by iptables/nftables to their
+// original destination, REDIRECT recovers it from conntrack and TPROXY
+// keeps it as the local address of the conn. Like socks5 the destination
+// is dialed by raw or handed to the ws/wss remote as remote_addr.
+type TProxyServer struct {
+	*BaseRelayServer
+
+	lis listeners
+	// address of the tcp listener, set before the first conn is accepted
+	listenAddr *net.TCPAddr
+	direct     *lb.Node
+}
+
+func newTProxyServer(bs *BaseRelayServer) (*TProxyServer, error) {
+	return &TProxyServer{BaseRelayServer: bs, direct: &lb.Node{Address: directRemoteAddress}}, nil
+}
+
+func (s *TProxyServer) ListenAndServe(ctx context.Context) error {
+	ts, err := s.listenTCP(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.lis.add(ts); err != nil {
+		return err
+	}
+	s.listenAddr = ts.Addr().(*net.TCPAddr)
+
+	if s.cfg.Options.EnableUDP {
+		udpLis, err := conn.NewUDPListener(ctx, s.cfg)
+		if err != nil {
+			return errors.Join(err, s.lis.close())
+		}
+		if err := s.lis.add(udpLis); err != nil {
+			return err
+		}
+		go s.listenUDP(ctx, udpLis)
+	}
+
+	for {
+		c, err := ts.Accept()
+		if err != nil {
+			return err
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_TCP) {
+				return
+			}
+			if err := s.handleConn(ctx, c); err != nil {
+				s.l.Errorf("handleConn meet error: %s", err.Error())
+			}
+		}(c)
+	}
+}
+
+func (s *TProxyServer) listenTCP(ctx context.Context) (net.Listener, error) {
+	if s.cfg.ListenType == constant.RelayTypeRedirect {
+		return NewTCPListener(ctx, s.cfg)
+	}
+	lcfg := net.ListenConfig{Control: conn.TransparentControl}
+	lcfg.SetMultipathTCP(s.cfg.Options.EnableMultipathTCP)
+	return lcfg.Listen(ctx, "tcp", s.cfg.Listen)
+}
+
+func (s *TProxyServer) handleConn(ctx context.Context, c net.Conn) error {
+	target, err := s.originalDst(c)
+	if err != nil {
+		return err
+	}
+	if !s.cfg.GetProxyConfig().AllowDestination(target.String()) {
+		return fmt.Errorf("destination %s not allowed", target)
+	}
+	remote := s.proxyRemote(s.direct, c.RemoteAddr().String())
+	return s.relayProxyTCP(ctx, c, remote, target.String(), "", func(net.Conn, error) error { return nil })
+}
+
+// originalDst returns where the client sent the conn to. A conn that was
+// not steered to us has our own address, relaying it would loop.
+func (s *TProxyServer) originalDst(c net.Conn) (*net.TCPAddr, error) {
+	local := c.LocalAddr().(*net.TCPAddr)
+	target := local
+	if s.cfg.ListenType == constant.RelayTypeRedirect {
+		tc, ok := c.(*net.TCPConn)
+		if !ok {
+			return nil, fmt.Errorf("redirect needs a plain tcp conn, got %T", c)
+		}
+		dst, err := conn.OriginalDst(tc)
+		if err != nil {
+			return nil, err
+		}
+		target = dst
+	}
+	if s.isListenAddr(target.IP, target.Port) {
+		return nil, fmt.Errorf("conn from %s was sent to the listener %s directly", c.RemoteAddr(), target)
+	}
+	return target, nil
+}
+
+func (s *TProxyServer) isListenAddr(ip net.IP, port int) bool {
+	lis := s.listenAddr
+	if port != lis.Port {
+		return false
+	}
+	if lis.IP.IsUnspecified() {
+		// any local address reaches the listener
+		ifAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return ip.IsLoopback()
+		}
+		for _, a := range ifAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return lis.IP.Equal(ip)
+}
+
+func (s *TProxyServer) listenUDP(ctx context.Context, udpLis *conn.UDPListener) {
+	for {
+		c, err := udpLis.Accept()
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				s.l.Errorf("UDP accept error: %v", err)
+			}
+			return
+		}
+		if !s.allowClient(c.RemoteAddr(), metrics.METRIC_CONN_TYPE_UDP) {
+			c.Close()
+			continue
+		}
+		go func() {
+			defer c.Close()
+			target := c.OriginalDst()
+			if s.isListenAddr(target.IP, target.Port) {
+				s.l.Debugf("udp session from %s was sent to the listener directly", c.RemoteAddr())
+				return
+			}
+			if !s.cfg.GetProxyConfig().AllowDestination(target.String()) {
+				s.l.Debugf("udp destination %s not allowed", target)
+				return
+			}
+			remote := s.proxyRemote(s.direct, c.RemoteAddr().String())
+			if err := s.relayProxyUDP(ctx, c, remote, target.String(), ""); err != nil {
+				s.l.Errorf("relayProxyUDP meet error: %s", err.Error())
+			}
+		}()
+	}
+}
+
+// StopAccepting closes the listeners, the udp sessions end with their
+// socket.
+func (s *TProxyServer) StopAccepting() error {
+	return s.lis.close()
+}
+
+func (s *TProxyServer) Close() error {
+	return errors.Join(s.closeRelayer(), s.StopAccepting())
+}
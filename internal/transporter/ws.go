@@ -2,6 +2,7 @@ package transporter
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
 	"net/url"
@@ -41,14 +42,14 @@ func newWsClient(cfg *conf.Config) (*WsClient, error) {
 	return s, nil
 }
 
-func (s *WsClient) addUDPQueryParam(addr string) string {
+func (s *WsClient) setQueryParam(addr, key, value string) string {
 	u, err := url.Parse(addr)
 	if err != nil {
 		s.l.Errorf("Failed to parse URL: %v", err)
 		return addr
 	}
 	q := u.Query()
-	q.Set("type", "udp")
+	q.Set(key, value)
 	u.RawQuery = q.Encode()
 	return u.String()
 }
@@ -60,9 +61,22 @@ func (s *WsClient) HandShake(ctx context.Context, remote *lb.Node, isTCP bool) (
 		return nil, err
 	}
 	if !isTCP {
-		addr = s.addUDPQueryParam(addr)
+		addr = s.setQueryParam(addr, "type", "udp")
 	}
-	wsc, _, _, err := s.dialer.Dial(ctx, addr)
+	// the remote ehco server dials the destination the client asked for
+	if target, ok := targetFrom(ctx); ok {
+		addr = s.setQueryParam(addr, conf.WS_QUERY_REMOTE_ADDR, target)
+	}
+	dialer := s.dialer
+	// keep the original client address for the next hop
+	if src, ok := sourceFrom(ctx); ok {
+		if host, _, err := net.SplitHostPort(src.src.String()); err == nil {
+			d := *s.dialer
+			d.Header = ws.HandshakeHeaderHTTP(http.Header{headerForwardedFor: {host}})
+			dialer = &d
+		}
+	}
+	wsc, _, _, err := dialer.Dial(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -73,8 +87,11 @@ func (s *WsClient) HandShake(ctx context.Context, remote *lb.Node, isTCP bool) (
 	}
 	labels := []string{s.cfg.Label, connType, remote.Address}
 	metrics.HandShakeDurationMilliseconds.WithLabelValues(labels...).Observe(float64(latency.Milliseconds()))
-	remote.HandShakeDuration = latency
+	remote.RecordHandShake(latency)
 	c := conn.NewWSConn(wsc, false)
+	if !isTCP {
+		return conn.NewUDPFrameConn(c, s.cfg.Label), nil
+	}
 	return c, nil
 }
 
@@ -94,17 +111,29 @@ func newWsServer(bs *BaseRelayServer) (*WsServer, error) {
 }
 
 func (s *WsServer) handleRequest(w http.ResponseWriter, req *http.Request) {
+	connType := metrics.METRIC_CONN_TYPE_TCP
+	if req.URL.Query().Get("type") == "udp" {
+		connType = metrics.METRIC_CONN_TYPE_UDP
+	}
+	if !s.allowHTTPClient(w, req, connType) {
+		return
+	}
 	// todo use bufio.ReadWriter
 	wsc, _, _, err := ws.UpgradeHTTP(req, w)
 	if err != nil {
 		return
 	}
 
+	var c net.Conn = conn.NewWSConn(wsc, true)
+	if src, ok := s.forwardedClient(req); ok {
+		c = &addrConn{Conn: c, remote: src}
+	}
+
 	var remote *lb.Node
 	if addr := req.URL.Query().Get(conf.WS_QUERY_REMOTE_ADDR); addr != "" {
 		remote = &lb.Node{Address: addr}
 	} else {
-		remote = s.remotes.Next()
+		remote = lb.NextFor(s.remotes, c.RemoteAddr().String())
 	}
 
 	if req.URL.Query().Get("type") == "udp" {
@@ -113,9 +142,9 @@ func (s *WsServer) handleRequest(w http.ResponseWriter, req *http.Request) {
 			wsc.Close()
 			return
 		}
-		err = s.RelayUDPConn(req.Context(), conn.NewWSConn(wsc, true), remote)
+		err = s.RelayUDPConn(req.Context(), conn.NewUDPFrameConn(c, s.cfg.Label), remote)
 	} else {
-		err = s.RelayTCPConn(req.Context(), conn.NewWSConn(wsc, true), remote)
+		err = s.RelayTCPConn(req.Context(), c, remote)
 	}
 	if err != nil {
 		s.l.Errorf("handleRequest meet error:%s", err)
@@ -130,6 +159,12 @@ func (s *WsServer) ListenAndServe(ctx context.Context) error {
 	return s.httpServer.Serve(listener)
 }
 
+// StopAccepting closes the listener, upgraded conns are hijacked from the
+// http server and left to the drain.
+func (s *WsServer) StopAccepting() error {
+	return stopHTTPServer(s.httpServer)
+}
+
 func (s *WsServer) Close() error {
-	return s.httpServer.Close()
+	return errors.Join(s.closeRelayer(), closeListener(s.httpServer))
 }
@@ -244,3 +244,61 @@ func (s *Server) HandleHealthCheck(c echo.Context) error {
 	}
 	return c.JSON(http.StatusOK, HealthCheckResp{Message: "connect success", Latency: latency})
 }
+
+func (s *Server) HandleListRemoteStatus(c echo.Context) error {
+	res, err := s.HealthChecker.ListRemoteStatus(c.QueryParam("relay_label"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) HandleListLimitedClients(c echo.Context) error {
+	res, err := s.ClientLimiter.ListLimitedClients(c.QueryParam("relay_label"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) HandleUnbanClient(c echo.Context) error {
+	ip := c.QueryParam("ip")
+	if ip == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "ip is required")
+	}
+	if err := s.ClientLimiter.UnbanClient(c.QueryParam("relay_label"), ip); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (s *Server) HandleListUDPSessions(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.connMgr.ListUDPSessions(c.QueryParam("relay_label")))
+}
+
+func (s *Server) HandleListDraining(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.Drainer.ListDraining())
+}
+
+func (s *Server) HandleListBandwidth(c echo.Context) error {
+	res, err := s.BandwidthLimiter.ListBandwidth(c.QueryParam("relay_label"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (s *Server) HandleUpdateBandwidth(c echo.Context) error {
+	relayLabel := c.QueryParam("relay_label")
+	if relayLabel == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "relay_label is required")
+	}
+	var req glue.Bandwidth
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := s.BandwidthLimiter.UpdateBandwidth(relayLabel, req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
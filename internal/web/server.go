@@ -25,6 +25,9 @@ const (
 type Server struct {
 	glue.Reloader
 	glue.HealthChecker
+	glue.ClientLimiter
+	glue.BandwidthLimiter
+	glue.Drainer
 
 	e    *echo.Echo
 	addr string
@@ -53,6 +56,9 @@ func NewServer(
 	cfg *config.Config,
 	relayReloader glue.Reloader,
 	healthChecker glue.HealthChecker,
+	clientLimiter glue.ClientLimiter,
+	bandwidthLimiter glue.BandwidthLimiter,
+	drainer glue.Drainer,
 	connMgr cmgr.Cmgr,
 ) (*Server, error) {
 	if err := validateConfig(cfg); err != nil {
@@ -70,8 +76,11 @@ func NewServer(
 	}
 
 	s := &Server{
-		Reloader:      relayReloader,
-		HealthChecker: healthChecker,
+		Reloader:         relayReloader,
+		HealthChecker:    healthChecker,
+		ClientLimiter:    clientLimiter,
+		BandwidthLimiter: bandwidthLimiter,
+		Drainer:          drainer,
 
 		e:       e,
 		l:       l,
@@ -120,6 +129,13 @@ func setupRoutes(s *Server) {
 	api.GET("/config/", s.CurrentConfig)
 	api.POST("/config/reload/", s.HandleReload)
 	api.GET("/health_check/", s.HandleHealthCheck)
+	api.GET("/remotes/", s.HandleListRemoteStatus)
+	api.GET("/limited_clients/", s.HandleListLimitedClients)
+	api.POST("/limited_clients/unban/", s.HandleUnbanClient)
+	api.GET("/bandwidth/", s.HandleListBandwidth)
+	api.POST("/bandwidth/", s.HandleUpdateBandwidth)
+	api.GET("/udp_sessions/", s.HandleListUDPSessions)
+	api.GET("/draining/", s.HandleListDraining)
 	api.GET("/node_metrics/", s.GetNodeMetrics)
 	api.GET("/overview", s.Overview)
 	api.GET("/version", s.Version)
@@ -32,6 +32,7 @@ import type {
   XrayUser,
   EhcoConfig,
   HealthCheckResp,
+  RemoteStatus,
   QueryNodeMetricsResp,
   VersionInfo,
   UpdateCheck,
@@ -49,6 +50,10 @@ export const api = {
     request<HealthCheckResp>(
       `/api/v1/health_check/?relay_label=${encodeURIComponent(label)}`,
     ),
+  remotes: (label?: string) =>
+    request<RemoteStatus[]>(
+      `/api/v1/remotes/${label ? `?relay_label=${encodeURIComponent(label)}` : ""}`,
+    ),
   nodeMetrics: (params: { start_ts?: number; end_ts?: number; latest?: boolean; step?: number }) => {
     const q = new URLSearchParams();
     if (params.start_ts != null) q.set("start_ts", String(params.start_ts));
@@ -68,11 +68,34 @@ export interface RelayConfig {
   listen?: string;
   listen_type?: string;
   transport_type?: string;
+  remotes?: string[];
   tcp_remotes?: string[];
   udp_remotes?: string[];
   [k: string]: unknown;
 }
 
+// Live per-remote state from /api/v1/remotes/. `ejected` flips on after
+// consecutive dial/handshake failures and clears on the next success.
+export interface RemoteStatus {
+  relay_label: string;
+  address: string;
+  weight: number;
+  ejected: boolean;
+  ejected_until?: string; // RFC3339, zero time when not ejected
+  consecutive_fails: number;
+  latency_ms: number;
+  // Background health checker state; remotes never probed report healthy.
+  healthy: boolean;
+  health_history: HealthSample[];
+}
+
+export interface HealthSample {
+  at: string; // RFC3339
+  up: boolean;
+  latency_ms: number;
+  error?: string;
+}
+
 export interface XrayConfig {
   inbounds?: unknown[];
   outbounds?: unknown[];
@@ -1,4 +1,4 @@
-import { createMemo, createResource, createSignal, Show } from "solid-js";
+import { createMemo, createResource, createSignal, For, Show } from "solid-js";
 import { ServerCog, Heart } from "lucide-solid";
 import PageHeader from "../ui/PageHeader";
 import Button from "../ui/Button";
@@ -6,7 +6,7 @@ import { Pill } from "../ui/Pill";
 import EmptyState from "../ui/EmptyState";
 import DataTable, { Column } from "../ui/DataTable";
 import { api, ApiError } from "../api/client";
-import type { RelayConfig } from "../api/types";
+import type { RelayConfig, RemoteStatus } from "../api/types";
 
 interface HCResult {
   state: "running" | "ok" | "err";
@@ -16,12 +16,23 @@ interface HCResult {
 interface Row {
   cfg: RelayConfig;
   remote: string;
+  statuses: RemoteStatus[];
 }
 
 export default function Rules() {
   const [config] = createResource(() => api.config());
+  const [remotes] = createResource(() => api.remotes().catch(() => []));
   const [hc, setHc] = createSignal<Record<string, HCResult>>({});
 
+  const statusByLabel = createMemo(() => {
+    const m: Record<string, RemoteStatus[]> = {};
+    for (const r of remotes() ?? []) {
+      if (!m[r.relay_label]) m[r.relay_label] = [];
+      m[r.relay_label].push(r);
+    }
+    return m;
+  });
+
   const ruleList = (): RelayConfig[] => {
     const c = config()?.relay_configs;
     return Array.isArray(c) ? c : [];
@@ -29,8 +40,16 @@ export default function Rules() {
 
   const rows = createMemo<Row[]>(() =>
     ruleList().map((cfg) => {
-      const remotes = [...(cfg.tcp_remotes ?? []), ...(cfg.udp_remotes ?? [])];
-      return { cfg, remote: remotes[0] ?? "" };
+      const remotes = [
+        ...(cfg.remotes ?? []),
+        ...(cfg.tcp_remotes ?? []),
+        ...(cfg.udp_remotes ?? []),
+      ];
+      return {
+        cfg,
+        remote: remotes[0] ?? "",
+        statuses: statusByLabel()[cfg.label ?? ""] ?? [],
+      };
     }),
   );
 
@@ -88,9 +107,34 @@ export default function Rules() {
       key: "remote",
       header: "remote",
       cell: (r) => (
-        <span class="block max-w-[220px] truncate font-mono text-xs text-zinc-500">
-          {r.remote || "—"}
-        </span>
+        <Show
+          when={r.statuses.length > 0}
+          fallback={
+            <span class="block max-w-[220px] truncate font-mono text-xs text-zinc-500">
+              {r.remote || "—"}
+            </span>
+          }
+        >
+          <div class="flex max-w-[320px] flex-wrap gap-1">
+            <For each={r.statuses}>
+              {(st) => (
+                <span
+                  title={
+                    st.ejected
+                      ? `ejected until ${st.ejected_until} · ${st.consecutive_fails} fails`
+                      : !st.healthy
+                        ? `down · ${st.health_history[st.health_history.length - 1]?.error ?? ""}`
+                        : `ewma ${st.latency_ms} ms · weight ${st.weight}`
+                  }
+                >
+                  <Pill tone={st.ejected || !st.healthy ? "error" : "ok"} dot>
+                    <span class="font-mono">{st.address}</span>
+                  </Pill>
+                </span>
+              )}
+            </For>
+          </div>
+        </Show>
       ),
       mdOnly: true,
     },
@@ -0,0 +1,65 @@
+// Package iptrie is a binary prefix trie answering whether an ip falls in
+// any of the inserted cidrs, ipv4 is stored mapped into ipv6 so both
+// families share one trie.
+package iptrie
+
+import "net/netip"
+
+type node struct {
+	child [2]*node
+	// a prefix ends here, everything below is covered
+	end bool
+}
+
+type Trie struct {
+	root node
+}
+
+func New() *Trie {
+	return &Trie{}
+}
+
+// Insert adds the prefix, prefixes covered by an inserted one are dropped.
+func (t *Trie) Insert(p netip.Prefix) {
+	addr, bits := to16(p.Addr(), p.Bits())
+	b := addr.As16()
+	n := &t.root
+	for i := 0; i < bits; i++ {
+		if n.end {
+			return
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &node{}
+		}
+		n = n.child[bit]
+	}
+	n.end = true
+	n.child = [2]*node{}
+}
+
+// Contains reports whether ip is covered by an inserted prefix.
+func (t *Trie) Contains(ip netip.Addr) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	b := ip.As16()
+	n := &t.root
+	for i := 0; i < 128; i++ {
+		if n.end {
+			return true
+		}
+		n = n.child[b[i/8]>>(7-i%8)&1]
+		if n == nil {
+			return false
+		}
+	}
+	return n.end
+}
+
+func to16(addr netip.Addr, bits int) (netip.Addr, int) {
+	if addr.Is4() {
+		return netip.AddrFrom16(addr.As16()), bits + 96
+	}
+	return addr, bits
+}
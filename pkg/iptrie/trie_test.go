@@ -0,0 +1,56 @@
+package iptrie
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestTrie_Contains(t *testing.T) {
+	tr := New()
+	for _, p := range []string{"10.0.0.0/8", "192.168.1.0/24", "1.2.3.4/32", "2001:db8::/32", "::1/128"} {
+		tr.Insert(netip.MustParsePrefix(p))
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.255", true},
+		{"192.168.2.1", false},
+		{"1.2.3.4", true},
+		{"1.2.3.5", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"::1", true},
+		{"::2", false},
+	}
+	for _, tt := range tests {
+		if got := tr.Contains(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("Contains(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if tr.Contains(netip.Addr{}) {
+		t.Error("invalid addr should not be contained")
+	}
+}
+
+func TestTrie_InsertCovered(t *testing.T) {
+	tr := New()
+	tr.Insert(netip.MustParsePrefix("10.1.0.0/16"))
+	tr.Insert(netip.MustParsePrefix("10.0.0.0/8"))
+	tr.Insert(netip.MustParsePrefix("10.2.3.0/24"))
+	for _, ip := range []string{"10.1.1.1", "10.200.0.1", "10.2.3.4"} {
+		if !tr.Contains(netip.MustParseAddr(ip)) {
+			t.Errorf("%s should be covered by 10.0.0.0/8", ip)
+		}
+	}
+
+	all := New()
+	all.Insert(netip.MustParsePrefix("0.0.0.0/0"))
+	if !all.Contains(netip.MustParseAddr("8.8.8.8")) || all.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("0.0.0.0/0 should cover ipv4 only")
+	}
+}
@@ -0,0 +1,69 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// BanList bans ips until their ban expires.
+type BanList struct {
+	sync.Mutex
+
+	// key: ip value: ban expire time
+	until map[string]time.Time
+}
+
+func NewBanList() *BanList {
+	return &BanList{until: make(map[string]time.Time)}
+}
+
+// Ban bans ip for d, an existing longer ban is kept.
+func (b *BanList) Ban(ip string, d time.Duration) time.Time {
+	b.Lock()
+	defer b.Unlock()
+	until := time.Now().Add(d)
+	if old, ok := b.until[ip]; ok && old.After(until) {
+		return old
+	}
+	b.until[ip] = until
+	return until
+}
+
+func (b *BanList) Banned(ip string) bool {
+	b.Lock()
+	defer b.Unlock()
+	until, ok := b.until[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.until, ip)
+		return false
+	}
+	return true
+}
+
+// Unban lifts the ban of ip, false when ip was not banned.
+func (b *BanList) Unban(ip string) bool {
+	b.Lock()
+	defer b.Unlock()
+	until, ok := b.until[ip]
+	delete(b.until, ip)
+	return ok && time.Now().Before(until)
+}
+
+// List returns the ips banned now with their ban expire time.
+func (b *BanList) List() map[string]time.Time {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	res := make(map[string]time.Time, len(b.until))
+	for ip, until := range b.until {
+		if now.After(until) {
+			delete(b.until, ip)
+			continue
+		}
+		res[ip] = until
+	}
+	return res
+}
@@ -0,0 +1,58 @@
+package limiter
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// Bandwidth is a token bucket of bytes that can be shared by many conns,
+// its rate can be changed while they wait on it.
+type Bandwidth struct {
+	l *rate.Limiter
+}
+
+// NewBandwidth returns a bucket of kbps, 0 means unlimited.
+func NewBandwidth(kbps int64) *Bandwidth {
+	b := &Bandwidth{l: rate.NewLimiter(rate.Inf, 0)}
+	b.SetKbps(kbps)
+	return b
+}
+
+// SetKbps changes the rate, the bucket holds one second of traffic. Waits
+// already reserved are not changed.
+func (b *Bandwidth) SetKbps(kbps int64) {
+	if kbps <= 0 {
+		b.l.SetLimit(rate.Inf)
+		return
+	}
+	bytesPerSec := kbps * 1000 / 8 // 1 kbps = 1000 bps, 1B = 8b
+	// set burst first so a finite limit never comes with an empty bucket
+	b.l.SetBurst(int(max(bytesPerSec, 1)))
+	b.l.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// Burst returns the most bytes WaitN lets pass at once, 0 when unlimited.
+func (b *Bandwidth) Burst() int {
+	if b.l.Limit() == rate.Inf {
+		return 0
+	}
+	return b.l.Burst()
+}
+
+// WaitN blocks until n bytes may pass, n larger than the bucket is waited
+// for in parts.
+func (b *Bandwidth) WaitN(ctx context.Context, n int) error {
+	for n > 0 {
+		burst := b.Burst()
+		if burst == 0 {
+			return nil
+		}
+		m := min(n, burst)
+		if err := b.l.WaitN(ctx, m); err != nil {
+			return err
+		}
+		n -= m
+	}
+	return nil
+}
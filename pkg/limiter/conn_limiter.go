@@ -0,0 +1,45 @@
+package limiter
+
+import "sync"
+
+// IPConnLimiter caps the concurrent conns of each ip.
+type IPConnLimiter struct {
+	sync.Mutex
+
+	max int
+	// key: ip
+	conns map[string]int
+}
+
+func NewIPConnLimiter(max int) *IPConnLimiter {
+	return &IPConnLimiter{max: max, conns: make(map[string]int)}
+}
+
+// Acquire takes a conn slot of ip, false when ip already has max conns.
+// Every successful Acquire must be followed by one Release.
+func (l *IPConnLimiter) Acquire(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *IPConnLimiter) Release(ip string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+		return
+	}
+	l.conns[ip]--
+}
+
+// Count returns the current conns of ip.
+func (l *IPConnLimiter) Count(ip string) int {
+	l.Lock()
+	defer l.Unlock()
+	return l.conns[ip]
+}
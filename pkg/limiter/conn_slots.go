@@ -0,0 +1,159 @@
+package limiter
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// ConnSlots caps the concurrent conns of each key. A conn over the limit
+// can queue for a slot, or for the slots of several keys at once, every
+// slot freed goes to the first waiter it fits, so the waiters are served
+// one at a time and in order.
+type ConnSlots struct {
+	sync.Mutex
+
+	conns   map[string]int
+	waiters []*slotWaiter
+}
+
+type slotWaiter struct {
+	// takes the slots of the waiter, the keys taken or nil when they are
+	// full
+	take func() []string
+
+	// set once the slots are taken for the waiter
+	keys  []string
+	ready chan struct{}
+}
+
+// Slot is a key and the most conns it may have, max <= 0 means no limit.
+type Slot struct {
+	Key string
+	Max int
+}
+
+func NewConnSlots() *ConnSlots {
+	return &ConnSlots{conns: make(map[string]int)}
+}
+
+// TryAcquire takes a slot of the first of keys with less than max conns,
+// max <= 0 means no limit. It returns the key taken, false when all of them
+// are full. Every key taken must be released once.
+func (s *ConnSlots) TryAcquire(max int, keys ...string) (string, bool) {
+	s.Lock()
+	defer s.Unlock()
+	return s.take(max, keys)
+}
+
+// Acquire is TryAcquire that queues for a slot until ctx is done.
+func (s *ConnSlots) Acquire(ctx context.Context, max int, keys ...string) (string, error) {
+	taken, err := s.wait(ctx, func() []string {
+		if key, ok := s.take(max, keys); ok {
+			return []string{key}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return taken[0], nil
+}
+
+// TryAcquireAll takes a slot of every one of slots or, when one of them is
+// full, none. Every key must be released once.
+func (s *ConnSlots) TryAcquireAll(slots ...Slot) bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.takeAll(slots) != nil
+}
+
+// AcquireAll is TryAcquireAll that queues for the slots until ctx is done,
+// no slot is held while it waits.
+func (s *ConnSlots) AcquireAll(ctx context.Context, slots ...Slot) error {
+	_, err := s.wait(ctx, func() []string { return s.takeAll(slots) })
+	return err
+}
+
+func (s *ConnSlots) Release(key string) {
+	s.Lock()
+	defer s.Unlock()
+	s.release(key)
+}
+
+// Count returns the current conns of key.
+func (s *ConnSlots) Count(key string) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.conns[key]
+}
+
+// wait runs take or, when the slots are full, queues it until ctx is done.
+func (s *ConnSlots) wait(ctx context.Context, take func() []string) ([]string, error) {
+	s.Lock()
+	if keys := take(); keys != nil {
+		s.Unlock()
+		return keys, nil
+	}
+	w := &slotWaiter{take: take, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	s.Unlock()
+
+	select {
+	case <-w.ready:
+		return w.keys, nil
+	case <-ctx.Done():
+	}
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-w.ready:
+		// the slots came with ctx, pass them on
+		for _, key := range w.keys {
+			s.release(key)
+		}
+	default:
+		s.waiters = slices.DeleteFunc(s.waiters, func(o *slotWaiter) bool { return o == w })
+	}
+	return nil, ctx.Err()
+}
+
+func (s *ConnSlots) take(max int, keys []string) (string, bool) {
+	for _, key := range keys {
+		if max <= 0 || s.conns[key] < max {
+			s.conns[key]++
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func (s *ConnSlots) takeAll(slots []Slot) []string {
+	for _, slot := range slots {
+		if slot.Max > 0 && s.conns[slot.Key] >= slot.Max {
+			return nil
+		}
+	}
+	keys := make([]string, 0, len(slots))
+	for _, slot := range slots {
+		s.conns[slot.Key]++
+		keys = append(keys, slot.Key)
+	}
+	return keys
+}
+
+func (s *ConnSlots) release(key string) {
+	if s.conns[key] <= 1 {
+		delete(s.conns, key)
+	} else {
+		s.conns[key]--
+	}
+	s.waiters = slices.DeleteFunc(s.waiters, func(w *slotWaiter) bool {
+		w.keys = w.take()
+		if w.keys == nil {
+			return false
+		}
+		close(w.ready)
+		return true
+	})
+}
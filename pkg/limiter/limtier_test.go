@@ -1,6 +1,7 @@
 package limiter
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -31,3 +32,206 @@ func TestIPRateLimiter_CanServe(t *testing.T) {
 		t.Errorf("IPRateLimiter can't server ip=%s after sleep", ip1)
 	}
 }
+
+func TestIPConnLimiter(t *testing.T) {
+	l := NewIPConnLimiter(2)
+	ip1, ip2 := "1.1.1.1", "2.2.2.2"
+
+	if !l.Acquire(ip1) || !l.Acquire(ip1) {
+		t.Fatalf("ip=%s should get 2 conns", ip1)
+	}
+	if l.Acquire(ip1) {
+		t.Errorf("ip=%s should not get the 3rd conn", ip1)
+	}
+	if !l.Acquire(ip2) {
+		t.Errorf("ip=%s should not be affected by ip=%s", ip2, ip1)
+	}
+
+	l.Release(ip1)
+	if c := l.Count(ip1); c != 1 {
+		t.Errorf("ip=%s count = %d, want 1", ip1, c)
+	}
+	if !l.Acquire(ip1) {
+		t.Errorf("ip=%s should get a conn after release", ip1)
+	}
+	l.Release(ip1)
+	l.Release(ip1)
+	if _, ok := l.conns[ip1]; ok {
+		t.Errorf("ip=%s without conns should be dropped", ip1)
+	}
+}
+
+func TestBanList(t *testing.T) {
+	b := NewBanList()
+	ip := "1.1.1.1"
+	if b.Banned(ip) {
+		t.Fatalf("ip=%s is not banned yet", ip)
+	}
+
+	b.Ban(ip, time.Hour)
+	// a shorter ban does not shorten the existing one
+	if until := b.Ban(ip, time.Millisecond); time.Until(until) < time.Minute {
+		t.Errorf("ban of ip=%s was shortened to %s", ip, until)
+	}
+	if !b.Banned(ip) || len(b.List()) != 1 {
+		t.Errorf("ip=%s should be banned", ip)
+	}
+	if !b.Unban(ip) || b.Banned(ip) {
+		t.Errorf("ip=%s should be unbanned", ip)
+	}
+
+	b.Ban(ip, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if b.Banned(ip) || len(b.List()) != 0 {
+		t.Errorf("ban of ip=%s should expire", ip)
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	b := NewBandwidth(0)
+	if b.Burst() != 0 {
+		t.Fatalf("unlimited bandwidth burst = %d, want 0", b.Burst())
+	}
+	if err := b.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatalf("unlimited bandwidth should not wait: %v", err)
+	}
+
+	// 80 kbps is 10000 bytes per second, the first second passes at once
+	b.SetKbps(80)
+	if b.Burst() != 10000 {
+		t.Fatalf("burst = %d, want 10000", b.Burst())
+	}
+	start := time.Now()
+	if err := b.WaitN(context.Background(), 15000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > time.Second {
+		t.Errorf("15000 bytes at 10000 bytes/s took %s, want about 500ms", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := b.WaitN(ctx, 10000); err == nil {
+		t.Error("wait longer than the deadline should fail")
+	}
+
+	b.SetKbps(0)
+	start = time.Now()
+	if err := b.WaitN(context.Background(), 1<<20); err != nil || time.Since(start) > 10*time.Millisecond {
+		t.Errorf("bandwidth set unlimited should not wait")
+	}
+}
+
+func TestConnSlots(t *testing.T) {
+	s := NewConnSlots()
+	if _, ok := s.TryAcquire(1, "a"); !ok {
+		t.Fatal("a should get 1 conn")
+	}
+	if _, ok := s.TryAcquire(1, "a"); ok {
+		t.Error("a should not get the 2nd conn")
+	}
+	if key, ok := s.TryAcquire(1, "a", "b"); !ok || key != "b" {
+		t.Errorf("want the slot of b, got %q %v", key, ok)
+	}
+
+	waiters := func() int {
+		s.Lock()
+		defer s.Unlock()
+		return len(s.waiters)
+	}
+
+	// waiters are served one at a time and in order
+	got := make(chan string, 2)
+	for i := range 2 {
+		go func() {
+			key, err := s.Acquire(context.Background(), 1, "a")
+			if err != nil {
+				t.Error(err)
+			}
+			got <- key
+		}()
+		for waiters() < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	s.Release("a")
+	if key := <-got; key != "a" {
+		t.Errorf("want a, got %q", key)
+	}
+	select {
+	case <-got:
+		t.Fatal("the second waiter should still wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Release("a")
+	<-got
+
+	// a waiter that gives up leaves the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.Acquire(ctx, 1, "a"); err == nil {
+		t.Error("a is full, acquire should time out")
+	}
+	if n := waiters(); n != 0 {
+		t.Errorf("want no waiters, got %d", n)
+	}
+	s.Release("a")
+	s.Release("b")
+	if len(s.conns) != 0 {
+		t.Errorf("keys without conns should be dropped, got %v", s.conns)
+	}
+}
+
+func TestConnSlots_AcquireAll(t *testing.T) {
+	s := NewConnSlots()
+	node, ruleA, ruleB := Slot{"node", 2}, Slot{"a", 1}, Slot{"b", 1}
+	if !s.TryAcquireAll(node, ruleA) {
+		t.Fatal("node and a should have room")
+	}
+	if s.TryAcquireAll(node, ruleA) {
+		t.Error("a is full, no slot should be taken")
+	}
+	if n := s.Count("node"); n != 1 {
+		t.Errorf("a failed take should leave node at 1 conn, got %d", n)
+	}
+
+	waiters := func() int {
+		s.Lock()
+		defer s.Unlock()
+		return len(s.waiters)
+	}
+
+	// the waiter of a full rule holds no node slot, other rules go on
+	got := make(chan error, 1)
+	go func() { got <- s.AcquireAll(context.Background(), node, ruleA) }()
+	for waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !s.TryAcquireAll(node, ruleB) {
+		t.Fatal("b should take the node slot left")
+	}
+	s.Release("a")
+	select {
+	case <-got:
+		t.Fatal("node is full, the waiter should still wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Release("node")
+	s.Release("b")
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if s.Count("node") != 2 || s.Count("a") != 1 {
+		t.Errorf("want node 2 a 1, got %d %d", s.Count("node"), s.Count("a"))
+	}
+
+	// a waiter that gives up takes nothing
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.AcquireAll(ctx, node, ruleB); err == nil {
+		t.Error("node is full, acquire should time out")
+	}
+	if s.Count("b") != 0 {
+		t.Errorf("b should have no conn, got %d", s.Count("b"))
+	}
+}
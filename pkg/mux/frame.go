@@ -0,0 +1,57 @@
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// frame layout, all numbers big endian:
+//
+//	| version(1) | cmd(1) | length(2) | stream id(4) | payload(length) |
+const (
+	version    = 1
+	headerSize = 8
+
+	// MaxFrameSize is the max payload of one frame, bigger writes are split.
+	MaxFrameSize = 16 * 1024
+	// streamWindow is how many unread bytes a stream buffers before the
+	// sender has to wait for a window update, same on both sides.
+	streamWindow = 256 * 1024
+)
+
+const (
+	cmdSYN  byte = iota // open stream, payload is the stream meta
+	cmdPSH              // stream data
+	cmdFIN              // stream closed
+	cmdUPD              // window update, payload is uint32 consumed bytes
+	cmdPING             // keepalive, stream id 0
+	cmdPONG             // keepalive reply, stream id 0
+)
+
+type header [headerSize]byte
+
+func newHeader(cmd byte, sid uint32, length int) header {
+	var h header
+	h[0] = version
+	h[1] = cmd
+	binary.BigEndian.PutUint16(h[2:], uint16(length))
+	binary.BigEndian.PutUint32(h[4:], sid)
+	return h
+}
+
+func (h header) cmd() byte        { return h[1] }
+func (h header) length() int      { return int(binary.BigEndian.Uint16(h[2:])) }
+func (h header) streamID() uint32 { return binary.BigEndian.Uint32(h[4:]) }
+
+func (h header) validate() error {
+	if h[0] != version {
+		return fmt.Errorf("mux: unsupported version %d", h[0])
+	}
+	if h.cmd() > cmdPONG {
+		return fmt.Errorf("mux: unknown cmd %d", h.cmd())
+	}
+	if h.length() > MaxFrameSize {
+		return fmt.Errorf("mux: frame size %d exceeds limit", h.length())
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newPair(t *testing.T, cfg *Config) (*Session, *Session) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client, server := Client(c1, cfg), Server(c2, cfg)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func echoServer(server *Session) {
+	for {
+		st, err := server.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			_, _ = io.Copy(st, st)
+		}()
+	}
+}
+
+func TestStreamsEcho(t *testing.T) {
+	client, server := newPair(t, nil)
+	go echoServer(server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.OpenStream([]byte{byte(i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+			// bigger than the window so flow control has to kick in
+			data := make([]byte, streamWindow*3)
+			_, _ = rand.Read(data)
+			go func() { _, _ = st.Write(data) }()
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("echo data mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStreamMeta(t *testing.T) {
+	client, server := newPair(t, nil)
+	if _, err := client.OpenStream([]byte("udp")); err != nil {
+		t.Fatal(err)
+	}
+	st, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(st.Meta()) != "udp" {
+		t.Fatalf("want meta udp, got %q", st.Meta())
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	client, server := newPair(t, nil)
+	st, err := client.OpenStream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+
+	// buffered data is still readable after the peer closed
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye" {
+		t.Fatalf("want bye, got %q", got)
+	}
+	if _, err := peer.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("want ErrClosedPipe, got %v", err)
+	}
+	peer.Close()
+
+	// closing one stream must not affect the session
+	if client.IsClosed() || server.IsClosed() {
+		t.Fatal("session should stay open")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := client.NumStreams(); n != 0 {
+		t.Fatalf("want 0 streams, got %d", n)
+	}
+}
+
+func TestAcceptBacklogFull(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AcceptBacklog = 1
+	client, server := newPair(t, cfg)
+	queued, err := client.OpenStream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused, err := client.OpenStream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stream over the backlog is closed by peer
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want EOF, got %v", err)
+	}
+	refused.Close()
+
+	go echoServer(server)
+	if _, err := queued.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(queued, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("want ping, got %q", buf)
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, _ := newPair(t, nil)
+	st, err := client.OpenStream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatal("deadline error should be a net timeout error")
+	}
+}
+
+func TestSessionCloseWakesStreams(t *testing.T) {
+	client, server := newPair(t, nil)
+	st, err := client.OpenStream(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		errCh <- err
+	}()
+	server.Close()
+	select {
+	case err := <-errCh:
+		if err == nil {
+			t.Fatal("want error after session closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not woken up by session close")
+	}
+	if _, err := client.OpenStream(nil); err == nil {
+		t.Fatal("want error opening stream on dead session")
+	}
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// the peer never answers, so the session must give up on its own
+	go func() { _, _ = io.Copy(io.Discard, c2) }()
+	client := Client(c1, &Config{
+		KeepAliveInterval: 10 * time.Millisecond,
+		KeepAliveTimeout:  50 * time.Millisecond,
+	})
+	select {
+	case <-client.CloseChan():
+	case <-time.After(time.Second):
+		t.Fatal("session not closed after keepalive timeout")
+	}
+}
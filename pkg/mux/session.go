@@ -0,0 +1,286 @@
+// Package mux multiplexes many logical streams over one reliable conn.
+// Every stream has its own flow control window so a slow reader only
+// stalls its own stream, and the session sends keepalive pings to detect
+// a dead tunnel.
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamClosed  = errors.New("mux: stream closed")
+
+	errWindowExceeded = errors.New("mux: peer exceeded stream window")
+)
+
+type Config struct {
+	// ping interval, the session is closed when nothing is received for KeepAliveTimeout
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+	// streams opened by peer but not accepted yet
+	AcceptBacklog int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveTimeout:  30 * time.Second,
+		AcceptBacklog:     256,
+	}
+}
+
+type Session struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	cfg    *Config
+	client bool
+
+	nextID   atomic.Uint32
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	acceptCh chan *Stream
+
+	writeMu sync.Mutex
+
+	lastRecv atomic.Int64 // unix nano
+	die      chan struct{}
+	dieOnce  sync.Once
+	dieErr   error
+}
+
+// Client returns the session of the side that opens streams.
+func Client(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, true)
+}
+
+// Server returns the session of the side that accepts streams.
+func Server(conn net.Conn, cfg *Config) *Session {
+	return newSession(conn, cfg, false)
+}
+
+func newSession(conn net.Conn, cfg *Config, client bool) *Session {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	s := &Session{
+		conn:     conn,
+		br:       bufio.NewReaderSize(conn, headerSize+MaxFrameSize),
+		cfg:      cfg,
+		client:   client,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, cfg.AcceptBacklog),
+		die:      make(chan struct{}),
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+	go s.recvLoop()
+	if cfg.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// OpenStream opens a new stream, meta is delivered to the peer with it.
+func (s *Session) OpenStream(meta []byte) (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+	if !s.client {
+		return nil, errors.New("mux: only client session can open stream")
+	}
+	if len(meta) > MaxFrameSize {
+		return nil, fmt.Errorf("mux: meta size %d exceeds limit", len(meta))
+	}
+	st := newStream(s.nextID.Add(1), s, meta)
+	s.mu.Lock()
+	s.streams[st.id] = st
+	s.mu.Unlock()
+	if err := s.writeFrame(cmdSYN, st.id, meta); err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the next stream opened by peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh:
+		return st, nil
+	case <-s.die:
+		return nil, s.err()
+	}
+}
+
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan is closed when the session dies.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+func (s *Session) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+func (s *Session) Close() error {
+	return s.closeWithErr(ErrSessionClosed)
+}
+
+func (s *Session) closeWithErr(err error) error {
+	var closeErr error
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.die)
+		closeErr = s.conn.Close()
+	})
+	return closeErr
+}
+
+func (s *Session) err() error {
+	<-s.die
+	return s.dieErr
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) writeFrame(cmd byte, sid uint32, payload []byte) error {
+	h := newHeader(cmd, sid, len(payload))
+	buf := make([]byte, 0, headerSize+len(payload))
+	buf = append(buf, h[:]...)
+	buf = append(buf, payload...)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return s.err()
+	}
+	// a peer that stops reading must not block every stream forever
+	if s.cfg.KeepAliveTimeout > 0 {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.cfg.KeepAliveTimeout))
+	}
+	if _, err := s.conn.Write(buf); err != nil {
+		_ = s.closeWithErr(fmt.Errorf("mux: write failed: %w", err))
+		return s.err()
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	var h header
+	for {
+		if _, err := io.ReadFull(s.br, h[:]); err != nil {
+			_ = s.closeWithErr(fmt.Errorf("mux: read failed: %w", err))
+			return
+		}
+		if err := h.validate(); err != nil {
+			_ = s.closeWithErr(err)
+			return
+		}
+		var payload []byte
+		if h.length() > 0 {
+			payload = make([]byte, h.length())
+			if _, err := io.ReadFull(s.br, payload); err != nil {
+				_ = s.closeWithErr(fmt.Errorf("mux: read failed: %w", err))
+				return
+			}
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+		if err := s.handleFrame(h, payload); err != nil {
+			_ = s.closeWithErr(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(h header, payload []byte) error {
+	sid := h.streamID()
+	switch h.cmd() {
+	case cmdSYN:
+		if s.client {
+			return errors.New("mux: server session can not open stream")
+		}
+		st := newStream(sid, s, payload)
+		s.mu.Lock()
+		s.streams[sid] = st
+		s.mu.Unlock()
+		select {
+		case s.acceptCh <- st:
+		default:
+			// a slow acceptor must not stall the frames of every other
+			// stream, refuse the stream once the backlog is full
+			s.removeStream(sid)
+			go func() { _ = s.writeFrame(cmdFIN, sid, nil) }()
+		}
+	case cmdPSH:
+		if st := s.getStream(sid); st != nil {
+			if err := st.pushData(payload); err != nil {
+				return err
+			}
+		}
+	case cmdFIN:
+		if st := s.getStream(sid); st != nil {
+			st.remoteClose()
+		}
+	case cmdUPD:
+		if len(payload) != 4 {
+			return errors.New("mux: invalid window update")
+		}
+		if st := s.getStream(sid); st != nil {
+			st.addCredit(int(binary.BigEndian.Uint32(payload)))
+		}
+	case cmdPING:
+		go func() { _ = s.writeFrame(cmdPONG, 0, nil) }()
+	case cmdPONG:
+	}
+	return nil
+}
+
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(s.cfg.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+			since := time.Since(time.Unix(0, s.lastRecv.Load()))
+			if s.cfg.KeepAliveTimeout > 0 && since > s.cfg.KeepAliveTimeout {
+				_ = s.closeWithErr(fmt.Errorf("mux: keepalive timeout, nothing received for %s", since))
+				return
+			}
+			_ = s.writeFrame(cmdPING, 0, nil)
+		}
+	}
+}
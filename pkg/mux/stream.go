@@ -0,0 +1,207 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = &Stream{}
+
+// Stream is one logical conn inside a session. Close is a full close,
+// after the peer closed a stream buffered data can still be read but
+// writes fail.
+type Stream struct {
+	id   uint32
+	sess *Session
+	meta []byte
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	consumed  int // bytes read since the last window update
+	credit    int // bytes we can still send before the peer's window is full
+	remoteFin bool
+
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	die       chan struct{}
+	closeOnce sync.Once
+}
+
+func newStream(id uint32, sess *Session, meta []byte) *Stream {
+	return &Stream{
+		id:          id,
+		sess:        sess,
+		meta:        meta,
+		credit:      streamWindow,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+		die:         make(chan struct{}),
+	}
+}
+
+func (s *Stream) ID() uint32 { return s.id }
+
+// Meta returns the payload given to OpenStream.
+func (s *Stream) Meta() []byte { return s.meta }
+
+func (s *Stream) Read(b []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(b)
+			s.consumed += n
+			upd := 0
+			if s.consumed >= streamWindow/2 {
+				upd, s.consumed = s.consumed, 0
+			}
+			s.mu.Unlock()
+			if upd > 0 {
+				var p [4]byte
+				binary.BigEndian.PutUint32(p[:], uint32(upd))
+				_ = s.sess.writeFrame(cmdUPD, s.id, p[:])
+			}
+			return n, nil
+		}
+		remoteFin, deadline := s.remoteFin, s.readDeadline
+		s.mu.Unlock()
+
+		if remoteFin {
+			return 0, io.EOF
+		}
+		if err := s.wait(s.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		s.mu.Lock()
+		if s.remoteFin {
+			s.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := min(len(b)-written, s.credit, MaxFrameSize)
+		s.credit -= n
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+
+		if n == 0 {
+			if err := s.wait(s.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		select {
+		case <-s.die:
+			return written, ErrStreamClosed
+		default:
+		}
+		if err := s.sess.writeFrame(cmdPSH, s.id, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// wait blocks until notify fires, the deadline passes or the stream dies.
+func (s *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.die:
+		return ErrStreamClosed
+	case <-s.sess.die:
+		return s.sess.err()
+	}
+}
+
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.die)
+		s.sess.removeStream(s.id)
+		_ = s.sess.writeFrame(cmdFIN, s.id, nil)
+	})
+	return nil
+}
+
+func (s *Stream) pushData(b []byte) error {
+	s.mu.Lock()
+	if s.buf.Len()+len(b) > streamWindow {
+		s.mu.Unlock()
+		return errWindowExceeded
+	}
+	s.buf.Write(b)
+	s.mu.Unlock()
+	notify(s.readNotify)
+	return nil
+}
+
+func (s *Stream) remoteClose() {
+	s.mu.Lock()
+	s.remoteFin = true
+	s.mu.Unlock()
+	notify(s.readNotify)
+	notify(s.writeNotify)
+}
+
+func (s *Stream) addCredit(n int) {
+	s.mu.Lock()
+	s.credit += n
+	s.mu.Unlock()
+	notify(s.writeNotify)
+}
+
+func (s *Stream) LocalAddr() net.Addr  { return s.sess.LocalAddr() }
+func (s *Stream) RemoteAddr() net.Addr { return s.sess.RemoteAddr() }
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readNotify)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeNotify)
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,247 @@
+// Package socks5 implements the server side wire format of SOCKS5 (RFC 1928)
+// and its username/password auth (RFC 1929).
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const Version = 5
+
+// auth methods
+const (
+	MethodNoAuth       byte = 0x00
+	MethodUserPass     byte = 0x02
+	MethodNoAcceptable byte = 0xff
+
+	userPassVersion byte = 0x01
+)
+
+// commands
+const (
+	CmdConnect      byte = 0x01
+	CmdBind         byte = 0x02
+	CmdUDPAssociate byte = 0x03
+)
+
+// address types
+const (
+	AtypIPv4   byte = 0x01
+	AtypDomain byte = 0x03
+	AtypIPv6   byte = 0x04
+)
+
+// reply codes
+const (
+	RepSuccess             byte = 0x00
+	RepGeneralFailure      byte = 0x01
+	RepNotAllowed          byte = 0x02
+	RepNetworkUnreachable  byte = 0x03
+	RepHostUnreachable     byte = 0x04
+	RepConnectionRefused   byte = 0x05
+	RepCommandNotSupported byte = 0x07
+	RepAddrNotSupported    byte = 0x08
+)
+
+var ErrFragmentNotSupported = errors.New("socks5: udp fragment not supported")
+
+// ReadGreeting reads the client greeting and returns the offered methods.
+func ReadGreeting(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != Version {
+		return nil, fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+func WriteMethod(w io.Writer, method byte) error {
+	_, err := w.Write([]byte{Version, method})
+	return err
+}
+
+// ReadUserPass reads the username/password sub negotiation.
+func ReadUserPass(r io.Reader) (user, pass string, err error) {
+	var ver [1]byte
+	if _, err = io.ReadFull(r, ver[:]); err != nil {
+		return "", "", err
+	}
+	if ver[0] != userPassVersion {
+		return "", "", fmt.Errorf("socks5: unsupported auth version %d", ver[0])
+	}
+	if user, err = readString(r); err != nil {
+		return "", "", err
+	}
+	if pass, err = readString(r); err != nil {
+		return "", "", err
+	}
+	return user, pass, nil
+}
+
+func WriteUserPassStatus(w io.Writer, ok bool) error {
+	status := byte(0x01)
+	if ok {
+		status = 0x00
+	}
+	_, err := w.Write([]byte{userPassVersion, status})
+	return err
+}
+
+type Request struct {
+	Cmd byte
+	// Addr is host:port, host may be a domain
+	Addr string
+}
+
+func ReadRequest(r io.Reader) (*Request, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != Version {
+		return nil, fmt.Errorf("socks5: unsupported version %d", hdr[0])
+	}
+	addr, err := ReadAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{Cmd: hdr[1], Addr: addr}, nil
+}
+
+// WriteReply writes the reply to a request, bind can be nil.
+func WriteReply(w io.Writer, rep byte, bind net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bind != nil {
+		addr = bind.String()
+	}
+	b, err := AppendAddr([]byte{Version, rep, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadAddr reads ATYP, ADDR and PORT and returns them as host:port.
+func ReadAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case AtypIPv4, AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case AtypDomain:
+		domain, err := readString(r)
+		if err != nil {
+			return "", err
+		}
+		host = domain
+	default:
+		return "", fmt.Errorf("socks5: unsupported address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// AppendAddr appends host:port as ATYP, ADDR and PORT to b.
+func AppendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port %s", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5: domain too long: %s", host)
+		}
+		b = append(b, AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ParseUDPDatagram splits a udp associate datagram into destination and payload.
+func ParseUDPDatagram(b []byte) (addr string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	if b[2] != 0 {
+		return "", nil, ErrFragmentNotSupported
+	}
+	r := &sliceReader{b: b[3:]}
+	if addr, err = ReadAddr(r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", nil, err
+	}
+	return addr, r.b, nil
+}
+
+// BuildUDPDatagram prefixes payload with the udp associate header for addr.
+func BuildUDPDatagram(addr string, payload []byte) ([]byte, error) {
+	b, err := AppendAddr(make([]byte, 3, 3+1+net.IPv6len+2+len(payload)), addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
+
+func readString(r io.Reader) (string, error) {
+	var l [1]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", err
+	}
+	b := make([]byte, l[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (r *sliceReader) Read(p []byte) (int, error) {
+	if len(r.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	return n, nil
+}
@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestAddrRoundTrip(t *testing.T) {
+	for _, addr := range []string{"1.2.3.4:80", "[2001:db8::1]:443", "example.com:8080"} {
+		b, err := AppendAddr(nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadAddr(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != addr {
+			t.Fatalf("want %s, got %s", addr, got)
+		}
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	raw := []byte{Version, CmdConnect, 0x00, AtypDomain, 11}
+	raw = append(raw, "example.com"...)
+	raw = append(raw, 0x01, 0xbb)
+	req, err := ReadRequest(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Cmd != CmdConnect || req.Addr != "example.com:443" {
+		t.Fatalf("unexpected request: %+v", req)
+	}
+}
+
+func TestReadUserPass(t *testing.T) {
+	raw := []byte{0x01, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}
+	user, pass, err := ReadUserPass(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "user" || pass != "pass" {
+		t.Fatalf("want user/pass, got %s/%s", user, pass)
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	var buf bytes.Buffer
+	bind := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1080}
+	if err := WriteReply(&buf, RepSuccess, bind); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{Version, RepSuccess, 0x00, AtypIPv4, 127, 0, 0, 1, 0x04, 0x38}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("want %v, got %v", want, buf.Bytes())
+	}
+}
+
+func TestUDPDatagram(t *testing.T) {
+	b, err := BuildUDPDatagram("8.8.8.8:53", []byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, payload, err := ParseUDPDatagram(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "8.8.8.8:53" || string(payload) != "query" {
+		t.Fatalf("unexpected datagram: %s %q", addr, payload)
+	}
+
+	b[2] = 1
+	if _, _, err := ParseUDPDatagram(b); !errors.Is(err, ErrFragmentNotSupported) {
+		t.Fatalf("want fragment error, got %v", err)
+	}
+	if _, _, err := ParseUDPDatagram(b[:5]); err == nil {
+		t.Fatal("want error for truncated datagram")
+	}
+}
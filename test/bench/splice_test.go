@@ -0,0 +1,127 @@
+//go:build linux
+
+package bench
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Ehco1996/ehco/internal/cmgr"
+	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/relay"
+	"github.com/Ehco1996/ehco/internal/relay/conf"
+)
+
+const (
+	SPLICE_LISTEN = "127.0.0.1:1400"
+	COPY_LISTEN   = "127.0.0.1:1401"
+
+	chunkSize = 1 << 20
+)
+
+// BenchmarkRawRelay pushes data through a raw to raw relay with and without
+// splice, cpu-ns/op is the user and system time of the whole process, the
+// client and the sink cost the same in both runs.
+//
+//	go test ./test/bench/ -run none -bench RawRelay
+func BenchmarkRawRelay(b *testing.B) {
+	sink := startSink(b)
+	cm, err := cmgr.NewCmgr(&cmgr.Config{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	startRelay(b, cm, "splice", SPLICE_LISTEN, sink, false)
+	startRelay(b, cm, "copy", COPY_LISTEN, sink, true)
+
+	b.Run("splice", func(b *testing.B) { benchRelay(b, SPLICE_LISTEN) })
+	b.Run("copy", func(b *testing.B) { benchRelay(b, COPY_LISTEN) })
+}
+
+func benchRelay(b *testing.B, addr string) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	chunk := make([]byte, chunkSize)
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	start := cpuTime()
+	for range b.N {
+		if _, err := c.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(cpuTime()-start)/float64(b.N), "cpu-ns/op")
+}
+
+// cpuTime returns the user and system time of the process so far.
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	_ = syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// startSink starts a tcp server that splices everything it reads to
+// /dev/null, so the bytes never reach user space on its side either and
+// the cpu time left is the one of the client and the relay.
+func startSink(b *testing.B) string {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { devNull.Close() })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(devNull, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func startRelay(b *testing.B, cm cmgr.Cmgr, label, listen, remote string, disableSplice bool) {
+	cfg := &conf.Config{
+		Label:         label,
+		Listen:        listen,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{remote},
+		Options:       &conf.Options{DisableSplice: disableSplice},
+	}
+	cfg.Adjust()
+	if err := cfg.Validate(); err != nil {
+		b.Fatal(err)
+	}
+	r, err := relay.NewRelay(cfg, cm)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go r.ListenAndServe(context.TODO())
+	b.Cleanup(func() { r.Stop() })
+	// wait for the listener
+	for range 50 {
+		if c, err := net.Dial("tcp", listen); err == nil {
+			c.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	b.Fatalf("relay %s not listening", label)
+}
@@ -125,7 +125,8 @@ func isClosedConnError(err error) bool {
 
 func (s *EchoServer) serveUDP() {
 	defer s.wg.Done()
-	buf := make([]byte, 1024)
+	// big enough for datagrams over the mtu
+	buf := make([]byte, 65535)
 	for {
 		select {
 		case <-s.stopChan:
@@ -1,23 +1,43 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	ctls "crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"runtime"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Ehco1996/ehco/internal/cmgr"
 	"github.com/Ehco1996/ehco/internal/config"
 
 	"github.com/Ehco1996/ehco/internal/constant"
+	"github.com/Ehco1996/ehco/internal/glue"
+	"github.com/Ehco1996/ehco/internal/metrics"
 	"github.com/Ehco1996/ehco/internal/relay"
 	"github.com/Ehco1996/ehco/internal/relay/conf"
 	"github.com/Ehco1996/ehco/internal/tls"
 	"github.com/Ehco1996/ehco/pkg/log"
+	"github.com/Ehco1996/ehco/pkg/socks5"
 	"github.com/Ehco1996/ehco/test/echo"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"golang.org/x/net/proxy"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -35,6 +55,93 @@ const (
 	WSS_LISTEN = "0.0.0.0:1236"
 	WSS_REMOTE = "wss://0.0.0.0:2001"
 	WSS_SERVER = "0.0.0.0:2001"
+
+	TLS_LISTEN = "0.0.0.0:1237"
+	TLS_REMOTE = "127.0.0.1:2002"
+	TLS_SERVER = "0.0.0.0:2002"
+
+	MUX_LISTEN = "0.0.0.0:1238"
+	MUX_REMOTE = "127.0.0.1:2003"
+	MUX_SERVER = "0.0.0.0:2003"
+
+	QUIC_LISTEN = "0.0.0.0:1239"
+	QUIC_REMOTE = "127.0.0.1:2004"
+	QUIC_SERVER = "0.0.0.0:2004"
+
+	SOCKS5_LISTEN    = "127.0.0.1:1240"
+	SOCKS5_WS_LISTEN = "127.0.0.1:1241"
+	SOCKS5_USER      = "user"
+	SOCKS5_PASS      = "pass"
+	SOCKS5_TARGET    = "127.0.0.1:9002"
+
+	HTTP_PROXY_LISTEN    = "127.0.0.1:1242"
+	HTTP_PROXY_WS_LISTEN = "127.0.0.1:1243"
+
+	PROXY_PROTOCOL_LISTEN = "127.0.0.1:1244"
+	PROXY_PROTOCOL_SERVER = "127.0.0.1:1245"
+
+	// the in rule maps 1250-1252 to 1260-1262 of the out rule by offset,
+	// the out rule sends every port to the echo server
+	PORT_RANGE_LISTEN = "127.0.0.1:1250-1252"
+	PORT_RANGE_REMOTE = "127.0.0.1:1260-1262"
+	// a range whose middle port is taken
+	PORT_RANGE_BUSY_LISTEN = "127.0.0.1:1302-1304"
+	PORT_RANGE_BUSY_PORT   = "127.0.0.1:1303"
+
+	// agents dial the tunnel listen and the server exposes echo on the service listen
+	REVERSE_TOKEN          = "reverse-token"
+	REVERSE_MUX_SERVER     = "127.0.0.1:1270"
+	REVERSE_MUX_SERVICE    = "127.0.0.1:1271"
+	REVERSE_WS_SERVER      = "127.0.0.1:1272"
+	REVERSE_WS_SERVICE     = "127.0.0.1:1273"
+	REVERSE_UNUSED_SERVICE = "127.0.0.1:1274"
+
+	// one raw listen routes to the backends by sni and http host
+	ROUTE_LISTEN          = "127.0.0.1:1280"
+	ROUTE_DEFAULT_BACKEND = "127.0.0.1:1281"
+	ROUTE_SITE_BACKEND    = "127.0.0.1:1282"
+	ROUTE_API_BACKEND     = "127.0.0.1:1283"
+
+	// only ssh and stun are relayed to the echo server
+	SNIFF_LISTEN = "127.0.0.1:1290"
+
+	// rules to the echo server that start with loopback denied
+	ACL_RAW_LISTEN = "127.0.0.1:1291"
+	ACL_WS_LISTEN  = "127.0.0.1:1292"
+
+	// a rule to the echo server allowing one conn per client ip
+	IP_LIMIT_LISTEN = "127.0.0.1:1293"
+
+	// a rule to the echo server with a rule wide download limit
+	BANDWIDTH_LISTEN = "127.0.0.1:1294"
+	// a udp rule to the echo server limited while a session is relayed
+	BANDWIDTH_UDP_LISTEN = "127.0.0.1:1309"
+
+	// a rule to the echo server with a 10KB quota
+	QUOTA_LISTEN = "127.0.0.1:1295"
+
+	// rules to the echo server with connection limits
+	CONN_LIMIT_LISTEN   = "127.0.0.1:1296"
+	CONN_QUEUE_LISTEN   = "127.0.0.1:1297"
+	REMOTE_LIMIT_LISTEN = "127.0.0.1:1298"
+	// two queueing rules under a node limit
+	NODE_QUEUE_LISTEN_A = "127.0.0.1:1310"
+	NODE_QUEUE_LISTEN_B = "127.0.0.1:1311"
+
+	// udp rule to the echo server, its sessions are listed by cmgr
+	UDP_SESSION_LISTEN = "127.0.0.1:1299"
+
+	// a raw rule over ws to the echo server, drained on shutdown
+	DRAIN_LISTEN    = "127.0.0.1:1300"
+	DRAIN_WS_SERVER = "127.0.0.1:1301"
+	// a raw rule with udp to the echo server, restarted by a reload
+	DRAIN_UDP_LISTEN = "127.0.0.1:1306"
+	// a reverse server restarted by a reload and its agent
+	DRAIN_REVERSE_SERVER  = "127.0.0.1:1307"
+	DRAIN_REVERSE_SERVICE = "127.0.0.1:1308"
+
+	// a raw to raw rule to the echo server, spliced on linux
+	SPLICE_LISTEN = "127.0.0.1:1305"
 )
 
 func TestMain(m *testing.M) {
@@ -67,6 +174,33 @@ func startRelayServers() []*relay.Relay {
 		IdleTimeoutSec: 3,
 		ReadTimeoutSec: 3,
 	}
+	// built in cert is self-signed, so skip verify for the tls client
+	tlsOptions := options
+	tlsOptions.TLSConfig = &conf.TLSConfig{InsecureSkipVerify: true}
+	socks5Options := options
+	socks5Options.ProxyConfig = &conf.ProxyConfig{
+		Users:        map[string]string{SOCKS5_USER: SOCKS5_PASS},
+		AllowedPorts: []int{ECHO_PORT},
+	}
+	sendProxyProtocolOptions := options
+	sendProxyProtocolOptions.SendProxyProtocol = 2
+	acceptProxyProtocolOptions := options
+	acceptProxyProtocolOptions.AcceptProxyProtocol = true
+	httpProxyOptions := options
+	httpProxyOptions.ProxyConfig = &conf.ProxyConfig{
+		Users:               map[string]string{SOCKS5_USER: SOCKS5_PASS},
+		AllowedDestinations: []string{"127.0.0.1"},
+	}
+	reverseServerOptions := func(services map[string]string) *conf.Options {
+		opts := tlsOptions
+		opts.ReverseConfig = &conf.ReverseConfig{Token: REVERSE_TOKEN, Services: services}
+		return &opts
+	}
+	reverseAgentOptions := tlsOptions
+	reverseAgentOptions.ReverseConfig = &conf.ReverseConfig{
+		Token:    REVERSE_TOKEN,
+		Services: map[string]string{"echo": ECHO_SERVER},
+	}
 	cfg := config.Config{
 		RelayConfigs: []*conf.Config{
 			// raw
@@ -113,6 +247,158 @@ func startRelayServers() []*relay.Relay {
 				TransportType: constant.RelayTypeRaw,
 				Options:       &options,
 			},
+
+			// tls
+			{
+				Label:         "tls-in",
+				Listen:        TLS_LISTEN,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{TLS_REMOTE},
+				TransportType: constant.RelayTypeTLS,
+				Options:       &tlsOptions,
+			},
+			{
+				Label:         "tls-out",
+				Listen:        TLS_SERVER,
+				ListenType:    constant.RelayTypeTLS,
+				Remotes:       []string{ECHO_SERVER},
+				TransportType: constant.RelayTypeRaw,
+				Options:       &options,
+			},
+
+			// mux
+			{
+				Label:         "mux-in",
+				Listen:        MUX_LISTEN,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{MUX_REMOTE},
+				TransportType: constant.RelayTypeMux,
+				Options:       &tlsOptions,
+			},
+			{
+				Label:         "mux-out",
+				Listen:        MUX_SERVER,
+				ListenType:    constant.RelayTypeMux,
+				Remotes:       []string{ECHO_SERVER},
+				TransportType: constant.RelayTypeRaw,
+				Options:       &options,
+			},
+
+			// quic
+			{
+				Label:         "quic-in",
+				Listen:        QUIC_LISTEN,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{QUIC_REMOTE},
+				TransportType: constant.RelayTypeQuic,
+				Options:       &tlsOptions,
+			},
+			{
+				Label:         "quic-out",
+				Listen:        QUIC_SERVER,
+				ListenType:    constant.RelayTypeQuic,
+				Remotes:       []string{ECHO_SERVER},
+				TransportType: constant.RelayTypeRaw,
+				Options:       &options,
+			},
+
+			// socks5, direct and through the ws-out server
+			{
+				Label:         "socks5",
+				Listen:        SOCKS5_LISTEN,
+				ListenType:    constant.RelayTypeSocks5,
+				TransportType: constant.RelayTypeRaw,
+				Options:       &socks5Options,
+			},
+			{
+				Label:         "socks5-ws",
+				Listen:        SOCKS5_WS_LISTEN,
+				ListenType:    constant.RelayTypeSocks5,
+				Remotes:       []string{WS_REMOTE},
+				TransportType: constant.RelayTypeWS,
+				Options:       &socks5Options,
+			},
+
+			// http proxy, direct and through the ws-out server
+			{
+				Label:         "http-proxy",
+				Listen:        HTTP_PROXY_LISTEN,
+				ListenType:    constant.RelayTypeHTTPProxy,
+				TransportType: constant.RelayTypeRaw,
+				Options:       &httpProxyOptions,
+			},
+			{
+				Label:         "http-proxy-ws",
+				Listen:        HTTP_PROXY_WS_LISTEN,
+				ListenType:    constant.RelayTypeHTTPProxy,
+				Remotes:       []string{WS_REMOTE},
+				TransportType: constant.RelayTypeWS,
+				Options:       &httpProxyOptions,
+			},
+
+			// proxy protocol, the out rule only accepts conns with a header
+			{
+				Label:         "proxy-protocol-in",
+				Listen:        PROXY_PROTOCOL_LISTEN,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{PROXY_PROTOCOL_SERVER},
+				TransportType: constant.RelayTypeRaw,
+				Options:       &sendProxyProtocolOptions,
+			},
+			{
+				Label:         "proxy-protocol-out",
+				Listen:        PROXY_PROTOCOL_SERVER,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{ECHO_SERVER},
+				TransportType: constant.RelayTypeRaw,
+				Options:       &acceptProxyProtocolOptions,
+			},
+			// port range
+			{
+				Label:         "port-range-in",
+				Listen:        PORT_RANGE_LISTEN,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{PORT_RANGE_REMOTE},
+				TransportType: constant.RelayTypeRaw,
+				Options:       &options,
+			},
+			{
+				Label:         "port-range-out",
+				Listen:        PORT_RANGE_REMOTE,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{ECHO_SERVER},
+				TransportType: constant.RelayTypeRaw,
+				Options:       &options,
+			},
+			// reverse tunnel over mux and ws
+			{
+				Label:         "reverse-mux-server",
+				Listen:        REVERSE_MUX_SERVER,
+				ListenType:    constant.RelayTypeReverseServer,
+				TransportType: constant.RelayTypeMux,
+				Options:       reverseServerOptions(map[string]string{"echo": REVERSE_MUX_SERVICE, "unused": REVERSE_UNUSED_SERVICE}),
+			},
+			{
+				Label:         "reverse-mux-agent",
+				ListenType:    constant.RelayTypeReverseAgent,
+				Remotes:       []string{REVERSE_MUX_SERVER},
+				TransportType: constant.RelayTypeMux,
+				Options:       &reverseAgentOptions,
+			},
+			{
+				Label:         "reverse-ws-server",
+				Listen:        REVERSE_WS_SERVER,
+				ListenType:    constant.RelayTypeReverseServer,
+				TransportType: constant.RelayTypeWS,
+				Options:       reverseServerOptions(map[string]string{"echo": REVERSE_WS_SERVICE}),
+			},
+			{
+				Label:         "reverse-ws-agent",
+				ListenType:    constant.RelayTypeReverseAgent,
+				Remotes:       []string{"ws://" + REVERSE_WS_SERVER},
+				TransportType: constant.RelayTypeWS,
+				Options:       &reverseAgentOptions,
+			},
 		},
 	}
 	cfg.Adjust()
@@ -142,6 +428,9 @@ func TestRelay(t *testing.T) {
 		{"Raw", RAW_LISTEN, "raw"},
 		{"WS", WS_LISTEN, "ws"},
 		{"WSS", WSS_LISTEN, "wss"},
+		{"TLS", TLS_LISTEN, "tls"},
+		{"MUX", MUX_LISTEN, "mux"},
+		{"QUIC", QUIC_LISTEN, "quic"},
 	}
 
 	for _, tc := range testCases {
@@ -154,6 +443,31 @@ func TestRelay(t *testing.T) {
 	}
 }
 
+func TestUDPOverStream(t *testing.T) {
+	// bigger than the mtu so the datagram is only kept whole by the framing
+	msg := bytes.Repeat([]byte("0123456789"), 400)
+	for _, tc := range []struct{ address, in, out string }{
+		{WS_LISTEN, "ws-in", "ws-out"},
+		{WSS_LISTEN, "wss-in", "wss-out"},
+		{TLS_LISTEN, "tls-in", "tls-out"},
+		{MUX_LISTEN, "mux-in", "mux-out"},
+		{QUIC_LISTEN, "quic-in", "quic-out"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			res, err := echo.SendUdpMsg(msg, tc.address)
+			require.NoError(t, err)
+			require.Equal(t, msg, res)
+			frames := func(label, flow string) float64 {
+				return testutil.ToFloat64(metrics.UDPFramePacketCount.WithLabelValues(label, flow))
+			}
+			require.Positive(t, frames(tc.in, metrics.METRIC_FLOW_WRITE))
+			require.Positive(t, frames(tc.in, metrics.METRIC_FLOW_READ))
+			require.Positive(t, frames(tc.out, metrics.METRIC_FLOW_READ))
+			require.Positive(t, frames(tc.out, metrics.METRIC_FLOW_WRITE))
+		})
+	}
+}
+
 func TestRelayConcurrent(t *testing.T) {
 	testCases := []struct {
 		name        string
@@ -163,6 +477,9 @@ func TestRelayConcurrent(t *testing.T) {
 		{"Raw", RAW_LISTEN, 10},
 		{"WS", WS_LISTEN, 10},
 		{"WSS", WSS_LISTEN, 10},
+		{"TLS", TLS_LISTEN, 10},
+		{"MUX", MUX_LISTEN, 10},
+		{"QUIC", QUIC_LISTEN, 10},
 	}
 
 	for _, tc := range testCases {
@@ -256,6 +573,1294 @@ func testUDPRelay(t *testing.T, address string, concurrent bool, concurrency ...
 	t.Logf("Test UDP over %s done!", address)
 }
 
+func TestSocks5(t *testing.T) {
+	auth := &proxy.Auth{User: SOCKS5_USER, Password: SOCKS5_PASS}
+	msg := []byte("hello socks5")
+	for _, addr := range []string{SOCKS5_LISTEN, SOCKS5_WS_LISTEN} {
+		t.Run(addr, func(t *testing.T) {
+			dialer, err := proxy.SOCKS5("tcp", addr, auth, proxy.Direct)
+			require.NoError(t, err)
+			c, err := dialer.Dial("tcp", SOCKS5_TARGET)
+			require.NoError(t, err)
+			defer c.Close()
+			_, err = c.Write(msg)
+			require.NoError(t, err)
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(c, buf)
+			require.NoError(t, err)
+			require.Equal(t, msg, buf)
+
+			testSocks5UDP(t, addr, msg)
+		})
+	}
+
+	t.Run("wrong password", func(t *testing.T) {
+		dialer, err := proxy.SOCKS5("tcp", SOCKS5_LISTEN, &proxy.Auth{User: SOCKS5_USER, Password: "bad"}, proxy.Direct)
+		require.NoError(t, err)
+		_, err = dialer.Dial("tcp", SOCKS5_TARGET)
+		require.Error(t, err)
+	})
+
+	t.Run("port not allowed", func(t *testing.T) {
+		dialer, err := proxy.SOCKS5("tcp", SOCKS5_LISTEN, auth, proxy.Direct)
+		require.NoError(t, err)
+		_, err = dialer.Dial("tcp", "127.0.0.1:9003")
+		require.Error(t, err)
+	})
+}
+
+// testSocks5UDP does the udp associate by hand, x/net/proxy only speaks connect.
+func testSocks5UDP(t *testing.T, addr string, msg []byte) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = c.Write([]byte{socks5.Version, 1, socks5.MethodUserPass})
+	require.NoError(t, err)
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(c, reply)
+	require.NoError(t, err)
+	require.Equal(t, socks5.MethodUserPass, reply[1])
+	authReq := append([]byte{0x01, byte(len(SOCKS5_USER))}, SOCKS5_USER...)
+	authReq = append(append(authReq, byte(len(SOCKS5_PASS))), SOCKS5_PASS...)
+	_, err = c.Write(authReq)
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, reply)
+	require.NoError(t, err)
+	require.Equal(t, byte(0), reply[1])
+
+	req, err := socks5.AppendAddr([]byte{socks5.Version, socks5.CmdUDPAssociate, 0x00}, "0.0.0.0:0")
+	require.NoError(t, err)
+	_, err = c.Write(req)
+	require.NoError(t, err)
+	hdr := make([]byte, 3)
+	_, err = io.ReadFull(c, hdr)
+	require.NoError(t, err)
+	require.Equal(t, socks5.RepSuccess, hdr[1])
+	bind, err := socks5.ReadAddr(c)
+	require.NoError(t, err)
+
+	uc, err := net.Dial("udp", bind)
+	require.NoError(t, err)
+	defer uc.Close()
+	p, err := socks5.BuildUDPDatagram(SOCKS5_TARGET, msg)
+	require.NoError(t, err)
+	buf := make([]byte, 1500)
+	// udp is unreliable, retry a few times
+	for attempt := 0; attempt < 3; attempt++ {
+		_, err = uc.Write(p)
+		require.NoError(t, err)
+		require.NoError(t, uc.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := uc.Read(buf)
+		if err != nil {
+			continue
+		}
+		from, payload, err := socks5.ParseUDPDatagram(buf[:n])
+		require.NoError(t, err)
+		require.Equal(t, SOCKS5_TARGET, from)
+		require.Equal(t, msg, payload)
+		return
+	}
+	t.Fatal("no udp reply through socks5")
+}
+
+func TestHTTPProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	defer origin.Close()
+	msg := []byte("hello http proxy")
+
+	for _, addr := range []string{HTTP_PROXY_LISTEN, HTTP_PROXY_WS_LISTEN} {
+		t.Run(addr, func(t *testing.T) {
+			proxyURL := &url.URL{Scheme: "http", Host: addr, User: url.UserPassword(SOCKS5_USER, SOCKS5_PASS)}
+			client := &http.Client{
+				Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+				Timeout:   5 * time.Second,
+			}
+			resp, err := client.Post(origin.URL+"/echo", "text/plain", bytes.NewReader(msg))
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, "POST /echo "+string(msg), string(body))
+
+			// CONNECT to the tcp echo server
+			c, err := net.Dial("tcp", addr)
+			require.NoError(t, err)
+			defer c.Close()
+			require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+			auth := base64.StdEncoding.EncodeToString([]byte(SOCKS5_USER + ":" + SOCKS5_PASS))
+			_, err = fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n",
+				SOCKS5_TARGET, SOCKS5_TARGET, auth)
+			require.NoError(t, err)
+			br := bufio.NewReader(c)
+			resp, err = http.ReadResponse(br, nil)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			_, err = c.Write(msg)
+			require.NoError(t, err)
+			buf := make([]byte, len(msg))
+			_, err = io.ReadFull(br, buf)
+			require.NoError(t, err)
+			require.Equal(t, msg, buf)
+		})
+	}
+
+	t.Run("no auth", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: HTTP_PROXY_LISTEN})},
+			Timeout:   5 * time.Second,
+		}
+		resp, err := client.Get(origin.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+	})
+
+	t.Run("destination not allowed", func(t *testing.T) {
+		proxyURL := &url.URL{Scheme: "http", Host: HTTP_PROXY_LISTEN, User: url.UserPassword(SOCKS5_USER, SOCKS5_PASS)}
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+			Timeout:   5 * time.Second,
+		}
+		resp, err := client.Get("http://localhost:9002/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+}
+
+func TestProxyProtocol(t *testing.T) {
+	testTCPRelay(t, PROXY_PROTOCOL_LISTEN, "proxy protocol", false)
+
+	// without a header the conn is rejected
+	c, err := net.Dial("tcp", PROXY_PROTOCOL_SERVER)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 5))
+	require.Error(t, err)
+
+	// a client that never sends its header does not hold back the others
+	silent, err := net.Dial("tcp", PROXY_PROTOCOL_SERVER)
+	require.NoError(t, err)
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	testTCPRelay(t, PROXY_PROTOCOL_LISTEN, "proxy protocol", false)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestPortRange(t *testing.T) {
+	for offset, port := range []int{1250, 1251, 1252} {
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+		testTCPRelay(t, addr, "port range", false)
+		testUDPRelay(t, addr, false)
+
+		// the out rule saw the traffic on the port matching the offset
+		outPort := strconv.Itoa(1260 + offset)
+		for _, connType := range []string{metrics.METRIC_CONN_TYPE_TCP, metrics.METRIC_CONN_TYPE_UDP} {
+			read := metrics.PortRangeTransmitBytes.WithLabelValues("port-range-out", connType, metrics.METRIC_FLOW_READ, outPort)
+			require.Positive(t, testutil.ToFloat64(read), "no %s traffic on port %s", connType, outPort)
+		}
+	}
+
+	t.Run("BindFailure", func(t *testing.T) {
+		busy, err := net.Listen("tcp", PORT_RANGE_BUSY_PORT)
+		require.NoError(t, err)
+		defer busy.Close()
+		cfg := &conf.Config{
+			Label:         "port-range-busy",
+			Listen:        PORT_RANGE_BUSY_LISTEN,
+			ListenType:    constant.RelayTypeRaw,
+			Remotes:       []string{ECHO_SERVER},
+			TransportType: constant.RelayTypeRaw,
+		}
+		cfg.Adjust()
+		require.NoError(t, cfg.Validate())
+		r, err := relay.NewRelay(cfg, nil)
+		require.NoError(t, err)
+		defer r.Stop()
+		require.Error(t, r.ListenAndServe(context.Background()))
+		// the port bound before the busy one is released
+		_, err = net.Dial("tcp", "127.0.0.1:1302")
+		require.Error(t, err)
+	})
+
+	invalid := []struct {
+		name   string
+		listen string
+		remote string
+	}{
+		{"ReversedRange", "127.0.0.1:1300-1200", ECHO_SERVER},
+		{"SizeMismatch", "127.0.0.1:1300-1302", "127.0.0.1:1400-1401"},
+		{"RemoteRangeOnly", "127.0.0.1:1300", "127.0.0.1:1400-1401"},
+		{"TooLarge", "127.0.0.1:1000-9000", ECHO_SERVER},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &conf.Config{
+				Listen:        tc.listen,
+				ListenType:    constant.RelayTypeRaw,
+				Remotes:       []string{tc.remote},
+				TransportType: constant.RelayTypeRaw,
+			}
+			require.Error(t, cfg.Validate())
+		})
+	}
+}
+
+func TestReverse(t *testing.T) {
+	for _, addr := range []string{REVERSE_MUX_SERVICE, REVERSE_WS_SERVICE} {
+		// the agent may still be dialing its server
+		require.Eventually(t, func() bool {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				return false
+			}
+			defer c.Close()
+			_ = c.SetDeadline(time.Now().Add(time.Second))
+			if _, err := c.Write([]byte("ping")); err != nil {
+				return false
+			}
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(c, buf)
+			return err == nil && string(buf) == "ping"
+		}, 5*time.Second, 100*time.Millisecond, "agent of %s not registered", addr)
+		testTCPRelay(t, addr, "reverse", true, 10)
+		testUDPRelay(t, addr, false)
+	}
+
+	// no agent registered the service, the conn is closed
+	c, err := net.Dial("tcp", REVERSE_UNUSED_SERVICE)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = c.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// an agent with a wrong token is rejected
+	wsc, _, _, err := ws.DefaultDialer.Dial(context.Background(), "ws://"+REVERSE_WS_SERVER+"/handshake")
+	require.NoError(t, err)
+	defer wsc.Close()
+	require.NoError(t, wsutil.WriteClientBinary(wsc, []byte(`{"token":"wrong","services":["echo"]}`+"\n")))
+	reply, err := wsutil.ReadServerBinary(wsc)
+	require.NoError(t, err)
+	require.Contains(t, string(reply), "invalid token")
+}
+
+// startNamedBackend replies its name to the first read of every conn.
+func startNamedBackend(t *testing.T, addr, name string) {
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				if _, err := c.Read(make([]byte, 4096)); err == nil {
+					_, _ = c.Write([]byte(name))
+				}
+			}()
+		}
+	}()
+}
+
+// clientHello returns the first record a tls client with sni sends.
+func clientHello(t *testing.T, sni string) []byte {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		_ = ctls.Client(c, &ctls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+		c.Close()
+	}()
+	buf := make([]byte, 4096)
+	n, err := s.Read(buf)
+	require.NoError(t, err)
+	return buf[:n]
+}
+
+func routedTo(t *testing.T, payload []byte) string {
+	c, err := net.Dial("tcp", ROUTE_LISTEN)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write(payload)
+	require.NoError(t, err)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+	name := make([]byte, 64)
+	n, err := c.Read(name)
+	require.NoError(t, err)
+	return string(name[:n])
+}
+
+func TestRoutes(t *testing.T) {
+	startNamedBackend(t, ROUTE_DEFAULT_BACKEND, "default")
+	startNamedBackend(t, ROUTE_SITE_BACKEND, "site")
+	startNamedBackend(t, ROUTE_API_BACKEND, "api")
+
+	cfg := &conf.Config{
+		Label:         "routes",
+		Listen:        ROUTE_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ROUTE_DEFAULT_BACKEND},
+		Options: &conf.Options{
+			Routes: []*conf.RouteConfig{
+				{Hosts: []string{"api.example.com"}, PathPrefix: "/v2", Remotes: []string{ROUTE_API_BACKEND}},
+				{Hosts: []string{"example.com", "*.example.com"}, Remotes: []string{ROUTE_SITE_BACKEND}},
+			},
+		},
+	}
+	cfg.Adjust()
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, nil)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	httpReq := func(host, path string) []byte {
+		return []byte(fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, host))
+	}
+	cases := []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		{"SNI", clientHello(t, "example.com"), "site"},
+		{"WildcardSNI", clientHello(t, "a.b.Example.com"), "site"},
+		{"UnknownSNI", clientHello(t, "example.org"), "default"},
+		{"NoSNI", clientHello(t, "127.0.0.1"), "default"},
+		// path_prefix routes never match tls
+		{"PathRouteSkippedForTLS", clientHello(t, "api.example.com"), "site"},
+		{"HTTPPath", httpReq("api.example.com:8080", "/v2/users"), "api"},
+		{"HTTPOtherPath", httpReq("api.example.com", "/v1/users"), "site"},
+		{"HTTPUnknownHost", httpReq("example.org", "/v2"), "default"},
+		{"Unknown", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "default"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, routedTo(t, tc.payload))
+		})
+	}
+
+	// routes are swapped in place, the listener keeps running
+	require.NoError(t, r.UpdateRoutes([]*conf.RouteConfig{
+		{Hosts: []string{"example.org"}, Remotes: []string{ROUTE_API_BACKEND}},
+	}))
+	require.Equal(t, "api", routedTo(t, clientHello(t, "example.org")))
+	require.Equal(t, "default", routedTo(t, clientHello(t, "example.com")))
+
+	invalid := []*conf.RouteConfig{
+		{Remotes: []string{ROUTE_API_BACKEND}},
+		{Hosts: []string{"*"}, Remotes: []string{ROUTE_API_BACKEND}},
+		{Hosts: []string{"example.com"}},
+		{Hosts: []string{"example.com"}, PathPrefix: "v2", Remotes: []string{ROUTE_API_BACKEND}},
+	}
+	for _, rc := range invalid {
+		require.Error(t, rc.Validate(), "%+v", rc)
+	}
+	noDefault := cfg.Clone()
+	noDefault.Remotes = nil
+	require.Error(t, noDefault.Validate())
+}
+
+func TestAllowedProtocols(t *testing.T) {
+	cfg := &conf.Config{
+		Label:         "allowed-protocols",
+		Listen:        SNIFF_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ECHO_SERVER},
+		Options: &conf.Options{
+			EnableUDP:        true,
+			AllowedProtocols: []string{conf.ProtocolSSH, conf.ProtocolSTUN},
+		},
+	}
+	cfg.Adjust()
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, nil)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	sendTCP := func(msg []byte) ([]byte, error) {
+		c, err := net.Dial("tcp", SNIFF_LISTEN)
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write(msg)
+		require.NoError(t, err)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+		res := make([]byte, len(msg))
+		_, err = io.ReadFull(c, res)
+		return res, err
+	}
+	sendUDP := func(msg []byte) ([]byte, error) {
+		c, err := net.Dial("udp", SNIFF_LISTEN)
+		require.NoError(t, err)
+		defer c.Close()
+		_, err = c.Write(msg)
+		require.NoError(t, err)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+		res := make([]byte, len(msg))
+		n, err := c.Read(res)
+		return res[:n], err
+	}
+
+	ssh := []byte("SSH-2.0-OpenSSH_9.6\r\n")
+	res, err := sendTCP(ssh)
+	require.NoError(t, err)
+	require.Equal(t, ssh, res)
+	_, err = sendTCP([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	require.Error(t, err, "http is not allowed")
+
+	// stun binding request with the magic cookie and a transaction id
+	stun := append([]byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, []byte("transaction1")...)
+	res, err = sendUDP(stun)
+	require.NoError(t, err)
+	require.Equal(t, stun, res)
+	_, err = sendUDP([]byte("hello udp"))
+	require.Error(t, err, "unknown protocol is not allowed")
+
+	count := func(connType, protocol, action string) float64 {
+		return testutil.ToFloat64(metrics.SniffedConnectionCount.WithLabelValues(cfg.Label, connType, protocol, action))
+	}
+	require.Equal(t, 1.0, count(metrics.METRIC_CONN_TYPE_TCP, conf.ProtocolSSH, metrics.METRIC_SNIFF_PASS))
+	require.Equal(t, 1.0, count(metrics.METRIC_CONN_TYPE_TCP, conf.ProtocolHTTP, metrics.METRIC_SNIFF_BLOCK))
+	require.Equal(t, 1.0, count(metrics.METRIC_CONN_TYPE_UDP, conf.ProtocolSTUN, metrics.METRIC_SNIFF_PASS))
+	require.Equal(t, 1.0, count(metrics.METRIC_CONN_TYPE_UDP, metrics.METRIC_PROTOCOL_UNKNOWN, metrics.METRIC_SNIFF_BLOCK))
+
+	both := cfg.Clone()
+	both.Options.BlockedProtocols = []string{conf.ProtocolTLS}
+	require.Error(t, both.Validate())
+	unknown := cfg.Clone()
+	unknown.Options.AllowedProtocols = []string{"gopher"}
+	require.Error(t, unknown.Validate())
+}
+
+func TestACL(t *testing.T) {
+	newRelay := func(label, listen string, listenType constant.RelayType, opts conf.Options) *relay.Relay {
+		opts.EnableUDP = true
+		opts.DenyCIDRs = []string{"127.0.0.0/8", "::1"}
+		cfg := &conf.Config{
+			Label:         label,
+			Listen:        listen,
+			ListenType:    listenType,
+			TransportType: constant.RelayTypeRaw,
+			Remotes:       []string{ECHO_SERVER},
+			Options:       &opts,
+		}
+		cfg.Adjust()
+		require.NoError(t, cfg.Validate())
+		r, err := relay.NewRelay(cfg, nil)
+		require.NoError(t, err)
+		go r.ListenAndServe(context.TODO())
+		return r
+	}
+	raw := newRelay("acl-raw", ACL_RAW_LISTEN, constant.RelayTypeRaw, conf.Options{})
+	defer raw.Stop()
+	ws := newRelay("acl-ws", ACL_WS_LISTEN, constant.RelayTypeWS, conf.Options{})
+	defer ws.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	msg := []byte("hello acl")
+	c, err := net.Dial("tcp", ACL_RAW_LISTEN)
+	require.NoError(t, err)
+	_, _ = c.Write(msg)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = c.Read(make([]byte, len(msg)))
+	require.Error(t, err, "denied tcp conn is closed at once")
+	c.Close()
+
+	u, err := net.Dial("udp", ACL_RAW_LISTEN)
+	require.NoError(t, err)
+	_, err = u.Write(msg)
+	require.NoError(t, err)
+	require.NoError(t, u.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = u.Read(make([]byte, len(msg)))
+	require.Error(t, err, "denied udp session gets no reply")
+	u.Close()
+
+	resp, err := http.Get("http://" + ACL_WS_LISTEN + "/" + conf.WS_HANDSHAKE_PATH)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	rejected := func(label, connType string) float64 {
+		return testutil.ToFloat64(metrics.ACLRejectedConnectionCount.WithLabelValues(label, connType))
+	}
+	require.Equal(t, 1.0, rejected("acl-raw", metrics.METRIC_CONN_TYPE_TCP))
+	require.Equal(t, 1.0, rejected("acl-raw", metrics.METRIC_CONN_TYPE_UDP))
+	require.Equal(t, 1.0, rejected("acl-ws", metrics.METRIC_CONN_TYPE_TCP))
+
+	// swap in an acl allowing loopback from a file, the listener keeps running
+	allowFile := t.TempDir() + "/allow.txt"
+	require.NoError(t, os.WriteFile(allowFile, []byte("# loopback only\n\n127.0.0.1/32\n::1\n"), 0o644))
+	allowLoopback := &conf.Config{Options: &conf.Options{AllowCIDRFiles: []string{allowFile}}}
+	require.NoError(t, raw.UpdateACL(allowLoopback))
+	testTCPRelay(t, ACL_RAW_LISTEN, "acl", false)
+	testUDPRelay(t, ACL_RAW_LISTEN, false)
+
+	// not in the allow list
+	require.NoError(t, os.WriteFile(allowFile, []byte("10.0.0.0/8\n"), 0o644))
+	require.NoError(t, raw.UpdateACL(allowLoopback))
+	c, err = net.Dial("tcp", ACL_RAW_LISTEN)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = c.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	// a broken file keeps the old acl
+	require.NoError(t, os.WriteFile(allowFile, []byte("not a cidr\n"), 0o644))
+	require.Error(t, raw.UpdateACL(allowLoopback))
+	_, err = conf.ParseCIDR("10.0.0.0/33")
+	require.Error(t, err)
+}
+
+func TestIPLimits(t *testing.T) {
+	cfg := &conf.Config{
+		Label:         "ip-limit",
+		Listen:        IP_LIMIT_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ECHO_SERVER},
+		Options:       &conf.Options{MaxConnsPerIP: 1, NewConnsPerIPPerSec: 100, BanSec: 60},
+	}
+	cfg.Adjust()
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, nil)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	msg := []byte("hello ip limit")
+	first, err := net.Dial("tcp", IP_LIMIT_LISTEN)
+	require.NoError(t, err)
+	defer first.Close()
+	_, err = first.Write(msg)
+	require.NoError(t, err)
+	buf := make([]byte, len(msg))
+	require.NoError(t, first.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = io.ReadFull(first, buf)
+	require.NoError(t, err)
+	require.Equal(t, msg, buf)
+
+	// the second conn is over max_conns_per_ip and gets the ip banned
+	readRejected := func() {
+		c, err := net.Dial("tcp", IP_LIMIT_LISTEN)
+		require.NoError(t, err)
+		defer c.Close()
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+		_, err = c.Read(make([]byte, 1))
+		require.Error(t, err)
+	}
+	readRejected()
+	first.Close()
+	time.Sleep(100 * time.Millisecond)
+	readRejected()
+
+	rejected := func(reason string) float64 {
+		return testutil.ToFloat64(metrics.IPLimitRejectedConnectionCount.WithLabelValues("ip-limit", metrics.METRIC_CONN_TYPE_TCP, reason))
+	}
+	require.Equal(t, 1.0, rejected(metrics.METRIC_IP_LIMIT_MAX_CONNS))
+	require.Equal(t, 1.0, rejected(metrics.METRIC_IP_LIMIT_BANNED))
+
+	clients := r.LimitedClients()
+	require.Len(t, clients, 1)
+	require.Equal(t, "ip-limit", clients[0].RelayLabel)
+	require.Equal(t, "127.0.0.1", clients[0].IP)
+	require.EqualValues(t, 2, clients[0].Rejected)
+	require.True(t, clients[0].BannedUntil.After(time.Now()))
+
+	require.True(t, r.UnbanClient("127.0.0.1"))
+	require.False(t, r.UnbanClient("127.0.0.1"))
+	testTCPRelay(t, IP_LIMIT_LISTEN, "ip-limit", false)
+
+	invalid := []conf.Options{
+		{MaxConnsPerIP: -1},
+		{NewConnsPerIPPerSec: -1},
+		{BanSec: 60},
+	}
+	for _, opts := range invalid {
+		cfg := &conf.Config{
+			Label:      "ip-limit-invalid",
+			Listen:     IP_LIMIT_LISTEN,
+			ListenType: constant.RelayTypeRaw,
+			Remotes:    []string{ECHO_SERVER},
+			Options:    &opts,
+		}
+		cfg.Adjust()
+		require.Error(t, cfg.Validate())
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	// 800 kbps is 100KB/s
+	cfg := &conf.Config{
+		Label:         "bandwidth",
+		Listen:        BANDWIDTH_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ECHO_SERVER},
+		Options: &conf.Options{
+			Bandwidth: &conf.BandwidthConfig{Rule: conf.BandwidthLimit{DownloadKbps: 800}},
+		},
+	}
+	cfg.Adjust()
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, nil)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := net.Dial("tcp", BANDWIDTH_LISTEN)
+	require.NoError(t, err)
+	defer c.Close()
+	echo := func(size int) time.Duration {
+		msg := bytes.Repeat([]byte("b"), size)
+		start := time.Now()
+		go c.Write(msg) // nolint: errcheck
+		buf := make([]byte, size)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(10*time.Second)))
+		_, err := io.ReadFull(c, buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, buf)
+		return time.Since(start)
+	}
+	// the first second of the bucket passes at once, the rest at 100KB/s
+	elapsed := echo(300_000)
+	require.Greater(t, elapsed, 1500*time.Millisecond)
+	require.Less(t, elapsed, 4*time.Second)
+
+	// lift the limit while the conn is open
+	require.NoError(t, r.UpdateBandwidth(conf.BandwidthConfig{}))
+	require.Equal(t, glue.Bandwidth{RelayLabel: "bandwidth"}, r.Bandwidth())
+	require.Less(t, echo(1_000_000), time.Second)
+
+	require.Error(t, r.UpdateBandwidth(conf.BandwidthConfig{IP: conf.BandwidthLimit{UploadKbps: -1}}))
+	old := cfg.Clone()
+	cfg.Options.MaxReadRateKbps = 100
+	require.True(t, old.BandwidthDifferent(cfg))
+	require.False(t, old.Different(cfg))
+}
+
+func TestBandwidth_UDP(t *testing.T) {
+	cfg := &conf.Config{
+		Label:         "bandwidth-udp",
+		Listen:        BANDWIDTH_UDP_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ECHO_SERVER},
+		Options:       &conf.Options{EnableUDP: true},
+	}
+	cfg.Adjust()
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, nil)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := net.Dial("udp", BANDWIDTH_UDP_LISTEN)
+	require.NoError(t, err)
+	defer c.Close()
+	echo := func(n int) time.Duration {
+		msg := bytes.Repeat([]byte("u"), 1000)
+		start := time.Now()
+		go func() {
+			for i := 0; i < n; i++ {
+				c.Write(msg) // nolint: errcheck
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		buf := make([]byte, 2000)
+		for i := 0; i < n; i++ {
+			require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+			m, err := c.Read(buf)
+			require.NoError(t, err)
+			// a datagram is never split by the limit
+			require.Equal(t, msg, buf[:m])
+		}
+		return time.Since(start)
+	}
+	require.Less(t, echo(5), time.Second)
+
+	// 80 kbps is 10KB/s, the session started without a limit is limited too
+	require.NoError(t, r.UpdateBandwidth(conf.BandwidthConfig{Rule: conf.BandwidthLimit{DownloadKbps: 80}}))
+	// the first second of the bucket passes at once, the rest at 10KB/s
+	elapsed := echo(30)
+	require.Greater(t, elapsed, 1500*time.Millisecond)
+	require.Less(t, elapsed, 4*time.Second)
+}
+
+func TestQuota(t *testing.T) {
+	cfg := &conf.Config{
+		Label:         "quota",
+		Listen:        QUOTA_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ECHO_SERVER},
+		Options:       &conf.Options{Quota: &conf.QuotaConfig{Bytes: 10_000}},
+	}
+	cfg.Adjust()
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, nil)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := net.Dial("tcp", QUOTA_LISTEN)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(3*time.Second)))
+	// 4000 bytes each way are within the quota
+	msg := bytes.Repeat([]byte("q"), 4000)
+	_, err = c.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, len(msg)))
+	require.NoError(t, err)
+
+	// the open conn is dropped once the quota is used up
+	_, err = c.Write(msg)
+	require.NoError(t, err)
+	_, err = io.ReadAll(c)
+	require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// and new ones are rejected
+	c2, err := net.Dial("tcp", QUOTA_LISTEN)
+	require.NoError(t, err)
+	defer c2.Close()
+	_, _ = c2.Write(msg)
+	require.NoError(t, c2.SetReadDeadline(time.Now().Add(3*time.Second)))
+	_, err = c2.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.QuotaRejectedConnectionCount.WithLabelValues("quota", metrics.METRIC_CONN_TYPE_TCP)))
+
+	for _, q := range []conf.QuotaConfig{
+		{},
+		{Bytes: 1, ResetPeriod: "yearly"},
+		{Bytes: 1, ResetPeriod: conf.QuotaResetWeekly, ResetDay: 7},
+		{Bytes: 1, ResetPeriod: conf.QuotaResetMonthly, ResetDay: 32},
+	} {
+		require.Error(t, q.Validate())
+	}
+
+	// periods start at local midnight, a monthly reset day past the end of
+	// a month is its last day
+	at := func(month time.Month, day, hour int) time.Time {
+		return time.Date(2024, month, day, hour, 0, 0, 0, time.Local)
+	}
+	monthly := conf.QuotaConfig{Bytes: 1, ResetPeriod: conf.QuotaResetMonthly, ResetDay: 31}
+	require.Equal(t, at(time.January, 31, 0), monthly.PeriodStart(at(time.February, 28, 12)))
+	require.Equal(t, at(time.February, 29, 0), monthly.PeriodStart(at(time.February, 29, 1)))
+	require.Equal(t, at(time.March, 31, 0), monthly.NextReset(at(time.March, 1, 0)))
+	// 2024-03-06 is a wednesday
+	weekly := conf.QuotaConfig{Bytes: 1, ResetPeriod: conf.QuotaResetWeekly, ResetDay: 1}
+	require.Equal(t, at(time.March, 4, 0), weekly.PeriodStart(at(time.March, 6, 12)))
+	require.Equal(t, at(time.March, 11, 0), weekly.NextReset(at(time.March, 6, 12)))
+	never := conf.QuotaConfig{Bytes: 1}
+	require.True(t, never.PeriodStart(at(time.March, 6, 12)).IsZero())
+}
+
+func TestConnLimits(t *testing.T) {
+	cm, err := cmgr.NewCmgr(&cmgr.Config{})
+	require.NoError(t, err)
+	newRelay := func(label, listen string, remotes []string, opts *conf.Options) {
+		cfg := &conf.Config{
+			Label:         label,
+			Listen:        listen,
+			ListenType:    constant.RelayTypeRaw,
+			TransportType: constant.RelayTypeRaw,
+			Remotes:       remotes,
+			Options:       opts,
+		}
+		cfg.Adjust()
+		require.NoError(t, cfg.Validate())
+		r, err := relay.NewRelay(cfg, cm)
+		require.NoError(t, err)
+		go r.ListenAndServe(context.TODO())
+		t.Cleanup(func() { r.Stop() })
+	}
+	newRelay("conn-limit", CONN_LIMIT_LISTEN, []string{ECHO_SERVER}, &conf.Options{MaxConnection: 1})
+	newRelay("conn-queue", CONN_QUEUE_LISTEN, []string{ECHO_SERVER},
+		&conf.Options{MaxConnection: 1, ConnOverflow: conf.ConnOverflowQueue, ConnQueueTimeoutSec: 3})
+	// two addresses of the echo server are two remotes
+	newRelay("remote-limit", REMOTE_LIMIT_LISTEN, []string{ECHO_SERVER, "127.0.0.1:9002"}, &conf.Options{MaxConnsPerRemote: 1})
+	time.Sleep(100 * time.Millisecond)
+
+	// echo opens a conn and checks it relays, the conn is active until closed
+	echo := func(listen string) (net.Conn, error) {
+		c, err := net.Dial("tcp", listen)
+		require.NoError(t, err)
+		msg := []byte("hello conn limit")
+		_, _ = c.Write(msg)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, make([]byte, len(msg))); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	rejected := func(label, limit string) float64 {
+		return testutil.ToFloat64(metrics.ConnLimitRejectedConnectionCount.WithLabelValues(label, limit))
+	}
+
+	// a full rule rejects, other rules are not affected
+	c1, err := echo(CONN_LIMIT_LISTEN)
+	require.NoError(t, err)
+	_, err = echo(CONN_LIMIT_LISTEN)
+	require.Error(t, err)
+	require.Equal(t, 1.0, rejected("conn-limit", metrics.METRIC_CONN_LIMIT_RULE))
+
+	// a queued conn is relayed once a slot is free
+	c2, err := echo(CONN_QUEUE_LISTEN)
+	require.NoError(t, err)
+	time.AfterFunc(500*time.Millisecond, func() { c2.Close() })
+	c3, err := echo(CONN_QUEUE_LISTEN)
+	require.NoError(t, err)
+	c3.Close()
+
+	// each remote takes one conn
+	c4, err := echo(REMOTE_LIMIT_LISTEN)
+	require.NoError(t, err)
+	defer c4.Close()
+	c5, err := echo(REMOTE_LIMIT_LISTEN)
+	require.NoError(t, err)
+	defer c5.Close()
+	_, err = echo(REMOTE_LIMIT_LISTEN)
+	require.Error(t, err)
+	require.Equal(t, 1.0, rejected("remote-limit", metrics.METRIC_CONN_LIMIT_REMOTE))
+
+	// the node limit covers every rule
+	c1.Close()
+	time.Sleep(100 * time.Millisecond)
+	cm.SetMaxConnection(cm.CountConnection(cmgr.ConnectionTypeActive))
+	_, err = echo(CONN_LIMIT_LISTEN)
+	require.Error(t, err)
+	require.Equal(t, 1.0, rejected("conn-limit", metrics.METRIC_CONN_LIMIT_NODE))
+	cm.SetMaxConnection(0)
+	c6, err := echo(CONN_LIMIT_LISTEN)
+	require.NoError(t, err)
+	c6.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// a burst of conns gets no more slots than the limit
+	burst := func(listen string, hold time.Duration) (relayed, maxActive int) {
+		var mu sync.Mutex
+		active := 0
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c, err := echo(listen)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				relayed++
+				active++
+				maxActive = max(maxActive, active)
+				mu.Unlock()
+				time.Sleep(hold)
+				mu.Lock()
+				active--
+				mu.Unlock()
+				c.Close()
+			}()
+		}
+		wg.Wait()
+		return relayed, maxActive
+	}
+	relayed, maxActive := burst(CONN_LIMIT_LISTEN, 200*time.Millisecond)
+	require.Equal(t, 1, relayed)
+	require.Equal(t, 1, maxActive)
+	// queued conns are let in one at a time
+	relayed, maxActive = burst(CONN_QUEUE_LISTEN, 50*time.Millisecond)
+	require.Equal(t, 8, relayed)
+	require.Equal(t, 1, maxActive)
+
+	require.Error(t, (&conf.Config{
+		Label: "invalid", Listen: CONN_LIMIT_LISTEN, ListenType: constant.RelayTypeRaw, TransportType: constant.RelayTypeRaw,
+		Remotes: []string{ECHO_SERVER}, Options: &conf.Options{ConnOverflow: "drop"},
+	}).Validate())
+}
+
+func TestConnLimits_QueueUnderNodeLimit(t *testing.T) {
+	cm, err := cmgr.NewCmgr(&cmgr.Config{})
+	require.NoError(t, err)
+	cm.SetMaxConnection(2)
+	for label, listen := range map[string]string{"node-queue-a": NODE_QUEUE_LISTEN_A, "node-queue-b": NODE_QUEUE_LISTEN_B} {
+		cfg := &conf.Config{
+			Label:         label,
+			Listen:        listen,
+			ListenType:    constant.RelayTypeRaw,
+			TransportType: constant.RelayTypeRaw,
+			Remotes:       []string{ECHO_SERVER},
+			Options:       &conf.Options{MaxConnection: 1, ConnOverflow: conf.ConnOverflowQueue, ConnQueueTimeoutSec: 3},
+		}
+		cfg.Adjust()
+		require.NoError(t, cfg.Validate())
+		r, err := relay.NewRelay(cfg, cm)
+		require.NoError(t, err)
+		go r.ListenAndServe(context.TODO())
+		t.Cleanup(func() { r.Stop() })
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	echo := func(listen string) (net.Conn, error) {
+		c, err := net.Dial("tcp", listen)
+		require.NoError(t, err)
+		msg := []byte("hello node queue")
+		_, _ = c.Write(msg)
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(c, make([]byte, len(msg))); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	a1, err := echo(NODE_QUEUE_LISTEN_A)
+	require.NoError(t, err)
+	// conns queued for the full rule a hold no node slot
+	queued := make(chan net.Conn, 3)
+	for range 3 {
+		go func() {
+			c, _ := echo(NODE_QUEUE_LISTEN_A)
+			queued <- c
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	start := time.Now()
+	b1, err := echo(NODE_QUEUE_LISTEN_B)
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), time.Second)
+
+	// a queued conn of a is let in once a1 is done
+	a1.Close()
+	c := <-queued
+	require.NotNil(t, c)
+	c.Close()
+	b1.Close()
+	for range 2 {
+		if c := <-queued; c != nil {
+			c.Close()
+		}
+	}
+}
+
+func TestUDPSessions(t *testing.T) {
+	cm, err := cmgr.NewCmgr(&cmgr.Config{})
+	require.NoError(t, err)
+	cfg := &conf.Config{
+		Label:         "udp-session",
+		Listen:        UDP_SESSION_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ECHO_SERVER},
+		Options:       &conf.Options{EnableUDP: true, IdleTimeoutSec: 1, ReadTimeoutSec: 1},
+	}
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, cm)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := net.Dial("udp", UDP_SESSION_LISTEN)
+	require.NoError(t, err)
+	defer c.Close()
+	msg := []byte("hello udp session")
+	buf := make([]byte, 64)
+	for range 3 {
+		_, err = c.Write(msg)
+		require.NoError(t, err)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := c.Read(buf)
+		require.NoError(t, err)
+		require.Equal(t, msg, buf[:n])
+	}
+
+	sessions := cm.ListUDPSessions("udp-session")
+	require.Len(t, sessions, 1)
+	require.Equal(t, c.LocalAddr().String(), sessions[0].Client)
+	require.Equal(t, ECHO_SERVER, sessions[0].Remote)
+	require.Equal(t, int64(3), sessions[0].InPackets)
+	require.Equal(t, int64(3), sessions[0].OutPackets)
+	require.Empty(t, cm.ListUDPSessions("other"))
+
+	// the idle session ends and its relay conn is closed
+	require.Eventually(t, func() bool {
+		return len(cm.ListUDPSessions("")) == 0
+	}, 5*time.Second, 100*time.Millisecond)
+	require.Equal(t, 1, cm.CountConnection(cmgr.ConnectionTypeClosed))
+}
+
+func TestDrain(t *testing.T) {
+	// a closed client ends a conn over ws at the idle timeout, ws has no
+	// half close
+	options := &conf.Options{IdleTimeoutSec: 1, ReadTimeoutSec: 1}
+	cfg := &config.Config{
+		RelayDrainTimeoutSec: 3,
+		RelayConfigs: []*conf.Config{
+			{
+				Label:         "drain-in",
+				Listen:        DRAIN_LISTEN,
+				ListenType:    constant.RelayTypeRaw,
+				TransportType: constant.RelayTypeWS,
+				Remotes:       []string{"ws://" + DRAIN_WS_SERVER},
+				Options:       options,
+			},
+			{
+				Label:         "drain-out",
+				Listen:        DRAIN_WS_SERVER,
+				ListenType:    constant.RelayTypeWS,
+				TransportType: constant.RelayTypeRaw,
+				Remotes:       []string{ECHO_SERVER},
+				Options:       options,
+			},
+		},
+	}
+	require.NoError(t, cfg.Adjust())
+	rs, err := relay.NewServer(cfg)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- rs.Start(ctx) }()
+	time.Sleep(100 * time.Millisecond)
+
+	ping := func(c net.Conn) error {
+		msg := []byte("hello drain")
+		if _, err := c.Write(msg); err != nil {
+			return err
+		}
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(c, make([]byte, len(msg)))
+		return err
+	}
+	finished, err := net.Dial("tcp", DRAIN_LISTEN)
+	require.NoError(t, err)
+	defer finished.Close()
+	require.NoError(t, ping(finished))
+	unfinished, err := net.Dial("tcp", DRAIN_LISTEN)
+	require.NoError(t, err)
+	defer unfinished.Close()
+	require.NoError(t, ping(unfinished))
+
+	// the shutdown path, the relays stop accepting and keep their conns
+	start := time.Now()
+	cancel()
+	require.Eventually(t, func() bool { return len(rs.ListDraining()) == 2 }, time.Second, 10*time.Millisecond)
+	draining := rs.ListDraining()
+	require.Equal(t, "drain-in", draining[0].RelayLabel)
+	require.Equal(t, 2, draining[0].ActiveConns)
+	require.WithinDuration(t, start.Add(3*time.Second), draining[0].Deadline, time.Second)
+	_, err = net.Dial("tcp", DRAIN_LISTEN)
+	require.Error(t, err)
+	require.NoError(t, ping(finished))
+	require.NoError(t, ping(unfinished))
+
+	require.NoError(t, finished.Close())
+	require.Eventually(t, func() bool {
+		d := rs.ListDraining()
+		return ping(unfinished) == nil && len(d) == 2 && d[0].ActiveConns == 1
+	}, 2*time.Second, 100*time.Millisecond)
+
+	// the conn still relayed at the drain timeout is closed
+	for ping(unfinished) == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay server not stopped after the drain timeout")
+	}
+	require.GreaterOrEqual(t, time.Since(start), 3*time.Second)
+	require.Empty(t, rs.ListDraining())
+
+	t.Run("ReloadUDP", func(t *testing.T) {
+		// the relay restarted by a reload binds the udp port of the relay
+		// it replaces while that one drains its tcp conns
+		path := t.TempDir() + "/config.json"
+		writeCfg := func(udpQueueSize int) {
+			t.Helper()
+			data := fmt.Sprintf(`{"relay_drain_timeout_sec": 3, "relay_configs": [{
+				"label": "drain-udp", "listen": %q, "listen_type": "raw", "transport_type": "raw",
+				"remotes": [%q], "options": {"enable_udp": true, "udp_queue_size": %d}}]}`,
+				DRAIN_UDP_LISTEN, ECHO_SERVER, udpQueueSize)
+			require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+		}
+		writeCfg(0)
+		cfg := config.NewConfig(path)
+		require.NoError(t, cfg.LoadConfig(true))
+		rs, err := relay.NewServer(cfg)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stopped := make(chan error, 1)
+		go func() { stopped <- rs.Start(ctx) }()
+		time.Sleep(100 * time.Millisecond)
+		testUDPRelay(t, DRAIN_UDP_LISTEN, false)
+
+		draining, err := net.Dial("tcp", DRAIN_UDP_LISTEN)
+		require.NoError(t, err)
+		defer draining.Close()
+		require.NoError(t, ping(draining))
+
+		writeCfg(64)
+		require.NoError(t, rs.Reload(true))
+		require.Eventually(t, func() bool { return len(rs.ListDraining()) == 1 }, time.Second, 10*time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		testUDPRelay(t, DRAIN_UDP_LISTEN, false)
+		testTCPRelay(t, DRAIN_UDP_LISTEN, "raw", false)
+		require.NoError(t, ping(draining))
+
+		require.NoError(t, draining.Close())
+		cancel()
+		select {
+		case err := <-stopped:
+			require.NoError(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("relay server not stopped")
+		}
+	})
+
+	t.Run("ReloadReverse", func(t *testing.T) {
+		// the agent leaves the reverse server being drained for the one
+		// restarted by the reload, the services are not down until the
+		// drain ends
+		path := t.TempDir() + "/config.json"
+		writeCfg := func(udpQueueSize int) {
+			t.Helper()
+			data := fmt.Sprintf(`{"relay_configs": [{
+				"label": "drain-reverse-server", "listen": %q, "listen_type": "reverse_server", "transport_type": "ws",
+				"options": {"idle_timeout_sec": 1, "read_timeout_sec": 1, "udp_queue_size": %d,
+					"reverse_config": {"token": %q, "services": {"echo": %q}}}
+			}, {
+				"label": "drain-reverse-agent", "listen_type": "reverse_agent", "transport_type": "ws", "remotes": [%q],
+				"options": {"idle_timeout_sec": 1, "read_timeout_sec": 1,
+					"reverse_config": {"token": %q, "services": {"echo": %q}}}
+			}]}`, DRAIN_REVERSE_SERVER, udpQueueSize, REVERSE_TOKEN, DRAIN_REVERSE_SERVICE,
+				"ws://"+DRAIN_REVERSE_SERVER, REVERSE_TOKEN, ECHO_SERVER)
+			require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+		}
+		writeCfg(0)
+		cfg := config.NewConfig(path)
+		require.NoError(t, cfg.LoadConfig(true))
+		rs, err := relay.NewServer(cfg)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stopped := make(chan error, 1)
+		go func() { stopped <- rs.Start(ctx) }()
+		dial := func() (net.Conn, error) {
+			c, err := net.Dial("tcp", DRAIN_REVERSE_SERVICE)
+			if err != nil {
+				return nil, err
+			}
+			if err := ping(c); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		}
+		var draining net.Conn
+		require.Eventually(t, func() bool {
+			draining, err = dial()
+			return err == nil
+		}, 5*time.Second, 50*time.Millisecond, "agent not registered")
+		defer draining.Close()
+
+		writeCfg(64)
+		require.NoError(t, rs.Reload(true))
+		require.Len(t, rs.ListDraining(), 1)
+		// well within the default drain timeout of the old server
+		require.Eventually(t, func() bool {
+			c, err := dial()
+			if err != nil {
+				return false
+			}
+			c.Close()
+			return true
+		}, 2*time.Second, 50*time.Millisecond, "service down after the reload")
+		require.NoError(t, ping(draining))
+
+		require.NoError(t, draining.Close())
+		cancel()
+		select {
+		case err := <-stopped:
+			require.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay server not stopped")
+		}
+	})
+}
+
+func TestSplice(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("splice is linux only")
+	}
+	cm, err := cmgr.NewCmgr(&cmgr.Config{})
+	require.NoError(t, err)
+	cfg := &conf.Config{
+		Label:         "splice",
+		Listen:        SPLICE_LISTEN,
+		ListenType:    constant.RelayTypeRaw,
+		TransportType: constant.RelayTypeRaw,
+		Remotes:       []string{ECHO_SERVER},
+	}
+	cfg.Adjust()
+	require.NoError(t, cfg.Validate())
+	r, err := relay.NewRelay(cfg, cm)
+	require.NoError(t, err)
+	go r.ListenAndServe(context.TODO())
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	c, err := net.Dial("tcp", SPLICE_LISTEN)
+	require.NoError(t, err)
+	defer c.Close()
+	msg := bytes.Repeat([]byte("s"), 64*1024)
+	go c.Write(msg) // nolint: errcheck
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(c, make([]byte, len(msg)))
+	require.NoError(t, err)
+
+	// the conn of a plain raw to raw rule is spliced by the kernel
+	conns := cm.ListConnections(cmgr.ConnectionTypeActive, 1, 10)
+	require.Len(t, conns, 1)
+	data, err := json.Marshal(conns[0])
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"spliced":true`)
+
+	// and its bytes are still counted once the relay ends
+	require.NoError(t, c.(*net.TCPConn).CloseWrite())
+	require.Eventually(t, func() bool { return cm.CountConnection(cmgr.ConnectionTypeClosed) == 1 }, 3*time.Second, 50*time.Millisecond)
+	stats := conns[0].GetStats()
+	require.Equal(t, int64(2*len(msg)), stats.Up)
+	require.Equal(t, int64(2*len(msg)), stats.Down)
+}
+
 func TestRelayIdleTimeout(t *testing.T) {
 	err := echo.EchoTcpMsgLong([]byte("hello"), time.Second*4, RAW_LISTEN)
 	require.Error(t, err, "Connection should be rejected")